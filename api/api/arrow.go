@@ -0,0 +1,195 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/gin-gonic/gin"
+)
+
+const arrowContentType = "application/vnd.apache.arrow.stream"
+
+/*
+ * The schema of the result as Arrow, with an int32 column index<n> for every
+ * dimension of the shape, with the position of the sample along it, and the
+ * float32 column value. The shape and attribute are in the schema metadata,
+ * with the shape as comma-separated dimensions, e.g. 1,5,10.
+ */
+func arrowSchema(attr string, shape []int) *arrow.Schema {
+	fields := make([]arrow.Field, 0, len(shape) + 1)
+	dims := make([]string, len(shape))
+	for i, dim := range shape {
+		fields = append(fields, arrow.Field {
+			Name: fmt.Sprintf("index%d", i),
+			Type: arrow.PrimitiveTypes.Int32,
+		})
+		dims[i] = fmt.Sprint(dim)
+	}
+	fields = append(fields, arrow.Field {
+		Name: "value",
+		Type: arrow.PrimitiveTypes.Float32,
+	})
+
+	metadata := arrow.NewMetadata(
+		[]string { "attribute", "shape" },
+		[]string { attr, strings.Join(dims, ",") },
+	)
+	return arrow.NewSchema(fields, &metadata)
+}
+
+/*
+ * GET /result/<pid>?format=arrow
+ *
+ * The result as an Arrow IPC stream [1], for dataframe pipelines that would
+ * otherwise go from msgpack to numpy to Arrow. Every bundle of the attribute
+ * (data, or the one given by ?attr=) is a record batch of its samples, with
+ * their position in the assembled array, see arrowSchema. The batches are
+ * written as the bundles are read, so unlike JSON and NPY, the result is never
+ * assembled in memory.
+ *
+ * Like Get, the result is checked to be complete before anything is sent, and
+ * should reading it fail after that, the stream is cut short without the
+ * end-of-stream marker.
+ *
+ * [1] https://arrow.apache.org/docs/format/Columnar.html#ipc-streaming-format
+ */
+func (r *Result) getArrow(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if acceptable(ctx, arrowContentType) == "" {
+		return
+	}
+	attr := ctx.DefaultQuery("attr", "data")
+
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, nil, false)
+	if result == nil {
+		return
+	}
+	head := result.head
+
+	header, err := parseAssemblyHeader(head.RawHeader)
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	shape, err := header.shape(attr)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+	/*
+	 * The positions in the array are int, which is only guaranteed to be 32
+	 * bits
+	 */
+	size, err := gridSize(shape, math.MaxInt32)
+	if errors.Is(err, errResultTooLarge) {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H {
+			"error": "result too large for conversion to Arrow",
+			"limit": math.MaxInt32,
+		})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "arrow", pid, head, start, false, tiles, failure)
+
+	cacheImmutable(ctx, result.etag)
+	setDisposition(ctx, pid, "arrow")
+	ctx.Header("Content-Type", arrowContentType)
+	ctx.Status(http.StatusOK)
+
+	/*
+	 * The strides of the shape, to go from the position in the assembled
+	 * array to the index along every dimension
+	 */
+	strides := make([]int, len(shape))
+	stride := 1
+	for i := len(shape) - 1; i >= 0; i-- {
+		strides[i] = stride
+		stride *= shape[i]
+	}
+
+	mem := memory.NewGoAllocator()
+	schema := arrowSchema(attr, shape)
+	writer := ipc.NewWriter(
+		ctx.Writer,
+		ipc.WithSchema(schema),
+		ipc.WithAllocator(mem),
+	)
+	batch := func(bundle []byte) error {
+		builder := array.NewRecordBuilder(mem, schema)
+		defer builder.Release()
+		indices := make([]*array.Int32Builder, len(shape))
+		for i := range indices {
+			indices[i] = builder.Field(i).(*array.Int32Builder)
+		}
+		values := builder.Field(len(shape)).(*array.Float32Builder)
+
+		place := func(offset int, samples []float32) {
+			for k := range samples {
+				pos := offset + k
+				for i, stride := range strides {
+					indices[i].Append(int32(pos / stride))
+					pos %= stride
+				}
+			}
+			values.AppendValues(samples, nil)
+		}
+		err := placeBundle(header.Function, bundle, attr, int(size), place)
+		if err != nil {
+			return err
+		}
+
+		record := builder.NewRecord()
+		defer record.Release()
+		if record.NumRows() == 0 {
+			return nil
+		}
+		return writer.Write(record)
+	}
+
+	for {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					r.logger(pid).Error("unable to collect result", "error", err)
+					return
+				}
+				if err := writer.Close(); err != nil {
+					r.logger(pid).Error("unable to close arrow stream", "error", err)
+				}
+				return
+			}
+			if output.id == "" {
+				continue
+			}
+			if err := batch(output.tile); err != nil {
+				r.logger(pid).Error("unable to write arrow batch", "error", err)
+				return
+			}
+
+		case err := <-failure:
+			r.logger(pid).Error("unable to collect result", "error", err)
+			return
+		}
+	}
+}
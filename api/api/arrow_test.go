@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+type arrowSample struct {
+	index []int32
+	value float32
+}
+
+/*
+ * Read the Arrow stream, and get the value of the metadata key shape, the
+ * number of record batches, and all the samples
+ */
+func readArrow(t *testing.T, body []byte) (string, int, []arrowSample) {
+	reader, err := ipc.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer reader.Release()
+
+	schema := reader.Schema()
+	i := schema.Metadata().FindKey("shape")
+	if i < 0 {
+		t.Fatalf("no shape in schema metadata")
+	}
+	shape := schema.Metadata().Values()[i]
+	ndims := len(schema.Fields()) - 1
+
+	batches := 0
+	samples := make([]arrowSample, 0)
+	for reader.Next() {
+		batches++
+		record := reader.Record()
+		values := record.Column(ndims).(*array.Float32)
+		for row := 0; row < int(record.NumRows()); row++ {
+			sample := arrowSample { value: values.Value(row) }
+			for dim := 0; dim < ndims; dim++ {
+				index := record.Column(dim).(*array.Int32)
+				sample.index = append(sample.index, index.Value(row))
+			}
+			samples = append(samples, sample)
+		}
+	}
+	if err := reader.Err(); err != nil && err != io.EOF {
+		t.Fatalf("%v", err)
+	}
+	return shape, batches, samples
+}
+
+func TestSliceAsArrow(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		2,
+		[]string { "data" },
+		[]int { 1, 2, 3 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/2", packSliceTiles("data", message.Tile {
+		Iterations:  2,
+		ChunkSize:   2,
+		Superstride: 3,
+		Substride:   2,
+		V:           []float32 { 0, 1, 10, 11 },
+	}))
+	storage.add("pid", "1/2", packSliceTiles("data", message.Tile {
+		Iterations:  2,
+		ChunkSize:   1,
+		InitialSkip: 2,
+		Superstride: 3,
+		Substride:   1,
+		V:           []float32 { 2, 12 },
+	}))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=arrow", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != arrowContentType {
+		t.Errorf("Content-Type = %s; want %s", ct, arrowContentType)
+	}
+
+	shape, batches, samples := readArrow(t, w.Body.Bytes())
+	if shape != "1,2,3" {
+		t.Errorf("shape = %s; want 1,2,3", shape)
+	}
+	if batches != 2 {
+		t.Errorf("got %d record batches; want one per bundle", batches)
+	}
+	if len(samples) != 6 {
+		t.Fatalf("got %d samples; want 6", len(samples))
+	}
+
+	/*
+	 * The value of sample (0, j, k) is 10j + k
+	 */
+	seen := make(map[float32]bool)
+	for _, s := range samples {
+		if s.index[0] != 0 {
+			t.Errorf("sample %v has index0 = %d; want 0", s, s.index[0])
+		}
+		want := float32(10 * s.index[1] + s.index[2])
+		if s.value != want {
+			t.Errorf("sample at %v = %v; want %v", s.index, s.value, want)
+		}
+		seen[s.value] = true
+	}
+	if len(seen) != 6 {
+		t.Errorf("samples = %v; want every position once", samples)
+	}
+}
+
+func TestCurtainAsArrow(t *testing.T) {
+	bundle := message.CurtainBundle {
+		Attr:    "data",
+		Size:    1,
+		Zlength: 3,
+		Major:   []int { 0, 2 },
+		Minor:   []int { 1, 3 },
+		Values:  []float32 { 1, 2, 11, 12 },
+	}
+	packed, err := bundle.Pack()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionCurtain,
+		1,
+		[]string { "data" },
+		[]int { 2, 3 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packed)
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=arrow", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	_, _, samples := readArrow(t, w.Body.Bytes())
+	if len(samples) != 4 {
+		t.Fatalf("got %d samples; want 4", len(samples))
+	}
+	for _, s := range samples {
+		want := float32(10 * s.index[0] + s.index[1])
+		if s.value != want {
+			t.Errorf("sample at %v = %v; want %v", s.index, s.value, want)
+		}
+	}
+}
+
+func TestArrowRejectsUnknownAttribute(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		1,
+		[]string { "data" },
+		[]int { 1, 2 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packSliceTiles("data"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=arrow&attr=cdpx", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestArrowOfPendingProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", packSliceTiles("data"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=arrow", "")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+}
@@ -0,0 +1,359 @@
+package api
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+ * The parts of the result header (process_header in
+ * oneseismic/messages.hpp) needed to assemble the result. The shapes of all
+ * the attributes are in a single array, each prefixed by the number of
+ * dimensions, e.g. [3 1 5 10 3 1 5 1] for data of 1x5x10 and an attribute of
+ * 1x5x1.
+ */
+type resultHeader struct {
+	Function   int      `msgpack:"function"`
+	Shapes     []int    `msgpack:"shapes"`
+	Attributes []string `msgpack:"attributes"`
+}
+
+func parseAssemblyHeader(doc []byte) (*resultHeader, error) {
+	if len(doc) < 1 {
+		return nil, fmt.Errorf("empty process header")
+	}
+	header := &resultHeader {}
+	if err := msgpack.Unmarshal(doc[1:], header); err != nil {
+		return nil, fmt.Errorf("unable to parse result header: %w", err)
+	}
+	return header, nil
+}
+
+func (h *resultHeader) shape(attr string) ([]int, error) {
+	shapes := h.Shapes
+	for _, name := range h.Attributes {
+		if len(shapes) == 0 || shapes[0] < 0 || shapes[0] >= len(shapes) {
+			return nil, fmt.Errorf("bad shapes %v in result header", h.Shapes)
+		}
+		n := shapes[0]
+		if name == attr {
+			return shapes[1:n + 1], nil
+		}
+		shapes = shapes[n + 1:]
+	}
+	return nil, fmt.Errorf("no attribute %s in result", attr)
+}
+
+/*
+ * The number of samples in an array of the shape, which must be a proper
+ * grid, i.e. have at least one dimension, and no empty ones. Grids of more
+ * than limit samples fail with errResultTooLarge.
+ */
+func gridSize(shape []int, limit int64) (int64, error) {
+	if len(shape) == 0 {
+		return 0, fmt.Errorf("shape %v is not a dense grid", shape)
+	}
+	size := int64(1)
+	for _, dim := range shape {
+		if dim <= 0 {
+			return 0, fmt.Errorf("shape %v is not a dense grid", shape)
+		}
+		/*
+		 * Check the limit as the size adds up, so that it can't overflow
+		 */
+		size *= int64(dim)
+		if size > limit {
+			return 0, errResultTooLarge
+		}
+	}
+	return size, nil
+}
+
+/*
+ * Place the samples of a bundle in the assembled (row-major) array of size
+ * samples of its attribute, like the decoder in the core library does, by
+ * calling place with every contiguous run of samples and the offset of the
+ * first one in the array. Runs that don't fit in the array fail, rather than
+ * being clipped, as that means the result doesn't match its header.
+ */
+func placeSlice(
+	bundle *message.SliceTiles,
+	size   int,
+	place  func(offset int, samples []float32),
+) error {
+	for _, tile := range bundle.Tiles {
+		for i := 0; i < tile.Iterations; i++ {
+			to   := i * tile.Superstride + tile.InitialSkip
+			from := i * tile.Substride
+			if to < 0 || to + tile.ChunkSize > size {
+				return fmt.Errorf(
+					"tile out of bounds; [%d, %d) of %d samples",
+					to,
+					to + tile.ChunkSize,
+					size,
+				)
+			}
+			if from < 0 || from + tile.ChunkSize > len(tile.V) {
+				return fmt.Errorf(
+					"tile has %d samples; want at least %d",
+					len(tile.V),
+					from + tile.ChunkSize,
+				)
+			}
+			place(to, tile.V[from:from + tile.ChunkSize])
+		}
+	}
+	return nil
+}
+
+/*
+ * Like placeSlice, but for the traces of a curtain bundle. See curtain_bundle
+ * in oneseismic/messages.hpp for the layout.
+ */
+func placeCurtain(
+	bundle *message.CurtainBundle,
+	size   int,
+	place  func(offset int, samples []float32),
+) error {
+	if len(bundle.Major) < 2 * bundle.Size || len(bundle.Minor) < 2 * bundle.Size {
+		return fmt.Errorf(
+			"bundle of size %d has %d major and %d minor indices",
+			bundle.Size,
+			len(bundle.Major),
+			len(bundle.Minor),
+		)
+	}
+
+	src := bundle.Values
+	for n := 0; n < bundle.Size; n++ {
+		ifst, ilst := bundle.Major[2 * n], bundle.Major[2 * n + 1]
+		zfst, zlst := bundle.Minor[2 * n], bundle.Minor[2 * n + 1]
+		chunk := zlst - zfst
+		for i := ifst; i < ilst; i++ {
+			to := i * bundle.Zlength + zfst
+			if chunk < 0 || to < 0 || to + chunk > size {
+				return fmt.Errorf(
+					"trace out of bounds; [%d, %d) of %d samples",
+					to,
+					to + chunk,
+					size,
+				)
+			}
+			if chunk > len(src) {
+				return fmt.Errorf("bundle has too few samples")
+			}
+			place(to, src[:chunk])
+			src = src[chunk:]
+		}
+	}
+	return nil
+}
+
+/*
+ * Place the samples of the bundle, if it is of the attribute, with placeSlice
+ * or placeCurtain depending on the function of the process
+ */
+func placeBundle(
+	function int,
+	doc      []byte,
+	attr     string,
+	size     int,
+	place    func(offset int, samples []float32),
+) error {
+	switch function {
+	case message.FunctionSlice:
+		bundle, err := (&message.SliceTiles{}).Unpack(doc)
+		if err != nil {
+			return fmt.Errorf("unable to parse bundle: %w", err)
+		}
+		if bundle.Attr != attr {
+			return nil
+		}
+		return placeSlice(bundle, size, place)
+
+	case message.FunctionCurtain:
+		bundle, err := (&message.CurtainBundle{}).Unpack(doc)
+		if err != nil {
+			return fmt.Errorf("unable to parse bundle: %w", err)
+		}
+		if bundle.Attr != attr {
+			return nil
+		}
+		return placeCurtain(bundle, size, place)
+
+	default:
+		return fmt.Errorf("unknown function %d", function)
+	}
+}
+
+/*
+ * The reasons a result can't be assembled, for the reason field of the 400
+ * response, so that clients can tell them apart without parsing the message
+ */
+const (
+	reasonIrregular        = "irregular-result"
+	reasonUnknownAttribute = "unknown-attribute"
+	reasonBadShape         = "bad-shape"
+	reasonTooManyDims      = "too-many-dimensions"
+)
+
+/*
+ * The samples of an attribute, assembled into a dense, row-major array of
+ * the shape
+ */
+type assembledSlice struct {
+	attr    string
+	shape   []int
+	samples []float32
+	etag    string
+}
+
+/*
+ * Assemble the attribute (data, or the one given by ?attr=) of a finished
+ * slice result, for formats that need the whole array up front. The array is
+ * assembled in memory, so arrays larger than the limit (see assembledLimit)
+ * get 413.
+ *
+ * Only slices are dense arrays of float32 - curtains are ragged - so other
+ * processes, or results without a proper shape, get 400 with the reason.
+ * With ?decimate=, the assembled array is decimated, see decimate.go.
+ *
+ * On failure the response is written, and nil is returned.
+ */
+func (r *Result) assembleSlice(
+	ctx    *gin.Context,
+	format string,
+) *assembledSlice {
+	pid := ctx.Param("pid")
+	attr := ctx.DefaultQuery("attr", "data")
+	decimate, ok := requestedDecimation(ctx)
+	if !ok {
+		return nil
+	}
+
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, nil, false)
+	if result == nil {
+		return nil
+	}
+	head := result.head
+
+	badRequest := func(reason string, err error) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error":  err.Error(),
+			"reason": reason,
+		})
+	}
+
+	header, err := parseAssemblyHeader(head.RawHeader)
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+	if header.Function != message.FunctionSlice {
+		badRequest(
+			reasonIrregular,
+			fmt.Errorf("%s is only available for slices", format),
+		)
+		return nil
+	}
+	shape, err := header.shape(attr)
+	if err != nil {
+		badRequest(reasonUnknownAttribute, err)
+		return nil
+	}
+
+	limit := r.assembledLimit()
+	size, err := gridSize(shape, limit / 4)
+	if errors.Is(err, errResultTooLarge) {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H {
+			"error": "result too large for assembly",
+			"limit": limit,
+		})
+		return nil
+	}
+	if err != nil {
+		badRequest(reasonBadShape, err)
+		return nil
+	}
+
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "assemble", pid, head, start, false, tiles, failure)
+
+	fail := func(err error) {
+		r.logger(pid).Error("unable to assemble result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	}
+
+	samples := make([]float32, size)
+	copied := 0
+	for tiles != nil {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					fail(err)
+					return nil
+				}
+				tiles = nil
+				break
+			}
+			if output.id == "" {
+				continue
+			}
+
+			err := placeBundle(
+				header.Function,
+				output.tile,
+				attr,
+				len(samples),
+				func(offset int, run []float32) {
+					copied += copy(samples[offset:], run)
+				},
+			)
+			if err != nil {
+				fail(err)
+				return nil
+			}
+
+		case err := <-failure:
+			fail(err)
+			return nil
+		}
+	}
+
+	if int64(copied) != size {
+		fail(fmt.Errorf("assembled %d samples; shape %v has %d", copied, shape, size))
+		return nil
+	}
+	if decimate > 1 {
+		samples, shape = decimateArray(samples, shape, decimate)
+	}
+
+	return &assembledSlice {
+		attr:    attr,
+		shape:   shape,
+		samples: samples,
+		etag:    result.etag,
+	}
+}
+
+/*
+ * Write the samples as little-endian float32 to dst, which must have room for
+ * all of them
+ */
+func putFloat32s(dst []byte, samples []float32) {
+	for i, x := range samples {
+		binary.LittleEndian.PutUint32(dst[4 * i:], math.Float32bits(x))
+	}
+}
@@ -0,0 +1,273 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * Describe an axis (dimension) of a cube, and map between its annotations
+ * (line numbers) and zero-based indices.
+ *
+ * The manifest is fetched on every request. It's tempting to cache it, but
+ * fetching the manifest (with the caller's credentials) is what authorizes
+ * the request in the first place, and a cache would skip that check.
+ */
+type AxisEndpoint struct {
+	endpoint string // e.g. https://oneseismic-storage.blob.windows.net
+}
+
+func MakeAxisEndpoint(endpoint string) AxisEndpoint {
+	return AxisEndpoint {
+		endpoint: endpoint,
+	}
+}
+
+/*
+ * The annotations of an axis are the line numbers from the manifest, which
+ * are sorted in increasing order. Most axes are regular (constant step), but
+ * nothing guarantees it, so lookups fall back to binary search.
+ */
+type axis struct {
+	dimension   int
+	name        string
+	annotations []int32
+}
+
+func (a *axis) regular() bool {
+	if len(a.annotations) < 2 {
+		return false
+	}
+	step := a.annotations[1] - a.annotations[0]
+	for i := 2; i < len(a.annotations); i++ {
+		if a.annotations[i] - a.annotations[i-1] != step {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *axis) describe() gin.H {
+	n := len(a.annotations)
+	desc := gin.H {
+		"dimension": a.dimension,
+		"length":    n,
+		"regular":   a.regular(),
+	}
+	if a.name != "" {
+		desc["name"] = a.name
+	}
+	if n > 0 {
+		desc["min"] = a.annotations[0]
+		desc["max"] = a.annotations[n - 1]
+	}
+	if a.regular() {
+		desc["step"] = a.annotations[1] - a.annotations[0]
+	}
+	return desc
+}
+
+/*
+ * The index of the annotation. If the annotation is not on the axis, ok is
+ * false and the index is that of the nearest annotation instead.
+ */
+func (a *axis) index(annotation int32) (index int, ok bool) {
+	n := len(a.annotations)
+	if n == 0 {
+		return -1, false
+	}
+	if a.regular() {
+		fst  := a.annotations[0]
+		step := a.annotations[1] - fst
+		offset := annotation - fst
+		if offset % step == 0 && 0 <= offset / step && int(offset / step) < n {
+			return int(offset / step), true
+		}
+	}
+
+	i := sort.Search(n, func(i int) bool {
+		return a.annotations[i] >= annotation
+	})
+	if i < n && a.annotations[i] == annotation {
+		return i, true
+	}
+
+	switch {
+	case i == 0:
+		return 0, false
+	case i == n:
+		return n - 1, false
+	case annotation - a.annotations[i-1] <= a.annotations[i] - annotation:
+		return i - 1, false
+	default:
+		return i, false
+	}
+}
+
+func makeAxis(manifest map[string]interface{}, dim int) (*axis, error) {
+	doc, ok := manifest["line-numbers"]
+	if !ok {
+		return nil, fmt.Errorf("manifest broken; no line-numbers")
+	}
+	linenos, err := asSliceSliceInt32(doc)
+	if err != nil {
+		return nil, fmt.Errorf("manifest broken; %w", err)
+	}
+	if dim < 0 || dim >= len(linenos) {
+		return nil, nil
+	}
+
+	/*
+	 * The line-labels are a fairly recent addition to the manifest, and older
+	 * cubes will not have them
+	 */
+	name := ""
+	if labels, ok := manifest["line-labels"].([]interface{}); ok {
+		if dim < len(labels) {
+			name, _ = labels[dim].(string)
+		}
+	}
+
+	return &axis {
+		dimension:   dim,
+		name:        name,
+		annotations: linenos[dim],
+	}, nil
+}
+
+/*
+ * GET /query/:guid/axis/:dim
+ *
+ * Describe the axis (name, length, min/max and step for regular axes) and
+ * optionally look up ?annotation=<lineno> or ?index=<i>, which returns the
+ * counterpart value. Asking for an annotation that is not on the axis gives
+ * 422 with the nearest annotation as a hint.
+ *
+ * The manifest does not record units, so they're not reported.
+ */
+func (a *AxisEndpoint) Get(ctx *gin.Context) {
+	guid := ctx.Param("guid")
+	dim, err := strconv.Atoi(ctx.Param("dim"))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	/*
+	 * Forward the remaining query parameters to the blob store, like for
+	 * /graphql, so that SAS and other URL encoded auth can be used
+	 */
+	query := ctx.Request.URL.Query()
+	annotationargs := query["annotation"]
+	indexargs      := query["index"]
+	if len(annotationargs) + len(indexargs) > 1 {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	delete(query, "annotation")
+	delete(query, "index")
+
+	container, err := url.Parse(fmt.Sprintf("%s/%s", a.endpoint, guid))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+	container.RawQuery = query.Encode()
+	creds := credentials(ctx.GetHeader("Authorization"))
+	doc, err := util.FetchManifestWithCredential(ctx, creds, container)
+	if err != nil {
+		logging.Default().Info("unable to fetch manifest", "guid", guid, "error", err)
+		util.AbortOnManifestError(ctx, err)
+		return
+	}
+
+	manifest, err := manifestAsMap(doc)
+	if err != nil {
+		logging.Default().Error("bad manifest", "guid", guid, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ax, err := makeAxis(manifest, dim)
+	if err != nil {
+		logging.Default().Error("unable to make axis", "guid", guid, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if ax == nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	status, body := ax.lookup(annotationargs, indexargs)
+	ctx.JSON(status, body)
+}
+
+/*
+ * Describe the axis, and perform the (optional) lookup
+ */
+func (a *axis) lookup(annotationargs, indexargs []string) (int, gin.H) {
+	desc := a.describe()
+	if len(annotationargs) == 1 {
+		annotation, err := strconv.ParseInt(annotationargs[0], 10, 32)
+		if err != nil {
+			return http.StatusBadRequest, gin.H {
+				"error": "annotation must be an integer",
+			}
+		}
+
+		index, ok := a.index(int32(annotation))
+		if index < 0 {
+			return http.StatusUnprocessableEntity, gin.H {
+				"error": fmt.Sprintf("dimension %d is empty", a.dimension),
+			}
+		}
+		if !ok {
+			return http.StatusUnprocessableEntity, gin.H {
+				"error": fmt.Sprintf(
+					"annotation %d not in dimension %d",
+					annotation,
+					a.dimension,
+				),
+				"nearest": gin.H {
+					"annotation": a.annotations[index],
+					"index":      index,
+				},
+			}
+		}
+		desc["annotation"] = annotation
+		desc["index"] = index
+	}
+
+	if len(indexargs) == 1 {
+		index, err := strconv.Atoi(indexargs[0])
+		if err != nil {
+			return http.StatusBadRequest, gin.H {
+				"error": "index must be an integer",
+			}
+		}
+
+		n := len(a.annotations)
+		if index < 0 || index >= n {
+			return http.StatusUnprocessableEntity, gin.H {
+				"error": fmt.Sprintf(
+					"index %d not in [0, %d)",
+					index,
+					n,
+				),
+			}
+		}
+		desc["index"] = index
+		desc["annotation"] = a.annotations[index]
+	}
+
+	return http.StatusOK, desc
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+/*
+ * Build the manifest like it would look when parsed from JSON
+ */
+func fakeManifest(labels []string, linenos ...[]int) map[string]interface{} {
+	doc := map[string]interface{} {
+		"line-numbers": linenos,
+	}
+	if labels != nil {
+		doc["line-labels"] = labels
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	manifest, err := manifestAsMap(raw)
+	if err != nil {
+		panic(err)
+	}
+	return manifest
+}
+
+func TestRegularAxis(t *testing.T) {
+	manifest := fakeManifest(
+		[]string{ "inline", "crossline", "time" },
+		[]int{ 1, 2, 3 },
+		[]int{ 2400, 2404, 2408, 2412 },
+		[]int{ 0, 4000, 8000 },
+	)
+	ax, err := makeAxis(manifest, 1)
+	assert.Nil(t, err)
+
+	status, body := ax.lookup(nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "crossline", body["name"])
+	assert.Equal(t, 4, body["length"])
+	assert.Equal(t, int32(2400), body["min"])
+	assert.Equal(t, int32(2412), body["max"])
+	assert.Equal(t, int32(4), body["step"])
+
+	status, body = ax.lookup([]string{ "2408" }, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, body["index"])
+
+	status, body = ax.lookup(nil, []string{ "3" })
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(2412), body["annotation"])
+}
+
+func TestIrregularAxis(t *testing.T) {
+	manifest := fakeManifest(nil, []int{ 1, 2, 5, 9, 10 })
+	ax, err := makeAxis(manifest, 0)
+	assert.Nil(t, err)
+
+	status, body := ax.lookup(nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, false, body["regular"])
+	assert.NotContains(t, body, "step")
+	assert.NotContains(t, body, "name")
+
+	status, body = ax.lookup([]string{ "9" }, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 3, body["index"])
+
+	status, body = ax.lookup([]string{ "6" }, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	nearest := body["nearest"].(gin.H)
+	assert.Equal(t, int32(5), nearest["annotation"])
+	assert.Equal(t, 2, nearest["index"])
+
+	status, body = ax.lookup([]string{ "8" }, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	nearest = body["nearest"].(gin.H)
+	assert.Equal(t, int32(9), nearest["annotation"])
+}
+
+func TestSingleElementAxis(t *testing.T) {
+	manifest := fakeManifest(nil, []int{ 7 })
+	ax, err := makeAxis(manifest, 0)
+	assert.Nil(t, err)
+
+	status, body := ax.lookup(nil, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, int32(7), body["min"])
+	assert.Equal(t, int32(7), body["max"])
+	assert.NotContains(t, body, "step")
+
+	status, body = ax.lookup([]string{ "7" }, nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 0, body["index"])
+
+	status, _ = ax.lookup([]string{ "100" }, nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	status, _ = ax.lookup(nil, []string{ "1" })
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+}
+
+func TestAxisOutOfRange(t *testing.T) {
+	manifest := fakeManifest(nil, []int{ 1, 2 })
+	ax, err := makeAxis(manifest, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, ax)
+}
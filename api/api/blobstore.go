@@ -0,0 +1,135 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+/*
+ * A BlobStore in an Azure blob container, signing URLs with the account key.
+ *
+ * Queries read the cubes with the credentials of the user, but Get only has
+ * the result token, so the uploads are made with the account key of the
+ * service instead.
+ */
+type AzureBlobStore struct {
+	container  azblob.ContainerURL
+	name       string
+	credential *azblob.SharedKeyCredential
+}
+
+/*
+ * Make a store in the container at containerURL, e.g.
+ * https://<account>.blob.core.windows.net/<container>, with the account key.
+ * The account name is taken from the URL.
+ */
+func NewAzureBlobStore(containerURL string, key string) (*AzureBlobStore, error) {
+	u, err := url.Parse(containerURL)
+	if err != nil {
+		return nil, fmt.Errorf("bad container URL: %w", err)
+	}
+	parts := azblob.NewBlobURLParts(*u)
+	account := strings.Split(parts.Host, ".")[0]
+	if account == "" || parts.ContainerName == "" {
+		return nil, fmt.Errorf(
+			"container URL %s must be https://<account>.<host>/<container>",
+			containerURL,
+		)
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(account, key)
+	if err != nil {
+		return nil, fmt.Errorf("bad account key: %w", err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	return &AzureBlobStore {
+		container:  azblob.NewContainerURL(*u, pipeline),
+		name:       parts.ContainerName,
+		credential: credential,
+	}, nil
+}
+
+func (s *AzureBlobStore) Upload(
+	ctx  context.Context,
+	name string,
+	body io.Reader,
+) error {
+	blob := s.container.NewBlockBlobURL(name)
+	_, err := azblob.UploadStreamToBlockBlob(
+		ctx,
+		body,
+		blob,
+		azblob.UploadStreamToBlockBlobOptions {
+			BufferSize: 8 * 1024 * 1024,
+			MaxBuffers: 4,
+			BlobHTTPHeaders: azblob.BlobHTTPHeaders {
+				ContentType: resultContentType,
+			},
+		},
+	)
+	return err
+}
+
+func (s *AzureBlobStore) SignedURL(name string, ttl time.Duration) (string, error) {
+	sas, err := azblob.BlobSASSignatureValues {
+		Protocol:      azblob.SASProtocolHTTPS,
+		ExpiryTime:    time.Now().UTC().Add(ttl),
+		ContainerName: s.name,
+		BlobName:      name,
+		Permissions:   azblob.BlobSASPermissions { Read: true }.String(),
+	}.NewSASQueryParameters(s.credential)
+	if err != nil {
+		return "", err
+	}
+
+	parts := azblob.NewBlobURLParts(s.container.NewBlobURL(name).URL())
+	parts.SAS = sas
+	u := parts.URL()
+	return u.String(), nil
+}
+
+func (s *AzureBlobStore) Delete(ctx context.Context, name string) error {
+	_, err := s.container.NewBlobURL(name).Delete(
+		ctx,
+		azblob.DeleteSnapshotsOptionInclude,
+		azblob.BlobAccessConditions {},
+	)
+	var serr azblob.StorageError
+	if errors.As(err, &serr) && serr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *AzureBlobStore) Expire(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		segment, err := s.container.ListBlobsFlatSegment(
+			ctx,
+			marker,
+			azblob.ListBlobsSegmentOptions {},
+		)
+		if err != nil {
+			return n, err
+		}
+		marker = segment.NextMarker
+
+		for _, blob := range segment.Segment.BlobItems {
+			if !blob.Properties.LastModified.Before(before) {
+				continue
+			}
+			if err := s.Delete(ctx, blob.Name); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
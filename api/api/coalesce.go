@@ -0,0 +1,67 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+ * A flightgroup coalesces concurrent calls for the same key into a single
+ * call, and hands the same result to all callers. This is the singleflight
+ * pattern, useful when many clients poll the same resource at the same time,
+ * e.g. a fleet of dashboards all asking for the status of the same popular
+ * process.
+ *
+ * The result can optionally be shared for a short window after the call
+ * started, to smooth out polling storms that don't quite line up. The window
+ * should be kept short, as the result is effectively cached for that long.
+ *
+ * The zero value is ready to use.
+ */
+type flightgroup struct {
+	mtx     sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done   chan struct{}
+	result interface{}
+}
+
+func (g *flightgroup) do(
+	key    string,
+	window time.Duration,
+	fn     func() interface{},
+) interface{} {
+	g.mtx.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mtx.Unlock()
+		<-f.done
+		return f.result
+	}
+	f := &flight { done: make(chan struct{}) }
+	g.flights[key] = f
+	g.mtx.Unlock()
+
+	start := time.Now()
+	f.result = fn()
+	close(f.done)
+
+	forget := func() {
+		g.mtx.Lock()
+		defer g.mtx.Unlock()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+	}
+	remaining := window - time.Since(start)
+	if remaining > 0 {
+		time.AfterFunc(remaining, forget)
+	} else {
+		forget()
+	}
+	return f.result
+}
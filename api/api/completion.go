@@ -0,0 +1,321 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * The CompletionWatcher is the single place in the API that figures out when a
+ * process is done. Without it, every handler that cares about completion would
+ * have to poll XLEN against the process header on its own, which under many
+ * concurrent clients multiplies the load on redis.
+ *
+ * The workers publish the pid on a (per-deployment) pub/sub channel when the
+ * last task of a process is written, and the watcher fans that event out
+ * in-process to everyone that subscribed for that pid. Completed pids are
+ * also remembered for a while, with the number of tasks they completed, so
+ * that the status of finished processes can be reported without going to
+ * redis at all.
+ *
+ * Should pub/sub not be available (detected when Run() starts), the watcher
+ * falls back to polling - but it polls once per pid per interval, regardless
+ * of the number of subscribers, which is still a lot better than every
+ * subscriber polling independently.
+ */
+type CompletionWatcher struct {
+	/*
+	 * The pub/sub channel the workers publish completed pids on. Must be
+	 * consistent with the workers.
+	 */
+	Channel  string
+	/*
+	 * Interval for checking subscribed pids when falling back to polling.
+	 */
+	Interval time.Duration
+	/*
+	 * How long completed pids are remembered. This should be roughly the
+	 * same as the expiration of the partial results.
+	 */
+	Retention time.Duration
+	/*
+	 * Optional - where to log. Nil means the default logger.
+	 */
+	Logger *logging.Logger
+
+	client  redis.UniversalClient
+	storage redis.Cmdable
+
+	mtx         sync.Mutex
+	subscribers map[string][]chan struct{}
+	finished    map[string]completion
+	available   bool
+}
+
+/*
+ * When a process was seen completed, and the number of tasks it had then
+ */
+type completion struct {
+	at     time.Time
+	ntasks int
+}
+
+func NewCompletionWatcher(
+	client  redis.UniversalClient,
+	channel string,
+) *CompletionWatcher {
+	return &CompletionWatcher {
+		Channel:     channel,
+		Interval:    time.Second,
+		Retention:   10 * time.Minute,
+		client:      client,
+		storage:     client,
+		subscribers: make(map[string][]chan struct{}),
+		finished:    make(map[string]completion),
+	}
+}
+
+/*
+ * Subscribe to the completion of the process pid. The returned channel is
+ * closed exactly once, when the process completes. If the process is already
+ * known to be completed, the channel is closed immediately.
+ *
+ * The cancel function must be called when the subscriber is no longer
+ * interested, e.g. when the client disconnects, or the subscription leaks. It
+ * is safe to call cancel after the channel has been closed.
+ */
+func (w *CompletionWatcher) Subscribe(pid string) (<-chan struct{}, func()) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	done := make(chan struct{})
+	if _, ok := w.finished[pid]; ok {
+		close(done)
+		return done, func() {}
+	}
+
+	w.subscribers[pid] = append(w.subscribers[pid], done)
+	cancel := func() {
+		w.mtx.Lock()
+		defer w.mtx.Unlock()
+		subs := w.subscribers[pid]
+		for i, sub := range subs {
+			if sub == done {
+				subs = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(subs) == 0 {
+			delete(w.subscribers, pid)
+		} else {
+			w.subscribers[pid] = subs
+		}
+	}
+	return done, cancel
+}
+
+/*
+ * Check if the process is known to be completed with (at least) ntasks tasks,
+ * which should be from the current process header. Should the process be
+ * reissued with more tasks after it was seen completed, it's no longer
+ * finished. A false return does *not* mean that the process is still
+ * running, only that the watcher has not (yet) seen it complete, and the
+ * caller must go to storage to find out.
+ */
+func (w *CompletionWatcher) Finished(pid string, ntasks int) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	c, ok := w.finished[pid]
+	return ok && c.ntasks >= ntasks
+}
+
+/*
+ * True if the watcher receives completion events through pub/sub, false if it
+ * has fallen back to polling.
+ */
+func (w *CompletionWatcher) Available() bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.available
+}
+
+/*
+ * Mark pid as completed with ntasks tasks, and notify all its subscribers.
+ * Workers that finish their tasks at the same time can both think they're the
+ * last, so the same pid can be reported multiple times. That's fine - the
+ * subscribers are removed as they're notified, so they only ever get notified
+ * once.
+ */
+func (w *CompletionWatcher) complete(pid string, ntasks int) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for _, sub := range w.subscribers[pid] {
+		close(sub)
+	}
+	delete(w.subscribers, pid)
+	w.finished[pid] = completion { at: time.Now(), ntasks: ntasks }
+}
+
+/*
+ * A worker announced that the process pid is completed. The worker judged it
+ * against the process header as it was then, so the announcement is checked
+ * against the current header before it's trusted. If the process has been
+ * reissued with more tasks since, it's not done until the new tasks are.
+ */
+func (w *CompletionWatcher) announced(ctx context.Context, pid string) {
+	ntasks, done, err := completed(ctx, w.storage, pid)
+	if err != nil {
+		w.Logger.Warn("unable to check completion", "pid", pid, "error", err)
+		return
+	}
+	if done {
+		w.complete(pid, ntasks)
+	}
+}
+
+func (w *CompletionWatcher) prune() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for pid, c := range w.finished {
+		if time.Since(c.at) > w.Retention {
+			delete(w.finished, pid)
+		}
+	}
+}
+
+func (w *CompletionWatcher) subscribed() []string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	pids := make([]string, 0, len(w.subscribers))
+	for pid := range w.subscribers {
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+/*
+ * Check storage for the completion of all subscribed pids. This is the polling
+ * fallback, but it's also used to catch up on events that might have been
+ * published while the pub/sub connection was down.
+ */
+func (w *CompletionWatcher) poll(ctx context.Context) {
+	for _, pid := range w.subscribed() {
+		ntasks, done, err := completed(ctx, w.storage, pid)
+		if err != nil {
+			w.Logger.Warn("unable to check completion", "pid", pid, "error", err)
+			continue
+		}
+		if done {
+			w.complete(pid, ntasks)
+		}
+	}
+}
+
+/*
+ * Run the watcher until ctx is cancelled. This function blocks, and should
+ * usually be called as a goroutine on program startup.
+ */
+func (w *CompletionWatcher) Run(ctx context.Context) {
+	pubsub := w.client.Subscribe(ctx, w.Channel)
+	defer pubsub.Close()
+
+	/*
+	 * The redis library subscribes lazily, so wait for the confirmation to
+	 * find out if pub/sub actually works before committing to it.
+	 */
+	_, err := pubsub.ReceiveTimeout(ctx, 5 * time.Second)
+	if err != nil {
+		w.Logger.Warn(
+			"unable to subscribe, falling back to polling",
+			"channel", w.Channel,
+			"error",   err,
+		)
+		w.run(ctx, nil)
+		return
+	}
+
+	w.mtx.Lock()
+	w.available = true
+	w.mtx.Unlock()
+	w.run(ctx, pubsub.ChannelWithSubscriptions(ctx, 100))
+}
+
+/*
+ * The event loop of the watcher, separated from Run() so that it can be driven
+ * without a redis server. A nil events channel means polling.
+ *
+ * The redis library transparently reconnects and re-subscribes when the
+ * connection is lost, but messages published in the meantime are gone. A
+ * re-subscription shows up as a new *redis.Subscription message, which is the
+ * signal to check storage for everything that's currently subscribed.
+ */
+func (w *CompletionWatcher) run(
+	ctx    context.Context,
+	events <-chan interface{},
+) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if events == nil {
+				w.poll(ctx)
+			}
+			w.prune()
+
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			switch msg := event.(type) {
+			case *redis.Subscription:
+				if msg.Kind == "subscribe" {
+					w.poll(ctx)
+				}
+			case *redis.Message:
+				w.announced(ctx, msg.Payload)
+			}
+		}
+	}
+}
+
+/*
+ * Check storage if the process pid is completed, i.e. all the tasks in the
+ * process header have written their results, and get the number of tasks. A
+ * missing header is not an error, but just means the process is not
+ * completed (yet).
+ */
+func completed(
+	ctx     context.Context,
+	storage redis.Cmdable,
+	pid     string,
+) (int, bool, error) {
+	body, err := storage.Get(ctx, headerkey(pid)).Bytes()
+	if err == redis.Nil {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to get process header: %w", err)
+	}
+
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		return 0, false, err
+	}
+
+	count, err := storage.XLen(ctx, pid).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	return head.Ntasks, count >= int64(head.Ntasks), nil
+}
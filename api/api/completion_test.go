@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func newTestWatcher(storage redis.Cmdable) *CompletionWatcher {
+	w := NewCompletionWatcher(nil, "completed")
+	w.storage = storage
+	w.Interval = 10 * time.Millisecond
+	return w
+}
+
+func TestCompletionReachesAllSubscribersOnce(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	w := newTestWatcher(storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan interface{})
+	go w.run(ctx, events)
+
+	nsubscribers := 5
+	received := make([]int, nsubscribers)
+	var wg sync.WaitGroup
+	for i := 0; i < nsubscribers; i++ {
+		done, unsubscribe := w.Subscribe("pid")
+		defer unsubscribe()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case <-done:
+				received[i]++
+			case <-time.After(time.Second):
+			}
+		}(i)
+	}
+
+	/*
+	 * Workers finishing at the same time may both announce completion, which
+	 * must not notify the subscribers twice
+	 */
+	events <- &redis.Message { Channel: "completed", Payload: "pid" }
+	events <- &redis.Message { Channel: "completed", Payload: "pid" }
+	wg.Wait()
+
+	for i, n := range received {
+		if n != 1 {
+			t.Errorf("subscriber %d notified %d times; want 1", i, n)
+		}
+	}
+
+	if !w.Finished("pid", 1) {
+		t.Errorf("expected pid to be finished")
+	}
+}
+
+func TestSubscribeToFinishedProcess(t *testing.T) {
+	w := newTestWatcher(newFakeStorage())
+	w.complete("pid", 1)
+
+	done, unsubscribe := w.Subscribe("pid")
+	defer unsubscribe()
+	select {
+	case <-done:
+	default:
+		t.Errorf("expected subscription to a finished pid to be closed")
+	}
+}
+
+func TestCompletionNotifiesOnlyMatchingPid(t *testing.T) {
+	w := newTestWatcher(newFakeStorage())
+	done, unsubscribe := w.Subscribe("pid")
+	defer unsubscribe()
+
+	w.complete("other-pid", 1)
+	select {
+	case <-done:
+		t.Errorf("subscriber notified for completion of another pid")
+	default:
+	}
+}
+
+func TestCompletionFallsBackToPolling(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+
+	w := newTestWatcher(storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, nil)
+
+	done, unsubscribe := w.Subscribe("pid")
+	defer unsubscribe()
+
+	select {
+	case <-done:
+		t.Fatalf("subscriber notified before process completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	storage.add("pid", "1/2", []byte("tile"))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("subscriber not notified after process completed")
+	}
+}
+
+func TestResubscribeChecksStorage(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+
+	w := newTestWatcher(storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan interface{})
+	go w.run(ctx, events)
+
+	done, unsubscribe := w.Subscribe("pid")
+	defer unsubscribe()
+
+	/*
+	 * The completion was published while the connection was down, and the
+	 * re-subscription should make the watcher catch up
+	 */
+	events <- &redis.Subscription { Kind: "subscribe", Channel: "completed" }
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("subscriber not notified after re-subscription")
+	}
+}
+
+func TestStatusOfFinishedProcessSkipsStorage(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+
+	w := newTestWatcher(storage)
+	w.complete("pid", 1)
+	result := Result {
+		Storage:     storage,
+		Completions: w,
+	}
+	head, _ := parseProcessHeader(fakeProcessHeader(1))
+	count, err := result.count(context.Background(), "pid", head)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if count != 1 {
+		t.Errorf("count = %d; want 1", count)
+	}
+	if n := storage.called("xlen"); n != 0 {
+		t.Errorf("XLEN called %d times for finished process; want 0", n)
+	}
+}
+
+func TestGetWaitsForCompletion(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+
+	w := newTestWatcher(storage)
+	result := Result {
+		Storage:        storage,
+		Completions:    w,
+		CompletionWait: 5 * time.Second,
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		storage.add("pid", "1/2", []byte("tile-1"))
+		w.complete("pid", 2)
+	}()
+
+	if rec := getResult(&result, "pid"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestGetAnswersAcceptedAfterCompletionWait(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+
+	result := Result {
+		Storage:        storage,
+		Completions:    newTestWatcher(storage),
+		CompletionWait: 20 * time.Millisecond,
+	}
+	if rec := getResult(&result, "pid"); rec.Code != http.StatusAccepted {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+}
+
+/*
+ * The process is reissued with more tasks after the worker that finished the
+ * original tasks announced it completed
+ */
+func TestAnnouncedCompletionIsCheckedAgainstReissue(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+
+	w := newTestWatcher(storage)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan interface{})
+	go w.run(ctx, events)
+
+	done, unsubscribe := w.Subscribe("pid")
+	defer unsubscribe()
+
+	events <- &redis.Message { Channel: "completed", Payload: "pid" }
+	select {
+	case <-done:
+		t.Fatalf("subscriber notified before the reissued task completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	storage.add("pid", "2/3", []byte("tile-2"))
+	events <- &redis.Message { Channel: "completed", Payload: "pid" }
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("subscriber not notified after the reissued task completed")
+	}
+	if !w.Finished("pid", 3) {
+		t.Errorf("expected pid to be finished with 3 tasks")
+	}
+}
+
+func TestReissueInvalidatesFinishedStatus(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile-0"))
+
+	w := newTestWatcher(storage)
+	w.complete("pid", 1)
+	result := Result {
+		Storage:     storage,
+		Completions: w,
+	}
+
+	status := func() (int, string) {
+		rec := getStatus(&result, "pid")
+		body := map[string]string {}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		return rec.Code, body["progress"]
+	}
+
+	if code, progress := status(); code != http.StatusOK || progress != "1/1" {
+		t.Fatalf("status = %d %s; want %d 1/1", code, progress, http.StatusOK)
+	}
+
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	code, progress := status()
+	if code != http.StatusAccepted || progress != "1/2" {
+		t.Errorf("status = %d %s; want %d 1/2", code, progress, http.StatusAccepted)
+	}
+	if rec := getResult(&result, "pid"); rec.Code != http.StatusAccepted {
+		t.Errorf("result = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+
+	storage.add("pid", "1/2", []byte("tile-1"))
+	if code, progress := status(); code != http.StatusOK || progress != "2/2" {
+		t.Errorf("status = %d %s; want %d 2/2", code, progress, http.StatusOK)
+	}
+	if rec := getResult(&result, "pid"); rec.Code != http.StatusOK {
+		t.Errorf("result = %d; want %d", rec.Code, http.StatusOK)
+	}
+}
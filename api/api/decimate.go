@@ -0,0 +1,273 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * Decimation, with ?decimate=n, keeps every nth sample along every dimension
+ * of the result, e.g. every 4th sample of every 4th trace, for overviews
+ * that would otherwise throw away most of the result. The samples kept are
+ * those at index 0, n, 2n, ... so a dimension of length m is decimated to
+ * ceil(m / n).
+ *
+ * Only slices can be decimated - their bundles are tiles of a dense array,
+ * so every sample has a position to stride over. Curtains are ragged, and
+ * get 400. The result is decimated after it's complete, and the msgpack
+ * result is assembled in memory to do so, which is also why streams can't
+ * be decimated.
+ */
+
+/*
+ * The decimation asked for with ?decimate=, 1 (none) by default. Bad values
+ * get 400, and false is returned.
+ */
+func requestedDecimation(ctx *gin.Context) (int, bool) {
+	param := ctx.Query("decimate")
+	if param == "" {
+		return 1, true
+	}
+	n, err := strconv.Atoi(param)
+	if err != nil || n < 1 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "decimate must be a positive integer",
+		})
+		return 0, false
+	}
+	return n, true
+}
+
+/*
+ * Reject ?decimate= for the endpoints that can't decimate, with 400. Returns
+ * true if the request was rejected.
+ */
+func rejectDecimation(ctx *gin.Context, endpoint string) bool {
+	if ctx.Query("decimate") == "" {
+		return false
+	}
+	ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+		"error": fmt.Sprintf("decimate is not available for %s", endpoint),
+	})
+	return true
+}
+
+func decimatedShape(shape []int, n int) []int {
+	decimated := make([]int, len(shape))
+	for i, dim := range shape {
+		decimated[i] = (dim + n - 1) / n
+	}
+	return decimated
+}
+
+/*
+ * The position of the sample at offset (in the row-major array of shape) in
+ * the decimated array, or false if the sample is not kept
+ */
+func decimatedOffset(offset int, shape []int, decimated []int, n int) (int, bool) {
+	to := 0
+	stride := 1
+	for d := len(shape) - 1; d >= 0; d-- {
+		i := offset % shape[d]
+		offset /= shape[d]
+		if i % n != 0 {
+			return 0, false
+		}
+		to += (i / n) * stride
+		stride *= decimated[d]
+	}
+	return to, true
+}
+
+/*
+ * Decimate the array of samples with the shape
+ */
+func decimateArray(samples []float32, shape []int, n int) ([]float32, []int) {
+	decimated := decimatedShape(shape, n)
+	out := make([]float32, 0)
+	for offset, x := range samples {
+		if _, ok := decimatedOffset(offset, shape, decimated, n); ok {
+			out = append(out, x)
+		}
+	}
+	return out, decimated
+}
+
+/*
+ * Decimate a bundle of the attribute with the shape. The samples kept are
+ * re-tiled as runs that are contiguous in the decimated array, one tile per
+ * run, which is the simplest layout that decodes like any other slice.
+ */
+func decimateSlice(
+	bundle *message.SliceTiles,
+	shape  []int,
+	n      int,
+) (*message.SliceTiles, error) {
+	size, err := gridSize(shape, math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	decimated := decimatedShape(shape, n)
+
+	out := &message.SliceTiles { Attr: bundle.Attr, Tiles: []message.Tile {} }
+	var run []float32
+	first, next := 0, -1
+	emit := func() {
+		if len(run) == 0 {
+			return
+		}
+		out.Tiles = append(out.Tiles, message.Tile {
+			Iterations:  1,
+			ChunkSize:   len(run),
+			InitialSkip: first,
+			Superstride: len(run),
+			Substride:   len(run),
+			V:           run,
+		})
+		run = nil
+	}
+
+	err = placeSlice(bundle, int(size), func(offset int, samples []float32) {
+		for i, x := range samples {
+			to, ok := decimatedOffset(offset + i, shape, decimated, n)
+			if !ok {
+				continue
+			}
+			if to != next {
+				emit()
+				first = to
+			}
+			run = append(run, x)
+			next = to + 1
+		}
+	})
+	emit()
+	return out, err
+}
+
+/*
+ * GET /result/<pid>?decimate=n
+ *
+ * The msgpack result, decimated. The shapes in the result header are those
+ * of the decimated arrays, and the bundles are decimated one by one, so the
+ * result decodes like any other slice.
+ */
+func (r *Result) getDecimated(ctx *gin.Context, pid string, n int) {
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, nil, false)
+	if result == nil {
+		return
+	}
+	head := result.head
+
+	header, err := parseAssemblyHeader(head.RawHeader)
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if header.Function != message.FunctionSlice {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error":  "decimate is only available for slices",
+			"reason": reasonIrregular,
+		})
+		return
+	}
+
+	shapes := make(map[string][]int)
+	flat := make([]int, 0, len(header.Shapes))
+	for _, attr := range header.Attributes {
+		shape, err := header.shape(attr)
+		if err == nil {
+			_, err = gridSize(shape, math.MaxInt32)
+		}
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+				"error":  err.Error(),
+				"reason": reasonBadShape,
+			})
+			return
+		}
+		shapes[attr] = shape
+		flat = append(flat, len(shape))
+		flat = append(flat, decimatedShape(shape, n)...)
+	}
+
+	doc, err := rewriteHeader(
+		head.RawHeader,
+		head.Ntasks,
+		map[string]interface{} { "shapes": flat },
+	)
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "decimate", pid, head, start, false, tiles, failure)
+
+	fail := func(err error) {
+		r.logger(pid).Error("unable to decimate result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	}
+
+	var body bytes.Buffer
+	body.Write(doc)
+	for tiles != nil {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					fail(err)
+					return
+				}
+				tiles = nil
+				break
+			}
+			if output.id == "" {
+				continue
+			}
+
+			bundle, err := (&message.SliceTiles{}).Unpack(output.tile)
+			output.release()
+			if err != nil {
+				fail(fmt.Errorf("unable to parse bundle: %w", err))
+				return
+			}
+			shape, ok := shapes[bundle.Attr]
+			if !ok {
+				fail(fmt.Errorf("no attribute %s in result", bundle.Attr))
+				return
+			}
+			decimated, err := decimateSlice(bundle, shape, n)
+			if err != nil {
+				fail(err)
+				return
+			}
+			packed, err := decimated.Pack()
+			if err != nil {
+				fail(err)
+				return
+			}
+			body.Write(packed)
+
+		case err := <-failure:
+			fail(err)
+			return
+		}
+	}
+
+	cacheImmutable(ctx, result.etag)
+	setDisposition(ctx, pid, "bin")
+	ctx.Data(http.StatusOK, resultContentType, body.Bytes())
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * The value of sample (j, k) of a slice, so that decimated samples can be
+ * told apart
+ */
+func sampleValue(j, k int) float32 {
+	return float32(1000 + 100 * j + k)
+}
+
+/*
+ * A 1 x nj x nk slice as a bundle of tiles of 1 x tj x tk, like the workers
+ * would make, starting at (j0, k0)
+ */
+func tiledSlice(nj, nk, tj, tk int) *message.SliceTiles {
+	bundle := &message.SliceTiles { Attr: "data" }
+	for j0 := 0; j0 < nj; j0 += tj {
+		for k0 := 0; k0 < nk; k0 += tk {
+			iterations := tj
+			if j0 + iterations > nj {
+				iterations = nj - j0
+			}
+			chunk := tk
+			if k0 + chunk > nk {
+				chunk = nk - k0
+			}
+			v := make([]float32, 0)
+			for j := j0; j < j0 + iterations; j++ {
+				for k := k0; k < k0 + chunk; k++ {
+					v = append(v, sampleValue(j, k))
+				}
+			}
+			bundle.Tiles = append(bundle.Tiles, message.Tile {
+				Iterations:  iterations,
+				ChunkSize:   chunk,
+				InitialSkip: j0 * nk + k0,
+				Superstride: nk,
+				Substride:   chunk,
+				V:           v,
+			})
+		}
+	}
+	return bundle
+}
+
+/*
+ * The slice, decimated the straightforward way
+ */
+func decimatedValues(nj, nk, n int) []float32 {
+	values := make([]float32, 0)
+	for j := 0; j < nj; j += n {
+		for k := 0; k < nk; k += n {
+			values = append(values, sampleValue(j, k))
+		}
+	}
+	return values
+}
+
+func assembleBundle(t *testing.T, bundle *message.SliceTiles, size int) []float32 {
+	samples := make([]float32, size)
+	err := placeSlice(bundle, size, func(offset int, run []float32) {
+		copy(samples[offset:], run)
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return samples
+}
+
+func TestDecimatedShape(t *testing.T) {
+	got := decimatedShape([]int { 1, 7, 8 }, 4)
+	if want := []int { 1, 2, 2 }; !reflect.DeepEqual(got, want) {
+		t.Errorf("shape = %v; want %v", got, want)
+	}
+}
+
+func TestDecimateArray(t *testing.T) {
+	nj, nk := 5, 7
+	bundle := tiledSlice(nj, nk, nj, nk)
+	samples := assembleBundle(t, bundle, nj * nk)
+
+	for _, n := range []int { 1, 2, 3, 8 } {
+		got, shape := decimateArray(samples, []int { 1, nj, nk }, n)
+		if want := decimatedShape([]int { 1, nj, nk }, n); !reflect.DeepEqual(shape, want) {
+			t.Errorf("n = %d: shape = %v; want %v", n, shape, want)
+		}
+		if want := decimatedValues(nj, nk, n); !reflect.DeepEqual(got, want) {
+			t.Errorf("n = %d: samples = %v; want %v", n, got, want)
+		}
+	}
+}
+
+/*
+ * Decimating the tiles one by one must give the same array as decimating
+ * the assembled array, whichever way the tiles cut across the strides
+ */
+func TestDecimateSliceStridesAcrossTiles(t *testing.T) {
+	nj, nk := 9, 11
+	shape := []int { 1, nj, nk }
+	for _, n := range []int { 2, 3, 4 } {
+		for _, tile := range [][2]int { { 1, 1 }, { 2, 3 }, { 4, 5 }, { nj, nk } } {
+			bundle := tiledSlice(nj, nk, tile[0], tile[1])
+			decimated, err := decimateSlice(bundle, shape, n)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			dshape := decimatedShape(shape, n)
+			got := assembleBundle(t, decimated, dshape[1] * dshape[2])
+			if want := decimatedValues(nj, nk, n); !reflect.DeepEqual(got, want) {
+				t.Errorf(
+					"n = %d, tiles of %v: samples = %v; want %v",
+					n, tile, got, want,
+				)
+			}
+		}
+	}
+}
+
+func TestDecimateSliceOutOfBounds(t *testing.T) {
+	bundle := tiledSlice(4, 4, 4, 4)
+	if _, err := decimateSlice(bundle, []int { 1, 2, 2 }, 2); err == nil {
+		t.Errorf("tile larger than the shape decimated without error")
+	}
+}
+
+func decimatedResult(nj, nk int) *fakeStorage {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		2,
+		[]string { "data" },
+		[]int { 1, nj, nk },
+	)
+	storage.set(headerkey("pid"), header)
+
+	/*
+	 * Split the tiles over two bundles, like two workers would
+	 */
+	bundle := tiledSlice(nj, nk, 2, 3)
+	half := len(bundle.Tiles) / 2
+	first := &message.SliceTiles { Attr: "data", Tiles: bundle.Tiles[:half] }
+	second := &message.SliceTiles { Attr: "data", Tiles: bundle.Tiles[half:] }
+	for i, b := range []*message.SliceTiles { first, second } {
+		packed, err := b.Pack()
+		if err != nil {
+			panic(err)
+		}
+		storage.add("pid", []string { "0/2", "1/2" }[i], packed)
+	}
+	return storage
+}
+
+func TestDecimatedResult(t *testing.T) {
+	nj, nk, n := 6, 9, 2
+	result := Result { Storage: decimatedResult(nj, nk) }
+
+	w := requestResult(&result, "/result/pid?decimate=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	dec := msgpack.NewDecoder(bytes.NewReader(w.Body.Bytes()[1:]))
+	var header resultHeader
+	if err := dec.Decode(&header); err != nil {
+		t.Fatalf("%v", err)
+	}
+	dshape := decimatedShape([]int { 1, nj, nk }, n)
+	if want := append([]int { 3 }, dshape...); !reflect.DeepEqual(header.Shapes, want) {
+		t.Errorf("shapes = %v; want %v", header.Shapes, want)
+	}
+
+	samples := make([]float32, dshape[1] * dshape[2])
+	bundles := 0
+	for {
+		var bundle message.SliceTiles
+		err := dec.Decode(&bundle)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		bundles++
+		err = placeSlice(&bundle, len(samples), func(offset int, run []float32) {
+			copy(samples[offset:], run)
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	if bundles != 2 {
+		t.Errorf("%d bundles; want 2", bundles)
+	}
+	if want := decimatedValues(nj, nk, n); !reflect.DeepEqual(samples, want) {
+		t.Errorf("samples = %v; want %v", samples, want)
+	}
+}
+
+func TestDecimatedNpy(t *testing.T) {
+	nj, nk := 6, 9
+	result := Result { Storage: decimatedResult(nj, nk) }
+
+	w := requestResult(&result, "/result/pid?format=npy&decimate=3", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	shape, samples := parseNpy(t, w.Body.Bytes())
+	if want := []int { 1, 2, 3 }; !reflect.DeepEqual(shape, want) {
+		t.Errorf("shape = %v; want %v", shape, want)
+	}
+	if want := decimatedValues(nj, nk, 3); !reflect.DeepEqual(samples, want) {
+		t.Errorf("samples = %v; want %v", samples, want)
+	}
+}
+
+func TestDecimateIsRefused(t *testing.T) {
+	curtain := newFakeStorage()
+	curtain.set(headerkey("pid"), fakeResultHeader(
+		message.FunctionCurtain,
+		1,
+		[]string { "data" },
+		[]int { 2, 2 },
+	))
+	curtain.add("pid", "0/1", []byte("bundle"))
+
+	cases := []struct {
+		storage *fakeStorage
+		path    string
+	} {
+		{ decimatedResult(4, 4), "/result/pid?decimate=0"                },
+		{ decimatedResult(4, 4), "/result/pid?decimate=two"              },
+		{ decimatedResult(4, 4), "/result/pid?format=json&decimate=2"    },
+		{ decimatedResult(4, 4), "/result/pid?partial=true&decimate=2"   },
+		{ decimatedResult(4, 4), "/result/pid/stream?decimate=2"         },
+		{ curtain,               "/result/pid?decimate=2"                },
+	}
+	for _, c := range cases {
+		result := Result { Storage: c.storage }
+		w := requestResult(&result, c.path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d; want %d", c.path, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * The pid of the running process of the query with the hash, see Dedup
+ */
+func querykey(hash string) string {
+	return fmt.Sprintf("query/%s", hash)
+}
+
+/*
+ * The hash of the query of the process pid, for cleaning up the mapping when
+ * the process is deleted
+ */
+func queryhashkey(pid string) string {
+	return fmt.Sprintf("%s/query-hash", pid)
+}
+
+/*
+ * The hash of the query, without the pid. The credentials (token and url
+ * query) are hashed too, so queries are only shared by clients with the same
+ * credentials, and no-one gets to read a result they could not have made
+ * themselves.
+ *
+ * The query is hashed as JSON, which sorts the keys of maps, so the same
+ * query always has the same hash.
+ */
+func queryHash(query *message.Query) (string, error) {
+	q := *query
+	q.Pid = ""
+	doc, err := json.Marshal(&q)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(doc)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+ * Deduplication of queries. When a query is identical to one that's still
+ * running, the client gets the pid of the running process (with its own
+ * token), rather than a process of its own that would do the same work.
+ *
+ * The running processes are mapped by the hash of their query, see
+ * queryHash. The mapping is dropped when the process is completed or
+ * failed - right away with Completions, and otherwise when the next
+ * identical query finds it done. It expires with the result anyway.
+ */
+type Dedup struct {
+	Storage redis.Cmdable
+	/*
+	 * How long the mapping is kept at most, which should be the same as the
+	 * result is kept, see DefaultResultTTL. Zero means the default.
+	 */
+	TTL time.Duration
+	/*
+	 * Optional - when set, the mappings of processes are dropped as soon as
+	 * they complete.
+	 */
+	Completions *CompletionWatcher
+}
+
+func (d *Dedup) ttl() time.Duration {
+	if d.TTL <= 0 {
+		return DefaultResultTTL
+	}
+	return d.TTL
+}
+
+/*
+ * Check if the process pid is still running. A process that is not yet
+ * scheduled (has no header) is running, as scheduling happens after the
+ * client gets the pid.
+ */
+func (d *Dedup) running(ctx context.Context, pid string) (bool, error) {
+	err := d.Storage.Get(ctx, errorkey(pid)).Err()
+	if err == nil {
+		return false, nil
+	}
+	if err != redis.Nil {
+		return false, err
+	}
+	msg, err := streamError(ctx, d.Storage, pid)
+	if err != nil {
+		return false, err
+	}
+	if msg != "" {
+		return false, nil
+	}
+	_, done, err := completed(ctx, d.Storage, pid)
+	if err != nil {
+		return false, err
+	}
+	return !done, nil
+}
+
+/*
+ * Claim the query with the hash for the process pid, and get the pid the
+ * client should use - pid itself, or the pid of the identical query that's
+ * still running, in which case reused is true. Two identical queries that
+ * come at the same time are claimed by one of them, since the claim is a
+ * SETNX.
+ */
+func (d *Dedup) claim(
+	ctx  context.Context,
+	hash string,
+	pid  string,
+) (string, bool, error) {
+	key := querykey(hash)
+	for {
+		ok, err := d.Storage.SetNX(ctx, key, pid, d.ttl()).Result()
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			break
+		}
+
+		existing, err := d.Storage.Get(ctx, key).Result()
+		if err == redis.Nil {
+			/*
+			 * Dropped after the SETNX, so try again
+			 */
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		running, err := d.running(ctx, existing)
+		if err != nil {
+			return "", false, err
+		}
+		if running {
+			return existing, true, nil
+		}
+
+		/*
+		 * The process is done, but its mapping was not dropped, e.g.
+		 * because there are no Completions. Should two queries find it at
+		 * the same time, they both get a process of their own, which is a
+		 * waste, but not wrong.
+		 */
+		err = d.Storage.Set(ctx, key, pid, d.ttl()).Err()
+		if err != nil {
+			return "", false, err
+		}
+		break
+	}
+
+	err := d.Storage.Set(ctx, queryhashkey(pid), hash, d.ttl()).Err()
+	if err != nil {
+		return "", false, err
+	}
+	if d.Completions != nil {
+		go d.forget(hash, pid)
+	}
+	return pid, false, nil
+}
+
+/*
+ * Claim the query for its process, see claim
+ */
+func (d *Dedup) claimQuery(
+	ctx   context.Context,
+	query *message.Query,
+) (string, bool, error) {
+	hash, err := queryHash(query)
+	if err != nil {
+		return "", false, err
+	}
+	return d.claim(ctx, hash, query.Pid)
+}
+
+/*
+ * Drop the mapping of the query with the hash, if it is (still) of the
+ * process pid. This is a read followed by a delete, so a mapping made in
+ * between is dropped too, which only means that the next identical query is
+ * not deduplicated.
+ */
+func (d *Dedup) drop(ctx context.Context, hash string, pid string) error {
+	key := querykey(hash)
+	mapped, err := d.Storage.Get(ctx, key).Result()
+	if err == redis.Nil || (err == nil && mapped != pid) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return d.Storage.Del(ctx, key).Err()
+}
+
+/*
+ * Drop the mapping when the process pid completes, or give up when it
+ * expires anyway
+ */
+func (d *Dedup) forget(hash string, pid string) {
+	done, cancel := d.Completions.Subscribe(pid)
+	defer cancel()
+	select {
+	case <-done:
+	case <-time.After(d.ttl()):
+		return
+	}
+
+	ctx, cancelctx := context.WithTimeout(context.Background(), 10 * time.Second)
+	defer cancelctx()
+	if err := d.drop(ctx, hash, pid); err != nil {
+		logging.Default().Warn("unable to drop query", "pid", pid, "error", err)
+	}
+}
+
+/*
+ * Drop the mapping of the query of the process pid, if there is one, e.g.
+ * when the process is cancelled
+ */
+func dropQuery(ctx context.Context, storage redis.Cmdable, pid string) error {
+	hash, err := storage.Get(ctx, queryhashkey(pid)).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d := Dedup { Storage: storage }
+	return d.drop(ctx, hash, pid)
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+)
+
+/*
+ * An endpoint that deduplicates queries in storage, and records the jobs it
+ * schedules
+ */
+func dedupEndpoint(
+	storage *fakeStorage,
+	dedup   *Dedup,
+) (*cube, *recordingScheduler, *auth.Keyring) {
+	keyring := auth.MakeKeyring([]byte("secret"))
+	sched := newRecordingScheduler()
+	if dedup == nil {
+		dedup = &Dedup { Storage: storage }
+	}
+	root := &resolver {
+		MakeBasicEndpoint(&keyring, "https://storage", sched, 0, dedup),
+	}
+	return &cube { id: "guid", root: root }, sched, &keyring
+}
+
+func slice(t *testing.T, c *cube, ctx context.Context, index int32) *promise {
+	t.Helper()
+	args := struct {
+		Dim   int32
+		Index int32
+		Opts  *opts
+	} { Dim: 0, Index: index }
+	promise, err := c.SliceByIndex(ctx, args)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if promise == nil {
+		t.Fatalf("no promise")
+	}
+	return promise
+}
+
+func assertNothingScheduled(t *testing.T, sched *recordingScheduler) {
+	t.Helper()
+	select {
+	case job := <-sched.scheduled:
+		t.Errorf("scheduled %s; want nothing", job.pid)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestIdenticalQueriesShareProcess(t *testing.T) {
+	c, sched, keyring := dedupEndpoint(newFakeStorage(), nil)
+
+	first := slice(t, c, sliceRequest("pid-1"), 1)
+	if job := sched.next(t); job.pid != "pid-1" {
+		t.Errorf("scheduled %s; want pid-1", job.pid)
+	}
+
+	second := slice(t, c, sliceRequest("pid-2"), 1)
+	if second.Url != first.Url {
+		t.Errorf("url = %s; want %s", second.Url, first.Url)
+	}
+	if err := keyring.Validate(second.Key, "pid-1"); err != nil {
+		t.Errorf("key is not a token for pid-1: %v", err)
+	}
+	assertNothingScheduled(t, sched)
+}
+
+func TestDifferentQueriesGetOwnProcess(t *testing.T) {
+	c, sched, _ := dedupEndpoint(newFakeStorage(), nil)
+
+	slice(t, c, sliceRequest("pid-1"), 1)
+	sched.next(t)
+	promise := slice(t, c, sliceRequest("pid-2"), 2)
+	if promise.Url != "result/pid-2" {
+		t.Errorf("url = %s; want result/pid-2", promise.Url)
+	}
+	if job := sched.next(t); job.pid != "pid-2" {
+		t.Errorf("scheduled %s; want pid-2", job.pid)
+	}
+}
+
+func TestQueriesWithOtherCredentialsGetOwnProcess(t *testing.T) {
+	c, sched, _ := dedupEndpoint(newFakeStorage(), nil)
+
+	slice(t, c, sliceRequest("pid-1"), 1)
+	sched.next(t)
+
+	keys := map[string]string {
+		"pid":           "pid-2",
+		"Authorization": "Bearer other-token",
+		"url-query":     "",
+	}
+	ctx := context.WithValue(context.Background(), "keys", keys)
+	promise := slice(t, c, ctx, 1)
+	if promise.Url != "result/pid-2" {
+		t.Errorf("url = %s; want result/pid-2", promise.Url)
+	}
+	sched.next(t)
+}
+
+func TestFinishedProcessIsNotReused(t *testing.T) {
+	cases := []struct {
+		name   string
+		finish func(*fakeStorage)
+	} {
+		{ "completed", func(storage *fakeStorage) {
+			storage.set(headerkey("pid-1"), fakeProcessHeader(1))
+			storage.add("pid-1", "0/1", []byte("tile"))
+		}},
+		{ "failed", func(storage *fakeStorage) {
+			storage.set(headerkey("pid-1"), fakeProcessHeader(2))
+			storage.addValues("pid-1", map[string]interface{} {
+				"error": "0/2: failed",
+			})
+		}},
+	}
+	for _, tc := range cases {
+		storage := newFakeStorage()
+		c, sched, _ := dedupEndpoint(storage, nil)
+
+		slice(t, c, sliceRequest("pid-1"), 1)
+		sched.next(t)
+		tc.finish(storage)
+
+		promise := slice(t, c, sliceRequest("pid-2"), 1)
+		if promise.Url != "result/pid-2" {
+			t.Errorf("%s: url = %s; want result/pid-2", tc.name, promise.Url)
+		}
+		sched.next(t)
+	}
+}
+
+func TestRunningProcessIsReused(t *testing.T) {
+	storage := newFakeStorage()
+	c, sched, _ := dedupEndpoint(storage, nil)
+
+	slice(t, c, sliceRequest("pid-1"), 1)
+	sched.next(t)
+	storage.set(headerkey("pid-1"), fakeProcessHeader(2))
+	storage.add("pid-1", "0/2", []byte("tile"))
+
+	promise := slice(t, c, sliceRequest("pid-2"), 1)
+	if promise.Url != "result/pid-1" {
+		t.Errorf("url = %s; want result/pid-1", promise.Url)
+	}
+	assertNothingScheduled(t, sched)
+}
+
+func TestDeletedProcessIsNotReused(t *testing.T) {
+	storage := newFakeStorage()
+	c, sched, _ := dedupEndpoint(storage, nil)
+	result := Result { Storage: storage }
+
+	slice(t, c, sliceRequest("pid-1"), 1)
+	sched.next(t)
+	if _, err := result.delete(context.Background(), "pid-1"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	promise := slice(t, c, sliceRequest("pid-2"), 1)
+	if promise.Url != "result/pid-2" {
+		t.Errorf("url = %s; want result/pid-2", promise.Url)
+	}
+	sched.next(t)
+}
+
+func TestQueryIsDroppedOnCompletion(t *testing.T) {
+	storage := newFakeStorage()
+	completions := NewCompletionWatcher(nil, "completed")
+	dedup := &Dedup { Storage: storage, Completions: completions }
+	c, sched, _ := dedupEndpoint(storage, dedup)
+
+	slice(t, c, sliceRequest("pid-1"), 1)
+	sched.next(t)
+	hash, err := storage.Get(context.Background(), queryhashkey("pid-1")).Result()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	completions.complete("pid-1", 1)
+	eventually(t, "query dropped", func() bool {
+		err := storage.Get(context.Background(), querykey(hash)).Err()
+		return err != nil
+	})
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The longest filename, in bytes, that most file systems accept
+ */
+const maxFilenameBytes = 255
+
+/*
+ * The filename from ?filename=, made safe to put in a header and to save as.
+ * Only the last path element is kept, control characters are dropped, and
+ * characters that are reserved in headers or on common file systems are
+ * replaced with _. Names that are empty after this, or only dots, are
+ * rejected with the empty string.
+ */
+func sanitizeFilename(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i + 1:]
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == utf8.RuneError, unicode.IsControl(r):
+			continue
+		case strings.ContainsRune(`"*:<>?|;`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.Trim(b.String(), " .")
+
+	/*
+	 * Cut at a rune boundary, so that the name stays valid UTF-8
+	 */
+	for len(name) > maxFilenameBytes {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name) - size]
+	}
+	return name
+}
+
+/*
+ * A filename for the filename* parameter, i.e. percent-encoded UTF-8 [1].
+ *
+ * [1] https://tools.ietf.org/html/rfc5987#section-3.2.1
+ */
+func encodeFilename(name string) string {
+	const attrchars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for _, c := range []byte(name) {
+		switch {
+		case c < utf8.RuneSelf && (
+			unicode.IsLetter(rune(c)) ||
+			unicode.IsDigit(rune(c)) ||
+			strings.IndexByte(attrchars, c) >= 0):
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+/*
+ * Set Content-Disposition: attachment, so that browsers and curl -OJ save the
+ * result with a sensible name rather than the pid. The name is ?filename=
+ * when the request has one, and oneseismic-<name>.<ext> otherwise.
+ *
+ * Names that are not plain ASCII are sent in both forms - filename* for
+ * clients that support RFC 6266, and filename with _ for the other
+ * characters for those that don't.
+ */
+func setDisposition(ctx *gin.Context, name string, ext string) {
+	filename := sanitizeFilename(ctx.Query("filename"))
+	if filename == "" {
+		filename = fmt.Sprintf("oneseismic-%s.%s", name, ext)
+	}
+
+	fallback := strings.Map(func(r rune) rune {
+		if r >= utf8.RuneSelf {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	disposition := fmt.Sprintf(`attachment; filename="%s"`, fallback)
+	if fallback != filename {
+		disposition += "; filename*=UTF-8''" + encodeFilename(filename)
+	}
+	ctx.Header("Content-Disposition", disposition)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	cases := []struct {
+		name string
+		want string
+	} {
+		{ "slice.bin",                    "slice.bin"              },
+		{ "../../etc/passwd",             "passwd"                 },
+		{ `..\..\windows\system.ini`,     "system.ini"             },
+		{ "/absolute/path.npy",           "path.npy"               },
+		{ "a\"b\r\nSet-Cookie: x=1",      "a_bSet-Cookie_ x=1"     },
+		{ "x\"; filename=evil.exe",       "x__ filename=evil.exe"  },
+		{ "con<>|?*.bin",                 "con_____.bin"           },
+		{ "nul\x00byte.bin",              "nulbyte.bin"            },
+		{ "\xff\xfeinvalid.bin",          "invalid.bin"            },
+		{ "  .hidden.  ",                 "hidden"                 },
+		{ "..",                           ""                       },
+		{ "dir/",                         ""                       },
+		{ "",                             ""                       },
+		{ "résumé.npy",                   "résumé.npy"             },
+	}
+	for _, c := range cases {
+		if got := sanitizeFilename(c.name); got != c.want {
+			t.Errorf("sanitizeFilename(%q) = %q; want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestSanitizeFilenameTruncatesAtRuneBoundary(t *testing.T) {
+	name := strings.Repeat("é", maxFilenameBytes)
+	got := sanitizeFilename(name)
+	if len(got) > maxFilenameBytes {
+		t.Errorf("len = %d; want <= %d", len(got), maxFilenameBytes)
+	}
+	if got != strings.Repeat("é", len(got) / 2) {
+		t.Errorf("name cut in the middle of a rune")
+	}
+}
+
+func TestResultHasDefaultFilename(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(1, 2))
+	result := Result { Storage: storage }
+
+	cases := []struct {
+		path string
+		want string
+	} {
+		{ "/result/pid",             `attachment; filename="oneseismic-pid.bin"`  },
+		{ "/result/pid?format=json", `attachment; filename="oneseismic-pid.json"` },
+	}
+	for _, c := range cases {
+		w := requestResult(&result, c.path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d; want %d", c.path, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != c.want {
+			t.Errorf("%s: Content-Disposition = %s; want %s", c.path, got, c.want)
+		}
+	}
+}
+
+func TestResultHasRequestedFilename(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	cases := []struct {
+		filename string
+		want     string
+	} {
+		{
+			"inline-42.bin",
+			`attachment; filename="inline-42.bin"`,
+		},
+		{
+			"..%2F..%2Fetc%2Fpasswd",
+			`attachment; filename="passwd"`,
+		},
+		{
+			"%22%0D%0AX-Injected:%201",
+			`attachment; filename="_X-Injected_ 1"`,
+		},
+		{
+			"r%C3%A9sum%C3%A9.bin",
+			`attachment; filename="r_sum_.bin"; ` +
+				`filename*=UTF-8''r%C3%A9sum%C3%A9.bin`,
+		},
+	}
+	for _, c := range cases {
+		w := requestResult(&result, "/result/pid?filename=" + c.filename, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d; want %d", c.filename, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get("Content-Disposition"); got != c.want {
+			t.Errorf("%s: Content-Disposition = %s; want %s", c.filename, got, c.want)
+		}
+		if got := w.Header().Get("X-Injected"); got != "" {
+			t.Errorf("%s: header injected", c.filename)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The type of the samples in assembled results, from ?dtype=. The samples
+ * are float32, and can be quantized to int16 or int8 to cut the size of the
+ * result to a half or a quarter, for clients like visualization that don't
+ * need the full resolution. The quantized samples q approximate the
+ * originals as
+ *
+ *     x = q * scale + offset
+ *
+ * where scale and offset are per result, from the range of the samples, and
+ * sent as the X-Oneseismic-Scale and X-Oneseismic-Offset headers. The
+ * quantized samples are symmetric around zero, i.e. int16 uses [-32767,
+ * 32767], so the error of every sample is at most scale / 2.
+ *
+ * Quantization needs the range of the whole result before the first sample
+ * is written, so it's only available for the formats that assemble the
+ * result, npy and raw.
+ */
+type sampleType struct {
+	name string
+	size int
+	/*
+	 * The descr in NPY headers, and the dtype in raw headers
+	 */
+	npy  string
+	raw  uint8
+	/*
+	 * The largest quantized value, or zero for float32
+	 */
+	levels float64
+}
+
+var (
+	sampleFloat32 = &sampleType { "float32", 4, "<f4", rawDtypeFloat32, 0     }
+	sampleInt16   = &sampleType { "int16",   2, "<i2", rawDtypeInt16,   32767 }
+	sampleInt8    = &sampleType { "int8",    1, "|i1", rawDtypeInt8,    127   }
+)
+
+const (
+	scaleHeader  = "X-Oneseismic-Scale"
+	offsetHeader = "X-Oneseismic-Offset"
+)
+
+func parseSampleType(name string) (*sampleType, error) {
+	switch name {
+	case "", "float32":
+		return sampleFloat32, nil
+	case "int16":
+		return sampleInt16, nil
+	case "int8":
+		return sampleInt8, nil
+	default:
+		return nil, fmt.Errorf("dtype must be float32, int16 or int8")
+	}
+}
+
+/*
+ * The sample type asked for with ?dtype=. Unknown types get 400, and nil is
+ * returned.
+ */
+func requestedSampleType(ctx *gin.Context) *sampleType {
+	dtype, err := parseSampleType(ctx.Query("dtype"))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return nil
+	}
+	return dtype
+}
+
+/*
+ * The scale and offset that map the range of the samples onto the quantized
+ * values. Samples that are not finite don't count towards the range. A
+ * result of all-equal (or no finite) samples has a scale of zero, and every
+ * sample is quantized to 0, i.e. the offset.
+ */
+func quantization(samples []float32, levels float64) (scale, offset float64) {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, x := range samples {
+		v := float64(x)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	if lo > hi {
+		return 0, 0
+	}
+	offset = lo / 2 + hi / 2
+	scale = (hi - lo) / (2 * levels)
+	return scale, offset
+}
+
+/*
+ * The quantized sample, clamped to [-levels, levels]. NaN is quantized to 0.
+ */
+func quantize(x float32, scale, offset, levels float64) float64 {
+	if scale == 0 || math.IsNaN(float64(x)) {
+		return 0
+	}
+	q := math.Round((float64(x) - offset) / scale)
+	return math.Max(-levels, math.Min(levels, q))
+}
+
+/*
+ * Write the samples as little-endian t to dst, which must have room for
+ * them. For the quantized types, the scale and offset are returned, and for
+ * float32 they are 1 and 0.
+ */
+func (t *sampleType) put(dst []byte, samples []float32) (scale, offset float64) {
+	if t.levels == 0 {
+		putFloat32s(dst, samples)
+		return 1, 0
+	}
+
+	scale, offset = quantization(samples, t.levels)
+	for i, x := range samples {
+		q := quantize(x, scale, offset, t.levels)
+		switch t.size {
+		case 2:
+			binary.LittleEndian.PutUint16(dst[2 * i:], uint16(int16(q)))
+		case 1:
+			dst[i] = uint8(int8(q))
+		}
+	}
+	return scale, offset
+}
+
+/*
+ * Tell the client how to get from the quantized samples back to float32.
+ * Nothing is sent for float32.
+ */
+func (t *sampleType) setScale(ctx *gin.Context, scale, offset float64) {
+	if t.levels == 0 {
+		return
+	}
+	ctx.Header(scaleHeader, strconv.FormatFloat(scale, 'g', -1, 64))
+	ctx.Header(offsetHeader, strconv.FormatFloat(offset, 'g', -1, 64))
+}
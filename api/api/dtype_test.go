@@ -0,0 +1,231 @@
+package api
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * Quantize the samples, and reconstruct the floats from the quantized
+ * values like a client would
+ */
+func roundTrip(dtype *sampleType, samples []float32) ([]float64, float64) {
+	buf := make([]byte, dtype.size * len(samples))
+	scale, offset := dtype.put(buf, samples)
+	return dequantize(dtype, buf, scale, offset), scale
+}
+
+func dequantize(dtype *sampleType, buf []byte, scale, offset float64) []float64 {
+	out := make([]float64, len(buf) / dtype.size)
+	for i := range out {
+		var q float64
+		switch dtype.size {
+		case 2:
+			q = float64(int16(binary.LittleEndian.Uint16(buf[2 * i:])))
+		case 1:
+			q = float64(int8(buf[i]))
+		}
+		out[i] = q * scale + offset
+	}
+	return out
+}
+
+func TestQuantizationErrorIsBounded(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ranges := []struct {
+		lo float64
+		hi float64
+	} {
+		{ -1,     1     },
+		{ -1000,  3000  },
+		{ 1e-6,   2e-6  },
+		{ 2500,   2501  },
+		{ -1e30,  1e30  },
+	}
+	for _, dtype := range []*sampleType { sampleInt16, sampleInt8 } {
+		for _, r := range ranges {
+			samples := make([]float32, 1000)
+			for i := range samples {
+				samples[i] = float32(r.lo + rng.Float64() * (r.hi - r.lo))
+			}
+			samples[0] = float32(r.lo)
+			samples[1] = float32(r.hi)
+
+			got, scale := roundTrip(dtype, samples)
+			/*
+			 * Half a step, with some room for the rounding of float64
+			 */
+			bound := scale / 2 * (1 + 1e-9)
+			worst := 0.0
+			for i, x := range samples {
+				worst = math.Max(worst, math.Abs(float64(x) - got[i]))
+			}
+			if worst > bound {
+				t.Errorf(
+					"%s [%g, %g]: max error = %g; want <= %g",
+					dtype.name, r.lo, r.hi, worst, bound,
+				)
+			}
+		}
+	}
+}
+
+func TestQuantizationUsesTheFullRange(t *testing.T) {
+	samples := []float32 { -3, 0, 5 }
+	buf := make([]byte, 2 * len(samples))
+	sampleInt16.put(buf, samples)
+
+	lo := int16(binary.LittleEndian.Uint16(buf[0:]))
+	hi := int16(binary.LittleEndian.Uint16(buf[4:]))
+	if lo != -32767 || hi != 32767 {
+		t.Errorf("range = [%d, %d]; want [-32767, 32767]", lo, hi)
+	}
+}
+
+func TestQuantizationOfConstantSamplesIsExact(t *testing.T) {
+	samples := []float32 { 42.5, 42.5, 42.5 }
+	got, scale := roundTrip(sampleInt8, samples)
+	if scale != 0 {
+		t.Errorf("scale = %g; want 0", scale)
+	}
+	for i, x := range got {
+		if x != 42.5 {
+			t.Errorf("sample %d = %g; want 42.5", i, x)
+		}
+	}
+}
+
+func TestQuantizationOfNonFiniteSamples(t *testing.T) {
+	inf := float32(math.Inf(1))
+	nan := float32(math.NaN())
+	samples := []float32 { -1, 1, nan, inf, -inf }
+	buf := make([]byte, len(samples))
+	scale, offset := sampleInt8.put(buf, samples)
+
+	if scale != 1.0 / 127 || offset != 0 {
+		t.Errorf("scale, offset = %g, %g; want range of the finite samples", scale, offset)
+	}
+	want := []int8 { -127, 127, 0, 127, -127 }
+	for i, q := range buf {
+		if int8(q) != want[i] {
+			t.Errorf("sample %d = %d; want %d", i, int8(q), want[i])
+		}
+	}
+}
+
+func quantizedResult() *fakeStorage {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		1,
+		[]string { "data" },
+		[]int { 1, 2, 2 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packSliceTiles("data", message.Tile {
+		Iterations:  1,
+		ChunkSize:   4,
+		Superstride: 4,
+		Substride:   4,
+		V:           []float32 { -2.5, 0.25, 1, 7.5 },
+	}))
+	return storage
+}
+
+func scaleOf(t *testing.T, header http.Header) (float64, float64) {
+	scale, err := strconv.ParseFloat(header.Get(scaleHeader), 64)
+	if err != nil {
+		t.Fatalf("%s: %v", scaleHeader, err)
+	}
+	offset, err := strconv.ParseFloat(header.Get(offsetHeader), 64)
+	if err != nil {
+		t.Fatalf("%s: %v", offsetHeader, err)
+	}
+	return scale, offset
+}
+
+func TestQuantizedNpy(t *testing.T) {
+	result := Result { Storage: quantizedResult() }
+	w := requestResult(&result, "/result/pid?format=npy&dtype=int16", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	body := w.Body.Bytes()
+	hlen := int(binary.LittleEndian.Uint16(body[8:10]))
+	header := string(body[10:10 + hlen])
+	if !strings.Contains(header, "'descr': '<i2'") {
+		t.Errorf("header = %s; want <i2", header)
+	}
+	data := body[10 + hlen:]
+	if len(data) != 2 * 4 {
+		t.Fatalf("%d bytes of samples; want %d", len(data), 2 * 4)
+	}
+
+	scale, offset := scaleOf(t, w.Header())
+	got := dequantize(sampleInt16, data, scale, offset)
+	for i, x := range []float64 { -2.5, 0.25, 1, 7.5 } {
+		if math.Abs(x - got[i]) > scale / 2 {
+			t.Errorf("sample %d = %g; want %g ± %g", i, got[i], x, scale / 2)
+		}
+	}
+}
+
+func TestQuantizedRaw(t *testing.T) {
+	result := Result { Storage: quantizedResult() }
+	w := requestResult(&result, "/result/pid?format=raw&dtype=int8", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	body := w.Body.Bytes()
+	if dtype := body[7]; dtype != rawDtypeInt8 {
+		t.Errorf("dtype = %d; want %d", dtype, rawDtypeInt8)
+	}
+	if len(body) != rawHeaderSize + 4 {
+		t.Errorf("%d bytes; want %d", len(body), rawHeaderSize + 4)
+	}
+	if n := w.Header().Get("Content-Length"); n != strconv.Itoa(len(body)) {
+		t.Errorf("Content-Length = %s; want %d", n, len(body))
+	}
+	scale, offset := scaleOf(t, w.Header())
+	got := dequantize(sampleInt8, body[rawHeaderSize:], scale, offset)
+	for i, x := range []float64 { -2.5, 0.25, 1, 7.5 } {
+		if math.Abs(x - got[i]) > scale / 2 {
+			t.Errorf("sample %d = %g; want %g ± %g", i, got[i], x, scale / 2)
+		}
+	}
+}
+
+func TestFloat32HasNoScale(t *testing.T) {
+	result := Result { Storage: quantizedResult() }
+	w := requestResult(&result, "/result/pid?format=npy&dtype=float32", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if scale := w.Header().Get(scaleHeader); scale != "" {
+		t.Errorf("%s = %s; want none for float32", scaleHeader, scale)
+	}
+}
+
+func TestDtypeIsRejectedWithoutAssembly(t *testing.T) {
+	result := Result { Storage: quantizedResult() }
+	for _, path := range []string {
+		"/result/pid?dtype=int16",
+		"/result/pid?format=json&dtype=int16",
+		"/result/pid?format=arrow&dtype=int8",
+		"/result/pid?format=npy&dtype=float16",
+	} {
+		w := requestResult(&result, path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d; want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -1,29 +1,41 @@
 package api
 
 import (
-	"github.com/go-redis/redis/v8"
-
 	"github.com/equinor/oneseismic/api/internal/auth"
 )
 
 type BasicEndpoint struct {
 	endpoint string // e.g. https://oneseismic-storage.blob.windows.net
 	keyring  *auth.Keyring
-	sched    scheduler
+	sched    Scheduler
+	/*
+	 * The max estimated size of results, see checkResultSize
+	 */
+	maxResult int64
+	/*
+	 * Optional - deduplication of identical queries
+	 */
+	dedup *Dedup
 }
 
+/*
+ * Queries are planned and scheduled with sched, see NewScheduler. Queries with
+ * results estimated to be larger than maxResult bytes are refused. Zero means
+ * no limit. Queries identical to one that's still running get its process,
+ * with dedup, see Dedup. Nil means no deduplication.
+ */
 func MakeBasicEndpoint(
-	keyring *auth.Keyring,
-	endpoint string,
-	storage  redis.Cmdable,
+	keyring   *auth.Keyring,
+	endpoint  string,
+	sched     Scheduler,
+	maxResult int64,
+	dedup     *Dedup,
 ) BasicEndpoint {
 	return BasicEndpoint {
-		endpoint: endpoint,
-		keyring: keyring,
-		/*
-		 * Scheduler should probably be exported (and in internal/?) and be
-		 * constructed directly by the caller.
-		 */
-		sched:   newScheduler(storage),
+		endpoint:  endpoint,
+		keyring:   keyring,
+		sched:     sched,
+		maxResult: maxResult,
+		dedup:     dedup,
 	}
 }
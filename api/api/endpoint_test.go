@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+type scheduledJob struct {
+	pid  string
+	plan *QueryPlan
+}
+
+/*
+ * A scheduler that plans every query as the one task, and records the jobs
+ * it's asked to schedule instead of scheduling them
+ */
+type recordingScheduler struct {
+	mtx       sync.Mutex
+	queries   []*message.Query
+	scheduled chan scheduledJob
+	err       error
+}
+
+func newRecordingScheduler() *recordingScheduler {
+	return &recordingScheduler {
+		scheduled: make(chan scheduledJob, 8),
+	}
+}
+
+func (s *recordingScheduler) MakeQuery(query *message.Query) (*QueryPlan, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.queries = append(s.queries, query)
+	if s.err != nil {
+		return nil, s.err
+	}
+	tasks := [][]byte { []byte(query.Function) }
+	return NewQueryPlan(fakeProcessHeader(len(tasks)), tasks), nil
+}
+
+func (s *recordingScheduler) Schedule(
+	ctx  context.Context,
+	pid  string,
+	plan *QueryPlan,
+) error {
+	s.scheduled <- scheduledJob { pid: pid, plan: plan }
+	return nil
+}
+
+func (s *recordingScheduler) next(t *testing.T) scheduledJob {
+	select {
+	case job := <-s.scheduled:
+		return job
+	case <-time.After(time.Second):
+		t.Fatalf("nothing scheduled after 1s")
+		return scheduledJob {}
+	}
+}
+
+func sliceRequest(pid string) context.Context {
+	keys := map[string]string {
+		"pid":           pid,
+		"Authorization": "Bearer token",
+		"url-query":     "",
+	}
+	return context.WithValue(context.Background(), "keys", keys)
+}
+
+func TestEndpointSchedulesWithInjectedScheduler(t *testing.T) {
+	keyring := auth.MakeKeyring([]byte("secret"))
+	sched := newRecordingScheduler()
+	root := &resolver { MakeBasicEndpoint(&keyring, "https://storage", sched, 0, nil) }
+	c := &cube { id: "guid", root: root }
+
+	args := struct {
+		Dim   int32
+		Index int32
+		Opts  *opts
+	} { Dim: 0, Index: 1 }
+	promise, err := c.SliceByIndex(sliceRequest("pid"), args)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if promise.Url != "result/pid" {
+		t.Errorf("url = %s; want result/pid", promise.Url)
+	}
+	if err := keyring.Validate(promise.Key, "pid"); err != nil {
+		t.Errorf("key is not a token for pid: %v", err)
+	}
+
+	job := sched.next(t)
+	if job.pid != "pid" {
+		t.Errorf("scheduled %s; want pid", job.pid)
+	}
+	tasks := job.plan.Tasks()
+	if len(tasks) != 1 || string(tasks[0]) != "slice" {
+		t.Errorf("scheduled tasks = %q; want the planned one", tasks)
+	}
+
+	sched.mtx.Lock()
+	defer sched.mtx.Unlock()
+	if len(sched.queries) != 1 {
+		t.Fatalf("%d queries planned; want 1", len(sched.queries))
+	}
+	query := sched.queries[0]
+	if query.Guid != "guid" || query.StorageEndpoint != "https://storage" {
+		t.Errorf("planned %+v; want guid at https://storage", query)
+	}
+}
+
+func TestEndpointDoesNotScheduleBadQueries(t *testing.T) {
+	keyring := auth.MakeKeyring([]byte("secret"))
+	sched := newRecordingScheduler()
+	sched.err = errors.New("bad query")
+	root := &resolver { MakeBasicEndpoint(&keyring, "https://storage", sched, 0, nil) }
+	c := &cube { id: "guid", root: root }
+
+	args := struct {
+		Dim   int32
+		Index int32
+		Opts  *opts
+	} { Dim: 0, Index: 1 }
+	promise, _ := c.SliceByIndex(sliceRequest("pid"), args)
+	if promise != nil {
+		t.Errorf("promise = %+v; want none for a bad query", promise)
+	}
+	select {
+	case job := <-sched.scheduled:
+		t.Errorf("scheduled %s for a bad query", job.pid)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
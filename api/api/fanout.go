@@ -0,0 +1,361 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * Concurrent streams of the same result share a single collector, so that
+ * every client of a popular result does not read it from redis, see
+ * Result.subscribe.
+ *
+ * The first stream of a result starts the collector (the hub), and the
+ * streams that come while it's running subscribe to the partial results it
+ * broadcasts. Subscribers that come after the hub has broadcast something
+ * replay what they missed from redis, up to where the hub was when they
+ * subscribed, and then follow the hub. The hub stops when the result is
+ * collected, when it fails, or when the last subscriber leaves.
+ *
+ * Broadcasts wait for every subscriber to take the partial, so the hub goes
+ * at the pace of the slowest stream, like a stream with its own collector
+ * would.
+ */
+type fanout struct {
+	mtx  sync.Mutex
+	hubs map[fanoutKey]*hub
+}
+
+/*
+ * Compressed tiles are passed through to some streams, and decompressed for
+ * others, so those are different hubs
+ */
+type fanoutKey struct {
+	pid         string
+	passthrough bool
+}
+
+type hub struct {
+	key         fanoutKey
+	cancel      context.CancelFunc
+	subscribers map[*subscriber]struct{}
+	/*
+	 * The header and the position of the last partial result broadcast, for
+	 * the subscribers that come late
+	 */
+	header []byte
+	sent   position
+	ended  bool
+}
+
+type subscriber struct {
+	/*
+	 * The partial results from the hub, and why it failed, if it did. The
+	 * failure is sent before live is closed.
+	 */
+	live    chan partial
+	failure chan error
+	/*
+	 * Closed when the subscriber leaves, so that the hub doesn't wait for it
+	 */
+	done chan struct{}
+	hub  *hub
+}
+
+/*
+ * Subscribe to the hub of key, and start it with start() if there is none.
+ * The subscriber missed what the hub broadcast before the returned position,
+ * and the header, if it's set.
+ */
+func (f *fanout) subscribe(
+	key   fanoutKey,
+	start func(*hub),
+) (*subscriber, position, []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.hubs == nil {
+		f.hubs = make(map[fanoutKey]*hub)
+	}
+
+	h, ok := f.hubs[key]
+	if !ok {
+		h = &hub {
+			key:         key,
+			subscribers: make(map[*subscriber]struct{}),
+		}
+		f.hubs[key] = h
+		start(h)
+	}
+
+	sub := &subscriber {
+		live:    make(chan partial, xreadCount),
+		failure: make(chan error, 1),
+		done:    make(chan struct{}),
+		hub:     h,
+	}
+	h.subscribers[sub] = struct{}{}
+	return sub, h.sent, h.header
+}
+
+/*
+ * Leave the hub, and stop it if this was the last subscriber
+ */
+func (f *fanout) unsubscribe(sub *subscriber) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	h := sub.hub
+	delete(h.subscribers, sub)
+	close(sub.done)
+	if len(h.subscribers) == 0 && !h.ended {
+		f.end(h)
+		h.cancel()
+	}
+}
+
+/*
+ * Take the hub out of the registry, so that the next stream starts a new one.
+ * The caller must hold the lock.
+ */
+func (f *fanout) end(h *hub) {
+	h.ended = true
+	if f.hubs[h.key] == h {
+		delete(f.hubs, h.key)
+	}
+}
+
+/*
+ * The number of streams subscribed to the hub of key, if there is one
+ */
+func (f *fanout) subscribers(key fanoutKey) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if h, ok := f.hubs[key]; ok {
+		return len(h.subscribers)
+	}
+	return 0
+}
+
+/*
+ * Broadcast p to the current subscribers. The position is moved under the
+ * same lock as the subscribers are taken, so that subscribers either get p
+ * from the hub, or replay it.
+ */
+func (f *fanout) broadcast(h *hub, p partial) {
+	/*
+	 * The tile is shared, so no subscriber can give its buffer back
+	 */
+	p.buf = nil
+
+	f.mtx.Lock()
+	if p.id == "" {
+		h.header = p.tile
+	} else {
+		h.sent = position { cursor: p.id, count: h.sent.count + 1 }
+	}
+	subscribers := make([]*subscriber, 0, len(h.subscribers))
+	for sub := range h.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	f.mtx.Unlock()
+
+	for _, sub := range subscribers {
+		select {
+		case sub.live <- p:
+		case <-sub.done:
+		}
+	}
+}
+
+/*
+ * Tell the subscribers the hub is done, with the failure if it failed
+ */
+func (f *fanout) finish(h *hub, err error) {
+	f.mtx.Lock()
+	f.end(h)
+	subscribers := make([]*subscriber, 0, len(h.subscribers))
+	for sub := range h.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	f.mtx.Unlock()
+
+	for _, sub := range subscribers {
+		if err != nil {
+			sub.failure <- err
+		}
+		close(sub.live)
+	}
+}
+
+/*
+ * Run the collector of the hub, and broadcast what it collects. The hub is
+ * not tied to any one stream, and runs until it's done or the last
+ * subscriber leaves. The subscribers have their own timeouts.
+ */
+func (r *Result) runHub(
+	ctx  context.Context,
+	h    *hub,
+	head *message.ProcessHeader,
+) {
+	defer h.cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(ctx, "stream", h.key.pid, head, start, h.key.passthrough, tiles, failure)
+
+	for {
+		select {
+		case p, ok := <-tiles:
+			if !ok {
+				r.hubs.finish(h, reportedFailure(failure))
+				return
+			}
+			r.hubs.broadcast(h, p)
+
+		case err := <-failure:
+			r.hubs.finish(h, err)
+			return
+		}
+	}
+}
+
+/*
+ * Collect the result of pid from the start, like collect, but from the hub
+ * that is shared by the concurrent streams of the result. The partial results
+ * and the failure are sent to tiles and failure like collect does.
+ */
+func (r *Result) subscribe(
+	ctx         context.Context,
+	pid         string,
+	head        *message.ProcessHeader,
+	passthrough bool,
+	tiles       chan partial,
+	failure     chan error,
+) {
+	defer close(tiles)
+
+	count := 0
+	send := func(p partial) bool {
+		select {
+		case tiles <- p:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(err error) {
+		select {
+		case failure <- err:
+		default:
+		}
+	}
+	stopped := func() {
+		fail(fmt.Errorf(
+			"stopped with %d/%d tasks collected: %w",
+			count,
+			head.Ntasks,
+			ctx.Err(),
+		))
+	}
+
+	key := fanoutKey { pid: pid, passthrough: passthrough }
+	sub, missed, header := r.hubs.subscribe(key, func(h *hub) {
+		hubctx, cancel := context.WithCancel(context.Background())
+		h.cancel = cancel
+		go r.runHub(hubctx, h, head)
+	})
+	defer r.hubs.unsubscribe(sub)
+
+	switch {
+	case missed.count > 0:
+		n, err := r.replay(ctx, pid, head, passthrough, missed.cursor, send)
+		count += n
+		if err != nil {
+			fail(err)
+			return
+		}
+	case header != nil:
+		if !send(partial { tile: header }) {
+			stopped()
+			return
+		}
+	}
+
+	for {
+		select {
+		case p, ok := <-sub.live:
+			if !ok {
+				if err := reportedFailure(sub.failure); err != nil {
+					fail(err)
+				}
+				return
+			}
+			if p.id != "" && count == 0 {
+				stopWaiting(ctx)
+			}
+			if !send(p) {
+				stopped()
+				return
+			}
+			if p.id != "" {
+				count++
+			}
+
+		case <-ctx.Done():
+			stopped()
+			return
+		}
+	}
+}
+
+/*
+ * Replay the result of pid from redis, from the start up to and including
+ * the partial result with the ID until, and return the number of partial
+ * results replayed.
+ */
+func (r *Result) replay(
+	ctx         context.Context,
+	pid         string,
+	head        *message.ProcessHeader,
+	passthrough bool,
+	until       string,
+	send        func(partial) bool,
+) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(ctx, "stream", pid, head, start, passthrough, tiles, failure)
+
+	count := 0
+	for {
+		select {
+		case p, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					return count, err
+				}
+				return count, fmt.Errorf("replay ended before %s", until)
+			}
+			if !send(p) {
+				return count, fmt.Errorf(
+					"stopped with %d/%d tasks collected: %w",
+					count,
+					head.Ntasks,
+					ctx.Err(),
+				)
+			}
+			if p.id == "" {
+				continue
+			}
+			count++
+			if p.id == until {
+				return count, nil
+			}
+
+		case err := <-failure:
+			return count, err
+		}
+	}
+}
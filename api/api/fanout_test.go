@@ -0,0 +1,155 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const framedStream = "/result/pid/stream?framing=v1"
+
+/*
+ * Wait for cond, or fail the test after a second
+ */
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/*
+ * Start n streams of the result, and return a function that waits for them
+ * and returns their bodies
+ */
+func startStreams(result *Result, n int) func() [][]byte {
+	bodies := make([][]byte, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := requestResult(result, framedStream, "")
+			bodies[i] = w.Body.Bytes()
+		}(i)
+	}
+	return func() [][]byte {
+		wg.Wait()
+		return bodies
+	}
+}
+
+func assertIdentical(t *testing.T, bodies [][]byte) {
+	t.Helper()
+	for i, body := range bodies[1:] {
+		if !bytes.Equal(body, bodies[0]) {
+			t.Errorf("stream %d = %q; want %q", i + 1, body, bodies[0])
+		}
+	}
+	for _, tile := range []string { "tile-0", "tile-1" } {
+		if !bytes.Contains(bodies[0], []byte(tile)) {
+			t.Errorf("stream has no %s", tile)
+		}
+	}
+}
+
+var streamKey = fanoutKey { pid: "pid" }
+
+func TestConcurrentStreamsShareCollector(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	result := Result { Storage: storage }
+
+	wait := startStreams(&result, 3)
+	eventually(t, "3 subscribers", func() bool {
+		return result.hubs.subscribers(streamKey) == 3
+	})
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+
+	assertIdentical(t, wait())
+	if n := storage.called("xread-messages"); n != 2 {
+		t.Errorf("%d messages read from storage; want 2 (read once)", n)
+	}
+}
+
+func TestLateStreamReplaysFromStorage(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	result := Result { Storage: storage }
+
+	first := startStreams(&result, 1)
+	eventually(t, "first subscriber", func() bool {
+		return result.hubs.subscribers(streamKey) == 1
+	})
+	storage.add("pid", "0/2", []byte("tile-0"))
+	eventually(t, "tile-0 broadcast", func() bool {
+		result.hubs.mtx.Lock()
+		defer result.hubs.mtx.Unlock()
+		h, ok := result.hubs.hubs[streamKey]
+		return ok && h.sent.count == 1
+	})
+
+	late := startStreams(&result, 1)
+	eventually(t, "late subscriber", func() bool {
+		return result.hubs.subscribers(streamKey) == 2
+	})
+	storage.add("pid", "1/2", []byte("tile-1"))
+
+	assertIdentical(t, append(first(), late()...))
+}
+
+func TestHubStopsWhenLastSubscriberLeaves(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	result := Result { Storage: storage }
+
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, framedStream, nil)
+	done := make(chan struct{})
+	go func() {
+		app.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	eventually(t, "subscriber", func() bool {
+		return result.hubs.subscribers(streamKey) == 1
+	})
+	cancel()
+	<-done
+
+	result.hubs.mtx.Lock()
+	defer result.hubs.mtx.Unlock()
+	if n := len(result.hubs.hubs); n != 0 {
+		t.Errorf("%d hubs after the last subscriber left; want 0", n)
+	}
+}
+
+func TestResumedStreamsDoNotShareCollector(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	cursor := storage.streams["pid"][0].ID
+	w := requestResult(&result, framedStream + "&from=" + cursor, "")
+	if bytes.Contains(w.Body.Bytes(), []byte("tile-0")) {
+		t.Errorf("resumed stream has tile-0")
+	}
+	if !bytes.Contains(w.Body.Bytes(), []byte("tile-1")) {
+		t.Errorf("resumed stream has no tile-1")
+	}
+}
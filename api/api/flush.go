@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	defaultFlushBytes = 256 * 1024
+	defaultFlushDelay = 10 * time.Millisecond
+)
+
+/*
+ * A coalescer decides when Stream flushes. Flushing every tile makes jobs
+ * with thousands of small tiles into thousands of small writes (and TCP
+ * packets), so the writes are instead flushed once limit bytes have been
+ * written since the last flush, or delay after the first of them, whichever
+ * comes first. The delay is up to the caller, which must select on
+ * deadline() and then flush().
+ *
+ * A coalescer with a limit of zero flushes every write.
+ */
+type coalescer struct {
+	flusher http.Flusher
+	limit   int
+	delay   time.Duration
+	pending int
+	timer   *time.Timer
+	expired <-chan time.Time
+}
+
+func newCoalescer(
+	flusher http.Flusher,
+	limit   int,
+	delay   time.Duration,
+) *coalescer {
+	return &coalescer {
+		flusher: flusher,
+		limit:   limit,
+		delay:   delay,
+	}
+}
+
+/*
+ * Tell the coalescer that n bytes were written
+ */
+func (c *coalescer) wrote(n int) {
+	c.pending += n
+	if c.pending >= c.limit || c.delay <= 0 {
+		c.flush()
+		return
+	}
+	if c.expired == nil {
+		if c.timer == nil {
+			c.timer = time.NewTimer(c.delay)
+		} else {
+			c.timer.Reset(c.delay)
+		}
+		c.expired = c.timer.C
+	}
+}
+
+/*
+ * A channel that fires when the pending writes are due to be flushed, or nil
+ * when there are none
+ */
+func (c *coalescer) deadline() <-chan time.Time {
+	return c.expired
+}
+
+func (c *coalescer) flush() {
+	c.flusher.Flush()
+	c.pending = 0
+	c.disarm()
+}
+
+/*
+ * Stop the timer, without flushing. Call this when done with the coalescer.
+ */
+func (c *coalescer) stop() {
+	c.disarm()
+}
+
+func (c *coalescer) disarm() {
+	if c.expired == nil {
+		return
+	}
+	if !c.timer.Stop() {
+		/*
+		 * Drain the channel, unless the caller already got the tick, so that
+		 * a later Reset doesn't fire right away
+		 */
+		select {
+		case <-c.timer.C:
+		default:
+		}
+	}
+	c.expired = nil
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+type countingFlusher struct {
+	flushes int
+}
+
+func (f *countingFlusher) Flush() {
+	f.flushes++
+}
+
+func TestCoalescerFlushesAtLimit(t *testing.T) {
+	flusher := &countingFlusher {}
+	c := newCoalescer(flusher, 10, time.Hour)
+	defer c.stop()
+
+	c.wrote(4)
+	c.wrote(4)
+	if flusher.flushes != 0 {
+		t.Errorf("flushed %d times below the limit; want 0", flusher.flushes)
+	}
+	if c.deadline() == nil {
+		t.Errorf("no deadline with pending writes")
+	}
+	c.wrote(4)
+	if flusher.flushes != 1 {
+		t.Errorf("flushed %d times at the limit; want 1", flusher.flushes)
+	}
+	if c.deadline() != nil {
+		t.Errorf("deadline without pending writes")
+	}
+}
+
+func TestCoalescerDeadlineFiresAfterDelay(t *testing.T) {
+	flusher := &countingFlusher {}
+	delay := 20 * time.Millisecond
+	c := newCoalescer(flusher, 1024, delay)
+	defer c.stop()
+
+	start := time.Now()
+	c.wrote(1)
+	select {
+	case <-c.deadline():
+		c.flush()
+	case <-time.After(time.Second):
+		t.Fatalf("deadline did not fire")
+	}
+	if elapsed := time.Since(start); elapsed < delay * 3 / 4 {
+		t.Errorf("deadline fired after %v; want >= %v", elapsed, delay)
+	}
+	if flusher.flushes != 1 {
+		t.Errorf("flushed %d times; want 1", flusher.flushes)
+	}
+
+	/*
+	 * The timer is reused, and must not fire early
+	 */
+	c.wrote(1)
+	select {
+	case <-c.deadline():
+		if elapsed := time.Since(start); elapsed < 2 * delay * 3 / 4 {
+			t.Errorf("reused deadline fired early")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("deadline did not fire")
+	}
+}
+
+func TestZeroLimitCoalescerFlushesEveryWrite(t *testing.T) {
+	flusher := &countingFlusher {}
+	c := newCoalescer(flusher, 0, 0)
+	defer c.stop()
+	for i := 0; i < 3; i++ {
+		c.wrote(1)
+	}
+	if flusher.flushes != 3 {
+		t.Errorf("flushed %d times; want 3", flusher.flushes)
+	}
+}
+
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes int
+}
+
+func (f *flushRecorder) Flush() {
+	f.flushes++
+	f.ResponseRecorder.Flush()
+}
+
+func streamFlushes(result *Result, path string) *flushRecorder {
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	w := &flushRecorder { ResponseRecorder: httptest.NewRecorder() }
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func manyTilesStorage(ntiles int) *fakeStorage {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntiles))
+	for i := 0; i < ntiles; i++ {
+		id := fmt.Sprintf("%d/%d", i, ntiles)
+		storage.add("pid", id, []byte(fmt.Sprintf("tile-%d", i)))
+	}
+	return storage
+}
+
+func TestStreamCoalescesFlushes(t *testing.T) {
+	result := Result {
+		Storage:          manyTilesStorage(100),
+		StreamFlushDelay: time.Hour,
+	}
+
+	w := streamFlushes(&result, "/result/pid/stream?framing=v1")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	frames := decodeFrames(t, w.Body.Bytes())
+	/* header, tile and cursor for every task, end */
+	if len(frames) != 1 + 2 * 100 + 1 {
+		t.Errorf("got %d frames; want %d", len(frames), 1 + 2 * 100 + 1)
+	}
+	/* the header, and the end */
+	if w.flushes != 2 {
+		t.Errorf("flushed %d times; want 2", w.flushes)
+	}
+
+	w = streamFlushes(&result, "/result/pid/stream?framing=v1&noDelay=true")
+	/* the header, every tile, and the end */
+	if w.flushes != 1 + 100 + 1 {
+		t.Errorf("flushed %d times with noDelay; want %d", w.flushes, 1 + 100 + 1)
+	}
+}
+
+func TestStreamFlushesAtThreshold(t *testing.T) {
+	result := Result {
+		Storage:          manyTilesStorage(100),
+		StreamFlushBytes: 60,
+		StreamFlushDelay: time.Hour,
+	}
+
+	/*
+	 * The tiles are 6-7 bytes, so a flush every 9-10 tiles
+	 */
+	w := streamFlushes(&result, "/result/pid/stream")
+	if w.flushes < 10 || w.flushes > 14 {
+		t.Errorf("flushed %d times; want 10-14", w.flushes)
+	}
+}
+
+/*
+ * Stream a 10k tile job, gzipped, as every flush also flushes the compressor
+ */
+func benchmarkStreamFlushes(b *testing.B, path string) {
+	ntiles := 10000
+	result := Result { Storage: manyTilesStorage(ntiles) }
+	app := gin.New()
+	app.Use(util.Compression())
+	app.GET("/result/:pid/stream", result.Stream)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	flushes := 0
+	for i := 0; i < b.N; i++ {
+		w := &flushRecorder { ResponseRecorder: httptest.NewRecorder() }
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		app.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+		}
+		flushes += w.flushes
+	}
+	b.ReportMetric(float64(flushes) / float64(b.N), "flushes/op")
+}
+
+func BenchmarkStreamNoDelay(b *testing.B) {
+	benchmarkStreamFlushes(b, "/result/pid/stream?framing=v1&noDelay=true")
+}
+
+func BenchmarkStreamCoalesced(b *testing.B) {
+	benchmarkStreamFlushes(b, "/result/pid/stream?framing=v1")
+}
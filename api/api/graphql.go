@@ -11,10 +11,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 	graphql "github.com/graph-gophers/graphql-go"
-	"github.com/go-redis/redis/v8"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
 	"github.com/equinor/oneseismic/api/internal/util"
 )
@@ -80,13 +81,13 @@ func (r *resolver) Cube(
 	)
 	// TODO: inspect error and determine if cached token should be evicted
 	if err != nil {
-		log.Printf("pid=%s %v", pid, err)
+		logging.Default().Info("unable to fetch manifest", "pid", pid, "error", err)
 		return nil, err
 	}
 
 	manifest, err := manifestAsMap(doc)
 	if err != nil {
-		log.Printf("pid=%s %v", pid, err)
+		logging.Default().Error("bad manifest", "pid", pid, "error", err)
 		return nil, err
 	}
 
@@ -138,10 +139,10 @@ func (c *cube) Linenumbers(ctx context.Context) ([][]int32, error) {
 	if !ok {
 		keys := ctx.Value("keys").(map[string]string)
 		pid  := keys["pid"]
-		log.Printf(
-			"pid=%s %s/manifest.json broken; no dimensions",
-			pid,
-			string(c.id),
+		logging.Default().Error(
+			"bad manifest; no line-numbers",
+			"pid", pid,
+			"id",  string(c.id),
 		)
 		return nil, errors.New("internal error; bad document")
 	}
@@ -259,29 +260,64 @@ func (c *cube) basicSlice(
 		Args:            args,
 		Opts:            opts,
 	}
+	return c.schedule(ctx, msg)
+}
+
+/*
+ * Plan and schedule the query, and make the promise of its result. With
+ * deduplication, the query gets the process of an identical query that's
+ * still running instead, if there is one, see Dedup.
+ */
+func (c *cube) schedule(
+	ctx context.Context,
+	msg message.Query,
+) (*promise, error) {
+	pid := msg.Pid
 	query, err := c.root.sched.MakeQuery(&msg)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logging.Default().Info("bad query", "pid", pid, "error", err)
 		return nil, nil
 	}
+	query.priority, _ = ctx.Value("priority").(util.Priority)
+	if err := c.root.checkResultSize(query); err != nil {
+		logging.Default().Info("query refused", "pid", pid, "error", err)
+		return nil, err
+	}
+
+	/*
+	 * Failing to deduplicate only costs a process, so the query is
+	 * scheduled anyway
+	 */
+	reused := false
+	if c.root.dedup != nil {
+		claimed, ok, err := c.root.dedup.claimQuery(ctx, &msg)
+		if err != nil {
+			logging.Default().Warn("unable to deduplicate", "pid", pid, "error", err)
+		} else if ok {
+			logging.Default().Info("reusing process", "pid", pid, "process", claimed)
+			pid, reused = claimed, true
+		}
+	}
 
 	key, err := c.root.keyring.Sign(pid)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		logging.Default().Error("unable to sign token", "pid", pid, "error", err)
 		return nil, errors.New("internal error")
 	}
 
-	go func () {
-		err := c.root.sched.Schedule(context.Background(), pid, query)
-		if err != nil {
-			/*
-			 * Make scheduling errors fatal to detect them for debugging.
-			 * Eventually this should log, maybe cancel the process, and
-			 * continue.
-			 */
-			log.Fatalf("pid=%s, %v", pid, err)
-		}
-	}()
+	if !reused {
+		go func () {
+			err := c.root.sched.Schedule(detachTrace(ctx), pid, query)
+			if err != nil {
+				/*
+				 * Make scheduling errors fatal to detect them for debugging.
+				 * Eventually this should log, maybe cancel the process, and
+				 * continue.
+				 */
+				log.Fatalf("pid=%s, %v", pid, err)
+			}
+		}()
+	}
 
 	return &promise {
 		Url: fmt.Sprintf("result/%s", pid),
@@ -341,40 +377,15 @@ func (c *cube) basicCurtain(
 		Args:            args,
 		Opts:            opts,
 	}
-	query, err := c.root.sched.MakeQuery(&msg)
-	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
-		return nil, nil
-	}
-
-	key, err := c.root.keyring.Sign(pid)
-	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
-		return nil, errors.New("internal error")
-	}
-
-	go func () {
-		err := c.root.sched.Schedule(context.Background(), pid, query)
-		if err != nil {
-			/*
-			 * Make scheduling errors fatal to detect them for debugging.
-			 * Eventually this should log, maybe cancel the process, and
-			 * continue.
-			 */
-			log.Fatalf("pid=%s, %v", pid, err)
-		}
-	}()
-
-	return &promise {
-		Url: fmt.Sprintf("result/%s", pid),
-		Key: key,
-	}, nil
+	return c.schedule(ctx, msg)
 }
 
 func MakeGraphQL(
-	keyring  *auth.Keyring,
-	endpoint string,
-	storage  redis.Cmdable,
+	keyring   *auth.Keyring,
+	endpoint  string,
+	sched     Scheduler,
+	maxResult int64,
+	dedup     *Dedup,
 ) *gql {
 	schema := `
 scalar Promise
@@ -408,7 +419,9 @@ type Cube {
 		MakeBasicEndpoint(
 			keyring,
 			endpoint,
-			storage,
+			sched,
+			maxResult,
+			dedup,
 		),
 	}
 
@@ -471,7 +484,8 @@ func (g *gql) Get(ctx *gin.Context) {
 	delete(query, "variables")
 
 	ctx.Request.URL.RawQuery = query.Encode()
-	ctx.JSON(200, g.execQuery(ctx, graphquery, opname, variables))
+	response := g.execQuery(ctx, graphquery, opname, variables)
+	ctx.JSON(responseStatus(response), response)
 }
 
 func (g *gql) Post(ctx *gin.Context) {
@@ -483,16 +497,31 @@ func (g *gql) Post(ctx *gin.Context) {
 	b := body {}
 	err := ctx.BindJSON(&b)
 	if err != nil {
-		log.Printf("pid=%s %v", ctx.GetString("pid"), err)
+		logging.Default().Info(
+			"bad request",
+			"pid",   ctx.GetString("pid"),
+			"error", err,
+		)
 		return
 	}
 
-	ctx.JSON(200, g.execQuery(
-		ctx,
-		b.Query,
-		b.OperationName,
-		b.Variables,
-	))
+	response := g.execQuery(ctx, b.Query, b.OperationName, b.Variables)
+	ctx.JSON(responseStatus(response), response)
+}
+
+/*
+ * 413 if a query was refused for the size of its result, see
+ * checkResultSize. Other errors are only reported in the response, like
+ * graphql does.
+ */
+func responseStatus(response *graphql.Response) int {
+	for _, err := range response.Errors {
+		var tooLarge *resultTooLargeError
+		if errors.As(err.ResolverError, &tooLarge) {
+			return http.StatusRequestEntityTooLarge
+		}
+	}
+	return http.StatusOK
 }
 
 func (g *gql) execQuery(
@@ -501,11 +530,25 @@ func (g *gql) execQuery(
 	opName string,
 	variables map[string]interface{},
 ) *graphql.Response {
+	pid := ctx.GetString("pid")
 	keys := map[string]string {
-		"pid": ctx.GetString("pid"),
+		"pid": pid,
 		"Authorization": ctx.GetHeader("Authorization"),
 		"url-query": ctx.Request.URL.RawQuery,
 	}
-	c := context.WithValue(ctx, "keys", keys)
+	traced, span := tracer().Start(
+		extractTrace(ctx, ctx.Request.Header),
+		"oneseismic.query",
+		trace.WithAttributes(pidAttribute(pid)),
+	)
+	defer span.End()
+	c := context.WithValue(traced, "keys", keys)
+	/*
+	 * The priority is set by Priorities.Parse, and queries without it are
+	 * normal
+	 */
+	if priority, ok := ctx.Get("priority"); ok {
+		c = context.WithValue(c, "priority", priority)
+	}
 	return g.schema.Exec(c, query, opName, variables)
 }
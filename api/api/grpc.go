@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/rpc"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+/*
+ * The results over gRPC, see rpc/results.proto. This is a thin layer on top
+ * of Result, which does the lookups, the collection and the deletes for both
+ * the HTTP and gRPC APIs, with the same configuration. The HTTP API is the
+ * reference, and the gRPC calls behave like their HTTP counterparts.
+ *
+ * Register it with rpc.RegisterResultsServer.
+ */
+type ResultService struct {
+	rpc.UnimplementedResultsServer
+	Result *Result
+}
+
+/*
+ * Check the token in the metadata, like auth.ResultAuth does for HTTP
+ */
+func (s *ResultService) authorize(ctx context.Context, pid string) error {
+	logger := s.Result.logger(pid)
+	md, _ := metadata.FromIncomingContext(ctx)
+	authorization := md.Get("authorization")
+	if len(authorization) == 0 {
+		logger.Info("rejected", "error", "no authorization metadata")
+		return grpcstatus.Error(codes.Unauthenticated, "no authorization")
+	}
+
+	token := ""
+	_, err := fmt.Sscanf(authorization[0], "Bearer %s", &token)
+	if err != nil {
+		logger.Info("rejected", "error", "malformed authorization metadata")
+		return grpcstatus.Error(codes.Unauthenticated, "malformed authorization")
+	}
+
+	err = s.Result.Keyring.Validate(token, pid)
+	if errors.Is(err, auth.ErrTokenExpired) {
+		logger.Info("rejected", "error", err)
+		return grpcstatus.Error(codes.Unauthenticated, "token expired")
+	}
+	if err != nil {
+		logger.Info("rejected", "error", err)
+		return grpcstatus.Error(codes.PermissionDenied, "forbidden")
+	}
+	return nil
+}
+
+/*
+ * The status message from the body of the HTTP status
+ */
+func statusMessage(body gin.H) *rpc.Status {
+	msg := &rpc.Status {}
+	msg.State, _        = body["status"].(string)
+	msg.Progress, _     = body["progress"].(string)
+	msg.Fraction, _     = body["fraction"].(float64)
+	msg.Error, _        = body["error"].(string)
+	msg.RetryAfterMs, _ = body["retry_after_ms"].(int64)
+	return msg
+}
+
+func (s *ResultService) GetStatus(
+	ctx context.Context,
+	req *rpc.StatusRequest,
+) (*rpc.Status, error) {
+	pid := req.GetPid()
+	if err := s.authorize(ctx, pid); err != nil {
+		return nil, err
+	}
+
+	/*
+	 * Failed processes have a status, and are not failed lookups
+	 */
+	st := s.Result.sharedStatus(pid)
+	switch {
+	case st.code == http.StatusGatewayTimeout:
+		return nil, grpcstatus.Error(codes.DeadlineExceeded, "timed out")
+	case st.body == nil:
+		return nil, grpcstatus.Error(codes.Internal, "status lookup failed")
+	}
+	return statusMessage(st.body), nil
+}
+
+/*
+ * The status of the last tile of the stream, see failureStatus
+ */
+func streamStatus(err error, count int, ntasks int) *rpc.Status {
+	msg := &rpc.Status {
+		State:    "finished",
+		Progress: fmt.Sprintf("%d/%d", count, ntasks),
+		Fraction: progressFraction(int64(count), ntasks),
+	}
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		msg.State = "timeout"
+	case err != nil:
+		msg.State = "failed"
+		msg.Error = err.Error()
+	}
+	return msg
+}
+
+func (s *ResultService) StreamResult(
+	req    *rpc.StreamRequest,
+	stream rpc.Results_StreamResultServer,
+) error {
+	r := s.Result
+	ctx := stream.Context()
+	pid := req.GetPid()
+	if err := s.authorize(ctx, pid); err != nil {
+		return err
+	}
+
+	release := r.Streams.tryAcquire()
+	if release == nil {
+		return grpcstatus.Error(
+			codes.ResourceExhausted,
+			"too many concurrent streams; try again later",
+		)
+	}
+	defer release()
+
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		return grpcstatus.Error(codes.NotFound, "no such process")
+	}
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		return grpcstatus.Error(codes.Internal, "bad process header")
+	}
+
+	cursor := req.GetFrom()
+	if cursor == "" {
+		cursor = start.cursor
+	}
+	from, err := findPosition(ctx, r.Storage, pid, cursor)
+	if err != nil {
+		r.logger(pid).Info("bad cursor", "error", err)
+		return grpcstatus.Error(codes.InvalidArgument, err.Error())
+	}
+
+	collectctx, cancel := r.withCollectTimeout(ctx)
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "grpc", pid, head, from, false, tiles, failure)
+
+	/*
+	 * The tile is marshalled by Send, so its buffer can be released right
+	 * after
+	 */
+	count := from.count
+	for {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					r.logger(pid).Error("stream failed", "endpoint", "grpc", "error", err)
+					return stream.Send(&rpc.Tile {
+						Status: streamStatus(err, count, head.Ntasks),
+					})
+				}
+				r.logger(pid).Info(
+					"finished",
+					"endpoint", "grpc",
+					"bundles",  count,
+				)
+				return stream.Send(&rpc.Tile {
+					Status: streamStatus(nil, count, head.Ntasks),
+				})
+			}
+
+			tile := &rpc.Tile { Payload: output.tile }
+			if output.id != "" {
+				count++
+				tile.Index  = int64(count)
+				tile.Cursor = output.id
+			}
+			err := stream.Send(tile)
+			output.release()
+			if err != nil {
+				return err
+			}
+
+		case err := <-failure:
+			r.logger(pid).Error("stream failed", "endpoint", "grpc", "error", err)
+			return stream.Send(&rpc.Tile {
+				Status: streamStatus(err, count, head.Ntasks),
+			})
+		}
+	}
+}
+
+func (s *ResultService) CancelJob(
+	ctx context.Context,
+	req *rpc.CancelRequest,
+) (*rpc.CancelReply, error) {
+	pid := req.GetPid()
+	if err := s.authorize(ctx, pid); err != nil {
+		return nil, err
+	}
+
+	n, err := s.Result.cancel(ctx, pid)
+	if err != nil {
+		s.Result.logger(pid).Error("unable to cancel process", "error", err)
+		return nil, grpcstatus.Error(codes.Internal, "unable to cancel")
+	}
+	return &rpc.CancelReply { Cancelled: n > 0 }, nil
+}
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+/*
+ * Serve the results of storage over an in-memory connection, and return the
+ * client and the keyring that signs its tokens
+ */
+func serveRPC(t *testing.T, storage *fakeStorage) (rpc.ResultsClient, *auth.Keyring) {
+	keyring := auth.MakeKeyring([]byte("secret"))
+	result := &Result { Storage: storage, Keyring: &keyring }
+
+	ln := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	rpc.RegisterResultsServer(srv, &ResultService { Result: result })
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+
+	dial := func(context.Context, string) (net.Conn, error) {
+		return ln.Dial()
+	}
+	conn, err := grpc.Dial(
+		"bufnet",
+		grpc.WithContextDialer(dial),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rpc.NewResultsClient(conn), &keyring
+}
+
+func withToken(t *testing.T, keyring *auth.Keyring, pid string) context.Context {
+	token, err := keyring.Sign(pid)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return metadata.AppendToOutgoingContext(
+		context.Background(),
+		"authorization", "Bearer " + token,
+	)
+}
+
+func assertCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+	if got := grpcstatus.Code(err); got != want {
+		t.Errorf("code = %v (%v); want %v", got, err, want)
+	}
+}
+
+func TestRPCRejectsMissingToken(t *testing.T) {
+	client, _ := serveRPC(t, newFakeStorage())
+	_, err := client.GetStatus(
+		context.Background(),
+		&rpc.StatusRequest { Pid: "pid" },
+	)
+	assertCode(t, err, codes.Unauthenticated)
+}
+
+func TestRPCRejectsTokenForOtherProcess(t *testing.T) {
+	client, keyring := serveRPC(t, newFakeStorage())
+	ctx := withToken(t, keyring, "other-pid")
+
+	_, err := client.GetStatus(ctx, &rpc.StatusRequest { Pid: "pid" })
+	assertCode(t, err, codes.PermissionDenied)
+
+	_, err = client.CancelJob(ctx, &rpc.CancelRequest { Pid: "pid" })
+	assertCode(t, err, codes.PermissionDenied)
+
+	stream, err := client.StreamResult(ctx, &rpc.StreamRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = stream.Recv()
+	assertCode(t, err, codes.PermissionDenied)
+}
+
+func TestRPCStatus(t *testing.T) {
+	storage := newFakeStorage()
+	client, keyring := serveRPC(t, storage)
+	ctx := withToken(t, keyring, "pid")
+
+	st, err := client.GetStatus(ctx, &rpc.StatusRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if st.State != "pending" {
+		t.Errorf("state = %s; want pending", st.State)
+	}
+
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	st, err = client.GetStatus(ctx, &rpc.StatusRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if st.State != "finished" || st.Progress != "2/2" || st.Fraction != 1 {
+		t.Errorf("status = %v; want finished, 2/2", st)
+	}
+}
+
+func receiveAll(t *testing.T, stream rpc.Results_StreamResultClient) []*rpc.Tile {
+	var tiles []*rpc.Tile
+	for {
+		tile, err := stream.Recv()
+		if err == io.EOF {
+			return tiles
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		tiles = append(tiles, tile)
+	}
+}
+
+func TestRPCStreamResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+	client, keyring := serveRPC(t, storage)
+	ctx := withToken(t, keyring, "pid")
+
+	stream, err := client.StreamResult(ctx, &rpc.StreamRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tiles := receiveAll(t, stream)
+	if len(tiles) != 4 {
+		t.Fatalf("got %d tiles; want header, 2 tiles and status", len(tiles))
+	}
+
+	if tiles[0].Index != 0 || string(tiles[0].Payload) != string(head.RawHeader) {
+		t.Errorf("first tile = %v; want the result header", tiles[0])
+	}
+	for i, want := range []string { "tile-0", "tile-1" } {
+		tile := tiles[i + 1]
+		if tile.Index != int64(i + 1) {
+			t.Errorf("index = %d; want %d", tile.Index, i + 1)
+		}
+		if string(tile.Payload) != want {
+			t.Errorf("payload = %s; want %s", tile.Payload, want)
+		}
+		if tile.Cursor == "" {
+			t.Errorf("tile %d has no cursor", i + 1)
+		}
+	}
+
+	last := tiles[3]
+	if last.Status == nil || last.Status.State != "finished" {
+		t.Errorf("status = %v; want finished", last.Status)
+	}
+	if len(last.Payload) != 0 {
+		t.Errorf("status tile has payload %q", last.Payload)
+	}
+}
+
+func TestRPCStreamResumes(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	client, keyring := serveRPC(t, storage)
+	ctx := withToken(t, keyring, "pid")
+
+	stream, err := client.StreamResult(ctx, &rpc.StreamRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	cursor := receiveAll(t, stream)[1].Cursor
+
+	req := &rpc.StreamRequest { Pid: "pid", From: cursor }
+	stream, err = client.StreamResult(ctx, req)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tiles := receiveAll(t, stream)
+	if len(tiles) != 2 {
+		t.Fatalf("got %d tiles; want the last tile and status", len(tiles))
+	}
+	if tiles[0].Index != 2 || string(tiles[0].Payload) != "tile-1" {
+		t.Errorf("tile = %v; want tile-1 at index 2", tiles[0])
+	}
+}
+
+func TestRPCStreamEndsWithFailure(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.addValues("pid", map[string]interface{} { "error": "1/2: failed" })
+	client, keyring := serveRPC(t, storage)
+	ctx := withToken(t, keyring, "pid")
+
+	stream, err := client.StreamResult(ctx, &rpc.StreamRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tiles := receiveAll(t, stream)
+	last := tiles[len(tiles) - 1]
+	if last.Status == nil || last.Status.State != "failed" {
+		t.Fatalf("status = %v; want failed", last.Status)
+	}
+	if last.Status.Progress != "1/2" {
+		t.Errorf("progress = %s; want 1/2", last.Status.Progress)
+	}
+}
+
+func TestRPCStreamOfUnknownProcess(t *testing.T) {
+	client, keyring := serveRPC(t, newFakeStorage())
+	ctx := withToken(t, keyring, "pid")
+
+	stream, err := client.StreamResult(ctx, &rpc.StreamRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = stream.Recv()
+	assertCode(t, err, codes.NotFound)
+}
+
+func TestRPCCancelJob(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	client, keyring := serveRPC(t, storage)
+	ctx := withToken(t, keyring, "pid")
+
+	reply, err := client.CancelJob(ctx, &rpc.CancelRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reply.Cancelled {
+		t.Errorf("cancelled = false; want true")
+	}
+	if _, err := storage.Get(ctx, headerkey("pid")).Result(); err == nil {
+		t.Errorf("header still in storage after cancel")
+	}
+	if _, err := storage.Get(ctx, cancelledkey("pid")).Result(); err != nil {
+		t.Errorf("process not flagged as cancelled: %v", err)
+	}
+
+	reply, err = client.CancelJob(ctx, &rpc.CancelRequest { Pid: "pid" })
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if reply.Cancelled {
+		t.Errorf("cancelled = true; want false when there's nothing to cancel")
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"time"
+)
+
+/*
+ * The default interval of keepalives in streams, see Result.KeepAlive.
+ * Proxies tend to close connections that have been idle for 30s or a minute,
+ * and the time between tiles can be longer than that, e.g. for processes
+ * reading from cold storage.
+ */
+const defaultKeepAlive = 15 * time.Second
+
+func (r *Result) keepAlive() time.Duration {
+	if r.KeepAlive == 0 {
+		return defaultKeepAlive
+	}
+	return r.KeepAlive
+}
+
+/*
+ * An idleTimer fires when nothing has been written for interval. Every write
+ * must reset() it. A nil idleTimer never fires, which is what streams that
+ * can't have keepalives get.
+ */
+type idleTimer struct {
+	interval time.Duration
+	timer    *time.Timer
+}
+
+/*
+ * An idle timer, or nil if interval is not positive
+ */
+func newIdleTimer(interval time.Duration) *idleTimer {
+	if interval <= 0 {
+		return nil
+	}
+	return &idleTimer {
+		interval: interval,
+		timer:    time.NewTimer(interval),
+	}
+}
+
+/*
+ * A channel that fires when the stream has been idle for the interval
+ */
+func (t *idleTimer) expired() <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.timer.C
+}
+
+/*
+ * Restart the interval, after a write
+ */
+func (t *idleTimer) reset() {
+	if t == nil {
+		return
+	}
+	if !t.timer.Stop() {
+		/*
+		 * Drain the channel, unless the caller already got the tick, so that
+		 * the reset timer doesn't fire right away
+		 */
+		select {
+		case <-t.timer.C:
+		default:
+		}
+	}
+	t.timer.Reset(t.interval)
+}
+
+func (t *idleTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.timer.Stop()
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/equinor/oneseismic/api/frame"
+)
+
+/*
+ * The types of the (version 1) frames in the stream, including keepalives,
+ * which the frame.Decoder skips
+ */
+func rawFrameTypes(t *testing.T, body []byte) []frame.Type {
+	types := make([]frame.Type, 0)
+	for len(body) > 0 {
+		if len(body) < frame.HeaderSize1 {
+			t.Fatalf("truncated frame header")
+		}
+		types = append(types, frame.Type(body[2]))
+		length := int(binary.BigEndian.Uint32(body[3:]))
+		body = body[frame.HeaderSize1 + length:]
+	}
+	return types
+}
+
+/*
+ * A process where the second tile takes a while, like when the blobs are in
+ * cold storage
+ */
+func slowStorage(delay time.Duration) *fakeStorage {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	go func() {
+		time.Sleep(delay)
+		storage.add("pid", "1/2", []byte("tile-1"))
+	}()
+	return storage
+}
+
+func TestStreamSendsKeepalivesWhileIdle(t *testing.T) {
+	result := Result {
+		Storage:   slowStorage(100 * time.Millisecond),
+		ReadBlock: 5 * time.Millisecond,
+		KeepAlive: 10 * time.Millisecond,
+	}
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1", "")
+	types := rawFrameTypes(t, w.Body.Bytes())
+
+	/*
+	 * The keepalives come while waiting for the second tile
+	 */
+	keepalives := 0
+	tiles := 0
+	for _, kind := range types {
+		switch kind {
+		case frame.Tile:
+			tiles++
+		case frame.Keepalive:
+			if tiles != 1 {
+				t.Errorf("keepalive after %d tiles; want only while idle", tiles)
+			}
+			keepalives++
+		}
+	}
+	if keepalives == 0 {
+		t.Errorf("no keepalives in %v", types)
+	}
+
+	/*
+	 * Clients don't see them
+	 */
+	frames := decodeFrames(t, w.Body.Bytes())
+	for _, f := range frames {
+		if f.Type == frame.Keepalive {
+			t.Errorf("decoder returned a keepalive")
+		}
+	}
+	if last := frames[len(frames) - 1]; last.Type != frame.End {
+		t.Errorf("last frame = %v; want end", last.Type)
+	}
+}
+
+func TestKeepalivesOnlyInFramedStreams(t *testing.T) {
+	result := Result {
+		Storage:   slowStorage(50 * time.Millisecond),
+		ReadBlock: 5 * time.Millisecond,
+		KeepAlive: 10 * time.Millisecond,
+	}
+
+	/*
+	 * The bare stream is the msgpack document, which has no room for them
+	 */
+	w := requestResult(&result, "/result/pid/stream", "")
+	want := string(fakeProcessHeader(2)) + "tile-0" + "tile-1"
+	if body := w.Body.String(); body != want {
+		t.Errorf("body = %q; want %q", body, want)
+	}
+}
+
+func TestNegativeKeepAliveDisablesKeepalives(t *testing.T) {
+	result := Result {
+		Storage:   slowStorage(50 * time.Millisecond),
+		ReadBlock: 5 * time.Millisecond,
+		KeepAlive: -1,
+	}
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1", "")
+	for _, kind := range rawFrameTypes(t, w.Body.Bytes()) {
+		if kind == frame.Keepalive {
+			t.Errorf("keepalive in stream with keepalives disabled")
+		}
+	}
+}
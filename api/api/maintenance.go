@@ -0,0 +1,99 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * Maintenance mode, for draining an instance before planned maintenance.
+ *
+ * In maintenance mode, new queries are rejected with 503 Service Unavailable
+ * and a Retry-After, so that well-behaved clients back off and try again
+ * later. Everything else, notably /result, is served as usual, so that
+ * processes that were scheduled before maintenance started can still be
+ * collected by their clients. The mode is reported by the readiness probe
+ * (see Probes), which is what operators (and load balancers) should watch.
+ */
+type Maintenance struct {
+	/*
+	 * How long clients are told to wait before trying again. Zero means no
+	 * Retry-After header.
+	 */
+	RetryAfter time.Duration
+	/*
+	 * Optional - when set, the readiness probe reports the active and
+	 * rejected streams.
+	 */
+	Streams *StreamLimiter
+
+	mtx     sync.Mutex
+	enabled bool
+}
+
+func (m *Maintenance) Enable() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.enabled = true
+}
+
+func (m *Maintenance) Disable() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.enabled = false
+}
+
+func (m *Maintenance) Enabled() bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.enabled
+}
+
+/*
+ * Middleware for the endpoints that start new work, which rejects requests
+ * when in maintenance mode.
+ */
+func (m *Maintenance) Reject(ctx *gin.Context) {
+	if !m.Enabled() {
+		return
+	}
+
+	setRetryAfter(ctx, m.RetryAfter)
+	ctx.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H {
+		"error": "down for maintenance; new queries are not accepted",
+	})
+}
+
+/*
+ * Set Retry-After to d, rounded up to whole seconds. Zero means no header.
+ */
+func setRetryAfter(ctx *gin.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	seconds := int64(d / time.Second)
+	if d % time.Second != 0 {
+		seconds++
+	}
+	ctx.Header("Retry-After", fmt.Sprint(seconds))
+}
+
+/*
+ * PUT /admin/maintenance
+ */
+func (a *Admin) EnableMaintenance(ctx *gin.Context) {
+	a.Maintenance.Enable()
+	ctx.Status(http.StatusNoContent)
+}
+
+/*
+ * DELETE /admin/maintenance
+ */
+func (a *Admin) DisableMaintenance(ctx *gin.Context) {
+	a.Maintenance.Disable()
+	ctx.Status(http.StatusNoContent)
+}
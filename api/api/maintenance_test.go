@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * An app with the maintenance endpoints, where /graphql stands in for the
+ * real query endpoint and schedules nothing
+ */
+func maintenanceApp(admin *Admin, result *Result) *gin.Engine {
+	app := gin.New()
+	graphql := app.Group("/graphql")
+	graphql.Use(admin.Maintenance.Reject)
+	graphql.POST("", func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, gin.H { "data": nil })
+	})
+	app.GET("/result/:pid", result.Get)
+	probes := &Probes {
+		Storage:     newFakeStorage(),
+		Maintenance: admin.Maintenance,
+	}
+	app.GET("/readyz", probes.Ready)
+	app.PUT("/admin/maintenance", admin.EnableMaintenance)
+	app.DELETE("/admin/maintenance", admin.DisableMaintenance)
+	return app
+}
+
+func serveRequest(app *gin.Engine, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+/*
+ * The maintenance mode, as reported by the readiness probe, which is not
+ * ready in maintenance mode
+ */
+func health(t *testing.T, app *gin.Engine) bool {
+	w := serveRequest(app, http.MethodGet, "/readyz")
+	var body struct {
+		Maintenance bool `json:"maintenance"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v", err)
+	}
+	status := http.StatusOK
+	if body.Maintenance {
+		status = http.StatusServiceUnavailable
+	}
+	if w.Code != status {
+		t.Fatalf("readyz: status = %d; want %d", w.Code, status)
+	}
+	return body.Maintenance
+}
+
+func TestMaintenanceRejectsQueriesButServesResults(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	admin := &Admin {
+		Storage:     storage,
+		Maintenance: &Maintenance { RetryAfter: 90 * time.Second },
+	}
+	app := maintenanceApp(admin, &Result { Storage: storage })
+
+	if health(t, app) {
+		t.Errorf("maintenance = true before it is enabled")
+	}
+	w := serveRequest(app, http.MethodPost, "/graphql")
+	if w.Code != http.StatusOK {
+		t.Errorf("query: status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	w = serveRequest(app, http.MethodPut, "/admin/maintenance")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("enable: status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+	if !health(t, app) {
+		t.Errorf("maintenance = false after it is enabled")
+	}
+
+	w = serveRequest(app, http.MethodPost, "/graphql")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf(
+			"query: status = %d; want %d",
+			w.Code,
+			http.StatusServiceUnavailable,
+		)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "90" {
+		t.Errorf("Retry-After = %q; want 90", retry)
+	}
+
+	w = serveRequest(app, http.MethodGet, "/result/pid")
+	if w.Code != http.StatusOK {
+		t.Errorf("result: status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	serveRequest(app, http.MethodDelete, "/admin/maintenance")
+	if health(t, app) {
+		t.Errorf("maintenance = true after it is disabled")
+	}
+	w = serveRequest(app, http.MethodPost, "/graphql")
+	if w.Code != http.StatusOK {
+		t.Errorf("query: status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ * The buckets of histograms of durations, in seconds, from 5ms to 5 minutes
+ */
+var durationBuckets = []float64 {
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300,
+}
+
+/*
+ * Metrics on result assembly, labeled by the endpoint that collects the
+ * result, e.g. "get" or "stream". A nil *Metrics records nothing.
+ */
+type Metrics struct {
+	firstTile *prometheus.HistogramVec
+	assembly  *prometheus.HistogramVec
+	tiles     *prometheus.CounterVec
+	errors    *prometheus.CounterVec
+}
+
+/*
+ * Make the metrics, and register them with the registerer, e.g.
+ * prometheus.DefaultRegisterer to serve them with promhttp.Handler()
+ */
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics {
+		firstTile: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts {
+				Name:    "oneseismic_result_first_tile_seconds",
+				Help:    "Time from the start of collecting a result to its first tile",
+				Buckets: durationBuckets,
+			},
+			[]string { "endpoint" },
+		),
+		assembly: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts {
+				Name:    "oneseismic_result_assembly_seconds",
+				Help:    "Time to collect all the tiles of a result",
+				Buckets: durationBuckets,
+			},
+			[]string { "endpoint" },
+		),
+		tiles: prometheus.NewCounterVec(
+			prometheus.CounterOpts {
+				Name: "oneseismic_result_tiles_total",
+				Help: "Tiles collected from storage",
+			},
+			[]string { "endpoint" },
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts {
+				Name: "oneseismic_result_errors_total",
+				Help: "Collections that stopped with an error, including timeouts",
+			},
+			[]string { "endpoint" },
+		),
+	}
+	registerer.MustRegister(m.firstTile, m.assembly, m.tiles, m.errors)
+	return m
+}
+
+/*
+ * The metrics of a single collection, see collectResult.
+ */
+type collection struct {
+	metrics  *Metrics
+	endpoint string
+	start    time.Time
+	tiles    int
+}
+
+func (m *Metrics) collection(endpoint string) *collection {
+	if m == nil {
+		return nil
+	}
+	return &collection {
+		metrics:  m,
+		endpoint: endpoint,
+		start:    time.Now(),
+	}
+}
+
+func (c *collection) tile() {
+	if c == nil {
+		return
+	}
+	if c.tiles == 0 {
+		c.metrics.firstTile.
+			WithLabelValues(c.endpoint).
+			Observe(time.Since(c.start).Seconds())
+	}
+	c.tiles++
+	c.metrics.tiles.WithLabelValues(c.endpoint).Inc()
+}
+
+func (c *collection) failed() {
+	if c == nil {
+		return
+	}
+	c.metrics.errors.WithLabelValues(c.endpoint).Inc()
+}
+
+func (c *collection) done() {
+	if c == nil {
+		return
+	}
+	c.metrics.assembly.
+		WithLabelValues(c.endpoint).
+		Observe(time.Since(c.start).Seconds())
+}
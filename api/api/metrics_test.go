@@ -0,0 +1,110 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func scrapeMetrics(t *testing.T, registry *prometheus.Registry) string {
+	app := gin.New()
+	app.GET("/metrics", gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts {})))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: status = %d; want %d", w.Code, http.StatusOK)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsCountTilesOfCompletedJob(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	for i := 0; i < 3; i++ {
+		storage.add("pid", fmt.Sprintf("%d/3", i), []byte("tile"))
+	}
+	registry := prometheus.NewRegistry()
+	result := Result {
+		Storage: storage,
+		Metrics: NewMetrics(registry),
+	}
+
+	before := scrapeMetrics(t, registry)
+	if strings.Contains(before, `endpoint="get"`) {
+		t.Errorf("metrics before the job:\n%s", before)
+	}
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	after := scrapeMetrics(t, registry)
+	for _, want := range []string {
+		`oneseismic_result_tiles_total{endpoint="get"} 3`,
+		`oneseismic_result_first_tile_seconds_count{endpoint="get"} 1`,
+		`oneseismic_result_assembly_seconds_count{endpoint="get"} 1`,
+	} {
+		if !strings.Contains(after, want) {
+			t.Errorf("metrics missing %s; got\n%s", want, after)
+		}
+	}
+	if strings.Contains(after, `oneseismic_result_errors_total{`) {
+		t.Errorf("errors counted for a successful job:\n%s", after)
+	}
+}
+
+func TestMetricsCountFailedCollections(t *testing.T) {
+	storage := newFakeStorage()
+	storage.add("pid", "0/2", []byte("tile"))
+	storage.addValues("pid", map[string]interface{} { "error": "1/2: failed" })
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+	m := NewMetrics(prometheus.NewRegistry())
+
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go collectResult(
+		context.Background(),
+		storage,
+		"pid",
+		head,
+		start,
+		xreadBlock,
+		backoff {},
+		&tiledecoder {},
+		m.collection("get"),
+		tiles,
+		failure,
+	)
+	for range tiles {}
+
+	if err := <-failure; err == nil {
+		t.Fatalf("expected collection to fail")
+	}
+	if n := testutil.ToFloat64(m.tiles.WithLabelValues("get")); n != 1 {
+		t.Errorf("tiles = %v; want 1", n)
+	}
+	if n := testutil.ToFloat64(m.errors.WithLabelValues("get")); n != 1 {
+		t.Errorf("errors = %v; want 1", n)
+	}
+	if n := testutil.CollectAndCount(m.assembly); n != 0 {
+		t.Errorf("assembly observed %d times; want 0 for failed job", n)
+	}
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	var m *Metrics
+	c := m.collection("get")
+	c.tile()
+	c.failed()
+	c.done()
+}
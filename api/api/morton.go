@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * With ?order=morton, the bundles of the msgpack result are sent in Morton
+ * (Z-)order of the fragments they were made from, rather than in the order
+ * the workers finished them, for clients that store results along a
+ * space-filling curve. The fragments of the tasks are from the plan the
+ * scheduler stored for the process (see storePlan), and a task is ordered by
+ * the first of its fragments in Z-order. Tasks without fragments go last.
+ *
+ * Only whole bundles are reordered - the tiles in a bundle stay in the order
+ * of the fragments of its task, which is not necessarily Z-order, and the
+ * fragments of different tasks are not interleaved. The result header
+ * records both, with the order in the "order" field, and what is ordered
+ * ("task") in the "order-unit" field, so that the result tells how it's
+ * ordered on its own.
+ *
+ * Like decimation, the result is assembled in memory to reorder it, so it is
+ * only available for the msgpack result from Get.
+ */
+const mortonOrder = "morton"
+
+/*
+ * The ETag of the result with the ETag etag in Morton order, which is another
+ * body than the result in the order the workers finished.
+ */
+func mortonETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-morton"`
+}
+
+/*
+ * The Morton code of the fragment ID (i, j, k), which interleaves the bits
+ * of the indices, with i as the most significant of every triple. Sorting by
+ * the code visits the fragments in Z-order. The indices are 21 bits at most,
+ * which is far more fragments than any cube has.
+ */
+func mortonCode(id [3]int) uint64 {
+	code := uint64(0)
+	for bit := uint(0); bit < 21; bit++ {
+		for dim := 0; dim < 3; dim++ {
+			b := (uint64(id[dim]) >> bit) & 1
+			code |= b << (3 * bit + uint(2 - dim))
+		}
+	}
+	return code
+}
+
+/*
+ * The order of the ntasks tasks of the plan, by the Morton code of their
+ * fragments. Ties, e.g. different attributes of the same fragment, are in
+ * task order.
+ */
+func mortonTaskOrder(layout *planlayout, ntasks int) ([]int, error) {
+	if len(layout.Tasks) != ntasks {
+		return nil, fmt.Errorf(
+			"plan has %d tasks; process has %d",
+			len(layout.Tasks),
+			ntasks,
+		)
+	}
+
+	keys := make([]uint64, ntasks)
+	for n, task := range layout.Tasks {
+		keys[n] = ^uint64(0)
+		for _, id := range task.Fragments {
+			if code := mortonCode(id); code < keys[n] {
+				keys[n] = code
+			}
+		}
+	}
+
+	order := make([]int, ntasks)
+	for n := range order {
+		order[n] = n
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return keys[order[a]] < keys[order[b]]
+	})
+	return order, nil
+}
+
+/*
+ * GET /result/<pid>?order=morton
+ *
+ * The msgpack result with the bundles in Morton order, see mortonOrder
+ */
+func (r *Result) getMorton(ctx *gin.Context, pid string) {
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, nil, false)
+	if result == nil {
+		return
+	}
+	if result.empty {
+		r.noContent(ctx, pid, result)
+		return
+	}
+	head := result.head
+
+	limit := r.assembledLimit()
+	if result.size > limit {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H {
+			"error": "result too large for reordering",
+			"limit": limit,
+		})
+		return
+	}
+
+	doc, err := r.Storage.Get(ctx, plankey(pid)).Bytes()
+	if err == redis.Nil {
+		ctx.AbortWithStatusJSON(http.StatusConflict, gin.H {
+			"error": "the process has no plan to order the result by",
+		})
+		return
+	}
+	if err != nil {
+		r.logger(pid).Error("unable to get plan", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var layout planlayout
+	if err := json.Unmarshal(doc, &layout); err != nil {
+		r.logger(pid).Error("bad plan", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	order, err := mortonTaskOrder(&layout, head.Ntasks)
+	if err != nil {
+		r.logger(pid).Error("unable to order result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	header, err := rewriteHeader(
+		head.RawHeader,
+		head.Ntasks,
+		map[string]interface{} {
+			"order":      mortonOrder,
+			"order-unit": "task",
+		},
+	)
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "morton", pid, head, start, false, tiles, failure)
+
+	fail := func(err error) {
+		r.logger(pid).Error("unable to order result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+	}
+
+	bundles := make([][]byte, head.Ntasks)
+	for tiles != nil {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					fail(err)
+					return
+				}
+				tiles = nil
+				break
+			}
+			if output.id == "" {
+				continue
+			}
+
+			index, err := taskIndex(output.part, head.Ntasks)
+			if err == nil && bundles[index] != nil {
+				err = fmt.Errorf("duplicated part %s", output.part)
+			}
+			if err != nil {
+				output.release()
+				fail(err)
+				return
+			}
+			bundles[index] = append([]byte(nil), output.tile...)
+			output.release()
+
+		case err := <-failure:
+			fail(err)
+			return
+		}
+	}
+
+	var body bytes.Buffer
+	body.Write(header)
+	for _, index := range order {
+		if bundles[index] == nil {
+			fail(fmt.Errorf("missing part %d/%d", index, head.Ntasks))
+			return
+		}
+		body.Write(bundles[index])
+	}
+
+	cacheImmutable(ctx, result.etag)
+	setDisposition(ctx, pid, "bin")
+	ctx.Data(http.StatusOK, resultContentType, body.Bytes())
+}
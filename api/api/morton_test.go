@@ -0,0 +1,193 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestMortonOrderOfSmallGrid(t *testing.T) {
+	var ids [][3]int
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			ids = append(ids, [3]int { i, j, 0 })
+		}
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return mortonCode(ids[a]) < mortonCode(ids[b])
+	})
+
+	expected := [][3]int {
+		{ 0, 0, 0 }, { 0, 1, 0 }, { 1, 0, 0 }, { 1, 1, 0 },
+		{ 0, 2, 0 }, { 0, 3, 0 }, { 1, 2, 0 }, { 1, 3, 0 },
+		{ 2, 0, 0 }, { 2, 1, 0 }, { 3, 0, 0 }, { 3, 1, 0 },
+		{ 2, 2, 0 }, { 2, 3, 0 }, { 3, 2, 0 }, { 3, 3, 0 },
+	}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Errorf("order = %v; want %v", ids, expected)
+	}
+}
+
+func TestMortonCodeInterleavesAllDimensions(t *testing.T) {
+	cases := []struct {
+		id   [3]int
+		code uint64
+	} {
+		{ [3]int { 0, 0, 1 }, 1 },
+		{ [3]int { 0, 1, 0 }, 2 },
+		{ [3]int { 1, 0, 0 }, 4 },
+		{ [3]int { 0, 0, 2 }, 8 },
+		{ [3]int { 1, 1, 1 }, 7 },
+		{ [3]int { 3, 0, 2 }, 44 },
+	}
+	for _, tc := range cases {
+		if code := mortonCode(tc.id); code != tc.code {
+			t.Errorf("mortonCode(%v) = %d; want %d", tc.id, code, tc.code)
+		}
+	}
+}
+
+/*
+ * Store a plan with the fragments of each task
+ */
+func storeMortonPlan(t *testing.T, storage *fakeStorage, tasks ...[][3]int) {
+	t.Helper()
+	layout := planlayout { Pid: "pid" }
+	for _, fragments := range tasks {
+		layout.Tasks = append(layout.Tasks, plannedtask {
+			Fragments: fragments,
+		})
+	}
+	doc, err := json.Marshal(layout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	storage.set(plankey("pid"), doc)
+}
+
+func TestGetInMortonOrder(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(4))
+	storeMortonPlan(t, storage,
+		[][3]int { { 1, 1, 0 } },
+		[][3]int { { 0, 0, 0 } },
+		[][3]int { { 1, 0, 0 }, { 2, 2, 2 } },
+		[][3]int { { 0, 1, 0 } },
+	)
+	storage.add("pid", "0/4", []byte("tile-0"))
+	storage.add("pid", "1/4", []byte("tile-1"))
+	storage.add("pid", "2/4", []byte("tile-2"))
+	storage.add("pid", "3/4", []byte("tile-3"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?order=morton", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	body := w.Body.Bytes()
+	dec := msgpack.NewDecoder(bytes.NewReader(body[1:]))
+	header := map[string]interface{} {}
+	if err := dec.Decode(&header); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if header["order"] != "morton" {
+		t.Errorf("header order = %v; want morton", header["order"])
+	}
+	if header["order-unit"] != "task" {
+		t.Errorf("header order-unit = %v; want task", header["order-unit"])
+	}
+
+	expected := "tile-1tile-3tile-2tile-0"
+	if !bytes.HasSuffix(body, []byte(expected)) {
+		t.Errorf("body = %q; want bundles %s", body, expected)
+	}
+}
+
+func TestMortonOrderNeedsPlan(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?order=morton", "")
+	if w.Code != http.StatusConflict {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestBadOrderIsRejected(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	for _, path := range []string {
+		"/result/pid?order=hilbert",
+		"/result/pid?order=morton&format=json",
+		"/result/pid?order=morton&partial=true",
+		"/result/pid?order=morton&decimate=2",
+	} {
+		w := requestResult(&result, path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d; want %d", path, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestMortonOrderHasOwnETag(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storeMortonPlan(t, storage, [][3]int { { 0, 0, 0 } })
+	storage.add("pid", "0/1", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	plain := requestResult(&result, "/result/pid", "").Header().Get("ETag")
+	w := requestResult(&result, "/result/pid?order=morton", "")
+	etag := w.Header().Get("ETag")
+	if etag == "" || etag == plain {
+		t.Fatalf("ETag = %q; want one other than %q", etag, plain)
+	}
+
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	for _, tc := range []struct {
+		match string
+		code  int
+	} {
+		{ etag,  http.StatusNotModified },
+		{ plain, http.StatusOK },
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/result/pid?order=morton", nil)
+		req.Header.Set("If-None-Match", tc.match)
+		app.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("If-None-Match %s: status = %d; want %d", tc.match, w.Code, tc.code)
+		}
+	}
+}
+
+func TestMortonOrderRejectsDuplicatedPart(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storeMortonPlan(t, storage,
+		[][3]int { { 0, 0, 0 } },
+		[][3]int { { 1, 0, 0 } },
+	)
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?order=morton", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+}
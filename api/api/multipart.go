@@ -0,0 +1,97 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/equinor/oneseismic/api/frame"
+)
+
+const multipartContentType = "multipart/mixed"
+
+/*
+ * The stream as multipart/mixed [1], for clients with a multipart parser at
+ * hand, which is most HTTP libraries. Every part has the result header or a
+ * single tile, as application/x-msgpack, in the same order as the stream.
+ * The tile parts have the index of the task that made them in the
+ * X-Oneseismic-Part-Index header, and unless the stream is ordered, their
+ * cursor for resuming the stream in X-Oneseismic-Cursor.
+ *
+ * The closing boundary marks the end of the stream, like the end frame. A
+ * stream that fails midway ends with a text/plain part with the error
+ * message, and with the X-Oneseismic-Error header set, before the closing
+ * boundary.
+ *
+ * The boundary is random, and made for every response.
+ *
+ * [1] https://tools.ietf.org/html/rfc2046#section-5.1.3
+ */
+type partWriter struct {
+	mw      *multipart.Writer
+	ntasks  int
+	cursors bool
+}
+
+func newPartWriter(w io.Writer, ntasks int, cursors bool) *partWriter {
+	return &partWriter {
+		mw:      multipart.NewWriter(w),
+		ntasks:  ntasks,
+		cursors: cursors,
+	}
+}
+
+func (p *partWriter) contentType() string {
+	return fmt.Sprintf("%s; boundary=%s", multipartContentType, p.mw.Boundary())
+}
+
+func (p *partWriter) part(header textproto.MIMEHeader, body []byte) error {
+	w, err := p.mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+/*
+ * Write the part for the frame of type kind, as far as there is one. Tiles
+ * must be written with tile, as their parts need more than the payload.
+ */
+func (p *partWriter) write(kind frame.Type, payload []byte) error {
+	switch kind {
+	case frame.Header:
+		header := textproto.MIMEHeader {}
+		header.Set("Content-Type", resultContentType)
+		return p.part(header, payload)
+
+	case frame.Error:
+		header := textproto.MIMEHeader {}
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+		header.Set("X-Oneseismic-Error", "true")
+		if err := p.part(header, payload); err != nil {
+			return err
+		}
+		return p.mw.Close()
+
+	case frame.End:
+		return p.mw.Close()
+	}
+	return nil
+}
+
+func (p *partWriter) tile(output partial) error {
+	index, err := taskIndex(output.part, p.ntasks)
+	if err != nil {
+		return err
+	}
+
+	header := textproto.MIMEHeader {}
+	header.Set("Content-Type", resultContentType)
+	header.Set("X-Oneseismic-Part-Index", fmt.Sprint(index))
+	if p.cursors {
+		header.Set("X-Oneseismic-Cursor", output.id)
+	}
+	return p.part(header, output.tile)
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+type mimepart struct {
+	header textproto.MIMEHeader
+	body   string
+}
+
+func readParts(t *testing.T, contentType string, body io.Reader) []mimepart {
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("Content-Type = %s; %v", contentType, err)
+	}
+	if mediatype != multipartContentType {
+		t.Fatalf("Content-Type = %s; want %s", mediatype, multipartContentType)
+	}
+
+	parts := make([]mimepart, 0)
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		parts = append(parts, mimepart { header: p.Header, body: string(b) })
+	}
+}
+
+func TestStreamMultipartRoundTrip(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeProcessHeader(2)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "1/2", []byte("tile-1"))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	ids := []string {
+		storage.streams["pid"][0].ID,
+		storage.streams["pid"][1].ID,
+	}
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream", "multipart/mixed")
+	parts := readParts(t, w.Header().Get("Content-Type"), w.Body)
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts; want 3", len(parts))
+	}
+
+	head := parts[0]
+	if head.body != string(header) {
+		t.Errorf("first part = %q; want the result header", head.body)
+	}
+	if ct := head.header.Get("Content-Type"); ct != "application/x-msgpack" {
+		t.Errorf("header part Content-Type = %s", ct)
+	}
+	if index := head.header.Get("X-Oneseismic-Part-Index"); index != "" {
+		t.Errorf("header part has index %s; want none", index)
+	}
+
+	expected := []struct {
+		body   string
+		index  string
+		cursor string
+	} {
+		{ "tile-1", "1", ids[0] },
+		{ "tile-0", "0", ids[1] },
+	}
+	for i, want := range expected {
+		part := parts[i + 1]
+		if part.body != want.body {
+			t.Errorf("part %d = %q; want %q", i + 1, part.body, want.body)
+		}
+		if ct := part.header.Get("Content-Type"); ct != "application/x-msgpack" {
+			t.Errorf("part %d Content-Type = %s", i + 1, ct)
+		}
+		if got := part.header.Get("X-Oneseismic-Part-Index"); got != want.index {
+			t.Errorf("part %d index = %s; want %s", i + 1, got, want.index)
+		}
+		if got := part.header.Get("X-Oneseismic-Cursor"); got != want.cursor {
+			t.Errorf("part %d cursor = %s; want %s", i + 1, got, want.cursor)
+		}
+	}
+}
+
+func TestStreamMultipartBoundaryIsPerResponse(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	boundary := func() string {
+		w := requestResult(&result, "/result/pid/stream", "multipart/mixed")
+		_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return params["boundary"]
+	}
+
+	first, second := boundary(), boundary()
+	if first == "" {
+		t.Fatalf("no boundary in Content-Type")
+	}
+	if first == second {
+		t.Errorf("boundary %s reused across responses", first)
+	}
+}
+
+func TestOrderedMultipartStreamHasNoCursors(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	path := "/result/pid/stream?ordered=true"
+	w := requestResult(&result, path, "multipart/mixed")
+	parts := readParts(t, w.Header().Get("Content-Type"), w.Body)
+	if len(parts) != 3 {
+		t.Fatalf("got %d parts; want 3", len(parts))
+	}
+	for i, want := range []string { "tile-0", "tile-1" } {
+		part := parts[i + 1]
+		if part.body != want {
+			t.Errorf("part %d = %q; want %q", i + 1, part.body, want)
+		}
+		if cursor := part.header.Get("X-Oneseismic-Cursor"); cursor != "" {
+			t.Errorf("part %d has cursor %s; want none", i + 1, cursor)
+		}
+	}
+}
+
+func TestMultipartStreamReportsErrors(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+
+	w := requestResult(&result, "/result/pid/stream", "multipart/mixed")
+	parts := readParts(t, w.Header().Get("Content-Type"), w.Body)
+	last := parts[len(parts) - 1]
+	if last.header.Get("X-Oneseismic-Error") == "" {
+		t.Errorf("last part = %v; want an error part", last.header)
+	}
+	if last.body == "" {
+		t.Errorf("error part has no message")
+	}
+}
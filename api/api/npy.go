@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The header of an NPY v1.0 file [1] of samples of the type descr (e.g. <f4
+ * for little-endian float32) in C (row-major) order with the shape. The
+ * header is padded with spaces so that the data starts at a multiple of 64
+ * bytes.
+ *
+ * [1] https://numpy.org/doc/stable/reference/generated/numpy.lib.format.html
+ */
+func npyHeader(descr string, shape []int) []byte {
+	dims := make([]string, len(shape))
+	for i, dim := range shape {
+		dims[i] = fmt.Sprint(dim)
+	}
+	tuple := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		tuple += ","
+	}
+
+	dict := fmt.Sprintf(
+		"{'descr': '%s', 'fortran_order': False, 'shape': (%s), }",
+		descr,
+		tuple,
+	)
+	/*
+	 * magic (6), version (2), header length (2), the dict and a newline
+	 */
+	size := 10 + len(dict) + 1
+	padding := (64 - size % 64) % 64
+	dict += strings.Repeat(" ", padding) + "\n"
+
+	var b bytes.Buffer
+	b.WriteString("\x93NUMPY")
+	b.Write([]byte { 1, 0 })
+	binary.Write(&b, binary.LittleEndian, uint16(len(dict)))
+	b.WriteString(dict)
+	return b.Bytes()
+}
+
+/*
+ * GET /result/<pid>?format=npy
+ *
+ * The result of a slice process as an NPY file, i.e. the samples of one
+ * attribute assembled into a dense, row-major array of float32, with the
+ * shape from the result header. This saves Python clients from decoding the
+ * msgpack and assembling the array themselves - np.load() is all it takes.
+ *
+ * The attribute is data, or the one given by ?attr=. Only slices are
+ * supported, see assembleSlice for the array and how requests that can't be
+ * assembled fail. The samples can be quantized with ?dtype=, see sampleType.
+ */
+func (r *Result) getNpy(ctx *gin.Context) {
+	if acceptable(ctx, "application/octet-stream") == "" {
+		return
+	}
+	dtype := requestedSampleType(ctx)
+	if dtype == nil {
+		return
+	}
+	result := r.assembleSlice(ctx, "npy")
+	if result == nil {
+		return
+	}
+
+	npy := npyHeader(dtype.npy, result.shape)
+	body := make([]byte, len(npy) + dtype.size * len(result.samples))
+	copy(body, npy)
+	scale, offset := dtype.put(body[len(npy):], result.samples)
+
+	cacheImmutable(ctx, result.etag)
+	dtype.setScale(ctx, scale, offset)
+	setDisposition(
+		ctx,
+		fmt.Sprintf("%s-%s", ctx.Param("pid"), result.attr),
+		"npy",
+	)
+	ctx.Data(http.StatusOK, "application/octet-stream", body)
+}
@@ -0,0 +1,286 @@
+package api
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * A result header like the one the planner makes, with the shapes of the
+ * attributes
+ */
+func fakeResultHeader(
+	function int,
+	ntasks   int,
+	attrs    []string,
+	shapes   ...[]int,
+) []byte {
+	flat := make([]int, 0)
+	for _, shape := range shapes {
+		flat = append(flat, len(shape))
+		flat = append(flat, shape...)
+	}
+
+	var body bytes.Buffer
+	enc := msgpack.NewEncoder(&body)
+	enc.SetSortMapKeys(true)
+	err := enc.Encode(map[string]interface{} {
+		"function":   function,
+		"nbundles":   ntasks,
+		"attributes": attrs,
+		"shapes":     flat,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{ 0x92 }, body.Bytes()...)
+}
+
+func packSliceTiles(attr string, tiles ...message.Tile) []byte {
+	bundle := message.SliceTiles { Attr: attr, Tiles: tiles }
+	packed, err := bundle.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+/*
+ * Parse the NPY file, and get the shape and the samples
+ */
+func parseNpy(t *testing.T, doc []byte) ([]int, []float32) {
+	if !bytes.HasPrefix(doc, []byte("\x93NUMPY\x01\x00")) {
+		t.Fatalf("bad npy magic: %q", doc[:8])
+	}
+	hlen := int(binary.LittleEndian.Uint16(doc[8:10]))
+	if (10 + hlen) % 64 != 0 {
+		t.Errorf("data starts at %d; want multiple of 64", 10 + hlen)
+	}
+	header := string(doc[10:10 + hlen])
+	if !strings.Contains(header, "'descr': '<f4'") {
+		t.Errorf("header = %s; want <f4", header)
+	}
+	if !strings.Contains(header, "'fortran_order': False") {
+		t.Errorf("header = %s; want C order", header)
+	}
+
+	match := regexp.MustCompile(`'shape': \(([0-9, ]*)\)`).FindStringSubmatch(header)
+	if match == nil {
+		t.Fatalf("no shape in header %s", header)
+	}
+	shape := make([]int, 0)
+	for _, dim := range strings.Split(match[1], ",") {
+		dim = strings.TrimSpace(dim)
+		if dim == "" {
+			continue
+		}
+		n, err := strconv.Atoi(dim)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		shape = append(shape, n)
+	}
+
+	data := doc[10 + hlen:]
+	samples := make([]float32, len(data) / 4)
+	for i := range samples {
+		bits := binary.LittleEndian.Uint32(data[4 * i:])
+		samples[i] = math.Float32frombits(bits)
+	}
+	return shape, samples
+}
+
+/*
+ * An inline (dim 0) slice of a 2x3x4 cube where the value of sample (i, j, k)
+ * is ijk, split into fragments of 1x2x2 like the workers would
+ */
+func TestSliceAsNpy(t *testing.T) {
+	value := func(j, k int) float32 {
+		return float32(100 + 10 * j + k)
+	}
+	fragment := func(j0, nj, k0 int) message.Tile {
+		v := make([]float32, 0)
+		for j := j0; j < j0 + nj; j++ {
+			for k := k0; k < k0 + 2; k++ {
+				v = append(v, value(j, k))
+			}
+		}
+		return message.Tile {
+			Iterations:  nj,
+			ChunkSize:   2,
+			InitialSkip: j0 * 4 + k0,
+			Superstride: 4,
+			Substride:   2,
+			V:           v,
+		}
+	}
+
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		3,
+		[]string { "data" },
+		[]int { 1, 3, 4 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "2/3", packSliceTiles("data", fragment(2, 1, 0), fragment(2, 1, 2)))
+	storage.add("pid", "0/3", packSliceTiles("data", fragment(0, 2, 0)))
+	storage.add("pid", "1/3", packSliceTiles("data", fragment(0, 2, 2)))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=npy", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type = %s", ct)
+	}
+
+	shape, samples := parseNpy(t, w.Body.Bytes())
+	if len(shape) != 3 || shape[0] != 1 || shape[1] != 3 || shape[2] != 4 {
+		t.Fatalf("shape = %v; want [1 3 4]", shape)
+	}
+	for j := 0; j < 3; j++ {
+		for k := 0; k < 4; k++ {
+			if got := samples[j * 4 + k]; got != value(j, k) {
+				t.Errorf("sample (0, %d, %d) = %v; want %v", j, k, got, value(j, k))
+			}
+		}
+	}
+}
+
+func TestSliceAttributeAsNpy(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		1,
+		[]string { "data", "cdpx" },
+		[]int { 1, 2, 2 },
+		[]int { 1, 2, 1 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packSliceTiles("cdpx", message.Tile {
+		Iterations:  1,
+		ChunkSize:   2,
+		Superstride: 2,
+		Substride:   2,
+		V:           []float32 { 7, 8 },
+	}))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=npy&attr=cdpx", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	shape, samples := parseNpy(t, w.Body.Bytes())
+	if len(shape) != 3 || shape[1] != 2 || shape[2] != 1 {
+		t.Errorf("shape = %v; want [1 2 1]", shape)
+	}
+	if len(samples) != 2 || samples[0] != 7 || samples[1] != 8 {
+		t.Errorf("samples = %v; want [7 8]", samples)
+	}
+}
+
+func TestNpyRejectsIrregularResults(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		path   string
+	} {
+		{
+			"curtain",
+			fakeResultHeader(message.FunctionCurtain, 1, []string { "data" }, []int { 2, 2 }),
+			"/result/pid?format=npy",
+		},
+		{
+			"empty dimension",
+			fakeResultHeader(message.FunctionSlice, 1, []string { "data" }, []int { 1, 0, 2 }),
+			"/result/pid?format=npy",
+		},
+		{
+			"no shape",
+			fakeProcessHeader(1),
+			"/result/pid?format=npy",
+		},
+		{
+			"unknown attribute",
+			fakeResultHeader(message.FunctionSlice, 1, []string { "data" }, []int { 1, 2 }),
+			"/result/pid?format=npy&attr=cdpy",
+		},
+	}
+
+	for _, c := range cases {
+		storage := newFakeStorage()
+		storage.set(headerkey("pid"), c.header)
+		storage.add("pid", "0/1", packSliceTiles("data"))
+		result := Result { Storage: storage }
+
+		w := requestResult(&result, c.path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d; want %d", c.name, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNpyTooLarge(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		1,
+		[]string { "data" },
+		[]int { 1, 100, 100 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packSliceTiles("data"))
+	result := Result {
+		Storage:        storage,
+		MaxResultBytes: 1024,
+	}
+
+	w := requestResult(&result, "/result/pid?format=npy", "")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestNpyFailsOnTilesOutOfBounds(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		1,
+		[]string { "data" },
+		[]int { 1, 2 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packSliceTiles("data", message.Tile {
+		Iterations:  1,
+		ChunkSize:   3,
+		V:           []float32 { 1, 2, 3 },
+	}))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=npy", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestNpyHeaderOfVector(t *testing.T) {
+	header := string(npyHeader("<f4", []int { 5 }))
+	if !strings.Contains(header, "'shape': (5,)") {
+		t.Errorf("header = %s; want 1-tuple shape", header)
+	}
+	if len(header) % 64 != 0 || !strings.HasSuffix(header, "\n") {
+		t.Errorf("header of %d bytes; want newline-terminated multiple of 64", len(header))
+	}
+}
@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gin-gonic/gin"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+ * The header of partial results, with the number of bundles included and the
+ * number of tasks in the process, i.e. <count>/<ntasks>
+ */
+const partialHeader = "X-Oneseismic-Partial"
+
+/*
+ * The header of partial results with the (comma-separated) indices of the
+ * tasks that failed, if any
+ */
+const failedHeader = "X-Oneseismic-Failed"
+
+/*
+ * A task that failed, as reported in the metadata after a partial result
+ */
+type failedTask struct {
+	/*
+	 * The index of the task, or -1 if the error doesn't say
+	 */
+	Task  int    `msgpack:"task"  json:"task"`
+	Error string `msgpack:"error" json:"error"`
+}
+
+/*
+ * The metadata that follows the partial result
+ */
+type partialMetadata struct {
+	Failed []failedTask `msgpack:"failed" json:"failed"`
+}
+
+/*
+ * The failed task from the error a worker wrote to the stream, which starts
+ * with the part (n/m) of the task, see process.fail in the fetch command
+ */
+func parseFailedTask(msg string) failedTask {
+	task := failedTask { Task: -1, Error: msg }
+	var n, m int
+	if _, err := fmt.Sscanf(msg, "%d/%d:", &n, &m); err == nil {
+		task.Task = n
+	}
+	return task
+}
+
+/*
+ * The process header with the number of bundles set to n, i.e. the header of
+ * a result with only n of the bundles. This is both the nbundles field of
+ * the header, and the length of the bundles array that follows it, if the
+ * header ends with one like the ones written by the scheduler do. See
+ * pack_with_envelope in the core library.
+ */
+func withBundles(doc []byte, n int) ([]byte, error) {
+	return rewriteHeader(doc, n, map[string]interface{} { "nbundles": n })
+}
+
+/*
+ * The process header with the fields of the result header replaced, and the
+ * bundles array (if any, see withBundles) of length nbundles.
+ */
+func rewriteHeader(
+	doc      []byte,
+	nbundles int,
+	fields   map[string]interface{},
+) ([]byte, error) {
+	if len(doc) < 1 {
+		return nil, fmt.Errorf("empty process header")
+	}
+	body := bytes.NewReader(doc[1:])
+	header := make(map[string]interface{})
+	if err := msgpack.NewDecoder(body).Decode(&header); err != nil {
+		return nil, fmt.Errorf("unable to parse result header: %w", err)
+	}
+	bundlesArray := body.Len() > 0
+	for key, value := range fields {
+		header[key] = value
+	}
+
+	var out bytes.Buffer
+	out.WriteByte(doc[0])
+	enc := msgpack.NewEncoder(&out)
+	enc.SetSortMapKeys(true)
+	if err := enc.Encode(header); err != nil {
+		return nil, err
+	}
+	if bundlesArray {
+		if err := enc.EncodeArrayLen(nbundles); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
+
+/*
+ * GET /result/<pid>?partial=true
+ *
+ * The result with whatever bundles are done right now, for interactive
+ * clients that would rather have most of a result now than all of it later.
+ * The stream is read with XRANGE, which never waits for more partial results
+ * to arrive. The header is rewritten to announce the bundles that are
+ * actually included, so the partial result decodes like any other, and the
+ * number of bundles included is in the X-Oneseismic-Partial header.
+ *
+ * Partial results are tolerant of failed tasks - rather than failing the
+ * whole request, the failed tasks are left out. The result document is
+ * followed by a msgpack map, with the failed tasks (index and error) under
+ * "failed", and the indices are also in the X-Oneseismic-Failed header.
+ *
+ * Finished processes without errors are not served here. This returns false
+ * for them, and they are served as usual, so that they are cached and
+ * verified like any other result. Like for the status, only the last
+ * errorScanCount entries are checked for errors.
+ */
+func (r *Result) getPartial(ctx *gin.Context, pid string) bool {
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return true
+	}
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+
+	count, err := r.count(ctx, pid, head)
+	if err != nil {
+		r.logger(pid).Error("unable to count completed tasks", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+	if count >= int64(head.Ntasks) {
+		msg, err := streamError(ctx, r.Storage, pid)
+		if err != nil {
+			r.logger(pid).Error("unable to look up failure", "error", err)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return true
+		}
+		if msg == "" {
+			return false
+		}
+	}
+
+	msgs, err := r.Storage.XRange(ctx, pid, "-", "+").Result()
+	if err != nil && err != redis.Nil {
+		r.logger(pid).Error("unable to read partial result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+
+	decoder := &tiledecoder {
+		zstd:   r.zstdDecoder,
+		limit:  r.maxTileBytes(),
+		verify: r.VerifyChecksums,
+	}
+	tiles := make([]partial, 0, len(msgs))
+	defer func() {
+		for _, tile := range tiles {
+			tile.release()
+		}
+	}()
+
+	meta := partialMetadata { Failed: []failedTask {} }
+	size := 0
+	for _, message := range msgs {
+		e, err := parseEntry(message.Values)
+		if err == nil && e.err != "" {
+			meta.Failed = append(meta.Failed, parseFailedTask(e.err))
+			continue
+		}
+		if err == nil {
+			e.tile, err = decoder.decode(e)
+		}
+		if err != nil {
+			if e != nil {
+				putTileBuffer(e.buf)
+			}
+			r.logger(pid).Error("unable to read partial result", "error", err)
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
+				"error": err.Error(),
+			})
+			return true
+		}
+		tiles = append(tiles, partial {
+			id:   message.ID,
+			part: e.part,
+			tile: e.tile,
+			buf:  e.buf,
+		})
+		size += len(e.tile)
+	}
+
+	header, err := withBundles(head.RawHeader, len(tiles))
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+	trailer, err := msgpack.Marshal(meta)
+	if err != nil {
+		r.logger(pid).Error("unable to pack failed tasks", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return true
+	}
+	size += len(header) + len(trailer)
+
+	/*
+	 * The result is still changing, so it can't be cached like the finished
+	 * result is
+	 */
+	cacheNever(ctx)
+	w := ctx.Writer
+	w.Header().Set("Content-Type", resultContentType)
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	w.Header().Set(partialHeader, fmt.Sprintf("%d/%d", len(tiles), head.Ntasks))
+	if len(meta.Failed) > 0 {
+		indices := make([]string, len(meta.Failed))
+		for i, task := range meta.Failed {
+			indices[i] = fmt.Sprint(task.Task)
+		}
+		w.Header().Set(failedHeader, strings.Join(indices, ","))
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(header)
+	for _, tile := range tiles {
+		w.Write(tile.tile)
+	}
+	w.Write(trailer)
+	return true
+}
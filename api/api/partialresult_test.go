@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+/*
+ * Decode the partial result into the header, the bundles, and the metadata
+ * that follows the result
+ */
+func decodePartial(
+	t    *testing.T,
+	body []byte,
+) (map[string]interface{}, []interface{}, partialMetadata) {
+	if len(body) < 1 || body[0] != 0x92 {
+		t.Fatalf("body = %q; want result in an envelope", body)
+	}
+	r := bytes.NewReader(body[1:])
+	dec := msgpack.NewDecoder(r)
+	header := make(map[string]interface{})
+	if err := dec.Decode(&header); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	n, err := dec.DecodeArrayLen()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	bundles := make([]interface{}, n)
+	for i := range bundles {
+		if bundles[i], err = dec.DecodeInterface(); err != nil {
+			t.Fatalf("bundle %d: %v", i, err)
+		}
+	}
+
+	var meta partialMetadata
+	if err := dec.Decode(&meta); err != nil {
+		t.Fatalf("metadata: %v", err)
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes after the metadata", r.Len())
+	}
+	return header, bundles, meta
+}
+
+/*
+ * A process header like the scheduler writes it, with the tag of the bundles
+ * array after it
+ */
+func schedulerHeader(ntasks int) []byte {
+	return append(fakeProcessHeader(ntasks), 0xdc, 0, byte(ntasks))
+}
+
+func TestPartialResultOfWorkingProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), schedulerHeader(3))
+	storage.add("pid", "0/3", fakeSliceBundle(0))
+	storage.add("pid", "2/3", fakeSliceBundle(2))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?partial=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "2/3", w.Header().Get(partialHeader))
+	assert.Empty(t, w.Header().Get(failedHeader))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, resultContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, fmt.Sprint(w.Body.Len()), w.Header().Get("Content-Length"))
+
+	header, bundles, meta := decodePartial(t, w.Body.Bytes())
+	assert.EqualValues(t, 2, header["nbundles"])
+	assert.Equal(t, 2, len(bundles))
+	assert.Empty(t, meta.Failed)
+
+	/*
+	 * The partial result never waits for the rest
+	 */
+	assert.Equal(t, 0, storage.called("xread"))
+
+	/*
+	 * Without ?partial, nothing changes
+	 */
+	w = requestResult(&result, "/result/pid", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestPartialResultBeforeAnyTask(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), schedulerHeader(2))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?partial=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0/2", w.Header().Get(partialHeader))
+	header, bundles, _ := decodePartial(t, w.Body.Bytes())
+	assert.EqualValues(t, 0, header["nbundles"])
+	assert.Empty(t, bundles)
+}
+
+func TestPartialResultOfFinishedProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	/*
+	 * Finished results are served as usual, whole and cacheable
+	 */
+	w := requestResult(&result, "/result/pid?partial=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(partialHeader))
+	assert.NotEmpty(t, w.Header().Get("ETag"))
+	assert.Equal(t, getResult(&result, "pid").Body.String(), w.Body.String())
+}
+
+func TestPartialResultWithFailedTasks(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), schedulerHeader(10))
+	for i := 0; i < 10; i++ {
+		part := fmt.Sprintf("%d/10", i)
+		if i == 3 || i == 7 {
+			storage.addValues("pid", map[string]interface{} {
+				errorfield: part + ": corrupted blob",
+			})
+			continue
+		}
+		storage.add("pid", part, fakeSliceBundle(float32(i)))
+	}
+	result := Result { Storage: storage }
+
+	/*
+	 * The whole result fails ...
+	 */
+	if w := getResult(&result, "pid"); w.Code != http.StatusFailedDependency {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusFailedDependency)
+	}
+
+	/*
+	 * ... but the partial result has the tasks that succeeded, and the ones
+	 * that failed listed after it
+	 */
+	w := requestResult(&result, "/result/pid?partial=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "8/10", w.Header().Get(partialHeader))
+	assert.Equal(t, "3,7", w.Header().Get(failedHeader))
+
+	header, bundles, meta := decodePartial(t, w.Body.Bytes())
+	assert.EqualValues(t, 8, header["nbundles"])
+	assert.Equal(t, 8, len(bundles))
+	assert.Equal(t, []failedTask {
+		{ Task: 3, Error: "3/10: corrupted blob" },
+		{ Task: 7, Error: "7/10: corrupted blob" },
+	}, meta.Failed)
+}
+
+func TestParseFailedTask(t *testing.T) {
+	assert.Equal(t, 4, parseFailedTask("4/9: not found").Task)
+	assert.Equal(t, -1, parseFailedTask("worker died").Task)
+}
+
+func TestPartialResultOfUnknownProcess(t *testing.T) {
+	result := Result { Storage: newFakeStorage() }
+	w := requestResult(&result, "/result/pid?partial=true", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+func plankey(pid string) string {
+	return fmt.Sprintf("%s/plan.json", pid)
+}
+
+/*
+ * The layout of a scheduled process, for debugging performance. It records
+ * which fragments the scheduler planned, and how the tasks were distributed
+ * across streams (which the workers read from).
+ *
+ * The fragment IDs are the (i, j, k) tuples from the tasks, in the order the
+ * scheduler made them. A fragment may show up in more than one task, e.g.
+ * when different attributes are read from it.
+ */
+type planlayout struct {
+	Pid       string         `json:"pid"`
+	Fragments [][3]int       `json:"fragments"`
+	Tasks     []plannedtask  `json:"tasks"`
+	Streams   map[string]int `json:"streams"`
+}
+
+type plannedtask struct {
+	Part      string   `json:"part"`
+	Stream    string   `json:"stream"`
+	Function  string   `json:"function"`
+	Attribute string   `json:"attribute,omitempty"`
+	Fragments [][3]int `json:"fragments"`
+}
+
+/*
+ * The fragment IDs of a task. Only the fields needed for the layout are
+ * parsed. The IDs are plain (i, j, k) tuples for slices, but curtain tasks
+ * carry the ID in an object along with the traces to extract, see
+ * slice_task and curtain_task in oneseismic/messages.hpp.
+ */
+type taskfragments struct {
+	Function  string            `json:"function"`
+	Attribute string            `json:"attribute"`
+	Ids       []json.RawMessage `json:"ids"`
+}
+
+func fragmentID(doc json.RawMessage) ([3]int, error) {
+	var id [3]int
+	if err := json.Unmarshal(doc, &id); err == nil {
+		return id, nil
+	}
+
+	single := struct {
+		Id [3]int `json:"id"`
+	} {}
+	if err := json.Unmarshal(doc, &single); err != nil {
+		return id, fmt.Errorf("bad fragment id %s: %w", string(doc), err)
+	}
+	return single.Id, nil
+}
+
+/*
+ * Make the layout of the plan for the process pid, as it is put on the
+ * stream.
+ */
+func makePlanLayout(
+	pid    string,
+	stream string,
+	plan   *QueryPlan,
+) (*planlayout, error) {
+	layout := &planlayout {
+		Pid:       pid,
+		Fragments: make([][3]int, 0),
+		Tasks:     make([]plannedtask, 0, len(plan.plan)),
+		Streams:   make(map[string]int),
+	}
+
+	ntasks := len(plan.plan)
+	for i, task := range plan.plan {
+		var doc taskfragments
+		if err := json.Unmarshal(task, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse task %d: %w", i, err)
+		}
+
+		fragments := make([][3]int, 0, len(doc.Ids))
+		for _, raw := range doc.Ids {
+			id, err := fragmentID(raw)
+			if err != nil {
+				return nil, fmt.Errorf("task %d: %w", i, err)
+			}
+			fragments = append(fragments, id)
+		}
+
+		layout.Fragments = append(layout.Fragments, fragments...)
+		layout.Tasks = append(layout.Tasks, plannedtask {
+			Part:      fmt.Sprintf("%d/%d", i, ntasks),
+			Stream:    stream,
+			Function:  doc.Function,
+			Attribute: doc.Attribute,
+			Fragments: fragments,
+		})
+		layout.Streams[stream]++
+	}
+	return layout, nil
+}
+
+/*
+ * Endpoints for operators, which should not be exposed to users.
+ */
+type Admin struct {
+	Storage     redis.Cmdable
+	Maintenance *Maintenance
+}
+
+/*
+ * GET /admin/jobs/:pid/plan
+ *
+ * The fragments the scheduler planned for the process, and how the tasks were
+ * distributed across streams. The plan is stored alongside the partial
+ * results, and expires with them.
+ */
+func (a *Admin) Plan(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	doc, err := a.Storage.Get(ctx, plankey(pid)).Bytes()
+	if err == redis.Nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logging.Default().Error("unable to get plan", "pid", pid, "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ctx.Data(http.StatusOK, "application/json", doc)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getPlan(admin *Admin, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/admin/jobs/:pid/plan", admin.Plan)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/admin/jobs/" + pid + "/plan", nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestPlanReflectsSchedule(t *testing.T) {
+	storage := newFakeStorage()
+	sched := cppscheduler { storage: storage, tasksize: 2 }
+	plan := &QueryPlan {
+		header: fakeProcessHeader(2),
+		plan:   [][]byte {
+			[]byte(`{"function": "slice", "attribute": "data", "ids": [[0, 0, 0], [0, 1, 0]]}`),
+			[]byte(`{"function": "curtain", "attribute": "data", "ids": [
+				{"id": [1, 0, 0], "offset": 0, "coordinates": [[0, 1]]}
+			]}`),
+		},
+	}
+	err := sched.Schedule(context.Background(), "pid", plan)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	w := getPlan(&Admin { Storage: storage }, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	var layout planlayout
+	if err := json.Unmarshal(w.Body.Bytes(), &layout); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fragments := [][3]int { {0, 0, 0}, {0, 1, 0}, {1, 0, 0} }
+	if !reflect.DeepEqual(layout.Fragments, fragments) {
+		t.Errorf("fragments = %v; want %v", layout.Fragments, fragments)
+	}
+	if len(layout.Tasks) != 2 {
+		t.Fatalf("got %d tasks; want 2", len(layout.Tasks))
+	}
+	if part := layout.Tasks[1].Part; part != "1/2" {
+		t.Errorf("part = %s; want 1/2", part)
+	}
+	if stream := layout.Tasks[0].Stream; stream != "jobs" {
+		t.Errorf("stream = %s; want jobs", stream)
+	}
+	streams := map[string]int { "jobs": 2 }
+	if !reflect.DeepEqual(layout.Streams, streams) {
+		t.Errorf("streams = %v; want %v", layout.Streams, streams)
+	}
+
+	/* the plan describes what was actually put on the stream */
+	if n := len(storage.streams["jobs"]); n != 2 {
+		t.Errorf("got %d tasks on the stream; want 2", n)
+	}
+}
+
+func TestPlanOfUnknownProcess(t *testing.T) {
+	w := getPlan(&Admin { Storage: newFakeStorage() }, "pid")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
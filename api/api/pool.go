@@ -0,0 +1,40 @@
+package api
+
+import (
+	"sync"
+)
+
+/*
+ * Partial results larger than this are not pooled, so that a single huge
+ * result doesn't pin its memory for the lifetime of the pool
+ */
+const maxPooledTile = 16 * 1024 * 1024
+
+/*
+ * The buffers partial results are read into. Results are often thousands of
+ * tiles of a megabyte or so, and copying every one into a fresh buffer keeps
+ * the GC busy for no good reason. The pool holds pointers to the slices, so
+ * that putting them back doesn't allocate.
+ */
+var tilebuffers = sync.Pool {
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+/*
+ * Get an empty buffer from the pool, to be given back with putTileBuffer once
+ * its contents are written, or left for the GC
+ */
+func getTileBuffer() *[]byte {
+	buf := tilebuffers.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func putTileBuffer(buf *[]byte) {
+	if buf == nil || cap(*buf) > maxPooledTile {
+		return
+	}
+	tilebuffers.Put(buf)
+}
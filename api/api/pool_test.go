@@ -0,0 +1,125 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTileBuffersAreEmpty(t *testing.T) {
+	buf := getTileBuffer()
+	*buf = append(*buf, "tile"...)
+	putTileBuffer(buf)
+
+	for i := 0; i < 4; i++ {
+		buf := getTileBuffer()
+		if len(*buf) != 0 {
+			t.Errorf("buffer from pool has %d bytes; want 0", len(*buf))
+		}
+		putTileBuffer(buf)
+	}
+}
+
+/*
+ * Partial results are read into pooled buffers, which are released and reused
+ * as the result is written, so every tile must still come out as it went in
+ */
+func TestStreamWithPooledBuffers(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("first-tile"))
+	storage.add("pid", "1/3", []byte("2nd"))
+	storage.add("pid", "2/3", []byte("the-third-tile"))
+	result := Result { Storage: storage }
+
+	want := "first-tile" + "2nd" + "the-third-tile"
+	for _, path := range []string { "/result/pid", "/result/pid/stream" } {
+		w := requestResult(&result, path, "")
+		if !strings.HasSuffix(w.Body.String(), want) {
+			t.Errorf("%s: body = %q; want suffix %q", path, w.Body.String(), want)
+		}
+	}
+}
+
+/*
+ * A response writer that throws the response away, so that benchmarks of
+ * large results measure the result path, and not the buffering of the
+ * response
+ */
+type discardResponse struct {
+	header http.Header
+	status int
+	n      int64
+}
+
+func (d *discardResponse) Header() http.Header {
+	return d.header
+}
+
+func (d *discardResponse) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return len(p), nil
+}
+
+func (d *discardResponse) WriteHeader(status int) {
+	d.status = status
+}
+
+func (d *discardResponse) Flush() {}
+
+/*
+ * A job of ntiles partial results of size bytes. The partial results all
+ * share the same backing string, so that the fake storage itself doesn't
+ * take gigabytes.
+ */
+func largeTilesStorage(ntiles, size int) *fakeStorage {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntiles))
+	tile := strings.Repeat("x", size)
+	for i := 0; i < ntiles; i++ {
+		id := fmt.Sprintf("%d/%d", i, ntiles)
+		storage.addValues("pid", map[string]interface{} { id: tile })
+	}
+	return storage
+}
+
+func benchmarkLargeResult(b *testing.B, path string) {
+	ntiles, size := 2000, 1024 * 1024
+	result := Result { Storage: largeTilesStorage(ntiles, size) }
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	app.GET("/result/:pid/stream", result.Stream)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(ntiles * size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &discardResponse { header: make(http.Header) }
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		app.ServeHTTP(w, req)
+		if w.status != http.StatusOK {
+			b.Fatalf("status = %d; want %d", w.status, http.StatusOK)
+		}
+		if w.n < int64(ntiles * size) {
+			b.Fatalf("wrote %d bytes; want at least %d", w.n, ntiles * size)
+		}
+	}
+}
+
+/*
+ * A 2000 tile job of 1MB tiles
+ */
+func BenchmarkGetLargeResult(b *testing.B) {
+	benchmarkLargeResult(b, "/result/pid")
+}
+
+func BenchmarkStreamLargeResult(b *testing.B) {
+	benchmarkLargeResult(b, "/result/pid/stream")
+}
+
+func BenchmarkFramedStreamLargeResult(b *testing.B) {
+	benchmarkLargeResult(b, "/result/pid/stream?framing=v1")
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/util"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * Job priorities for queries. Clients ask for the priority of their query
+ * with ?priority=low|normal|high, and the tasks are scheduled on the stream
+ * of that priority, see util.JobQueue. Anyone can ask for low priority, but
+ * high priority is reserved for privileged clients - the bearer token must
+ * be valid, and have the scope.
+ *
+ * The Authorization header is otherwise just passed on to blob storage, and
+ * not checked by oneseismic at all, so the token is only validated for high
+ * priority queries.
+ */
+type Priorities struct {
+	/*
+	 * The scope (in the scp or roles claim) required for high priority, e.g.
+	 * One.Priority. Empty means no client can ask for high priority.
+	 */
+	Scope string
+	/*
+	 * Validates the token and returns its claims, e.g. with auth.ValidateJWT.
+	 * Nil means no client can ask for high priority.
+	 */
+	Validate func(token string) (jwt.MapClaims, error)
+}
+
+/*
+ * Check that the bearer token of authorization has the scope
+ */
+func (p *Priorities) authorize(authorization string) error {
+	if p == nil || p.Scope == "" || p.Validate == nil {
+		return fmt.Errorf("high priority is disabled")
+	}
+
+	token := ""
+	_, err := fmt.Sscanf(authorization, "Bearer %s", &token)
+	if err != nil {
+		return fmt.Errorf("malformed authorization header")
+	}
+	claims, err := p.Validate(token)
+	if err != nil {
+		return err
+	}
+	if !auth.HasScope(claims, p.Scope) {
+		return fmt.Errorf("token does not have the scope %s", p.Scope)
+	}
+	return nil
+}
+
+/*
+ * Middleware for /graphql which parses and checks ?priority=, and sets it on
+ * the context for the query, see gql.execQuery. The parameter is removed from
+ * the query string, so that it's not passed on to blob storage. Queries
+ * without a priority are normal.
+ */
+func (p *Priorities) Parse(ctx *gin.Context) {
+	query := ctx.Request.URL.Query()
+	args, ok := query["priority"]
+	if !ok {
+		return
+	}
+	if len(args) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "priority must be passed once",
+		})
+		return
+	}
+	priority, err := util.ParsePriority(args[0])
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+
+	if priority == util.PriorityHigh {
+		err := p.authorize(ctx.GetHeader("Authorization"))
+		if err != nil {
+			logging.Default().Info(
+				"high priority refused",
+				"pid",   ctx.GetString("pid"),
+				"error", err,
+			)
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H {
+				"error": "not allowed to schedule high priority queries",
+			})
+			return
+		}
+	}
+
+	delete(query, "priority")
+	ctx.Request.URL.RawQuery = query.Encode()
+	ctx.Set("priority", priority)
+}
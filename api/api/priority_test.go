@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/util"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * Priorities where the token is the scope of the client, and "invalid" is an
+ * invalid token
+ */
+func fakePriorities() *Priorities {
+	return &Priorities {
+		Scope: "One.Priority",
+		Validate: func(token string) (jwt.MapClaims, error) {
+			if token == "invalid" {
+				return nil, errors.New("invalid token")
+			}
+			return jwt.MapClaims { "scp": token }, nil
+		},
+	}
+}
+
+type parsedPriority struct {
+	code     int
+	priority util.Priority
+	query    string
+}
+
+func parsePriority(p *Priorities, target string, token string) parsedPriority {
+	parsed := parsedPriority {}
+	app := gin.New()
+	app.Use(p.Parse)
+	app.GET("/graphql", func(ctx *gin.Context) {
+		if priority, ok := ctx.Get("priority"); ok {
+			parsed.priority = priority.(util.Priority)
+		}
+		parsed.query = ctx.Request.URL.RawQuery
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer " + token)
+	}
+	app.ServeHTTP(w, req)
+	parsed.code = w.Code
+	return parsed
+}
+
+func TestPriorityDefaultsToNormal(t *testing.T) {
+	got := parsePriority(fakePriorities(), "/graphql?sig=x", "")
+	if got.code != http.StatusOK || got.priority != util.PriorityNormal {
+		t.Errorf("got %+v; want normal priority", got)
+	}
+	if got.query != "sig=x" {
+		t.Errorf("query = %s; want the parameters passed on", got.query)
+	}
+}
+
+func TestLowPriorityNeedsNoScope(t *testing.T) {
+	got := parsePriority(fakePriorities(), "/graphql?priority=low&sig=x", "")
+	if got.code != http.StatusOK || got.priority != util.PriorityLow {
+		t.Errorf("got %+v; want low priority", got)
+	}
+	if got.query != "sig=x" {
+		t.Errorf("query = %s; want priority removed", got.query)
+	}
+}
+
+func TestHighPriorityNeedsScope(t *testing.T) {
+	cases := []struct {
+		token string
+		code  int
+	} {
+		{ "One.Priority", http.StatusOK },
+		{ "One.Read",     http.StatusForbidden },
+		{ "invalid",      http.StatusForbidden },
+		{ "",             http.StatusForbidden },
+	}
+	for _, c := range cases {
+		got := parsePriority(fakePriorities(), "/graphql?priority=high", c.token)
+		if got.code != c.code {
+			t.Errorf("token %q: status = %d; want %d", c.token, got.code, c.code)
+		}
+		if got.code == http.StatusOK && got.priority != util.PriorityHigh {
+			t.Errorf("token %q: priority = %v; want high", c.token, got.priority)
+		}
+	}
+}
+
+func TestHighPriorityIsDisabledByDefault(t *testing.T) {
+	for _, p := range []*Priorities { nil, &Priorities {} } {
+		got := parsePriority(p, "/graphql?priority=high", "One.Priority")
+		if got.code != http.StatusForbidden {
+			t.Errorf("status = %d; want %d", got.code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestBadPriority(t *testing.T) {
+	for _, target := range []string {
+		"/graphql?priority=urgent",
+		"/graphql?priority=low&priority=high",
+	} {
+		got := parsePriority(fakePriorities(), target, "")
+		if got.code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d; want 400", target, got.code)
+		}
+	}
+}
+
+func TestEndpointSchedulesWithPriority(t *testing.T) {
+	keyring := auth.MakeKeyring([]byte("secret"))
+	sched := newRecordingScheduler()
+	root := &resolver { MakeBasicEndpoint(&keyring, "https://storage", sched, 0, nil) }
+	c := &cube { id: "guid", root: root }
+
+	args := struct {
+		Dim   int32
+		Index int32
+		Opts  *opts
+	} { Dim: 0, Index: 1 }
+	for _, want := range []util.Priority {
+		util.PriorityLow,
+		util.PriorityNormal,
+		util.PriorityHigh,
+	} {
+		ctx := context.WithValue(sliceRequest("pid"), "priority", want)
+		if _, err := c.SliceByIndex(ctx, args); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if got := sched.next(t).plan.Priority(); got != want {
+			t.Errorf("scheduled with priority %v; want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * Liveness and readiness probes for orchestrators. They're cheap and
+ * unauthenticated, and should be routed outside the auth middleware.
+ *
+ * The instance is alive as long as it can answer at all, and ready when it
+ * is not in maintenance mode and can reach storage - without it, no query
+ * can be scheduled and no result collected. An instance that is not ready
+ * should be taken out of the load balancer, not restarted, which is why the
+ * two are separate.
+ */
+type Probes struct {
+	Storage redis.Cmdable
+	/*
+	 * Optional - when set, the instance is not ready in maintenance mode,
+	 * and the readiness probe reports the mode and the streams.
+	 */
+	Maintenance *Maintenance
+	/*
+	 * How long to wait for storage to answer before the instance is not
+	 * ready. Zero means the default, 1s.
+	 */
+	Timeout time.Duration
+}
+
+const defaultProbeTimeout = time.Second
+
+func (p *Probes) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return defaultProbeTimeout
+	}
+	return p.Timeout
+}
+
+/*
+ * GET /healthz
+ */
+func (p *Probes) Live(ctx *gin.Context) {
+	cacheNever(ctx)
+	ctx.JSON(http.StatusOK, gin.H { "status": "ok" })
+}
+
+/*
+ * GET /readyz
+ *
+ * 200 when the instance is not in maintenance mode and storage answers PING
+ * in time, and 503 with a reason otherwise. The body reports the maintenance
+ * mode, and the active and rejected streams when they're limited.
+ */
+func (p *Probes) Ready(ctx *gin.Context) {
+	cacheNever(ctx)
+	body := gin.H { "status": "ok" }
+	if p.Maintenance != nil {
+		body["maintenance"] = p.Maintenance.Enabled()
+		if streams := p.Maintenance.Streams; streams != nil {
+			body["streams"] = gin.H {
+				"active":   streams.Active(),
+				"rejected": streams.Rejected(),
+				"max":      streams.Max(),
+			}
+		}
+	}
+
+	if p.Maintenance != nil && p.Maintenance.Enabled() {
+		setRetryAfter(ctx, p.Maintenance.RetryAfter)
+		body["status"] = "maintenance"
+		ctx.JSON(http.StatusServiceUnavailable, body)
+		return
+	}
+
+	pingctx, cancel := context.WithTimeout(ctx.Request.Context(), p.timeout())
+	defer cancel()
+	if err := p.Storage.Ping(pingctx).Err(); err != nil {
+		logging.Default().Warn("storage unreachable", "error", err)
+		body["status"] = "unavailable"
+		body["error"] = "storage unreachable"
+		ctx.JSON(http.StatusServiceUnavailable, body)
+		return
+	}
+	ctx.JSON(http.StatusOK, body)
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func probeApp(probes *Probes) *gin.Engine {
+	app := gin.New()
+	app.GET("/healthz", probes.Live)
+	app.GET("/readyz", probes.Ready)
+	return app
+}
+
+func TestReadyWithReachableStorage(t *testing.T) {
+	storage := newFakeStorage()
+	app := probeApp(&Probes { Storage: storage })
+
+	w := serveRequest(app, http.MethodGet, "/readyz")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if n := storage.called("ping"); n != 1 {
+		t.Errorf("storage pinged %d times; want 1", n)
+	}
+}
+
+func TestNotReadyWithUnreachableStorage(t *testing.T) {
+	storage := newFakeStorage()
+	storage.down = errors.New("dial tcp: connection refused")
+	app := probeApp(&Probes { Storage: storage })
+
+	w := serveRequest(app, http.MethodGet, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestNotReadyWhenStorageTimesOut(t *testing.T) {
+	storage := newFakeStorage()
+	storage.latency = time.Second
+	app := probeApp(&Probes { Storage: storage, Timeout: 10 * time.Millisecond })
+
+	start := time.Now()
+	w := serveRequest(app, http.MethodGet, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if elapsed := time.Since(start); elapsed >= storage.latency {
+		t.Errorf("probe took %v; want it to give up after the timeout", elapsed)
+	}
+}
+
+func TestAliveWithUnreachableStorage(t *testing.T) {
+	storage := newFakeStorage()
+	storage.down = errors.New("dial tcp: connection refused")
+	app := probeApp(&Probes { Storage: storage })
+
+	w := serveRequest(app, http.MethodGet, "/healthz")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if n := storage.called("ping"); n != 0 {
+		t.Errorf("storage pinged %d times; want none for liveness", n)
+	}
+}
+
+func TestNotReadyInMaintenance(t *testing.T) {
+	storage := newFakeStorage()
+	maintenance := &Maintenance { RetryAfter: 90 * time.Second }
+	maintenance.Enable()
+	app := probeApp(&Probes { Storage: storage, Maintenance: maintenance })
+
+	w := serveRequest(app, http.MethodGet, "/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	if retry := w.Header().Get("Retry-After"); retry != "90" {
+		t.Errorf("Retry-After = %q; want 90", retry)
+	}
+
+	maintenance.Disable()
+	w = serveRequest(app, http.MethodGet, "/readyz")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d after maintenance", w.Code, http.StatusOK)
+	}
+}
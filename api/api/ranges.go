@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ * A byte range [first, last] of the result, inclusive at both ends like in the
+ * Range header.
+ */
+type byteRange struct {
+	first int64
+	last  int64
+}
+
+func (r *byteRange) length() int64 {
+	return r.last - r.first + 1
+}
+
+func (r *byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.first, r.last, size)
+}
+
+/*
+ * The part of the tile, which starts at offset in the result, that is in the
+ * range. This is empty for tiles outside the range.
+ */
+func (r *byteRange) clip(tile []byte, offset int64) []byte {
+	first := r.first - offset
+	last  := r.last  - offset + 1
+	if first < 0 {
+		first = 0
+	}
+	if last > int64(len(tile)) {
+		last = int64(len(tile))
+	}
+	if first >= last {
+		return nil
+	}
+	return tile[first:last]
+}
+
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+/*
+ * Parse the Range header [1] of a request for a result of size bytes.
+ *
+ * Only a single byte range is served, which is what download managers use to
+ * resume downloads. Ranges that overlap or are adjacent are coalesced, and
+ * unsatisfiable ranges (those that start past the end) are dropped, like the
+ * RFC permits. If that leaves more than one range, or the header is missing,
+ * malformed, or in another unit, the range is nil and the whole result
+ * should be sent. If no range is satisfiable, the error is errUnsatisfiable.
+ *
+ * [1] https://tools.ietf.org/html/rfc7233#section-3.1
+ */
+func parseRange(header string, size int64) (*byteRange, error) {
+	const unit = "bytes="
+	if !strings.HasPrefix(header, unit) {
+		return nil, nil
+	}
+
+	nspecs := 0
+	ranges := make([]byteRange, 0)
+	for _, spec := range strings.Split(header[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		nspecs++
+		rng, ok, valid := parseRangeSpec(spec, size)
+		if !valid {
+			return nil, nil
+		}
+		if ok {
+			ranges = append(ranges, rng)
+		}
+	}
+
+	if nspecs == 0 {
+		return nil, nil
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+	merged := ranges[0]
+	for _, rng := range ranges[1:] {
+		if rng.first > merged.last + 1 {
+			return nil, nil
+		}
+		if rng.last > merged.last {
+			merged.last = rng.last
+		}
+	}
+	return &merged, nil
+}
+
+/*
+ * Parse a single byte-range-spec, e.g. 0-9, 10- or -10 (the last 10 bytes).
+ * The range is only ok if it's satisfiable, and the spec is only valid if it
+ * is well-formed.
+ */
+func parseRangeSpec(spec string, size int64) (rng byteRange, ok, valid bool) {
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return rng, false, false
+	}
+	firstpos := strings.TrimSpace(spec[:dash])
+	lastpos  := strings.TrimSpace(spec[dash + 1:])
+
+	if firstpos == "" {
+		n, err := strconv.ParseInt(lastpos, 10, 64)
+		if err != nil || n < 0 {
+			return rng, false, false
+		}
+		if n == 0 || size == 0 {
+			return rng, false, true
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange { first: size - n, last: size - 1 }, true, true
+	}
+
+	first, err := strconv.ParseInt(firstpos, 10, 64)
+	if err != nil || first < 0 {
+		return rng, false, false
+	}
+	last := size - 1
+	if lastpos != "" {
+		last, err = strconv.ParseInt(lastpos, 10, 64)
+		if err != nil || last < first {
+			return rng, false, false
+		}
+		if last > size - 1 {
+			last = size - 1
+		}
+	}
+
+	if first >= size {
+		return rng, false, true
+	}
+	return byteRange { first: first, last: last }, true, true
+}
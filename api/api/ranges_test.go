@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header string
+		want   *byteRange
+		err    error
+	} {
+		{ "",                nil,                       nil              },
+		{ "bytes=0-9",       &byteRange { 0, 9 },       nil              },
+		{ "bytes=10-",       &byteRange { 10, 99 },     nil              },
+		{ "bytes=-10",       &byteRange { 90, 99 },     nil              },
+		{ "bytes=-1000",     &byteRange { 0, 99 },      nil              },
+		{ "bytes=50-1000",   &byteRange { 50, 99 },     nil              },
+		{ "bytes=99-99",     &byteRange { 99, 99 },     nil              },
+		{ "bytes=100-",      nil,                       errUnsatisfiable },
+		{ "bytes=-0",        nil,                       errUnsatisfiable },
+		{ "bytes=0-9,20-29", nil,                       nil              },
+		{ "bytes=0-9,5-19",  &byteRange { 0, 19 },      nil              },
+		{ "bytes=10-19,0-9", &byteRange { 0, 19 },      nil              },
+		{ "bytes=0-9,200-",  &byteRange { 0, 9 },       nil              },
+		{ "bytes=100-,200-", nil,                       errUnsatisfiable },
+		{ "bytes=0-9,x",     nil,                       nil              },
+		{ "bytes=9-0",       nil,                       nil              },
+		{ "bytes=x-9",       nil,                       nil              },
+		{ "items=0-9",       nil,                       nil              },
+		{ "bytes=",          nil,                       nil              },
+	}
+
+	for _, c := range cases {
+		got, err := parseRange(c.header, 100)
+		if err != c.err {
+			t.Errorf("parseRange(%q) err = %v; want %v", c.header, err, c.err)
+			continue
+		}
+		if (got == nil) != (c.want == nil) || (got != nil && *got != *c.want) {
+			t.Errorf("parseRange(%q) = %v; want %v", c.header, got, c.want)
+		}
+	}
+}
+
+func getRange(result *Result, header, ifRange string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+	req.Header.Set("Range", header)
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestGetRange(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("tile-0"))
+	storage.add("pid", "1/3", []byte("tile-1"))
+	storage.add("pid", "2/3", []byte("tile-2"))
+	result := Result { Storage: storage }
+
+	full := getResult(&result, "pid")
+	if ar := full.Header().Get("Accept-Ranges"); ar != "bytes" {
+		t.Errorf("Accept-Ranges = %q; want bytes", ar)
+	}
+	body := full.Body.Bytes()
+	size := len(body)
+
+	/*
+	 * Ranges that start and end mid-tile, span tiles, and that end early
+	 */
+	ranges := [][2]int {
+		{ 0, size - 1 },
+		{ 3, size - 4 },
+		{ size - 10, size - 1 },
+		{ size - 13, size - 8 },
+		{ 0, 0 },
+	}
+	for _, rng := range ranges {
+		header := fmt.Sprintf("bytes=%d-%d", rng[0], rng[1])
+		w := getRange(&result, header, "")
+		if w.Code != http.StatusPartialContent {
+			t.Errorf("%s: status = %d; want %d", header, w.Code, http.StatusPartialContent)
+			continue
+		}
+
+		want := body[rng[0]:rng[1] + 1]
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("%s: body = %q; want %q", header, w.Body.Bytes(), want)
+		}
+		contentRange := fmt.Sprintf("bytes %d-%d/%d", rng[0], rng[1], size)
+		if cr := w.Header().Get("Content-Range"); cr != contentRange {
+			t.Errorf("%s: Content-Range = %s; want %s", header, cr, contentRange)
+		}
+		if cl := w.Header().Get("Content-Length"); cl != fmt.Sprint(len(want)) {
+			t.Errorf("%s: Content-Length = %s; want %d", header, cl, len(want))
+		}
+	}
+}
+
+func TestGetUnsatisfiableRange(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+	size := getResult(&result, "pid").Body.Len()
+
+	w := getRange(&result, fmt.Sprintf("bytes=%d-", size), "")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf(
+			"status = %d; want %d",
+			w.Code,
+			http.StatusRequestedRangeNotSatisfiable,
+		)
+	}
+	if cr := w.Header().Get("Content-Range"); cr != fmt.Sprintf("bytes */%d", size) {
+		t.Errorf("Content-Range = %s; want bytes */%d", cr, size)
+	}
+
+	/*
+	 * Only when none of the ranges can be satisfied
+	 */
+	w = getRange(&result, fmt.Sprintf("bytes=%d-,%d-", size, 2 * size), "")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf(
+			"status = %d; want %d",
+			w.Code,
+			http.StatusRequestedRangeNotSatisfiable,
+		)
+	}
+	w = getRange(&result, fmt.Sprintf("bytes=%d-,0-1", size), "")
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusPartialContent)
+	}
+}
+
+func TestGetIgnoresRange(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+	full := getResult(&result, "pid")
+	etag := full.Header().Get("ETag")
+
+	cases := []struct {
+		header  string
+		ifRange string
+	} {
+		{ "bytes=0-1,3-4", ""              },
+		{ "bytes=0-1",     `"other-etag"`  },
+	}
+	for _, c := range cases {
+		w := getRange(&result, c.header, c.ifRange)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d; want %d", c.header, w.Code, http.StatusOK)
+		}
+		if !bytes.Equal(w.Body.Bytes(), full.Body.Bytes()) {
+			t.Errorf("%s: body is not the full result", c.header)
+		}
+	}
+
+	w := getRange(&result, "bytes=0-1", etag)
+	if w.Code != http.StatusPartialContent {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusPartialContent)
+	}
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The raw format is a fixed-size, 32-byte header followed by the samples as
+ * little-endian float32 (or quantized, see sampleType) in C (row-major)
+ * order:
+ *
+ *  offset  size  field
+ *       0     4  magic, "OSRW"
+ *       4     2  version (uint16), 1
+ *       6     1  ndim (uint8), the number of dimensions
+ *       7     1  dtype (uint8), the type of the samples, 1 for float32,
+ *                2 for int16 and 3 for int8
+ *       8    24  dims (uint32), the shape, padded with zeros to 6 dimensions
+ *
+ * All integers are little-endian.
+ */
+const (
+	rawMagic        = "OSRW"
+	rawVersion      = 1
+	rawHeaderSize   = 32
+	rawMaxDims      = 6
+	rawDtypeFloat32 = 1
+	rawDtypeInt16   = 2
+	rawDtypeInt8    = 3
+)
+
+func rawHeader(dtype uint8, shape []int) []byte {
+	header := make([]byte, rawHeaderSize)
+	copy(header, rawMagic)
+	binary.LittleEndian.PutUint16(header[4:], rawVersion)
+	header[6] = uint8(len(shape))
+	header[7] = dtype
+	for i, dim := range shape {
+		binary.LittleEndian.PutUint32(header[8 + 4 * i:], uint32(dim))
+	}
+	return header
+}
+
+/*
+ * GET /result/<pid>?format=raw
+ *
+ * The result of a slice process as raw float32 samples with a small, fixed
+ * header (see rawHeader), for clients like Matlab and C++ that want to read
+ * the array without a msgpack or NPY parser. The Content-Length is exact, so
+ * that clients can allocate the array up front.
+ *
+ * Like for npy, the attribute is data, or the one given by ?attr=, and only
+ * slices are supported, see assembleSlice. Arrays of more than 6 dimensions
+ * don't fit in the header, and get 400. The samples can be quantized with
+ * ?dtype=, see sampleType.
+ */
+func (r *Result) getRaw(ctx *gin.Context) {
+	if acceptable(ctx, "application/octet-stream") == "" {
+		return
+	}
+	dtype := requestedSampleType(ctx)
+	if dtype == nil {
+		return
+	}
+	result := r.assembleSlice(ctx, "raw")
+	if result == nil {
+		return
+	}
+	if len(result.shape) > rawMaxDims {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": fmt.Sprintf(
+				"raw is only available for up to %d dimensions; got %d",
+				rawMaxDims,
+				len(result.shape),
+			),
+			"reason": reasonTooManyDims,
+		})
+		return
+	}
+
+	body := make([]byte, rawHeaderSize + dtype.size * len(result.samples))
+	copy(body, rawHeader(dtype.raw, result.shape))
+	scale, offset := dtype.put(body[rawHeaderSize:], result.samples)
+
+	cacheImmutable(ctx, result.etag)
+	dtype.setScale(ctx, scale, offset)
+	ctx.Header("Content-Length", strconv.Itoa(len(body)))
+	setDisposition(
+		ctx,
+		fmt.Sprintf("%s-%s", ctx.Param("pid"), result.attr),
+		"raw",
+	)
+	ctx.Data(http.StatusOK, "application/octet-stream", body)
+}
@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * Parse the raw result, and get the shape and the samples
+ */
+func parseRaw(t *testing.T, doc []byte) ([]int, []float32) {
+	if len(doc) < rawHeaderSize {
+		t.Fatalf("got %d bytes; want at least the %d byte header", len(doc), rawHeaderSize)
+	}
+	if magic := string(doc[:4]); magic != "OSRW" {
+		t.Fatalf("magic = %q; want OSRW", magic)
+	}
+	if version := binary.LittleEndian.Uint16(doc[4:]); version != 1 {
+		t.Errorf("version = %d; want 1", version)
+	}
+	if dtype := doc[7]; dtype != 1 {
+		t.Errorf("dtype = %d; want 1 (float32)", dtype)
+	}
+
+	ndim := int(doc[6])
+	shape := make([]int, ndim)
+	for i := range shape {
+		shape[i] = int(binary.LittleEndian.Uint32(doc[8 + 4 * i:]))
+	}
+	for i := ndim; i < 6; i++ {
+		if dim := binary.LittleEndian.Uint32(doc[8 + 4 * i:]); dim != 0 {
+			t.Errorf("unused dim %d = %d; want 0", i, dim)
+		}
+	}
+
+	data := doc[rawHeaderSize:]
+	samples := make([]float32, len(data) / 4)
+	for i := range samples {
+		bits := binary.LittleEndian.Uint32(data[4 * i:])
+		samples[i] = math.Float32frombits(bits)
+	}
+	return shape, samples
+}
+
+func TestSliceAsRaw(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		2,
+		[]string { "data" },
+		[]int { 1, 2, 3 },
+	)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/2", packSliceTiles("data", message.Tile {
+		Iterations:  2,
+		ChunkSize:   2,
+		Superstride: 3,
+		Substride:   2,
+		V:           []float32 { 0, 1, 10, 11 },
+	}))
+	storage.add("pid", "1/2", packSliceTiles("data", message.Tile {
+		Iterations:  2,
+		ChunkSize:   1,
+		InitialSkip: 2,
+		Superstride: 3,
+		Substride:   1,
+		V:           []float32 { 2, 12 },
+	}))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=raw", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	want := fmt.Sprint(rawHeaderSize + 6 * 4)
+	if cl := w.Header().Get("Content-Length"); cl != want {
+		t.Errorf("Content-Length = %s; want %s", cl, want)
+	}
+
+	shape, samples := parseRaw(t, w.Body.Bytes())
+	if len(shape) != 3 || shape[0] != 1 || shape[1] != 2 || shape[2] != 3 {
+		t.Fatalf("shape = %v; want [1 2 3]", shape)
+	}
+	expected := []float32 { 0, 1, 2, 10, 11, 12 }
+	if len(samples) != len(expected) {
+		t.Fatalf("got %d samples; want %d", len(samples), len(expected))
+	}
+	for i := range expected {
+		if samples[i] != expected[i] {
+			t.Errorf("samples = %v; want %v", samples, expected)
+			break
+		}
+	}
+}
+
+func TestRawRejectsWithReason(t *testing.T) {
+	cases := []struct {
+		name   string
+		header []byte
+		path   string
+		reason string
+	} {
+		{
+			"curtain",
+			fakeResultHeader(message.FunctionCurtain, 1, []string { "data" }, []int { 2, 2 }),
+			"/result/pid?format=raw",
+			"irregular-result",
+		},
+		{
+			"empty dimension",
+			fakeResultHeader(message.FunctionSlice, 1, []string { "data" }, []int { 1, 0, 2 }),
+			"/result/pid?format=raw",
+			"bad-shape",
+		},
+		{
+			"unknown attribute",
+			fakeResultHeader(message.FunctionSlice, 1, []string { "data" }, []int { 1, 2 }),
+			"/result/pid?format=raw&attr=cdpy",
+			"unknown-attribute",
+		},
+		{
+			"too many dimensions",
+			fakeResultHeader(
+				message.FunctionSlice,
+				1,
+				[]string { "data" },
+				[]int { 1, 1, 1, 1, 1, 1, 1 },
+			),
+			"/result/pid?format=raw",
+			"too-many-dimensions",
+		},
+	}
+
+	for _, c := range cases {
+		storage := newFakeStorage()
+		storage.set(headerkey("pid"), c.header)
+		storage.add("pid", "0/1", packSliceTiles("data", message.Tile {
+			Iterations:  1,
+			ChunkSize:   1,
+			Superstride: 1,
+			Substride:   1,
+			V:           []float32 { 1 },
+		}))
+		result := Result { Storage: storage }
+
+		w := requestResult(&result, c.path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d; want %d", c.name, w.Code, http.StatusBadRequest)
+			continue
+		}
+		var body struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if body.Reason != c.reason {
+			t.Errorf("%s: reason = %q; want %q", c.name, body.Reason, c.reason)
+		}
+	}
+}
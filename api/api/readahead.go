@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+)
+
+/*
+ * The defaults for how far the collector reads ahead of the writer, see
+ * Result.ReadAhead.
+ */
+const (
+	defaultReadAhead      = 1000
+	defaultReadAheadBytes = 8 * 1024 * 1024
+)
+
+/*
+ * Pass the partial results from in on to out, and read up to n partial
+ * results and (about) budget bytes ahead of out. Without this, the collector
+ * can only read from storage when the writer has taken the last partial
+ * result, so every slow write stalls the reads, and the reads of the next
+ * batch only start when the writer is done with the last one.
+ *
+ * The budget is the size of the partial results that are read but not yet
+ * taken, and reads stop once it's reached. A single partial result larger
+ * than the budget is still read, when nothing else is buffered.
+ *
+ * The failure of the collection (from infailure) is passed on to failure
+ * after the partial results that came before it, like collectResult does,
+ * and out is closed when there is nothing more to send. Both failure
+ * channels must be buffered, see collectResult.
+ */
+func readahead(
+	ctx       context.Context,
+	n         int,
+	budget    int64,
+	in        chan partial,
+	infailure chan error,
+	out       chan partial,
+	failure   chan error,
+) {
+	defer close(out)
+
+	var queue []partial
+	var queued int64
+	var failed error
+	defer func() {
+		for _, p := range queue {
+			p.release()
+		}
+	}()
+
+	/*
+	 * When ctx is done, nothing more is sent, but the collector may still
+	 * report why it stopped, which is passed on
+	 */
+	done := ctx.Done()
+	for {
+		over := in == nil || failed != nil
+		if over && (len(queue) == 0 || ctx.Err() != nil) {
+			break
+		}
+
+		/*
+		 * When ctx is done, the partial results are read and dropped, so
+		 * that the collector is never stuck on a send
+		 */
+		stopped := ctx.Err() != nil
+		room := len(queue) < n && (len(queue) == 0 || queued < budget)
+		var recv chan partial
+		if !over && (room || stopped) {
+			recv = in
+		}
+		var send chan partial
+		var next partial
+		if len(queue) > 0 && !stopped {
+			send = out
+			next = queue[0]
+		}
+
+		select {
+		case p, ok := <-recv:
+			if !ok {
+				in = nil
+				if failed == nil {
+					failed = reportedFailure(infailure)
+					infailure = nil
+				}
+				continue
+			}
+			if stopped {
+				p.release()
+				continue
+			}
+			queue = append(queue, p)
+			queued += int64(len(p.tile))
+
+		case err := <-infailure:
+			failed = err
+			infailure = nil
+
+		case send <- next:
+			queue[0] = partial {}
+			queue = queue[1:]
+			queued -= int64(len(next.tile))
+
+		case <-done:
+			done = nil
+		}
+	}
+
+	if failed == nil {
+		return
+	}
+	select {
+	case failure <- failed:
+	default:
+	}
+}
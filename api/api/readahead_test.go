@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * Start readahead, and return its input, failure and output
+ */
+func startReadahead(
+	ctx    context.Context,
+	n      int,
+	budget int64,
+) (chan partial, chan error, chan partial, chan error) {
+	in := make(chan partial)
+	infailure := make(chan error, 1)
+	out := make(chan partial)
+	failure := make(chan error, 1)
+	go readahead(ctx, n, budget, in, infailure, out, failure)
+	return in, infailure, out, failure
+}
+
+/*
+ * Send tiles to in until it blocks, and return the number sent
+ */
+func fill(in chan partial, tile []byte) int {
+	sent := 0
+	for {
+		select {
+		case in <- partial { id: fmt.Sprint(sent), tile: tile }:
+			sent++
+		case <-time.After(50 * time.Millisecond):
+			return sent
+		}
+	}
+}
+
+func TestReadaheadPassesPartialsInOrder(t *testing.T) {
+	in, _, out, _ := startReadahead(context.Background(), 4, 1024)
+	go func() {
+		defer close(in)
+		for i := 0; i < 10; i++ {
+			in <- partial { id: fmt.Sprint(i), tile: []byte("tile") }
+		}
+	}()
+
+	i := 0
+	for p := range out {
+		if p.id != fmt.Sprint(i) {
+			t.Errorf("partial %d has id %s", i, p.id)
+		}
+		i++
+	}
+	if i != 10 {
+		t.Errorf("got %d partials; want 10", i)
+	}
+}
+
+func TestReadaheadIsBoundedByCount(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in, _, _, _ := startReadahead(ctx, 4, 1024)
+
+	if n := fill(in, []byte("x")); n != 4 {
+		t.Errorf("read %d ahead; want 4", n)
+	}
+}
+
+func TestReadaheadIsBoundedByBytes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in, _, out, _ := startReadahead(ctx, 100, 25)
+
+	/*
+	 * Reads stop once 25 bytes are buffered, i.e. after the third tile
+	 */
+	tile := make([]byte, 10)
+	if n := fill(in, tile); n != 3 {
+		t.Errorf("read %d ahead; want 3", n)
+	}
+	<-out
+	if n := fill(in, tile); n != 1 {
+		t.Errorf("read %d more after 1 was taken; want 1", n)
+	}
+}
+
+func TestReadaheadTakesTilesLargerThanBudget(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	in, _, out, _ := startReadahead(ctx, 100, 25)
+
+	if n := fill(in, make([]byte, 100)); n != 1 {
+		t.Errorf("read %d ahead; want 1", n)
+	}
+	if p := <-out; len(p.tile) != 100 {
+		t.Errorf("tile is %d bytes; want 100", len(p.tile))
+	}
+}
+
+func TestReadaheadFailsAfterPartials(t *testing.T) {
+	in, infailure, out, failure := startReadahead(context.Background(), 4, 1024)
+	go func() {
+		defer close(in)
+		in <- partial { id: "0", tile: []byte("tile") }
+		in <- partial { id: "1", tile: []byte("tile") }
+		infailure <- errors.New("process failed")
+	}()
+
+	/*
+	 * Give the failure plenty of time to overtake the partials
+	 */
+	time.Sleep(20 * time.Millisecond)
+	got := 0
+	for range out {
+		got++
+	}
+	if got != 2 {
+		t.Errorf("failed after %d partials; want 2", got)
+	}
+	err := reportedFailure(failure)
+	if err == nil || err.Error() != "process failed" {
+		t.Errorf("failure = %v; want process failed", err)
+	}
+}
+
+func TestReadaheadDrainsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	in, _, out, _ := startReadahead(ctx, 2, 1024)
+	fill(in, []byte("x"))
+	cancel()
+
+	/*
+	 * The collector must never be stuck on a send, and the output is
+	 * closed once the collector is done
+	 */
+	sent := make(chan struct{})
+	go func() {
+		in <- partial { tile: []byte("x") }
+		close(in)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("collector stuck after cancel")
+	}
+	for range out {
+	}
+}
+
+/*
+ * Storage where every read takes a while, like a round trip to a redis
+ * somewhere else
+ */
+type latentStorage struct {
+	*fakeStorage
+	latency time.Duration
+}
+
+func (s *latentStorage) XRead(
+	ctx  context.Context,
+	args *redis.XReadArgs,
+) *redis.XStreamSliceCmd {
+	time.Sleep(s.latency)
+	return s.fakeStorage.XRead(ctx, args)
+}
+
+/*
+ * Collect a result from storage with a 20ms round trip, for a writer that
+ * spends 1ms on every tile. Without reading ahead, the reads and writes take
+ * turns, and with it, the reads of the next batch overlap the writes.
+ */
+func benchmarkSlowWriter(b *testing.B, readahead int) {
+	ntiles := 64
+	storage := &latentStorage {
+		fakeStorage: manyTilesStorage(ntiles),
+		latency:     20 * time.Millisecond,
+	}
+	result := Result { Storage: storage, ReadAhead: readahead }
+	body, _ := storage.Get(context.Background(), headerkey("pid")).Bytes()
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		b.Fatalf("%v", err)
+	}
+
+	b.ResetTimer()
+	began := time.Now()
+	for i := 0; i < b.N; i++ {
+		tiles := make(chan partial)
+		failure := make(chan error, 1)
+		go result.collect(
+			context.Background(),
+			"stream",
+			"pid",
+			head,
+			start,
+			false,
+			tiles,
+			failure,
+		)
+		for range tiles {
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case err := <-failure:
+			b.Fatalf("%v", err)
+		default:
+		}
+	}
+	elapsed := time.Since(began)
+	b.ReportMetric(float64(ntiles * b.N) / elapsed.Seconds(), "tiles/s")
+}
+
+func BenchmarkSlowWriterNoReadahead(b *testing.B) {
+	benchmarkSlowWriter(b, -1)
+}
+
+func BenchmarkSlowWriterReadahead(b *testing.B) {
+	benchmarkSlowWriter(b, 0)
+}
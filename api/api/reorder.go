@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"fmt"
+)
+
+/*
+ * The default for the max size of the tiles held back to send them in task
+ * order, see Result.MaxReorderBytes.
+ */
+const defaultMaxReorderBytes = 256 * 1024 * 1024
+
+/*
+ * The task index n of the part n/m of a partial result
+ */
+func taskIndex(part string, ntasks int) (int, error) {
+	var index, n int
+	if _, err := fmt.Sscanf(part, "%d/%d", &index, &n); err != nil {
+		return 0, fmt.Errorf("bad part %q", part)
+	}
+	if index < 0 || index >= ntasks {
+		return 0, fmt.Errorf("part %s out of range; ntasks = %d", part, ntasks)
+	}
+	return index, nil
+}
+
+/*
+ * Pass the partial results from in on to out in ascending task order. The
+ * workers write partial results as they finish, so every partial result that
+ * arrives before its turn is held back until the ones before it have been
+ * sent. The result header (the partial without a part) is passed on right
+ * away.
+ *
+ * How much is held back depends on how far apart the tasks finish, so it is
+ * bounded by limit bytes, and the reordering fails when it would need more.
+ * It also fails on duplicated tasks, and on missing tasks when in is closed.
+ * Like collectResult, out is closed when there is nothing more to send, and
+ * failure must be buffered.
+ */
+func reorder(
+	ctx     context.Context,
+	ntasks  int,
+	limit   int64,
+	in      chan partial,
+	out     chan partial,
+	failure chan error,
+) {
+	defer close(out)
+
+	send := func(p partial) bool {
+		select {
+		case out <- p:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	fail := func(err error) {
+		select {
+		case failure <- err:
+		default:
+		}
+	}
+
+	pending := make(map[int]partial)
+	held := int64(0)
+	next := 0
+	for p := range in {
+		if p.part == "" {
+			if !send(p) {
+				return
+			}
+			continue
+		}
+
+		index, err := taskIndex(p.part, ntasks)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if _, ok := pending[index]; ok || index < next {
+			fail(fmt.Errorf("duplicated part %s", p.part))
+			return
+		}
+
+		pending[index] = p
+		held += int64(len(p.tile))
+		for {
+			p, ok := pending[next]
+			if !ok {
+				break
+			}
+			if !send(p) {
+				return
+			}
+			delete(pending, next)
+			held -= int64(len(p.tile))
+			next++
+		}
+
+		if held > limit {
+			fail(fmt.Errorf(
+				"%d bytes held back waiting for part %d/%d; max is %d",
+				held,
+				next,
+				ntasks,
+				limit,
+			))
+			return
+		}
+	}
+
+	/*
+	 * The collection is over, but it might have stopped early, in which case
+	 * the reason is already reported.
+	 */
+	if ctx.Err() == nil && next < ntasks {
+		fail(fmt.Errorf("missing part %d/%d", next, ntasks))
+	}
+}
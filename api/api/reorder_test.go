@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/equinor/oneseismic/api/frame"
+)
+
+/*
+ * Run the partial results with parts through reorder, and return the parts in
+ * the order they came out, and the failure, if any
+ */
+func runReorder(parts []string, limit int64) ([]string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan partial)
+	out := make(chan partial)
+	failure := make(chan error, 1)
+	go func() {
+		defer close(in)
+		for _, part := range parts {
+			select {
+			case in <- partial { id: part, part: part, tile: []byte(part) }:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go reorder(ctx, len(parts), limit, in, out, failure)
+
+	got := make([]string, 0)
+	for {
+		select {
+		case p, ok := <-out:
+			if !ok {
+				return got, reportedFailure(failure)
+			}
+			got = append(got, p.part)
+		case err := <-failure:
+			return got, err
+		}
+	}
+}
+
+func TestReorder(t *testing.T) {
+	got, err := runReorder([]string { "2/4", "0/4", "3/4", "1/4" }, 1024)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := []string { "0/4", "1/4", "2/4", "3/4" }
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parts = %v; want %v", got, want)
+	}
+}
+
+func TestReorderFailures(t *testing.T) {
+	cases := []struct {
+		parts []string
+		limit int64
+		err   string
+	} {
+		{ []string { "0/2", "0/2" }, 1024, "duplicated" },
+		{ []string { "1/2", "1/2" }, 1024, "duplicated" },
+		{ []string { "1/3", "2/3", "2/3" }, 1024, "duplicated" },
+		{ []string { "0/2", "2/2" }, 1024, "out of range" },
+		{ []string { "0/2", "x" }, 1024, "bad part" },
+		{ []string { "2/3", "1/3", "0/3" }, 4, "held back" },
+	}
+	for _, c := range cases {
+		_, err := runReorder(c.parts, c.limit)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%v: err = %v; want %s", c.parts, err, c.err)
+		}
+	}
+}
+
+func TestReorderMissingPart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := make(chan partial, 1)
+	out := make(chan partial)
+	failure := make(chan error, 1)
+	in <- partial { id: "1/2", part: "1/2" }
+	close(in)
+	go reorder(ctx, 2, 1024, in, out, failure)
+
+	err := <-failure
+	if err == nil || !strings.Contains(err.Error(), "missing part 0/2") {
+		t.Errorf("err = %v; want missing part 0/2", err)
+	}
+}
+
+func TestOrderedStream(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "2/3", []byte("tile-2"))
+	storage.add("pid", "0/3", []byte("tile-0"))
+	storage.add("pid", "1/3", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	path := "/result/pid/stream?framing=v1&ordered=true"
+	frames := decodeFrames(t, requestResult(&result, path, "").Body.Bytes())
+	tiles := make([]string, 0)
+	for _, f := range frames {
+		if f.Type == frame.Cursor {
+			t.Errorf("cursor frame in ordered stream")
+		}
+		if f.Type == frame.Tile {
+			tiles = append(tiles, string(f.Payload))
+		}
+	}
+	want := []string { "tile-0", "tile-1", "tile-2" }
+	if fmt.Sprint(tiles) != fmt.Sprint(want) {
+		t.Errorf("tiles = %v; want %v", tiles, want)
+	}
+	if end := frames[len(frames) - 1]; end.Type != frame.End {
+		t.Errorf("last frame = %v; want %v", end.Type, frame.End)
+	}
+}
+
+func TestOrderedStreamReportsDuplicates(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	path := "/result/pid/stream?framing=v1&ordered=true"
+	frames := decodeFrames(t, requestResult(&result, path, "").Body.Bytes())
+	if last := frames[len(frames) - 1]; last.Type != frame.Error {
+		t.Errorf("last frame = %v; want %v", last.Type, frame.Error)
+	}
+}
+
+func TestOrderedStreamCannotBeResumed(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	path := "/result/pid/stream?ordered=true&from=0-1"
+	if w := requestResult(&result, path, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
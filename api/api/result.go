@@ -4,238 +4,2515 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/equinor/oneseismic/api/frame"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/go-redis/redis/v8"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Result struct {
+	/*
+	 * The maximum time to spend collecting a result, or looking up the
+	 * status. Zero means no limit.
+	 */
 	Timeout    time.Duration
+	/*
+	 * The maximum time to wait for the first partial result of a
+	 * collection, so that requests for processes that never start give up
+	 * before Timeout, see withCollectTimeout. Zero means no limit other than
+	 * Timeout.
+	 */
+	FirstResultTimeout time.Duration
 	StorageURL string
 	Storage    redis.Cmdable
 	Keyring    *auth.Keyring
+	/*
+	 * Optional - when set, completion events from the watcher are used to
+	 * avoid going to storage for the progress of processes that are known to
+	 * be done.
+	 */
+	Completions *CompletionWatcher
+	/*
+	 * With Completions, Get waits up to this long for a running process to
+	 * complete before answering 202, so that clients of quick queries get
+	 * the result without coming back for it. Zero means no waiting.
+	 */
+	CompletionWait time.Duration
+	/*
+	 * Concurrent requests for the status of the same process always share a
+	 * single lookup. The window optionally extends the sharing to requests
+	 * that arrive shortly after the lookup started. Keep it short - the status
+	 * is effectively cached for this long.
+	 */
+	StatusWindow time.Duration
+	/*
+	 * The maximum size (in bytes) of results. Get and Head refuse larger
+	 * results with 413, and stop reading them as soon as they're known to be
+	 * too large. Stream is exempt, as it never holds more than a bundle. Zero
+	 * means no limit, except for results assembled in memory, e.g. converted
+	 * to JSON, which are limited to 64MB by default.
+	 */
+	MaxResultBytes int64
+	/*
+	 * Results up to this size are cached whole after the first Get, so that
+	 * the next Get, HEAD or range request is served from the cache rather
+	 * than reading the stream again. Zero means the default, 16MB, and
+	 * negative disables the cache.
+	 */
+	MaxCachedBytes int64
+	/*
+	 * Verify that the number of bundles in the assembled result matches the
+	 * number announced in the header.
+	 */
+	VerifyBundles bool
+	/*
+	 * Verify the checksums the workers write with the partial results, and
+	 * fail the request on the first mismatch. This costs a pass over every
+	 * partial result, so it's opt-in.
+	 */
+	VerifyChecksums bool
+	/*
+	 * A process that has made no progress for this long since its last
+	 * partial result is considered failed, e.g. because its workers died.
+	 * Processes without partial results never stall, as they may just be
+	 * waiting in the queue. Zero means processes never stall.
+	 */
+	MaxStall time.Duration
+	/*
+	 * Optionally throttle Stream - the first StreamBurst tiles are sent at
+	 * full speed, then the rest at StreamRate tiles per second. Zero rate
+	 * means no throttling. Throttling makes streams take longer, so Timeout
+	 * must allow for it.
+	 */
+	StreamBurst int
+	StreamRate  float64
+	/*
+	 * Stream flushes the tiles once StreamFlushBytes have been written, or
+	 * StreamFlushDelay after the first unflushed one, rather than every tile,
+	 * see coalescer. Clients can ask for every tile to be flushed right away
+	 * with ?noDelay=true. Zero means the defaults, 256KB and 10ms.
+	 */
+	StreamFlushBytes int
+	StreamFlushDelay time.Duration
+	/*
+	 * Streams that have sent nothing for this long send a keepalive, so that
+	 * proxies don't close them as idle - a keepalive frame in framed streams,
+	 * and a comment in StreamSSE. Bare msgpack and multipart streams have no
+	 * room for keepalives. Zero means the default, 15s, and negative means
+	 * no keepalives.
+	 */
+	KeepAlive time.Duration
+	/*
+	 * Streams are aborted when a write blocks for this long, so that clients
+	 * that stop reading don't hold on to the stream (and its share of
+	 * MaxStreams) forever. This needs the server's connections in the
+	 * request context, see ConnContext. Zero means the default, 30s, and
+	 * negative means writes never time out.
+	 */
+	StreamWriteTimeout time.Duration
+	/*
+	 * Optional - where to log. Nil means the default logger, which writes
+	 * to stderr.
+	 */
+	Logger *logging.Logger
+	/*
+	 * Link the spans of result collections to the span of the query that
+	 * made the process, see tracing.go. This costs a lookup in storage per
+	 * collection, so it's opt-in.
+	 */
+	TraceLinks bool
+	/*
+	 * Optional - when set, large results are uploaded to blob storage, and
+	 * Get redirects to them, see Uploads.
+	 */
+	Uploads *Uploads
+	/*
+	 * Optional - when set, the time to assemble results and the number of
+	 * tiles and errors are recorded, see NewMetrics.
+	 */
+	Metrics *Metrics
+	/*
+	 * How long the result and what's derived from it (statistics, errors)
+	 * are kept in storage. This should be the same as the one the result
+	 * was written with, see DefaultResultTTL. Zero means the default.
+	 */
+	ResultTTL time.Duration
+	/*
+	 * The Content-Type of Stream responses, for deployments with proxies
+	 * that need something else than the default
+	 * application/x-oneseismic-stream. Empty means the default.
+	 */
+	StreamContentType string
+	/*
+	 * How long a single read from storage blocks waiting for partial results
+	 * to arrive. This is not a timeout for the whole collection (see
+	 * Timeout), but bounds how long it takes to notice that the collection
+	 * should stop, e.g. because of the timeout or because the client went
+	 * away. Zero means the default, 1s.
+	 */
+	ReadBlock time.Duration
+	/*
+	 * How many times a read of partial results that fails with a transient
+	 * error, e.g. a dropped connection to storage, is retried before the
+	 * request fails. The waits between retries grow exponentially, from
+	 * 50ms to 2s. Zero means the default, 5, and negative means no retries.
+	 */
+	MaxRetries int
+	/*
+	 * The max size of a partial result after decompression. Partial results
+	 * that decompress to more fail the request. Zero means the default,
+	 * 64MB.
+	 */
+	MaxTileBytes int64
+	/*
+	 * The max size of the tiles Stream holds back to send them in task
+	 * order, when asked to. Streams that need more fail. Zero means the
+	 * default, 256MB.
+	 */
+	MaxReorderBytes int64
+	/*
+	 * Report the time spent in the phases of Get in the Server-Timing
+	 * header. This tells clients a bit about the inner workings of the
+	 * server, so it's opt-in.
+	 */
+	ServerTiming bool
+	/*
+	 * The Retry-After of 202 responses when there's no progress to estimate
+	 * it from, e.g. before the process is scheduled or before the first task
+	 * is done. Zero means the default, 2s. See pollInterval.
+	 */
+	RetryAfter time.Duration
+	/*
+	 * Optional - limit the number of concurrent Get and Stream, which are
+	 * rejected with 429 when saturated. Nil means no limit.
+	 */
+	Streams *StreamLimiter
+	/*
+	 * The collector reads partial results from storage ahead of the
+	 * consumer, e.g. the writer of a stream, up to ReadAhead partial results
+	 * and ReadAheadBytes bytes, so that a slow client does not stall the
+	 * reads, see readahead. Zero means the defaults, 1000 and 8MB, and a
+	 * negative ReadAhead disables reading ahead.
+	 */
+	ReadAhead      int
+	ReadAheadBytes int64
+
+	statusflight flightgroup
+	hubs         fanout
+
+	zstdonce sync.Once
+	zstd     *zstd.Decoder
+}
+
+/*
+ * The content types of results. The stream and the assembled result carry
+ * the same msgpack document, but the stream is delivered piecemeal, and
+ * clients should decode it incrementally.
+ */
+const (
+	streamContentType = "application/x-oneseismic-stream"
+	resultContentType = "application/x-msgpack"
+	/*
+	 * The stream in frames, see the frame package
+	 */
+	framedContentType = "application/x-oneseismic-frames"
+)
+
+/*
+ * Negotiate the content type from the offered types, in order of preference,
+ * and respond with 406 Not Acceptable if the client accepts none of them.
+ * Clients that send no Accept header (or a wildcard) accept anything, and get
+ * the first offered type, which covers the clients written before the content
+ * types were meaningful.
+ */
+func acceptable(ctx *gin.Context, offered ...string) string {
+	if contentType := ctx.NegotiateFormat(offered...); contentType != "" {
+		return contentType
+	}
+
+	ctx.AbortWithStatusJSON(http.StatusNotAcceptable, gin.H {
+		"error":     fmt.Sprintf("not acceptable: %s", ctx.GetHeader("Accept")),
+		"available": offered,
+	})
+	return ""
+}
+
+/*
+ * Silly helper to centralise the name/key of the header object. It's not
+ * likely to change too much, but it beats hardcoding the key with formatting
+ * all over the place.
+ */
+func headerkey(pid string) string {
+	return fmt.Sprintf("%s/header.json", pid)
+}
+
+/*
+ * The time the process was scheduled, as milliseconds since epoch (like the
+ * redis stream IDs).
+ */
+func createdkey(pid string) string {
+	return fmt.Sprintf("%s/created", pid)
+}
+
+/*
+ * The error that failed the process. If this key exists, the process is
+ * failed. Workers set it when a task fails, and the API when it finds the
+ * failure some other way, see failed.
+ */
+func errorkey(pid string) string {
+	return fmt.Sprintf("%s/error", pid)
+}
+
+/*
+ * Set when the client cancels the process, see Cancel. Workers poll it, and
+ * stop working on the tasks of cancelled processes.
+ */
+func cancelledkey(pid string) string {
+	return fmt.Sprintf("%s/cancelled", pid)
+}
+
+/*
+ * Workers that fail a task write an entry with this field to the stream
+ * instead of the partial result, with the error message as the value.
+ */
+const errorfield = "error"
+
+/*
+ * The failure of a process, i.e. of one of its tasks, as written to the
+ * stream by the worker
+ */
+type processError struct {
+	task failedTask
+}
+
+func (e *processError) Error() string {
+	return fmt.Sprintf("process failed: %s", e.task.Error)
+}
+
+/*
+ * The number of entries, from the end of the stream, that are scanned for
+ * errors when looking up the status. Errors are usually among the last
+ * entries, as the process stops making progress when a task fails, and
+ * bounding the scan keeps status lookups cheap for large processes.
+ */
+const errorScanCount = 64
+
+/*
+ * The (assembled) result of a finished process never changes, so it can be
+ * cached for as long as anyone wants by any cache, e.g. a CDN in front of the
+ * API. The result is stored in redis only for a short while, but a cached copy
+ * outlives it just fine.
+ *
+ * The tokens are tied to the pid, so varying on Authorization keeps shared
+ * caches from handing the result to clients without a valid token. Results
+ * that are still being computed must not be cached at all.
+ */
+const immutableMaxAge = 365 * 24 * time.Hour
+
+func cacheImmutable(ctx *gin.Context, etag string) {
+	ctx.Header(
+		"Cache-Control",
+		fmt.Sprintf(
+			"public, max-age=%d, immutable",
+			int64(immutableMaxAge / time.Second),
+		),
+	)
+	ctx.Writer.Header().Add("Vary", "Authorization")
+	ctx.Header("ETag", etag)
+}
+
+func cacheNever(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-store")
+}
+
+/*
+ * The pid uniquely identifies a process, and a process always produces the
+ * same result, so (pid, ntasks) makes for a strong ETag without having to look
+ * at the result itself.
+ */
+func resultETag(pid string, head *message.ProcessHeader) string {
+	return fmt.Sprintf(`"%s-%d"`, pid, head.Ntasks)
+}
+
+/*
+ * Check if the etag is in the If-None-Match header [1], which is either * or a
+ * list of (possibly weak) etags. Like the RFC says, the comparison is weak,
+ * i.e. W/"x" matches "x".
+ *
+ * [1] https://tools.ietf.org/html/rfc7232#section-3.2
+ */
+func matchesETag(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+func parseProcessHeader(doc []byte) (*message.ProcessHeader, error) {
+	ph, err := (&message.ProcessHeader{}).Unpack(doc)
+	if err != nil {
+		logging.Default().Warn("bad process header", "header", doc)
+		return ph, fmt.Errorf("unable to parse process header: %w", err)
+	}
+
+	/*
+	 * Queries that select nothing have no tasks, see ProcessHeader.IsEmpty
+	 */
+	if ph.Ntasks < 0 {
+		logging.Default().Warn("bad process header", "header", doc)
+		return ph, fmt.Errorf("processheader.parts = %d; want >= 0", ph.Ntasks)
+	}
+	return ph, nil
+}
+
+/*
+ * The default for how long a single XREAD blocks waiting for partial results,
+ * see Result.ReadBlock.
+ */
+const xreadBlock = time.Second
+
+/*
+ * The max number of partial results read from redis at a time. Without a
+ * limit, XREAD happily returns the whole stream in one reply, which is then
+ * held in memory while it is written to a client that might be slow. With a
+ * limit, the collector only reads more when the previous batch has been
+ * handed off, and since writes to clients block (under HTTP/2 too, once the
+ * peer's flow control window is exhausted), a slow client slows down the
+ * collector rather than making the server buffer the result.
+ */
+const xreadCount = 16
+
+/*
+ * The response for requests that ran out of time, with the progress of the
+ * process if it is known.
+ */
+func timedout(progress string) gin.H {
+	body := gin.H {
+		"error": "timed out",
+	}
+	if progress != "" {
+		body["progress"] = progress
+	}
+	return body
+}
+
+/*
+ * A collected partial result, the ID of its entry in the stream, and its part
+ * (n/m), i.e. the task that made it. The result header is not in the stream,
+ * and has neither.
+ */
+type partial struct {
+	id   string
+	part string
+	tile []byte
+	/*
+	 * The pooled buffer that backs tile, if any. Consumers that are done
+	 * with the tile once it's written should release() it, the rest can
+	 * leave it for the GC.
+	 */
+	buf *[]byte
+}
+
+/*
+ * Give the buffer of the tile back to the pool. The tile must not be used
+ * after this.
+ */
+func (p partial) release() {
+	putTileBuffer(p.buf)
+}
+
+/*
+ * A position in the stream - the ID of the last entry collected, and the
+ * number of entries up to and including it. Collecting from the start
+ * position also collects the result header.
+ */
+type position struct {
+	cursor string
+	count  int
+}
+
+var start = position { cursor: "0" }
+
+/*
+ * The position of the entry with the ID cursor, for resuming after it. The
+ * entries up to the cursor are counted by reading them, in batches, since
+ * redis has no way of counting the entries in a range. The cursor must be in
+ * the stream.
+ */
+func findPosition(
+	ctx     context.Context,
+	storage redis.Cmdable,
+	pid     string,
+	cursor  string,
+) (position, error) {
+	if cursor == start.cursor {
+		return start, nil
+	}
+	var ms, seq uint64
+	if _, err := fmt.Sscanf(cursor, "%d-%d", &ms, &seq); err != nil {
+		return start, fmt.Errorf("bad cursor %q", cursor)
+	}
+
+	at := start.cursor
+	count := 0
+	for {
+		xreadArgs := redis.XReadArgs{
+			Streams: []string{pid, at},
+			Count:   xreadCount,
+			Block:   -1,
+		}
+		reply, err := storage.XRead(ctx, &xreadArgs).Result()
+		if err == redis.Nil {
+			return start, fmt.Errorf("cursor %s not in stream", cursor)
+		}
+		if err != nil {
+			return start, err
+		}
+		messages, err := streamMessages(reply, pid)
+		if err != nil {
+			return start, err
+		}
+
+		for _, message := range messages {
+			count++
+			if message.ID == cursor {
+				return position { cursor: cursor, count: count }, nil
+			}
+			at = message.ID
+		}
+	}
+}
+
+/*
+ * The messages of the reply to an XREAD of the stream pid, and only that
+ * stream. Redis replies with exactly that one stream (or nil, see
+ * redis.Nil), but a reply of any other shape is an error rather than a
+ * panic.
+ */
+func streamMessages(reply []redis.XStream, pid string) ([]redis.XMessage, error) {
+	if len(reply) != 1 {
+		return nil, fmt.Errorf(
+			"xread %s: reply has %d streams; want 1",
+			pid,
+			len(reply),
+		)
+	}
+	if reply[0].Stream != pid {
+		return nil, fmt.Errorf(
+			"xread %s: reply is of stream %s",
+			pid,
+			reply[0].Stream,
+		)
+	}
+	return reply[0].Messages, nil
+}
+
+func collectResult(
+	ctx context.Context,
+	storage redis.Cmdable,
+	pid string,
+	head *message.ProcessHeader,
+	from position,
+	block time.Duration,
+	retry backoff,
+	decoder *tiledecoder,
+	observer *collection,
+	tiles chan partial,
+	failure chan error,
+) {
+	// This close is quite important - when the tiles channel is closed, it is
+	// a signal to the caller that there is nothing more to come. The
+	// transfer is completed unless a failure was reported, see
+	// reportedFailure.
+	defer close(tiles)
+	count := from.count
+
+	// The caller may give up at any time, e.g. when the client disconnects,
+	// and must then cancel ctx. Every send must also watch ctx, or the
+	// collector would block forever on a send no one is receiving, holding
+	// on to the goroutine and the redis connection.
+	send := func(p partial) bool {
+		select {
+		case tiles <- p:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	// Failures are always reported, also when ctx is done, so that callers
+	// can tell why the collection stopped, and never mistake a collection
+	// that was cut short for a complete one. The failure channel must be
+	// buffered, so that the failure is there before tiles is closed,
+	// whether anyone is listening or not.
+	fail := func(err error) {
+		observer.failed()
+		select {
+		case failure <- err:
+		default:
+		}
+	}
+	stopped := func() {
+		fail(fmt.Errorf(
+			"stopped with %d/%d tasks collected: %w",
+			count,
+			head.Ntasks,
+			ctx.Err(),
+		))
+	}
+
+	if from == start && !send(partial { tile: head.RawHeader }) {
+		stopped()
+		return
+	}
+
+	streamCursor := from.cursor
+	attempts := 0
+	for count < head.Ntasks {
+		xreadArgs := redis.XReadArgs{
+			Streams: []string{pid, streamCursor},
+			Count:   xreadCount,
+			Block:   block,
+		}
+		reply, err := storage.XRead(ctx, &xreadArgs).Result()
+
+		/*
+		 * When the context is done, redis errors are pretty much guaranteed
+		 * to be because of it, so report the context error instead. This
+		 * way callers can tell timeouts apart from other failures.
+		 */
+		if ctx.Err() != nil {
+			stopped()
+			return
+		}
+		/*
+		 * A connection blip should not fail the whole process, so transient
+		 * errors are retried, a few times. Should ctx be done while waiting,
+		 * the next read fails right away, and the failure is reported above.
+		 */
+		if transientError(err) && attempts < retry.retries {
+			retry.wait(ctx, attempts)
+			attempts++
+			continue
+		}
+		if err != nil && err != redis.Nil && attempts > 0 {
+			fail(fmt.Errorf("giving up after %d retries: %w", attempts, err))
+			return
+		}
+		attempts = 0
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		messages, err := streamMessages(reply, pid)
+		if err != nil {
+			fail(err)
+			return
+		}
+
+		for _, message := range messages {
+			e, err := parseEntry(message.Values)
+			if err != nil {
+				fail(err)
+				return
+			}
+			if e.err != "" {
+				fail(&processError { task: parseFailedTask(e.err) })
+				return
+			}
+
+			tile, err := decoder.decode(e)
+			if err != nil {
+				fail(err)
+				return
+			}
+			p := partial {
+				id:   message.ID,
+				part: e.part,
+				tile: tile,
+				buf:  e.buf,
+			}
+			if count == from.count {
+				stopWaiting(ctx)
+			}
+			if !send(p) {
+				stopped()
+				return
+			}
+			observer.tile()
+			count++
+			streamCursor = message.ID
+		}
+	}
+	observer.done()
+}
+
+/*
+ * The failure of the collection, for when tiles is closed. The collector
+ * reports failures before it closes tiles, so a closed tiles may just have
+ * won the select over the failure. Nil if the collection is complete.
+ */
+func reportedFailure(failure chan error) error {
+	select {
+	case err := <-failure:
+		return err
+	default:
+		return nil
+	}
+}
+
+/*
+ * The logger for requests for the process pid
+ */
+func (r *Result) logger(pid string) *logging.Logger {
+	return r.Logger.With("pid", pid)
+}
+
+/*
+ * The zstd decoder for compressed partial results. It is safe for concurrent
+ * use, so all requests share the one made on first use. It is not made until
+ * it's needed, since it comes with goroutines of its own.
+ */
+func (r *Result) zstdDecoder() *zstd.Decoder {
+	r.zstdonce.Do(func() {
+		dec, err := newZstdDecoder(r.maxTileBytes())
+		if err != nil {
+			panic(err)
+		}
+		r.zstd = dec
+	})
+	return r.zstd
+}
+
+/*
+ * The default for the max size of results assembled in memory, see
+ * Result.assembledLimit
+ */
+const defaultMaxAssembledBytes = 64 * 1024 * 1024
+
+/*
+ * The max size of results assembled in memory, e.g. converted to JSON. Unlike
+ * the msgpack result, these always have a limit - MaxResultBytes when set, or
+ * the default.
+ */
+func (r *Result) assembledLimit() int64 {
+	if r.MaxResultBytes <= 0 {
+		return defaultMaxAssembledBytes
+	}
+	return r.MaxResultBytes
+}
+
+func (r *Result) maxTileBytes() int64 {
+	if r.MaxTileBytes <= 0 {
+		return defaultMaxTileBytes
+	}
+	return r.MaxTileBytes
+}
+
+/*
+ * The default expiration of results in storage, i.e. the header, the stream
+ * of partial results, and the keys that go with them. Results are meant to
+ * be fetched right away, so this is fairly short, which also keeps storage
+ * from filling up with abandoned processes.
+ */
+const DefaultResultTTL = 10 * time.Minute
+
+func (r *Result) resultTTL() time.Duration {
+	if r.ResultTTL <= 0 {
+		return DefaultResultTTL
+	}
+	return r.ResultTTL
+}
+
+func (r *Result) streamFlushBytes() int {
+	if r.StreamFlushBytes <= 0 {
+		return defaultFlushBytes
+	}
+	return r.StreamFlushBytes
+}
+
+func (r *Result) streamFlushDelay() time.Duration {
+	if r.StreamFlushDelay <= 0 {
+		return defaultFlushDelay
+	}
+	return r.StreamFlushDelay
+}
+
+func (r *Result) readAhead() int {
+	if r.ReadAhead == 0 {
+		return defaultReadAhead
+	}
+	return r.ReadAhead
+}
+
+func (r *Result) readAheadBytes() int64 {
+	if r.ReadAheadBytes <= 0 {
+		return defaultReadAheadBytes
+	}
+	return r.ReadAheadBytes
+}
+
+func (r *Result) maxReorderBytes() int64 {
+	if r.MaxReorderBytes <= 0 {
+		return defaultMaxReorderBytes
+	}
+	return r.MaxReorderBytes
+}
+
+/*
+ * Collect the result of the process pid from the result's storage, from the
+ * position from. With passthrough, compressed partial results are collected
+ * as they are, see tiledecoder. The endpoint labels the collection in the
+ * metrics.
+ */
+func (r *Result) collect(
+	ctx         context.Context,
+	endpoint    string,
+	pid         string,
+	head        *message.ProcessHeader,
+	from        position,
+	passthrough bool,
+	tiles       chan partial,
+	failure     chan error,
+) {
+	var links []trace.Link
+	if r.TraceLinks {
+		query, err := storedTrace(ctx, r.Storage, pid)
+		if err != nil {
+			r.logger(pid).Warn("unable to get trace context", "error", err)
+		}
+		if query.IsValid() {
+			links = append(links, trace.Link { SpanContext: query })
+		}
+	}
+	ctx, span := tracer().Start(
+		ctx,
+		"oneseismic.collect",
+		trace.WithAttributes(
+			pidAttribute(pid),
+			label.String("oneseismic.endpoint", endpoint),
+		),
+		trace.WithLinks(links...),
+	)
+	defer span.End()
+
+	block := r.ReadBlock
+	if block <= 0 {
+		block = xreadBlock
+	}
+	decoder := &tiledecoder {
+		zstd:        r.zstdDecoder,
+		limit:       r.maxTileBytes(),
+		passthrough: passthrough,
+		verify:      r.VerifyChecksums,
+	}
+	if n := r.readAhead(); n > 0 {
+		read := make(chan partial)
+		readfailure := make(chan error, 1)
+		go readahead(ctx, n, r.readAheadBytes(), read, readfailure, tiles, failure)
+		tiles, failure = read, readfailure
+	}
+	collectResult(
+		ctx,
+		r.Storage,
+		pid,
+		head,
+		from,
+		block,
+		r.retryBackoff(),
+		decoder,
+		r.Metrics.collection(endpoint),
+		tiles,
+		failure,
+	)
+}
+
+/*
+ * The number of completed tasks for the process pid. If the completion
+ * watcher has already seen the process finish with the tasks in head, the
+ * count is Ntasks and there is no need to ask storage. The header must be
+ * current, i.e. read for this request, or a reissued process would be judged
+ * against the wrong number of tasks.
+ */
+func (r *Result) count(
+	ctx  context.Context,
+	pid  string,
+	head *message.ProcessHeader,
+) (int64, error) {
+	if r.Completions != nil && r.Completions.Finished(pid, head.Ntasks) {
+		return int64(head.Ntasks), nil
+	}
+	return r.Storage.XLen(ctx, pid).Result()
+}
+
+/*
+ * Wait for the completion watcher to see the process pid complete, for at
+ * most CompletionWait. True if it did, in which case the count is current
+ * without going to storage.
+ */
+func (r *Result) awaitCompletion(ctx context.Context, pid string) bool {
+	if r.Completions == nil || r.CompletionWait <= 0 {
+		return false
+	}
+	done, cancel := r.Completions.Subscribe(pid)
+	defer cancel()
+
+	timer := time.NewTimer(r.CompletionWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+/*
+ * The trailer of streams with how the stream ended, since the status code is
+ * sent long before that is known. It is "done" when the whole result was
+ * sent, "timeout" when the stream ran out of time, and "error: <message>"
+ * for any other failure. Streams without the trailer were cut short, e.g. by
+ * a dropped connection.
+ *
+ * The trailer is only sent when asked for with ?trailer=true, since some
+ * proxies and clients (like older python clients) choke on trailers they
+ * did not expect. It's sent at the end of the chunked body over HTTP/1.1,
+ * and as the final HEADERS frame over HTTP/2.
+ */
+const statusTrailer = "X-OnePac-Status"
+
+/*
+ * The size of the result, for clients that report progress - the number of
+ * bundles, and the number of bytes of the (uncompressed) result when known.
+ */
+const (
+	bundlesTotalHeader = "X-Oneseismic-Bundles-Total"
+	bytesTotalHeader   = "X-Oneseismic-Bytes-Total"
+)
+
+/*
+ * Set on streams of results that are known to be empty up front, see
+ * ProcessHeader.IsEmpty. Their stream is the header and the end, with no
+ * data in between.
+ */
+const emptyHeader = "X-Oneseismic-Empty"
+
+func setTotals(header http.Header, nbundles int, size int64) {
+	header.Set(bundlesTotalHeader, fmt.Sprint(nbundles))
+	if size > 0 {
+		header.Set(bytesTotalHeader, fmt.Sprint(size))
+	}
+}
+
+func failureStatus(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	/*
+	 * Header values can't span lines
+	 */
+	msg := strings.Join(strings.Fields(err.Error()), " ")
+	return "error: " + msg
+}
+
+/*
+ * The error frame payload for err, see frame.ErrorInfo
+ */
+func errorInfo(err error) frame.ErrorInfo {
+	info := frame.ErrorInfo {
+		Code:    frame.ErrorInternal,
+		Message: err.Error(),
+		Task:    -1,
+	}
+	var failed *processError
+	switch {
+	case errors.As(err, &failed):
+		info.Code = frame.ErrorTaskFailed
+		info.Task = failed.task.Task
+	case errors.Is(err, context.DeadlineExceeded):
+		info.Code = frame.ErrorTimeout
+	}
+	return info
+}
+
+/*
+ * The body of error responses for err, with the same code and task as the
+ * error frames of streams
+ */
+func failureBody(err error) gin.H {
+	info := errorInfo(err)
+	body := gin.H {
+		"error": info.Message,
+		"code":  info.Code,
+	}
+	if info.Task >= 0 {
+		body["task"] = info.Task
+	}
+	return body
+}
+
+func (r *Result) Stream(ctx *gin.Context) {
+	if rejectDecimation(ctx, "streams") {
+		return
+	}
+	release := r.Streams.acquire(ctx)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	pid := ctx.Param("pid")
+	contentType := r.StreamContentType
+	if contentType == "" {
+		contentType = streamContentType
+	}
+	/*
+	 * Framing is opt-in, by either asking for the framed content type, or
+	 * with ?framing=v1 for clients that can't easily set headers. Framing
+	 * with checksums (version 2) is only available as ?framing=v2, as
+	 * existing clients of the framed content type only know version 1.
+	 * Clients can also ask for the stream as multipart/mixed, see
+	 * partWriter.
+	 */
+	framing := byte(frame.Version1)
+	switch ctx.Query("framing") {
+	case "v1":
+		contentType = framedContentType
+	case "v2":
+		contentType = framedContentType
+		framing = frame.Version2
+	default:
+		contentType = acceptable(
+			ctx,
+			contentType,
+			framedContentType,
+			multipartContentType,
+		)
+		if contentType == "" {
+			return
+		}
+	}
+	framed := contentType == framedContentType
+	multipart := contentType == multipartContentType
+	/*
+	 * Progress frames are opt-in, as clients from before they were added
+	 * reject frames of unknown types
+	 */
+	progress := framed && ctx.Query("progress") == "true"
+
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	/*
+	 * A process that is already failed never completes, so there's no point
+	 * in waiting for it. Failures that come later, and of processes that
+	 * look complete (the error entries count too), are reported in the
+	 * stream, like Get does.
+	 */
+	count, err := r.count(ctx, pid, head)
+	if err != nil {
+		r.logger(pid).Error("unable to count completed tasks", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if count < int64(head.Ntasks) && r.abortFailed(ctx, pid, head, count) {
+		return
+	}
+
+	/*
+	 * With ?ordered=true, the tiles are sent in task order rather than as
+	 * they arrive, see reorder. The stream IDs are then out of order, so
+	 * ordered streams have no cursors, and can't be resumed.
+	 */
+	ordered := ctx.Query("ordered") == "true"
+	if ordered && ctx.Query("from") != "" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "ordered streams can't be resumed",
+		})
+		return
+	}
+
+	/*
+	 * Resume after the entry with the stream ID ?from=, which is in the
+	 * cursor frames of framed streams. The result header is only sent when
+	 * starting from the beginning.
+	 */
+	from, err := findPosition(ctx, r.Storage, pid, ctx.DefaultQuery("from", "0"))
+	if err != nil {
+		r.logger(pid).Info("bad cursor", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+
+	w := ctx.Writer
+	/*
+	 * The frames carry the length of the uncompressed tiles, so compressed
+	 * tiles can only be passed through without framing
+	 */
+	var zw util.ZstdFrameWriter
+	if !framed && !multipart {
+		zw = passthroughWriter(w)
+	}
+
+	/*
+	 * The gin context is never done, so derive from the request context to
+	 * stop collecting when the client disconnects.
+	 */
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	/*
+	 * Streams from the start share the collector with the other streams of
+	 * the result, see fanout. Resumed streams are rare enough to collect on
+	 * their own.
+	 */
+	if from == start {
+		go r.subscribe(collectctx, pid, head, zw != nil, tiles, failure)
+	} else {
+		go r.collect(collectctx, "stream", pid, head, from, zw != nil, tiles, failure)
+	}
+	if ordered {
+		collected := tiles
+		tiles = make(chan partial)
+		limit := r.maxReorderBytes()
+		go reorder(collectctx, head.Ntasks, limit, collected, tiles, failure)
+	}
+
+	var parts *partWriter
+	if multipart {
+		parts = newPartWriter(w, head.Ntasks, !ordered)
+	}
+
+	header := w.Header()
+	header.Set("Transfer-Encoding", "chunked")
+	/*
+	 * With ?trailer=true, how the stream ended is in the trailer, see
+	 * statusTrailer
+	 */
+	trailer := ctx.Query("trailer") == "true"
+	if trailer {
+		header.Set("Trailer", statusTrailer)
+	}
+	setTrailer := func(status string) {
+		if trailer {
+			header.Set(statusTrailer, status)
+		}
+	}
+	setTotals(header, head.Ntasks, head.TotalBytes)
+	if head.IsEmpty() {
+		header.Set(emptyHeader, "true")
+	}
+	switch {
+	case multipart:
+		header.Set("Content-Type", parts.contentType())
+	case framing == frame.Version2:
+		header.Set("Content-Type", contentType + "; version=2")
+	default:
+		header.Set("Content-Type", contentType)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	/*
+	 * Without framing, the stream is just the msgpack document, and there is
+	 * no way to tell the client about the end of the stream or errors other
+	 * than ending the response.
+	 */
+	enc := frame.NewEncoder(w, framing)
+	write := func(kind frame.Type, payload []byte) {
+		if framed {
+			enc.Encode(kind, payload)
+		} else if multipart {
+			parts.write(kind, payload)
+		} else if kind == frame.Header || kind == frame.Tile {
+			writeTile(w, zw, payload)
+		}
+	}
+	/*
+	 * The error frame is the last frame of the stream. Version 1 clients
+	 * only know error frames with the message.
+	 */
+	fail := func(err error) {
+		r.logger(pid).Error("stream failed", "error", err)
+		payload := []byte(err.Error())
+		if framing == frame.Version2 {
+			payload = errorInfo(err).Pack()
+		}
+		write(frame.Error, payload)
+		setTrailer(failureStatus(err))
+		w.(http.Flusher).Flush()
+	}
+
+	/*
+	 * The header (the partial without an ID) always goes out right away.
+	 * The tiles are flushed in batches (see coalescer), or the compressor of
+	 * compressed streams would hold on to them until it has a full block.
+	 * When throttled, or asked to with ?noDelay=true, every tile is flushed
+	 * as it is written, or the pacing would be up to the batching. Frames
+	 * are written before compression, so the frame lengths are always those
+	 * of the uncompressed payload.
+	 *
+	 * Every tile is followed by a cursor frame, so that clients that lose
+	 * the connection can resume from the last tile they got, unless the
+	 * stream is ordered. With ?progress=true, the cursor is followed by a
+	 * progress frame. Resumed streams count the bytes from where they
+	 * resumed.
+	 */
+	bundle := uint32(from.count)
+	var sent uint64
+	throttle := newThrottle(r.StreamBurst, r.StreamRate)
+	flusher := w.(http.Flusher)
+	coalesce := newCoalescer(flusher, r.streamFlushBytes(), r.streamFlushDelay())
+	if throttle != nil || ctx.Query("noDelay") == "true" {
+		coalesce = newCoalescer(flusher, 0, 0)
+	}
+	defer coalesce.stop()
+
+	/*
+	 * Only framed streams have room for keepalives. They are flushed right
+	 * away, as the point is to get bytes on the wire.
+	 */
+	var keepalive *idleTimer
+	if framed {
+		keepalive = newIdleTimer(r.keepAlive())
+	}
+	defer keepalive.stop()
+
+	/*
+	 * Waiting for tiles can take any time, but writing them should not, so
+	 * the write deadline is only extended once there is something to write.
+	 */
+	deadline := newWriteDeadline(ctx.Request.Context(), r.streamWriteTimeout())
+	defer deadline.clear()
+	slow := func() bool {
+		if !deadline.exceeded() {
+			return false
+		}
+		r.logger(pid).Warn(
+			"slow client",
+			"endpoint", "stream",
+			"timeout",  r.streamWriteTimeout().String(),
+			"bundles",  bundle,
+			"bytes",    sent,
+		)
+		return true
+	}
+	for {
+		if slow() {
+			return
+		}
+		select {
+		case output, ok := <-tiles:
+			deadline.extend()
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					fail(err)
+					return
+				}
+				write(frame.End, nil)
+				setTrailer("done")
+				coalesce.flush()
+				if slow() {
+					return
+				}
+				r.logger(pid).Info(
+					"finished",
+					"endpoint", "stream",
+					"bundles",  bundle,
+					"bytes",    sent,
+				)
+				return
+			}
+			if output.id == "" {
+				write(frame.Header, output.tile)
+				sent += uint64(len(output.tile))
+				coalesce.flush()
+				keepalive.reset()
+				continue
+			}
+
+			if err := throttle.wait(collectctx); err != nil {
+				fail(err)
+				return
+			}
+			if multipart {
+				if err := parts.tile(output); err != nil {
+					fail(err)
+					return
+				}
+			} else {
+				write(frame.Tile, output.tile)
+				if !ordered {
+					write(frame.Cursor, []byte(output.id))
+				}
+			}
+			bundle++
+			sent += uint64(len(output.tile))
+			if progress {
+				info := frame.ProgressInfo {
+					Bundle:  bundle,
+					Bundles: uint32(head.Ntasks),
+					Bytes:   sent,
+				}
+				write(frame.Progress, info.Pack())
+			}
+			coalesce.wrote(len(output.tile))
+			output.release()
+			keepalive.reset()
+
+		case <-coalesce.deadline():
+			deadline.extend()
+			coalesce.flush()
+
+		case <-keepalive.expired():
+			deadline.extend()
+			write(frame.Keepalive, nil)
+			coalesce.flush()
+			keepalive.reset()
+
+		case err := <-failure:
+			/*
+			 * The status is already sent, so the error can only be told
+			 * in-band, if framed or multipart, and in the status trailer.
+			 */
+			deadline.extend()
+			fail(err)
+			return
+		}
+	}
+}
+
+/*
+ * A completed result, as far as Get and Head are concerned - its header and
+ * ETag, and the size in bytes, once measured.
+ */
+type finishedResult struct {
+	head *message.ProcessHeader
+	etag string
+	size int64
+	/*
+	 * The result has no data, either by its header, or because all the
+	 * partial results are empty (the size is that of the header alone). The
+	 * latter is only known once the result is read, so Status only knows
+	 * the former.
+	 */
+	empty bool
+	/*
+	 * The whole result, if it was cached
+	 */
+	assembled []byte
+}
+
+/*
+ * Check that the process pid is complete, and measure and verify its result,
+ * reading it with collectctx. When the result can't be served, for whatever
+ * reason, the response is written and nil returned. This includes clients
+ * that already have the result, which get 304.
+ *
+ * With cached, the result is taken from the cache when it's there (see
+ * assembledkey), rather than measured.
+ */
+func (r *Result) finished(
+	ctx        *gin.Context,
+	collectctx context.Context,
+	pid        string,
+	timing     *serverTiming,
+	cached     bool,
+) *finishedResult {
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return nil
+	}
+
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+	timing.mark("header")
+
+	limit := r.MaxResultBytes
+	if limit > 0 && head.TotalBytes > limit {
+		r.refuseTooLarge(ctx, pid, head.TotalBytes)
+		return nil
+	}
+
+	count, err := r.count(ctx, pid, head)
+	if err != nil {
+		r.logger(pid).Error("unable to count completed tasks", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return nil
+	}
+
+	/*
+	 * Failed processes never complete, and must not be reported as working
+	 * forever. Failed processes that look complete (the error entries count
+	 * too) are found when the result is measured.
+	 */
+	if count < int64(head.Ntasks) && r.abortFailed(ctx, pid, head, count) {
+		return nil
+	}
+	if count < int64(head.Ntasks) && r.awaitCompletion(ctx, pid) {
+		count, err = r.count(ctx, pid, head)
+		if err != nil {
+			r.logger(pid).Error("unable to count completed tasks", "error", err)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return nil
+		}
+	}
+	if count < int64(head.Ntasks) {
+		cacheNever(ctx)
+		wait := r.pollInterval(ctx, pid, count, head.Ntasks)
+		setRetryAfter(ctx, wait)
+		ctx.AbortWithStatusJSON(http.StatusAccepted, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status": "working",
+			"progress": fmt.Sprintf("%d/%d", count, head.Ntasks),
+			"retry_after_ms": wait.Milliseconds(),
+		})
+		return nil
+	}
+
+	/*
+	 * The ETag is known without reading the result, so clients that already
+	 * have it are answered right away. The result is only ever complete
+	 * here, so the ETag never describes a result that can still change.
+	 * Results in Morton order are other bodies, with ETags of their own.
+	 */
+	etag := resultETag(pid, head)
+	if ctx.Query("order") == mortonOrder {
+		etag = mortonETag(etag)
+	}
+	if matchesETag(ctx.GetHeader("If-None-Match"), etag) {
+		cacheImmutable(ctx, etag)
+		ctx.AbortWithStatus(http.StatusNotModified)
+		return nil
+	}
+
+	if cached {
+		body := r.cachedResult(collectctx, pid)
+		if body != nil && limit > 0 && int64(len(body)) > limit {
+			r.refuseTooLarge(ctx, pid, int64(len(body)))
+			return nil
+		}
+		if body != nil {
+			timing.mark("cache")
+			return &finishedResult {
+				head:      head,
+				etag:      etag,
+				size:      int64(len(body)),
+				empty:     isEmpty(head, int64(len(body))),
+				assembled: body,
+			}
+		}
+	}
+
+	nbundles, size, err := r.measure(collectctx, pid, head, timing)
+	if errors.Is(err, errResultTooLarge) {
+		r.refuseTooLarge(ctx, pid, size)
+		return nil
+	}
+	var failed *processError
+	if errors.As(err, &failed) {
+		r.logger(pid).Info("process failed", "error", err)
+		progress := fmt.Sprintf("%d/%d", nbundles, head.Ntasks)
+		cacheNever(ctx)
+		ctx.AbortWithStatusJSON(
+			http.StatusFailedDependency,
+			failedBody(failed.task.Error, progress),
+		)
+		return nil
+	}
+	if err != nil {
+		r.logger(pid).Error("unable to measure result", "error", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			progress := fmt.Sprintf("%d/%d", nbundles, head.Ntasks)
+			ctx.AbortWithStatusJSON(
+				http.StatusGatewayTimeout,
+				timedout(progress),
+			)
+			return nil
+		}
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, failureBody(err))
+		return nil
+	}
+
+	/*
+	 * The header announces the number of bundles to the client (it's the
+	 * length of the msgpack array that follows it), so a result with any
+	 * other number of bundles is malformed. This is a bug in the scheduler or
+	 * the workers, and it's better to fail loudly than to hand the client an
+	 * inconsistent result.
+	 */
+	if r.VerifyBundles && nbundles != head.Ntasks {
+		msg := fmt.Sprintf(
+			"result has %d bundles; header announces %d",
+			nbundles,
+			head.Ntasks,
+		)
+		r.logger(pid).Error("bundle count mismatch", "error", msg)
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H {
+			"error": msg,
+		})
+		return nil
+	}
+
+	return &finishedResult {
+		head:  head,
+		etag:  etag,
+		size:  size,
+		empty: isEmpty(head, size),
+	}
+}
+
+/*
+ * Check if the result of size bytes (with header) is empty, see
+ * finishedResult.empty
+ */
+func isEmpty(head *message.ProcessHeader, size int64) bool {
+	return head.IsEmpty() || size == int64(len(head.RawHeader))
+}
+
+/*
+ * Respond to requests for empty results with 204, rather than the header
+ * alone, which some clients take for a broken result
+ */
+func (r *Result) noContent(ctx *gin.Context, pid string, result *finishedResult) {
+	r.logger(pid).Info("finished", "endpoint", "get", "empty", true)
+	cacheImmutable(ctx, result.etag)
+	ctx.Status(http.StatusNoContent)
+}
+
+/*
+ * HEAD /result/<pid>
+ *
+ * The headers Get would send, without the result. The Content-Length is the
+ * size of the uncompressed result, which is only known by reading it, so
+ * this is not much cheaper for the server than Get, only for the client.
+ */
+func (r *Result) Head(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if acceptable(ctx, resultContentType) == "" {
+		return
+	}
+	if r.redirectUploaded(ctx, pid) {
+		return
+	}
+
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, nil, true)
+	if result == nil {
+		return
+	}
+	if result.empty {
+		r.noContent(ctx, pid, result)
+		return
+	}
+
+	cacheImmutable(ctx, result.etag)
+	setDisposition(ctx, pid, "bin")
+	ctx.Header("Content-Type", resultContentType)
+	ctx.Header("Content-Length", fmt.Sprint(result.size))
+	setTotals(ctx.Writer.Header(), result.head.Ntasks, result.size)
+	ctx.Status(http.StatusOK)
+}
+
+func (r *Result) Get(ctx *gin.Context) {
+	release := r.Streams.acquire(ctx)
+	if release == nil {
+		return
+	}
+	defer release()
+
+	/*
+	 * msgpack is the default. The other formats are conversions of the
+	 * completed result, see getJSON, getNpy, getRaw and getArrow. Without
+	 * ?format, clients can ask for JSON with Accept, which is convenient for
+	 * debugging with tools that set headers more easily than they build
+	 * URLs.
+	 */
+	format := ctx.Query("format")
+	if format == "" {
+		ctx.Writer.Header().Add("Vary", "Accept")
+		switch acceptable(ctx, resultContentType, "application/json") {
+		case "":
+			return
+		case "application/json":
+			format = "json"
+		default:
+			format = "msgpack"
+		}
+	}
+
+	/*
+	 * Quantization needs the whole result, see sampleType
+	 */
+	dtype := ctx.Query("dtype")
+	if dtype != "" && dtype != "float32" && format != "npy" && format != "raw" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "dtype is only available for the npy and raw formats",
+		})
+		return
+	}
+	decimate, ok := requestedDecimation(ctx)
+	if !ok {
+		return
+	}
+	if decimate > 1 && (format == "json" || format == "arrow") {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "decimate is only available for the msgpack, npy and raw formats",
+		})
+		return
+	}
+	/*
+	 * The bundles can only be reordered in the msgpack result, the other
+	 * formats are assembled arrays, see mortonOrder
+	 */
+	order := ctx.Query("order")
+	if order != "" && order != mortonOrder {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "order must be morton",
+		})
+		return
+	}
+	if order != "" && format != "msgpack" {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "order is only available for the msgpack format",
+		})
+		return
+	}
+
+	switch format {
+	case "msgpack":
+	case "json":
+		r.getJSON(ctx)
+		return
+	case "npy":
+		r.getNpy(ctx)
+		return
+	case "raw":
+		r.getRaw(ctx)
+		return
+	case "arrow":
+		r.getArrow(ctx)
+		return
+	default:
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "format must be msgpack, json, npy, raw or arrow",
+		})
+		return
+	}
+
+	pid := ctx.Param("pid")
+	if acceptable(ctx, resultContentType) == "" {
+		return
+	}
+	if ctx.Query("partial") == "true" && decimate > 1 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "partial results can't be decimated",
+		})
+		return
+	}
+	if order != "" && (ctx.Query("partial") == "true" || decimate > 1) {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "ordered results can't be partial or decimated",
+		})
+		return
+	}
+	if ctx.Query("partial") == "true" && r.getPartial(ctx, pid) {
+		return
+	}
+	if order == mortonOrder {
+		r.getMorton(ctx, pid)
+		return
+	}
+	if decimate > 1 {
+		r.getDecimated(ctx, pid, decimate)
+		return
+	}
+	if r.redirectUploaded(ctx, pid) {
+		return
+	}
+	timing := newServerTiming(r.ServerTiming)
+
+	/*
+	 * The result is streamed to the client rather than assembled in memory,
+	 * which for large results would be hundreds of megabytes per request.
+	 * This means reading the result twice - first to measure it, so that the
+	 * size is known up front and the result can be verified before anything
+	 * is sent, then to send it. The partial results are immutable, so both
+	 * passes see the same result.
+	 */
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, timing, true)
+	if result == nil {
+		return
+	}
+	if result.empty {
+		r.noContent(ctx, pid, result)
+		return
+	}
+	head, etag, size := result.head, result.etag, result.size
+	r.startUpload(pid, head, size)
+
+	/*
+	 * The result is sent after the header, so the timing only covers the
+	 * first pass over the result
+	 */
+	timing.mark("assembly")
+	w := ctx.Writer
+	if timing != nil {
+		w.Header().Set("Server-Timing", timing.String())
+	}
+	cacheImmutable(ctx, etag)
+	setDisposition(ctx, pid, "bin")
+	w.Header().Set("Content-Type", resultContentType)
+	setTotals(w.Header(), head.Ntasks, size)
+
+	/*
+	 * The size is of the uncompressed result, which is wrong when the
+	 * response is compressed. For the same reason, ranges are only served
+	 * for uncompressed responses - a range of the compressed response would
+	 * mean compressing it all, and then some.
+	 */
+	var rng *byteRange
+	if w.Header().Get("Content-Encoding") == "" {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+
+		var err error
+		rng, err = parseRange(ctx.GetHeader("Range"), size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			ctx.AbortWithStatus(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if ifRange := ctx.GetHeader("If-Range"); ifRange != "" && ifRange != etag {
+			rng = nil
+		}
+	}
+
+	writeHeader := func() {
+		if rng == nil {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.Header().Set("Content-Range", rng.contentRange(size))
+			w.Header().Set("Content-Length", fmt.Sprint(rng.length()))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+	}
+
+	finished := func(cached bool) {
+		r.logger(pid).Info(
+			"finished",
+			"endpoint", "get",
+			"bundles",  head.Ntasks,
+			"bytes",    size,
+			"cached",   cached,
+		)
+	}
+
+	if result.assembled != nil {
+		writeHeader()
+		if rng == nil {
+			w.Write(result.assembled)
+			finished(true)
+		} else {
+			w.Write(result.assembled[rng.first:rng.last + 1])
+		}
+		return
+	}
+
+	zw := passthroughWriter(w)
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "get", pid, head, start, zw != nil, tiles, failure)
+	writeHeader()
+
+	/*
+	 * Whole results are cached as they are sent, unless they are too large,
+	 * or passed through compressed, as the cache is of the plain result
+	 */
+	var assembled []byte
+	if rng == nil && zw == nil && r.cacheable(size) {
+		assembled = make([]byte, 0, size)
+	}
+
+	/*
+	 * The offset of the next tile in the result, to find the tiles in the
+	 * range. Once past the range, there's no need to read the rest.
+	 */
+	var offset int64
+	for {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					r.logger(pid).Error("unable to send result", "error", err)
+					return
+				}
+				if assembled != nil && int64(len(assembled)) == size {
+					r.cacheResult(pid, assembled)
+				}
+				if rng == nil {
+					finished(false)
+				}
+				return
+			}
+			if rng == nil {
+				writeTile(w, zw, output.tile)
+				if assembled != nil {
+					assembled = append(assembled, output.tile...)
+				}
+				output.release()
+				continue
+			}
+
+			w.Write(rng.clip(output.tile, offset))
+			offset += int64(len(output.tile))
+			output.release()
+			if offset > rng.last {
+				return
+			}
+
+		case err := <-failure:
+			/*
+			 * The status is already sent, which leaves cutting the response
+			 * short. The client can tell, from the Content-Length.
+			 */
+			r.logger(pid).Error("unable to send result", "error", err)
+			return
+		}
+	}
+}
+
+/*
+ * Read the result without keeping it, and get the number of bundles and the
+ * size of the result (with header) in bytes. On failure, nbundles is the
+ * number of bundles read so far. The wait for the first bundle is marked as
+ * first-tile in the timing. Results larger than MaxResultBytes fail with
+ * errResultTooLarge.
+ */
+func (r *Result) measure(
+	ctx    context.Context,
+	pid    string,
+	head   *message.ProcessHeader,
+	timing *serverTiming,
+) (nbundles int, size int64, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(ctx, "measure", pid, head, start, false, tiles, failure)
+
+	/*
+	 * The first tile is the header, the rest are the bundles. Results larger
+	 * than MaxResultBytes are not read any further than it takes to know,
+	 * but the tiles already on their way must still be drained.
+	 */
+	nbundles = -1
+	limit := r.MaxResultBytes
+	for output := range tiles {
+		size += int64(len(output.tile))
+		output.release()
+		nbundles++
+		if nbundles == 1 {
+			timing.mark("first-tile")
+		}
+		if limit > 0 && size > limit && err == nil {
+			err = errResultTooLarge
+			cancel()
+		}
+	}
+	if err != nil {
+		return nbundles, size, err
+	}
+
+	return nbundles, size, reportedFailure(failure)
+}
+
+/*
+ * Purge the partial results of a process, so that clients that have what they
+ * need can free the memory right away, rather than waiting for the keys to
+ * expire. This also removes the bookkeeping keys of the process, which are of
+ * no use without the partial results.
+ *
+ * Responds 204 when the process is deleted, and 404 if there was nothing to
+ * delete.
+ */
+func (r *Result) Delete(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	n, err := r.delete(ctx, pid)
+	if err != nil {
+		r.logger(pid).Error("unable to delete result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if n == 0 {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
 }
 
 /*
- * Silly helper to centralise the name/key of the header object. It's not
- * likely to change too much, but it beats hardcoding the key with formatting
- * all over the place.
+ * POST /result/<pid>/cancel
+ *
+ * Cancel the process, for clients that no longer need the result, e.g.
+ * because the user navigated away. The process is flagged as cancelled (see
+ * cancelledkey), so that the workers stop working on it, and the partial
+ * results and bookkeeping are deleted like in Delete. The flag is set first,
+ * so workers that are still busy don't write partial results after the
+ * cleanup for long.
+ *
+ * Responds 202, as workers may still be busy for a little while, after
+ * which Status reports the process as cancelled.
  */
-func headerkey(pid string) string {
-	return fmt.Sprintf("%s/header.json", pid)
+func (r *Result) Cancel(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if _, err := r.cancel(ctx, pid); err != nil {
+		r.logger(pid).Error("unable to cancel process", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	r.logger(pid).Info("cancelled")
+	ctx.JSON(http.StatusAccepted, gin.H {
+		"location": fmt.Sprintf("result/%s/status", pid),
+		"status": "cancelled",
+	})
 }
 
-func parseProcessHeader(doc []byte) (*message.ProcessHeader, error) {
-	ph, err := (&message.ProcessHeader{}).Unpack(doc)
+/*
+ * Flag the process pid as cancelled, and delete its result. Returns the
+ * number of keys deleted, like delete.
+ */
+func (r *Result) cancel(ctx context.Context, pid string) (int64, error) {
+	err := r.Storage.Set(ctx, cancelledkey(pid), "cancelled", r.resultTTL()).Err()
 	if err != nil {
-		log.Printf("bad process header: %s", string(doc))
-		return ph, fmt.Errorf("unable to parse process header: %w", err)
+		return 0, err
 	}
+	return r.delete(ctx, pid)
+}
 
-	if ph.Ntasks <= 0 {
-		log.Printf("bad process header: %s", string(doc))
-		return ph, fmt.Errorf("processheader.parts = %d; want >= 1", ph.Ntasks)
+/*
+ * Check if the process pid is cancelled, see Cancel
+ */
+func (r *Result) cancelled(ctx context.Context, pid string) (bool, error) {
+	err := r.Storage.Get(ctx, cancelledkey(pid)).Err()
+	if err == redis.Nil {
+		return false, nil
 	}
-	return ph, nil
+	return err == nil, err
 }
 
-func collectResult(
-	ctx context.Context,
-	storage redis.Cmdable,
-	pid string,
-	head *message.ProcessHeader,
-	tiles chan []byte,
-	failure chan error,
-) {
-	// This close is quite important - when the tiles channel is closed, it is
-	// a signal to the caller that all partial results are in and processed,
-	// and that the transfer is completed.
-	defer close(tiles)
+/*
+ * Delete the result of the process pid, and return the number of keys that
+ * were deleted, i.e. 0 if there was nothing to delete.
+ */
+func (r *Result) delete(ctx context.Context, pid string) (int64, error) {
+	/*
+	 * Identical queries must not get the pid of a deleted process, see Dedup
+	 */
+	if err := dropQuery(ctx, r.Storage, pid); err != nil {
+		r.logger(pid).Warn("unable to drop query", "error", err)
+	}
+	n, err := r.Storage.Del(
+		ctx,
+		pid,
+		headerkey(pid),
+		createdkey(pid),
+		errorkey(pid),
+		statskey(pid),
+		plankey(pid),
+		uploadkey(pid),
+		tracekey(pid),
+		queryhashkey(pid),
+	).Result()
+	if err != nil {
+		return 0, err
+	}
+	if r.Uploads != nil {
+		if err := r.Uploads.Store.Delete(ctx, pid); err != nil {
+			r.logger(pid).Warn("unable to delete upload", "error", err)
+		}
+	}
+	return n, nil
+}
 
-	tiles <- head.RawHeader
+/*
+ * The time of the last progress of the process, i.e. when the last partial
+ * result was written. Redis stream IDs are the millisecond timestamp of the
+ * entry, so there is no need to record the time separately.
+ *
+ * The zero time means there has been no progress yet. The process may well
+ * be waiting in the queue behind other jobs then, which is not a stall.
+ */
+func (r *Result) lastProgress(ctx context.Context, pid string) (time.Time, error) {
+	msgs, err := r.Storage.XRevRangeN(ctx, pid, "+", "-", 1).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(msgs) == 0 {
+		return time.Time{}, nil
+	}
 
-	streamCursor := "0"
-	count := 0
-	for count < head.Ntasks {
-		xreadArgs := redis.XReadArgs{
-			Streams: []string{pid, streamCursor},
-			Block:   0,
-		}
-		reply, err := storage.XRead(ctx, &xreadArgs).Result()
+	var ms, seq int64
+	_, err = fmt.Sscanf(msgs[0].ID, "%d-%d", &ms, &seq)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad message ID: %w", err)
+	}
+	return time.Unix(0, ms * int64(time.Millisecond)), nil
+}
 
-		if err != nil {
-			failure <- err
-			return
-		}
+/*
+ * The time the process was scheduled, or the zero time if it is not known.
+ */
+func (r *Result) created(ctx context.Context, pid string) (time.Time, error) {
+	ms, err := r.Storage.Get(ctx, createdkey(pid)).Int64()
+	if err == redis.Nil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ms * int64(time.Millisecond)), nil
+}
 
-		for _, message := range reply[0].Messages {
-			for _, tile := range message.Values {
-				chunk, ok := tile.(string)
-				if !ok {
-					msg := fmt.Sprintf("tile.type = %T; expected []byte]", tile)
-					failure <- errors.New(msg)
-					return
-				}
+/*
+ * The fraction of the tasks that are completed, from 0 to 1
+ */
+func progressFraction(count int64, ntasks int) float64 {
+	if ntasks <= 0 || count >= int64(ntasks) {
+		return 1
+	}
+	return float64(count) / float64(ntasks)
+}
 
-				tiles <- []byte(chunk)
-				count++
-			}
-			streamCursor = message.ID
+/*
+ * Estimate the seconds left until the process is done, assuming the remaining
+ * tasks complete at the same rate as the ones so far have since the process
+ * was scheduled. There is no rate to go by before the first task completes,
+ * so then there is no estimate.
+ */
+func secondsRemaining(
+	created time.Time,
+	now     time.Time,
+	count   int64,
+	ntasks  int,
+) (float64, bool) {
+	if created.IsZero() || count <= 0 {
+		return 0, false
+	}
+	remaining := int64(ntasks) - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	elapsed := now.Sub(created).Seconds()
+	eta := elapsed / float64(count) * float64(remaining)
+	return math.Round(eta * 10) / 10, true
+}
+
+/*
+ * The bounds of the Retry-After of processes that are still working, so that
+ * clients neither poll in a tight loop, nor wait for ages on an estimate that
+ * turns out to be pessimistic.
+ */
+const (
+	minRetryAfter = time.Second
+	maxRetryAfter = 30 * time.Second
+)
+
+/*
+ * The default for the Retry-After when there's no progress, see
+ * Result.RetryAfter
+ */
+const defaultRetryAfter = 2 * time.Second
+
+/*
+ * How long clients should wait before polling a process that is still working
+ * again - the estimated time until it's done, see secondsRemaining, within
+ * minRetryAfter and maxRetryAfter. Without an estimate, it's the fallback.
+ */
+func retryAfter(
+	created  time.Time,
+	now      time.Time,
+	count    int64,
+	ntasks   int,
+	fallback time.Duration,
+) time.Duration {
+	eta, ok := secondsRemaining(created, now, count, ntasks)
+	if !ok {
+		return fallback
+	}
+	wait := time.Duration(eta * float64(time.Second))
+	if wait < minRetryAfter {
+		return minRetryAfter
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+func (r *Result) fallbackRetryAfter() time.Duration {
+	if r.RetryAfter == 0 {
+		return defaultRetryAfter
+	}
+	return r.RetryAfter
+}
+
+/*
+ * The Retry-After for the process pid, with count of ntasks done. Like the
+ * estimate in the status, it's only a hint, so failing to look up when the
+ * process was created just means falling back to the default.
+ */
+func (r *Result) pollInterval(
+	ctx    context.Context,
+	pid    string,
+	count  int64,
+	ntasks int,
+) time.Duration {
+	created, err := r.created(ctx, pid)
+	if err != nil {
+		r.logger(pid).Warn("unable to get creation time", "error", err)
+	}
+	return retryAfter(created, time.Now(), count, ntasks, r.fallbackRetryAfter())
+}
+
+/*
+ * Scan the last errorScanCount entries of the stream for errors written by
+ * the workers, and get the first one found, or the empty string if there are
+ * none.
+ */
+func streamError(
+	ctx     context.Context,
+	storage redis.Cmdable,
+	pid     string,
+) (string, error) {
+	msgs, err := storage.XRevRangeN(ctx, pid, "+", "-", errorScanCount).Result()
+	if err != nil {
+		return "", err
+	}
+
+	for _, msg := range msgs {
+		if val, ok := msg.Values[errorfield]; ok {
+			return fmt.Sprint(val), nil
 		}
 	}
+	return "", nil
 }
 
-func (r *Result) Stream(ctx *gin.Context) {
-	pid := ctx.Param("pid")
-	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+/*
+ * Get the error that failed the process, or the empty string if the process
+ * has not failed. A process has failed if a worker reported an error to the
+ * stream, which is recorded, so that the stream does not need to be scanned
+ * again.
+ *
+ * A process that is not done and has stalled for longer than MaxStall is
+ * reported as failed too, so that clients polling the status learn that it
+ * will likely never complete. The stall is a guess, and a process that
+ * completes after all is not failed, so the stall is not recorded.
+ */
+func (r *Result) failed(
+	ctx  context.Context,
+	pid  string,
+	done bool,
+) (string, error) {
+	msg, err := r.Storage.Get(ctx, errorkey(pid)).Result()
+	if err == nil {
+		return msg, nil
+	}
+	if err != redis.Nil {
+		return "", err
+	}
+
+	msg, err = streamError(ctx, r.Storage, pid)
 	if err != nil {
-		log.Printf("Unable to get process header: %v", err)
-		ctx.AbortWithStatus(http.StatusNotFound)
-		return
+		return "", err
+	}
+	if msg != "" {
+		err = r.Storage.Set(ctx, errorkey(pid), msg, r.resultTTL()).Err()
+		if err != nil {
+			return "", err
+		}
+		return msg, nil
 	}
 
-	head, err := parseProcessHeader(body)
+	if done || r.MaxStall <= 0 {
+		return "", nil
+	}
+
+	last, err := r.lastProgress(ctx, pid)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
-		ctx.AbortWithStatus(http.StatusInternalServerError)
-		return
+		return "", err
+	}
+	if last.IsZero() || time.Since(last) <= r.MaxStall {
+		return "", nil
 	}
 
-	tiles := make(chan []byte)
-	failure := make(chan error)
-	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
+	return fmt.Sprintf("stalled; no progress since %s", last.Format(time.RFC3339)), nil
+}
 
-	w := ctx.Writer
-	header := w.Header()
-	header.Set("Transfer-Encoding", "chunked")
-	header.Set("Content-Type", "text/html")
-	w.WriteHeader(http.StatusOK)
+/*
+ * The body of responses about failed processes, with the error and the task
+ * that failed, as far as it's known (see parseFailedTask), and the progress
+ * of the process when it failed.
+ *
+ * Failed processes are reported with 424 (Failed Dependency), as it's the
+ * workers that failed, not the request. 500 is for failures in the API,
+ * which the client could try again.
+ */
+func failedBody(msg string, progress string) gin.H {
+	task := parseFailedTask(msg)
+	body := gin.H {
+		"status": "failed",
+		"error":  msg,
+		"code":   frame.ErrorTaskFailed,
+	}
+	if task.Task >= 0 {
+		body["task"] = task.Task
+	}
+	if progress != "" {
+		body["progress"] = progress
+	}
+	return body
+}
 
-	for {
-		select {
-		case output, ok := <-tiles:
-			if !ok {
-				w.(http.Flusher).Flush()
-				return
-			}
-			w.Write(output)
+/*
+ * Respond 424 with the failure if the process pid, with count tasks
+ * completed, is failed (see failed), and return true. Should the lookup
+ * fail, nothing is written - the failure, if any, is found when reading
+ * the result anyway.
+ */
+func (r *Result) abortFailed(
+	ctx   *gin.Context,
+	pid   string,
+	head  *message.ProcessHeader,
+	count int64,
+) bool {
+	msg, err := r.failed(ctx, pid, count >= int64(head.Ntasks))
+	if err != nil {
+		r.logger(pid).Warn("unable to look up failure", "error", err)
+		return false
+	}
+	if msg == "" {
+		return false
+	}
+	r.logger(pid).Info("process failed", "error", msg)
+	progress := fmt.Sprintf("%d/%d", count, head.Ntasks)
+	cacheNever(ctx)
+	ctx.AbortWithStatusJSON(http.StatusFailedDependency, failedBody(msg, progress))
+	return true
+}
 
-		case err := <-failure:
-			log.Printf("pid=%s, %s", pid, err)
-			return
+/*
+ * The status of a process, as reported to the client. A nil body means the
+ * lookup failed, and the request should be aborted with the status code.
+ */
+type status struct {
+	code int
+	body gin.H
+	/*
+	 * The Retry-After of processes that are still working, see retryAfter
+	 */
+	retryAfter time.Duration
+}
+
+/*
+ * The status for a lookup that failed with err. Timeouts are reported as
+ * such, with the progress if it's known, everything else is an internal
+ * error.
+ */
+func lookupFailed(err error, progress string) *status {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &status {
+			code: http.StatusGatewayTimeout,
+			body: timedout(progress),
 		}
 	}
+	return &status { code: http.StatusInternalServerError }
 }
 
-func (r *Result) Get(ctx *gin.Context) {
+/*
+ * The result header from the process header, i.e. the first element of the
+ * result document without the envelope around it, as a generic map. See
+ * pack_with_envelope in the core library for the envelope.
+ */
+func parseResultHeader(doc []byte) (map[string]interface{}, error) {
+	if len(doc) < 1 {
+		return nil, fmt.Errorf("empty process header")
+	}
+	header := make(map[string]interface{})
+	if err := msgpack.Unmarshal(doc[1:], &header); err != nil {
+		return nil, fmt.Errorf("unable to parse result header: %w", err)
+	}
+	return header, nil
+}
+
+/*
+ * GET /result/<pid>/header
+ *
+ * The result header alone, so that clients can allocate for the result
+ * before fetching it. The header is written when the process is scheduled,
+ * so it's available while the process is still working. Before that, the
+ * process is pending, like in Status. The header is JSON, or msgpack like in
+ * the result when asked for.
+ */
+func (r *Result) Header(ctx *gin.Context) {
 	pid := ctx.Param("pid")
+	contentType := acceptable(ctx, "application/json", resultContentType)
+	if contentType == "" {
+		return
+	}
+	cacheNever(ctx)
+
 	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err == redis.Nil {
+		/*
+		 * Not 404 - the token says the process exists, it's just not
+		 * scheduled yet, and clients should come back rather than give up
+		 */
+		wait := r.fallbackRetryAfter()
+		setRetryAfter(ctx, wait)
+		ctx.JSON(http.StatusAccepted, gin.H {
+			"location": fmt.Sprintf("result/%s/status", pid),
+			"status": "pending",
+			"retry_after_ms": wait.Milliseconds(),
+		})
+		return
+	}
 	if err != nil {
-		log.Printf("Unable to get process header: %v", err)
-		ctx.AbortWithStatus(http.StatusNotFound)
+		r.logger(pid).Error("unable to get result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	head, err := parseProcessHeader(body)
+	header, err := parseResultHeader(body)
 	if err != nil {
-		log.Printf("pid=%s, %v", pid, err)
+		r.logger(pid).Error("bad result header", "error", err)
 		ctx.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
-
-	if count < int64(head.Ntasks) {
-		ctx.AbortWithStatus(http.StatusAccepted)
+	if contentType == resultContentType {
+		doc, err := msgpack.Marshal(header)
+		if err != nil {
+			r.logger(pid).Error("unable to pack result header", "error", err)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.Data(http.StatusOK, resultContentType, doc)
 		return
 	}
+	ctx.JSON(http.StatusOK, header)
+}
 
-	tiles := make(chan []byte, 1000)
-	failure := make(chan error)
-	go collectResult(ctx, r.Storage, pid, head, tiles, failure)
-
-	result := make([]byte, 0)
-
-	for tile := range tiles {
-		result = append(result, tile...)
-	}
+func (r *Result) Status(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	s := r.sharedStatus(pid)
 
-	select {
-	case err = <-failure:
-		ctx.AbortWithStatus(http.StatusInternalServerError)
+	/*
+	 * Only the status may change, so never cache it. A finished status could
+	 * be cached, but the status is cheap and the client will go for the
+	 * result next anyway.
+	 */
+	cacheNever(ctx)
+	if s.body == nil {
+		ctx.AbortWithStatus(s.code)
 		return
-	default:
 	}
+	setRetryAfter(ctx, s.retryAfter)
+	ctx.JSON(s.code, s.body)
+}
 
-	ctx.Data(http.StatusOK, "application/octet-stream", result)
+/*
+ * Concurrent requests for the status of the same process share the same
+ * lookup. The shared lookup must not be tied to the request that happened to
+ * start it, or a disconnecting client would fail everyone else's request too.
+ */
+func (r *Result) sharedStatus(pid string) *status {
+	return r.statusflight.do(pid, r.StatusWindow, func() interface{} {
+		ctx, cancel := r.withTimeout(context.Background())
+		defer cancel()
+		return r.status(ctx, pid)
+	}).(*status)
 }
 
-func (r *Result) Status(ctx *gin.Context) {
-	pid := ctx.Param("pid")
+func (r *Result) status(ctx context.Context, pid string) *status {
 	/*
 	 * There's an interesting timing issue here - if /result is called before
 	 * the job is scheduled and the header written, it is considered pending.
 	 *
 	 * The fact that the token checks out means that it is essentially pending
-	 * - it's enqueued, but no processing has started [1]. Also, partial
-	 * results have a fairly short expiration set, and requests to /result
-	 * after expiration would still carry a valid auth token.
-	 *
-	 * The fix here is probably to include created-at and expiration in the
-	 * token as well - if the token checks out, but the header does not exist,
-	 * the status is pending.
+	 * - it's enqueued, but no processing has started [1]. The tokens carry
+	 * issued-at and expiration, and the auth middleware rejects expired tokens
+	 * with 410 Gone, so expired processes don't end up here - provided the
+	 * tokens expire before the partial results do.
 	 *
 	 * [1] the header-write step not completed, to be precise
+	 *
+	 * Cancelled processes have no header (or anything else) left, see
+	 * Cancel, so they must be told apart before that. They are gone for good,
+	 * and clients should stop polling.
 	 */
+	cancelled, err := r.cancelled(ctx, pid)
+	if err != nil {
+		r.logger(pid).Error("status lookup failed", "error", err)
+		return lookupFailed(err, "")
+	}
+	if cancelled {
+		return &status {
+			code: http.StatusGone,
+			body: gin.H { "status": "cancelled" },
+		}
+	}
+
 	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
 	if err == redis.Nil {
 		/* request sucessful, but key does not exist */
-		ctx.JSON(http.StatusAccepted, gin.H {
-			"location": fmt.Sprintf("result/%s/status", pid),
-			"status": "pending",
-		})
-		return
+		wait := r.fallbackRetryAfter()
+		return &status {
+			code: http.StatusAccepted,
+			body: gin.H {
+				"location": fmt.Sprintf("result/%s/status", pid),
+				"status": "pending",
+				"retry_after_ms": wait.Milliseconds(),
+			},
+			retryAfter: wait,
+		}
 	}
 	if err != nil {
-		log.Printf("%s %v", pid, err)
-		ctx.AbortWithStatus(http.StatusInternalServerError)
-		return
+		r.logger(pid).Error("status lookup failed", "error", err)
+		return lookupFailed(err, "")
 	}
 
 	proc, err := parseProcessHeader(body)
 	if err != nil {
-		log.Printf("%s %v", pid, err)
-		ctx.AbortWithStatus(http.StatusInternalServerError)
-		return
+		r.logger(pid).Error("bad process header", "error", err)
+		return &status { code: http.StatusInternalServerError }
 	}
 
-	count, err := r.Storage.XLen(ctx, pid).Result()
+	count, err := r.count(ctx, pid, proc)
 	if err != nil {
-		log.Printf("%s %v", pid, err)
-		ctx.AbortWithStatus(http.StatusInternalServerError)
-		return
+		r.logger(pid).Error("unable to count completed tasks", "error", err)
+		return lookupFailed(err, "")
 	}
 
-	done := count == int64(proc.Ntasks)
+	done := count >= int64(proc.Ntasks)
 	completed := fmt.Sprintf("%d/%d", count, proc.Ntasks)
+	fraction := progressFraction(count, proc.Ntasks)
+
+	/*
+	 * Errors are entries in the stream too, so a process can look done even
+	 * though it failed, and must be checked for errors either way
+	 */
+	msg, err := r.failed(ctx, pid, done)
+	if err != nil {
+		r.logger(pid).Error("unable to look up failure", "error", err)
+		return lookupFailed(err, completed)
+	}
+	if msg != "" {
+		body := failedBody(msg, completed)
+		body["fraction"] = fraction
+		return &status {
+			code: http.StatusFailedDependency,
+			body: body,
+		}
+	}
 
-	// TODO: add (and detect) failed status
 	if done {
-		ctx.JSON(http.StatusOK, gin.H {
+		/*
+		 * Uploaded results are finished too, but tell clients that Get
+		 * redirects to the upload
+		 */
+		state := "finished"
+		if r.isUploaded(ctx, pid) {
+			state = "uploaded"
+		}
+		body := gin.H {
 			"location": fmt.Sprintf("result/%s", pid),
-			"status": "finished",
-			"progress": completed,
-		})
-	} else {
-		ctx.JSON(http.StatusAccepted, gin.H {
-			"location": fmt.Sprintf("result/%s/status", pid),
-			"status": "working",
+			"status": state,
 			"progress": completed,
-		})
+			"fraction": fraction,
+		}
+		/*
+		 * Finished, but with no data, so that users understand why Get
+		 * has nothing for them
+		 */
+		if proc.IsEmpty() {
+			body["empty"] = true
+		}
+		return &status {
+			code: http.StatusOK,
+			body: body,
+		}
+	}
+
+	working := gin.H {
+		"location": fmt.Sprintf("result/%s/status", pid),
+		"status": "working",
+		"progress": completed,
+		"fraction": fraction,
+	}
+	/*
+	 * The estimate is only a nicety, so don't fail the status over it
+	 */
+	created, err := r.created(ctx, pid)
+	if err != nil {
+		r.logger(pid).Warn("unable to get creation time", "error", err)
+	}
+	now := time.Now()
+	eta, ok := secondsRemaining(created, now, count, proc.Ntasks)
+	if ok {
+		working["seconds_remaining"] = eta
+	}
+	wait := retryAfter(created, now, count, proc.Ntasks, r.fallbackRetryAfter())
+	working["retry_after_ms"] = wait.Milliseconds()
+	return &status {
+		code:       http.StatusAccepted,
+		body:       working,
+		retryAfter: wait,
 	}
 }
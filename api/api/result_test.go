@@ -0,0 +1,2410 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/equinor/oneseismic/api/frame"
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+func getStatus(result *Result, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid/status", result.Status)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/" + pid + "/status", nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestConcurrentStatusSharesLookup(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+
+	/*
+	 * Count the commands issued by a single status lookup, which should be
+	 * the same as for the many concurrent ones
+	 */
+	single := Result { Storage: storage }
+	getStatus(&single, "pid")
+	gets  := storage.called("get")
+	xlens := storage.called("xlen")
+
+	storage.latency = 20 * time.Millisecond
+	result := Result {
+		Storage:      storage,
+		StatusWindow: time.Second,
+	}
+
+	nrequests := 50
+	codes := make([]int, nrequests)
+	var wg sync.WaitGroup
+	for i := 0; i < nrequests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = getStatus(&result, "pid").Code
+		}(i)
+	}
+	wg.Wait()
+
+	for i, code := range codes {
+		if code != http.StatusAccepted {
+			t.Errorf("request %d: status = %d; want %d", i, code, http.StatusAccepted)
+		}
+	}
+	if n := storage.called("get") - gets; n != gets {
+		t.Errorf("GET called %d times; want %d", n, gets)
+	}
+	if n := storage.called("xlen") - xlens; n != xlens {
+		t.Errorf("XLEN called %d times; want %d", n, xlens)
+	}
+}
+
+func TestStatusLookupNotSharedAfterWindow(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+
+	result := Result { Storage: storage }
+	getStatus(&result, "pid")
+	gets := storage.called("get")
+	getStatus(&result, "pid")
+
+	if n := storage.called("get"); n != 2 * gets {
+		t.Errorf("GET called %d times; want %d", n, 2 * gets)
+	}
+}
+
+func TestStalledProcessFails(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.addAt("pid", "0/2", []byte("tile"), time.Now().Add(-time.Hour))
+
+	result := Result {
+		Storage:  storage,
+		MaxStall: time.Minute,
+	}
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusFailedDependency {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusFailedDependency)
+	}
+
+	body := map[string]string {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["status"] != "failed" {
+		t.Errorf("status = %s; want failed", body["status"])
+	}
+
+	/*
+	 * The stall is only a guess, and a process that completes after all is
+	 * served like any other
+	 */
+	storage.add("pid", "1/2", []byte("tile"))
+	w = getStatus(&result, "pid")
+	body = map[string]string {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusOK || body["status"] != "finished" {
+		t.Errorf("status = %d %s; want %d finished", w.Code, body["status"], http.StatusOK)
+	}
+	for _, path := range []string {
+		"/result/pid",
+		"/result/pid/stream",
+	} {
+		if w := requestResult(&result, path, ""); w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d; want %d", path, w.Code, http.StatusOK)
+		}
+	}
+}
+
+/*
+ * Processes without partial results may just be waiting in the queue
+ */
+func TestProcessWithoutProgressDoesNotStall(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	created := time.Now().Add(-time.Hour).UnixNano() / int64(time.Millisecond)
+	storage.set(createdkey("pid"), []byte(fmt.Sprint(created)))
+
+	result := Result {
+		Storage:  storage,
+		MaxStall: time.Minute,
+	}
+	w := getStatus(&result, "pid")
+	body := map[string]string {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["status"] != "working" {
+		t.Errorf("status = %s; want working", body["status"])
+	}
+}
+
+func TestStatusFraction(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(4))
+	storage.add("pid", "0/4", []byte("tile"))
+	result := Result { Storage: storage }
+
+	body := map[string]interface{} {}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &body)
+	if body["fraction"] != 0.25 {
+		t.Errorf("fraction = %v; want 0.25", body["fraction"])
+	}
+
+	for i := 1; i < 4; i++ {
+		storage.add("pid", fmt.Sprintf("%d/4", i), []byte("tile"))
+	}
+	body = map[string]interface{} {}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &body)
+	if body["status"] != "finished" || body["fraction"] != 1.0 {
+		t.Errorf("status = %v %v; want finished 1", body["status"], body["fraction"])
+	}
+}
+
+func TestStatusSecondsRemaining(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(4))
+	created := time.Now().Add(-time.Minute).UnixNano() / int64(time.Millisecond)
+	storage.set(createdkey("pid"), []byte(fmt.Sprint(created)))
+	result := Result { Storage: storage }
+
+	body := map[string]interface{} {}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &body)
+	if eta, ok := body["seconds_remaining"]; ok {
+		t.Errorf("seconds_remaining = %v before any task completed", eta)
+	}
+
+	/*
+	 * One of four tasks in a minute leaves three minutes
+	 */
+	storage.add("pid", "0/4", []byte("tile"))
+	body = map[string]interface{} {}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &body)
+	eta, ok := body["seconds_remaining"].(float64)
+	if !ok || eta < 179 || eta > 181 {
+		t.Errorf("seconds_remaining = %v; want 180", body["seconds_remaining"])
+	}
+}
+
+func TestSecondsRemaining(t *testing.T) {
+	now := time.Now()
+	created := now.Add(-10 * time.Second)
+	cases := []struct {
+		created time.Time
+		count   int64
+		want    float64
+		ok      bool
+	} {
+		{ created,     0, 0,  false },
+		{ time.Time{}, 1, 0,  false },
+		{ created,     1, 90, true  },
+		{ created,     5, 10, true  },
+		{ created,    10, 0,  true  },
+	}
+	for _, c := range cases {
+		eta, ok := secondsRemaining(c.created, now, c.count, 10)
+		if eta != c.want || ok != c.ok {
+			t.Errorf(
+				"secondsRemaining(%v, %d) = %v, %v; want %v, %v",
+				c.created,
+				c.count,
+				eta,
+				ok,
+				c.want,
+				c.ok,
+			)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Now()
+	fallback := 7 * time.Second
+	cases := []struct {
+		created time.Time
+		count   int64
+		want    time.Duration
+	} {
+		/* no progress, nothing to estimate from */
+		{ now.Add(-10 * time.Second),       0, fallback         },
+		{ time.Time{},                      1, fallback         },
+		/* 1 of 10 in 1s leaves 9s */
+		{ now.Add(-time.Second),            1, 9 * time.Second  },
+		/* floor */
+		{ now.Add(-100 * time.Millisecond), 1, time.Second      },
+		/* ceiling */
+		{ now.Add(-time.Minute),            1, 30 * time.Second },
+	}
+	for _, c := range cases {
+		wait := retryAfter(c.created, now, c.count, 10, fallback)
+		if wait != c.want {
+			t.Errorf(
+				"retryAfter(%v, %d) = %v; want %v",
+				c.created,
+				c.count,
+				wait,
+				c.want,
+			)
+		}
+	}
+}
+
+func TestWorkingProcessHasRetryAfter(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(4))
+	created := time.Now().Add(-3 * time.Second).UnixNano() / int64(time.Millisecond)
+	storage.set(createdkey("pid"), []byte(fmt.Sprint(created)))
+	storage.add("pid", "0/4", []byte("tile"))
+	result := Result { Storage: storage }
+
+	/*
+	 * One of four tasks in 3s leaves about 9s
+	 */
+	responses := map[string]*httptest.ResponseRecorder {
+		"status": getStatus(&result, "pid"),
+		"result": getResult(&result, "pid"),
+	}
+	for name, w := range responses {
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%s: status = %d; want %d", name, w.Code, http.StatusAccepted)
+			continue
+		}
+		if ra := w.Header().Get("Retry-After"); ra != "9" && ra != "10" {
+			t.Errorf("%s: Retry-After = %q; want 9", name, ra)
+		}
+		body := map[string]interface{} {}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		ms, ok := body["retry_after_ms"].(float64)
+		if !ok || ms < 8500 || ms > 9500 {
+			t.Errorf("%s: retry_after_ms = %v; want 9000", name, body["retry_after_ms"])
+		}
+	}
+}
+
+func TestPendingProcessHasDefaultRetryAfter(t *testing.T) {
+	result := Result {
+		Storage:    newFakeStorage(),
+		RetryAfter: 5 * time.Second,
+	}
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "5" {
+		t.Errorf("Retry-After = %q; want 5", ra)
+	}
+	body := map[string]interface{} {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if ms := body["retry_after_ms"]; ms != 5000.0 {
+		t.Errorf("retry_after_ms = %v; want 5000", ms)
+	}
+
+	result.RetryAfter = 0
+	if ra := getStatus(&result, "pid").Header().Get("Retry-After"); ra != "2" {
+		t.Errorf("Retry-After = %q; want the default, 2", ra)
+	}
+}
+
+func TestProgressingProcessIsWorking(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.addAt("pid", "0/2", []byte("tile"), time.Now().Add(-time.Hour))
+	storage.add("pid", "1/2", []byte("tile"))
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+
+	result := Result {
+		Storage:  storage,
+		MaxStall: time.Minute,
+	}
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	body := map[string]string {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["status"] != "working" {
+		t.Errorf("status = %s; want working", body["status"])
+	}
+}
+
+func TestErrorEntryFailsProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("tile"))
+	storage.add("pid", "error", []byte("1/3: download failed"))
+
+	result := Result { Storage: storage }
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusFailedDependency {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusFailedDependency)
+	}
+
+	body := map[string]string {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["status"] != "failed" {
+		t.Errorf("status = %s; want failed", body["status"])
+	}
+	if body["error"] != "1/3: download failed" {
+		t.Errorf("error = %s; want 1/3: download failed", body["error"])
+	}
+
+	/*
+	 * The error is recorded, so the stream is only scanned once
+	 */
+	scans := storage.called("xrevrange")
+	getStatus(&result, "pid")
+	if n := storage.called("xrevrange"); n != scans {
+		t.Errorf("stream scanned %d times; want %d", n, scans)
+	}
+}
+
+/*
+ * The error entry counts towards the length of the stream, so a process with
+ * an error can look complete
+ */
+func TestErrorEntryFailsCompleteLookingProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+	storage.add("pid", "error", []byte("1/2: download failed"))
+
+	result := Result { Storage: storage }
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusFailedDependency {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusFailedDependency)
+	}
+
+	w = getResult(&result, "pid")
+	if w.Code != http.StatusFailedDependency {
+		t.Errorf("result: status = %d; want %d", w.Code, http.StatusFailedDependency)
+	}
+}
+
+/*
+ * Processes that fail before any task completes, and after some have, for
+ * the failure tests below
+ */
+func failedProcesses() map[string]*fakeStorage {
+	first := newFakeStorage()
+	first.set(headerkey("pid"), fakeProcessHeader(3))
+	first.addValues("pid", map[string]interface{} {
+		"error": "0/3: download failed",
+	})
+
+	partial := newFakeStorage()
+	partial.set(headerkey("pid"), fakeProcessHeader(3))
+	partial.add("pid", "0/3", []byte("tile"))
+	partial.addValues("pid", map[string]interface{} {
+		"error": "1/3: download failed",
+	})
+
+	return map[string]*fakeStorage {
+		"before any tiles":    first,
+		"after some progress": partial,
+	}
+}
+
+func TestStatusReportsFailure(t *testing.T) {
+	for name, storage := range failedProcesses() {
+		result := Result { Storage: storage }
+		w := getStatus(&result, "pid")
+		if w.Code != http.StatusFailedDependency {
+			t.Errorf("%s: status = %d; want %d", name, w.Code, http.StatusFailedDependency)
+		}
+		body := map[string]interface{} {}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if body["status"] != "failed" {
+			t.Errorf("%s: status = %v; want failed", name, body["status"])
+		}
+		if msg, _ := body["error"].(string); !strings.Contains(msg, "download failed") {
+			t.Errorf("%s: error = %v; want the error of the task", name, body["error"])
+		}
+	}
+}
+
+/*
+ * Get and Stream respond with the failure, rather than reporting the process
+ * as working, or waiting for tasks that never complete
+ */
+func TestGetAndStreamReportFailure(t *testing.T) {
+	for name, storage := range failedProcesses() {
+		result := Result {
+			Storage: storage,
+			Timeout: time.Second,
+		}
+		for _, path := range []string {
+			"/result/pid",
+			"/result/pid/stream",
+			"/result/pid/stream?framing=v2",
+		} {
+			w := requestResult(&result, path, "")
+			if w.Code != http.StatusFailedDependency {
+				t.Errorf("%s: %s status = %d; want %d",
+					name, path, w.Code, http.StatusFailedDependency)
+				continue
+			}
+			body := map[string]interface{} {}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if body["status"] != "failed" || body["code"] != frame.ErrorTaskFailed {
+				t.Errorf("%s: %s body = %s; want failed task", name, path, w.Body)
+			}
+		}
+	}
+}
+
+/*
+ * Storage where the stream lengths can't be read
+ */
+type uncountableStorage struct {
+	*fakeStorage
+}
+
+func (s uncountableStorage) XLen(ctx context.Context, stream string) *redis.IntCmd {
+	return redis.NewIntResult(0, connreset)
+}
+
+/*
+ * A process with tasks that can't be counted is neither working nor done,
+ * and must not be reported as either
+ */
+func TestUncountedTasksFailRequest(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+	result := Result {
+		Storage: uncountableStorage { storage },
+		Timeout: time.Second,
+	}
+
+	if w := getStatus(&result, "pid"); w.Code != http.StatusInternalServerError {
+		t.Errorf("status: status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	for _, path := range []string {
+		"/result/pid",
+		"/result/pid/stream",
+	} {
+		w := requestResult(&result, path, "")
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("%s: status = %d; want %d",
+				path, w.Code, http.StatusInternalServerError)
+		}
+	}
+}
+
+func TestErrorScanIsBounded(t *testing.T) {
+	ntasks := errorScanCount + 2
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks + 1))
+	storage.add("pid", "error", []byte("0/n: download failed"))
+	for i := 1; i < ntasks; i++ {
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), []byte("tile"))
+	}
+
+	/*
+	 * The error is too far back to be found, so the process is still working
+	 */
+	result := Result { Storage: storage }
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+}
+
+func getResult(result *Result, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/" + pid, nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func headResult(result *Result, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.HEAD("/result/:pid", result.Head)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodHead, "/result/" + pid, nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestHeadHasHeadersOfGet(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	get  := getResult(&result, "pid")
+	head := headResult(&result, "pid")
+	if head.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", head.Code, http.StatusOK)
+	}
+	if head.Body.Len() != 0 {
+		t.Errorf("body = %q; want none", head.Body)
+	}
+	if cl := head.Header().Get("Content-Length"); cl != fmt.Sprint(get.Body.Len()) {
+		t.Errorf("Content-Length = %s; want %d", cl, get.Body.Len())
+	}
+	for _, key := range []string { "Content-Type", "ETag", "Cache-Control" } {
+		if head.Header().Get(key) != get.Header().Get(key) {
+			t.Errorf(
+				"%s = %s; want %s",
+				key,
+				head.Header().Get(key),
+				get.Header().Get(key),
+			)
+		}
+	}
+}
+
+func TestHeadOfUnfinishedResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	w := headResult(&result, "pid")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("ETag = %s; want none for working result", etag)
+	}
+
+	w = headResult(&result, "no-such-pid")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func getHeader(result *Result, pid, accept string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid/header", result.Header)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/" + pid + "/header", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestHeaderAsJSON(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	result := Result { Storage: storage }
+
+	w := getHeader(&result, "pid", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %s; want application/json", ct)
+	}
+
+	var header map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &header); err != nil {
+		t.Fatalf("unable to parse header: %v", err)
+	}
+	if nbundles := header["nbundles"]; nbundles != 2.0 {
+		t.Errorf("nbundles = %v; want 2", nbundles)
+	}
+}
+
+func TestHeaderAsMsgpack(t *testing.T) {
+	/*
+	 * The scheduler writes the tag of the bundles array after the header, which
+	 * is not a part of it
+	 */
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), append(fakeProcessHeader(2), 0x92))
+	result := Result { Storage: storage }
+
+	w := getHeader(&result, "pid", resultContentType)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != resultContentType {
+		t.Errorf("Content-Type = %s; want %s", ct, resultContentType)
+	}
+
+	header, err := parseResultHeader(append([]byte{ 0x92 }, w.Body.Bytes()...))
+	if err != nil {
+		t.Fatalf("unable to parse header: %v", err)
+	}
+	want, _ := parseResultHeader(fakeProcessHeader(2))
+	if fmt.Sprint(header) != fmt.Sprint(want) {
+		t.Errorf("header = %v; want %v", header, want)
+	}
+}
+
+func TestHeaderOfPendingProcess(t *testing.T) {
+	result := Result { Storage: newFakeStorage() }
+	w := getHeader(&result, "pid", "")
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %s; want no-store", cc)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "2" {
+		t.Errorf("Retry-After = %q; want the default, 2", ra)
+	}
+}
+
+func TestHeaderOfWorkingProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+	result := Result { Storage: storage }
+
+	w := getHeader(&result, "pid", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestGetVerifiesBundleCount(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+
+	result := Result {
+		Storage:       storage,
+		VerifyBundles: true,
+	}
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	want := string(fakeProcessHeader(2)) + "tile-0tile-1"
+	if w.Body.String() != want {
+		t.Errorf("body = %q; want %q", w.Body.String(), want)
+	}
+}
+
+func TestGetFailsOnBundleCountMismatch(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	/* A task written twice, e.g. by a re-delivered job */
+	storage.add("pid", "1/2", []byte("tile-1"))
+
+	result := Result {
+		Storage:       storage,
+		VerifyBundles: true,
+	}
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+	if !strings.Contains(w.Body.String(), "3 bundles") {
+		t.Errorf("body = %s; expected it to describe the mismatch", w.Body)
+	}
+}
+
+func TestFinishedResultIsImmutable(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+
+	w := getResult(&Result { Storage: storage }, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	cachecontrol := w.Header().Get("Cache-Control")
+	if !strings.Contains(cachecontrol, "immutable") {
+		t.Errorf("Cache-Control = %s; want immutable", cachecontrol)
+	}
+	if !strings.Contains(cachecontrol, "max-age=") {
+		t.Errorf("Cache-Control = %s; want max-age", cachecontrol)
+	}
+	vary := strings.Join(w.Header().Values("Vary"), ", ")
+	if !strings.Contains(vary, "Authorization") {
+		t.Errorf("Vary = %s; want Authorization", vary)
+	}
+	if etag := w.Header().Get("ETag"); etag == "" {
+		t.Errorf("expected ETag on finished result")
+	}
+}
+
+func getResultIfNoneMatch(result *Result, ifNoneMatch string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+	req.Header.Set("If-None-Match", ifNoneMatch)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestFinishedResultNotModified(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	etag := getResult(&result, "pid").Header().Get("ETag")
+	xreads := storage.called("xread")
+
+	for _, ifNoneMatch := range []string { etag, "W/" + etag, `"other", ` + etag, "*" } {
+		w := getResultIfNoneMatch(&result, ifNoneMatch)
+		if w.Code != http.StatusNotModified {
+			t.Errorf(
+				"%s: status = %d; want %d",
+				ifNoneMatch,
+				w.Code,
+				http.StatusNotModified,
+			)
+		}
+		if got := w.Header().Get("ETag"); got != etag {
+			t.Errorf("%s: ETag = %s; want %s", ifNoneMatch, got, etag)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("%s: body = %q; want none", ifNoneMatch, w.Body)
+		}
+	}
+
+	/*
+	 * Not modified is answered without reading the result
+	 */
+	if n := storage.called("xread"); n != xreads {
+		t.Errorf("XREAD called %d times for not modified; want 0", n - xreads)
+	}
+
+	w := getResultIfNoneMatch(&result, `"other"`)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+/*
+ * Compressed results have weak ETags, which are still good for If-None-Match
+ */
+func TestCompressedResultNotModified(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(make([]float32, 1024)...))
+	result := Result { Storage: storage }
+
+	request := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		app := gin.New()
+		app.Use(util.Compression())
+		app.GET("/result/:pid", result.Get)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("")
+	etag := w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, "W/") {
+		t.Fatalf("ETag = %s; want weak for compressed result", etag)
+	}
+
+	w = request(etag)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestWorkingResultIsNeverNotModified(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+	result := Result { Storage: storage }
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+
+	w := getResultIfNoneMatch(&result, resultETag("pid", head))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("ETag = %s; want none for working result", etag)
+	}
+}
+
+func TestWorkingResultIsNotCached(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+
+	w := getResult(&Result { Storage: storage }, "pid")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	if cachecontrol := w.Header().Get("Cache-Control"); cachecontrol != "no-store" {
+		t.Errorf("Cache-Control = %s; want no-store", cachecontrol)
+	}
+	if etag := w.Header().Get("ETag"); etag != "" {
+		t.Errorf("ETag = %s; want none for working result", etag)
+	}
+
+	w = getStatus(&Result { Storage: storage }, "pid")
+	if cachecontrol := w.Header().Get("Cache-Control"); cachecontrol != "no-store" {
+		t.Errorf("status Cache-Control = %s; want no-store", cachecontrol)
+	}
+}
+
+func TestGetTimesOutOnMissingTasks(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+
+	/*
+	 * The process is announced as completed, but the last partial result
+	 * never shows up
+	 */
+	w := newTestWatcher(storage)
+	w.complete("pid", 2)
+	result := Result {
+		Storage:     storage,
+		Completions: w,
+		Timeout:     50 * time.Millisecond,
+	}
+
+	rec := getResult(&result, "pid")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d; want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	body := map[string]string {}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["progress"] != "1/2" {
+		t.Errorf("progress = %s; want 1/2", body["progress"])
+	}
+}
+
+func TestStreamEndsOnTimeout(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid/stream", nil)
+
+	done := make(chan struct{})
+	go func() {
+		app.ServeHTTP(rec, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream did not end after timeout")
+	}
+
+	if !strings.HasSuffix(rec.Body.String(), "tile-0") {
+		t.Errorf("expected partial result in stream; got %q", rec.Body.String())
+	}
+}
+
+func TestStatusTimesOut(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.latency = time.Second
+
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+	rec := getStatus(&result, "pid")
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+}
+
+/*
+ * A response writer that records when each write happened
+ */
+type timedWriter struct {
+	*httptest.ResponseRecorder
+	writes []time.Time
+}
+
+func (w *timedWriter) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, time.Now())
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestStreamBurstsThenThrottles(t *testing.T) {
+	storage := newFakeStorage()
+	ntasks := 6
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		part := fmt.Sprintf("%d/%d", i, ntasks)
+		storage.add("pid", part, []byte(part))
+	}
+
+	interval := 40 * time.Millisecond
+	result := Result {
+		Storage:     storage,
+		StreamBurst: 3,
+		StreamRate:  float64(time.Second / interval),
+	}
+
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	w := &timedWriter { ResponseRecorder: httptest.NewRecorder() }
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid/stream", nil)
+	app.ServeHTTP(w, req)
+
+	/* the header, then the bundles */
+	if len(w.writes) != ntasks + 1 {
+		t.Fatalf("got %d writes; want %d", len(w.writes), ntasks + 1)
+	}
+
+	start := w.writes[0]
+	if burst := w.writes[3].Sub(start); burst > interval / 2 {
+		t.Errorf("burst took %v; want < %v", burst, interval / 2)
+	}
+	for i := 4; i < len(w.writes); i++ {
+		gap := w.writes[i].Sub(w.writes[i - 1])
+		if gap < interval * 3 / 4 {
+			t.Errorf("tile %d after %v; want >= %v", i, gap, interval)
+		}
+	}
+}
+
+func TestStreamCollectorExitsOnDisconnect(t *testing.T) {
+	/*
+	 * The tile must be large enough to not sit in the response buffers, or
+	 * the client would never see it before the stream ends
+	 */
+	tile := bytes.Repeat([]byte("x"), 64 * 1024)
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", tile)
+
+	result := Result { Storage: storage }
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+
+	before := runtime.NumGoroutine()
+	transport := &http.Transport {}
+	client := http.Client { Transport: transport }
+	resp, err := client.Get(srv.URL + "/result/pid/stream")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := io.ReadFull(resp.Body, make([]byte, len(tile))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	resp.Body.Close()
+	transport.CloseIdleConnections()
+
+	/*
+	 * The last task never completes, so the only way the goroutines go away
+	 * is the collector noticing that the client is gone
+	 */
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf(
+				"goroutines = %d after disconnect; want <= %d",
+				runtime.NumGoroutine(),
+				before,
+			)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func deleteResult(result *Result, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.DELETE("/result/:pid", result.Delete)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/result/" + pid, nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestDeletePurgesResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+
+	result := Result { Storage: storage }
+	w := deleteResult(&result, "pid")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+
+	if _, ok := storage.keys[headerkey("pid")]; ok {
+		t.Errorf("header not deleted")
+	}
+	if _, ok := storage.streams["pid"]; ok {
+		t.Errorf("stream not deleted")
+	}
+
+	w = deleteResult(&result, "pid")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeleteUnknownProcess(t *testing.T) {
+	result := Result { Storage: newFakeStorage() }
+	w := deleteResult(&result, "pid")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+/*
+ * Queries outside the cube have no tasks, and their result is the header
+ * alone
+ */
+func TestGetEmptyResultIsNoContent(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(0))
+	result := Result { Storage: storage }
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("body = %q; want nothing", w.Body.Bytes())
+	}
+	if w := headResult(&result, "pid"); w.Code != http.StatusNoContent {
+		t.Errorf("HEAD status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestGetResultOfEmptyTilesIsNoContent(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte{})
+	storage.add("pid", "1/2", []byte{})
+	result := Result { Storage: storage }
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+}
+
+func TestStreamEmptyResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(0))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get(emptyHeader) != "true" {
+		t.Errorf("%s = %q; want true", emptyHeader, w.Header().Get(emptyHeader))
+	}
+	frames := decodeFrames(t, w.Body.Bytes())
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames; want header and end", len(frames))
+	}
+	if frames[0].Type != frame.Header || frames[1].Type != frame.End {
+		t.Errorf("frames = %v, %v; want header, end", frames[0].Type, frames[1].Type)
+	}
+}
+
+func TestStatusEmptyResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(0))
+	result := Result { Storage: storage }
+
+	w := getStatus(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Errorf("status code = %d; want %d", w.Code, http.StatusOK)
+	}
+	body := map[string]interface{} {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["status"] != "finished" || body["empty"] != true {
+		t.Errorf("status = %v; want finished and empty", body)
+	}
+}
+
+func cancelResult(result *Result, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.POST("/result/:pid/cancel", result.Cancel)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/result/" + pid + "/cancel", nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestCancelFlagsProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+	result := Result { Storage: storage }
+
+	w := cancelResult(&result, "pid")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	if _, ok := storage.keys[cancelledkey("pid")]; !ok {
+		t.Errorf("process not flagged as cancelled")
+	}
+	if storage.ttl(cancelledkey("pid")) != DefaultResultTTL {
+		t.Errorf("cancelled flag does not expire with the result")
+	}
+	if _, ok := storage.streams["pid"]; ok {
+		t.Errorf("stream not deleted")
+	}
+
+	w = getStatus(&result, "pid")
+	if w.Code != http.StatusGone {
+		t.Errorf("status code = %d; want %d", w.Code, http.StatusGone)
+	}
+	body := map[string]string {}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body["status"] != "cancelled" {
+		t.Errorf("status = %s; want cancelled", body["status"])
+	}
+}
+
+/*
+ * Processes can be cancelled before the header is written, and must stay
+ * cancelled when it is
+ */
+func TestCancelPendingProcess(t *testing.T) {
+	storage := newFakeStorage()
+	result := Result { Storage: storage }
+
+	if w := cancelResult(&result, "pid"); w.Code != http.StatusAccepted {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusAccepted)
+	}
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+
+	body := map[string]string {}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &body)
+	if body["status"] != "cancelled" {
+		t.Errorf("status = %s; want cancelled", body["status"])
+	}
+}
+
+func requestResult(
+	result *Result,
+	path   string,
+	accept string,
+) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	app.GET("/result/:pid/stream", result.Stream)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestResultContentTypes(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	cases := []struct {
+		path        string
+		accept      string
+		contentType string
+	} {
+		{ "/result/pid",        "",                                "application/x-msgpack" },
+		{ "/result/pid",        "*/*",                             "application/x-msgpack" },
+		{ "/result/pid",        "application/x-msgpack",           "application/x-msgpack" },
+		{ "/result/pid/stream", "",                                "application/x-oneseismic-stream" },
+		{ "/result/pid/stream", "application/*",                   "application/x-oneseismic-stream" },
+		{ "/result/pid/stream", "application/x-oneseismic-stream", "application/x-oneseismic-stream" },
+	}
+
+	for _, c := range cases {
+		w := requestResult(&result, c.path, c.accept)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s (Accept: %s): status = %d", c.path, c.accept, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != c.contentType {
+			t.Errorf(
+				"%s (Accept: %s): Content-Type = %s; want %s",
+				c.path,
+				c.accept,
+				ct,
+				c.contentType,
+			)
+		}
+		/*
+		 * The body is the same msgpack document regardless of how it's
+		 * advertised, so existing clients keep working
+		 */
+		if !strings.HasSuffix(w.Body.String(), "tile") {
+			t.Errorf("%s: unexpected body %q", c.path, w.Body.String())
+		}
+	}
+}
+
+func TestResultNotAcceptable(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	for _, path := range []string { "/result/pid", "/result/pid/stream" } {
+		w := requestResult(&result, path, "text/html")
+		if w.Code != http.StatusNotAcceptable {
+			t.Errorf(
+				"%s: status = %d; want %d",
+				path,
+				w.Code,
+				http.StatusNotAcceptable,
+			)
+		}
+	}
+}
+
+func TestStreamContentTypeIsConfigurable(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result {
+		Storage:           storage,
+		StreamContentType: "application/octet-stream",
+	}
+
+	w := requestResult(&result, "/result/pid/stream", "")
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Content-Type = %s; want application/octet-stream", ct)
+	}
+
+	w = requestResult(&result, "/result/pid/stream", "application/octet-stream")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+func decodeFrames(t *testing.T, body []byte) []*frame.Frame {
+	frames := make([]*frame.Frame, 0)
+	dec := frame.NewDecoder(bytes.NewReader(body))
+	for {
+		f, err := dec.Decode()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		frames = append(frames, f)
+	}
+}
+
+func TestStreamFraming(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeProcessHeader(2)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	ids := []string {
+		storage.streams["pid"][0].ID,
+		storage.streams["pid"][1].ID,
+	}
+	result := Result { Storage: storage }
+
+	requests := []struct {
+		path   string
+		accept string
+	} {
+		{ "/result/pid/stream",            "application/x-oneseismic-frames" },
+		{ "/result/pid/stream?framing=v1", "" },
+	}
+
+	for _, req := range requests {
+		w := requestResult(&result, req.path, req.accept)
+		ct := w.Header().Get("Content-Type")
+		if ct != "application/x-oneseismic-frames" {
+			t.Errorf("Content-Type = %s; want framed", ct)
+		}
+
+		frames := decodeFrames(t, w.Body.Bytes())
+		want := []frame.Frame {
+			{ Type: frame.Header, Payload: header },
+			{ Type: frame.Tile,   Payload: []byte("tile-0") },
+			{ Type: frame.Cursor, Payload: []byte(ids[0]) },
+			{ Type: frame.Tile,   Payload: []byte("tile-1") },
+			{ Type: frame.Cursor, Payload: []byte(ids[1]) },
+			{ Type: frame.End,    Payload: []byte{} },
+		}
+		if len(frames) != len(want) {
+			t.Fatalf("got %d frames; want %d", len(frames), len(want))
+		}
+		for i := range want {
+			if frames[i].Type != want[i].Type {
+				t.Errorf("frame %d: type = %v; want %v", i, frames[i].Type, want[i].Type)
+			}
+			if !bytes.Equal(frames[i].Payload, want[i].Payload) {
+				t.Errorf("frame %d: payload = %q; want %q", i, frames[i].Payload, want[i].Payload)
+			}
+		}
+	}
+}
+
+func TestStreamFramingVersion2(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream?framing=v2", "")
+	ct := w.Header().Get("Content-Type")
+	if ct != "application/x-oneseismic-frames; version=2" {
+		t.Errorf("Content-Type = %s; want framed version 2", ct)
+	}
+
+	body := w.Body.Bytes()
+	frames := decodeFrames(t, body)
+	if end := frames[len(frames) - 1]; end.Type != frame.End {
+		t.Errorf("last frame = %v; want %v", end.Type, frame.End)
+	}
+	if got := framePayload(frames); !bytes.Contains(got, []byte("tile-1")) {
+		t.Errorf("payload = %q; want tile-1 in it", got)
+	}
+
+	corrupted := append([]byte{}, body...)
+	corrupted[bytes.Index(corrupted, []byte("tile-0"))] = 'T'
+	dec := frame.NewDecoder(bytes.NewReader(corrupted))
+	for {
+		_, err := dec.Decode()
+		var ierr *frame.IntegrityError
+		if errors.As(err, &ierr) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("err = %v; want *frame.IntegrityError", err)
+		}
+	}
+}
+
+func TestCompletedGetLogsFinished(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	var logs bytes.Buffer
+	result := Result {
+		Storage: storage,
+		Logger:  logging.New(&logs, logging.Info),
+	}
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if entry["msg"] != "finished" {
+			continue
+		}
+		if entry["pid"] != "pid" || entry["level"] != "info" {
+			t.Errorf("finished = %v; want info with pid", entry)
+		}
+		if entry["bundles"] != float64(2) {
+			t.Errorf("bundles = %v; want 2", entry["bundles"])
+		}
+		return
+	}
+	t.Errorf("no finished event in logs %q", logs.String())
+}
+
+func TestStreamProgressFrames(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeProcessHeader(2)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-01"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1&progress=true", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if n := w.Header().Get(bundlesTotalHeader); n != "2" {
+		t.Errorf("%s = %s; want 2", bundlesTotalHeader, n)
+	}
+	if n := w.Header().Get(bytesTotalHeader); n != "" {
+		t.Errorf("%s = %s; want none without total-bytes", bytesTotalHeader, n)
+	}
+
+	progress := make([]frame.ProgressInfo, 0)
+	for _, f := range decodeFrames(t, w.Body.Bytes()) {
+		if f.Type != frame.Progress {
+			continue
+		}
+		info, err := frame.UnpackProgress(f.Payload)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		progress = append(progress, info)
+	}
+	headsize := uint64(len(header))
+	want := []frame.ProgressInfo {
+		{ Bundle: 1, Bundles: 2, Bytes: headsize + 6 },
+		{ Bundle: 2, Bundles: 2, Bytes: headsize + 6 + 7 },
+	}
+	if len(progress) != len(want) {
+		t.Fatalf("progress = %+v; want %+v", progress, want)
+	}
+	for i := range want {
+		if progress[i] != want[i] {
+			t.Errorf("progress[%d] = %+v; want %+v", i, progress[i], want[i])
+		}
+	}
+}
+
+func TestStreamHasNoProgressFramesByDefault(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1", "")
+	for _, f := range decodeFrames(t, w.Body.Bytes()) {
+		if f.Type == frame.Progress {
+			t.Fatalf("progress frame without ?progress=true")
+		}
+	}
+}
+
+func TestStreamBytesTotalFromHeader(t *testing.T) {
+	storage := newFakeStorage()
+	var body bytes.Buffer
+	enc := msgpack.NewEncoder(&body)
+	enc.SetSortMapKeys(true)
+	enc.Encode(map[string]interface{} {
+		"function":    message.FunctionSlice,
+		"nbundles":    1,
+		"total-bytes": 4096,
+	})
+	storage.set(headerkey("pid"), append([]byte{ 0x92 }, body.Bytes()...))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream", "")
+	if n := w.Header().Get(bytesTotalHeader); n != "4096" {
+		t.Errorf("%s = %s; want 4096", bytesTotalHeader, n)
+	}
+	if n := w.Header().Get(bundlesTotalHeader); n != "1" {
+		t.Errorf("%s = %s; want 1", bundlesTotalHeader, n)
+	}
+}
+
+func TestGetHasTotals(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if n := w.Header().Get(bundlesTotalHeader); n != "2" {
+		t.Errorf("%s = %s; want 2", bundlesTotalHeader, n)
+	}
+	size := fmt.Sprint(w.Body.Len())
+	if n := w.Header().Get(bytesTotalHeader); n != size {
+		t.Errorf("%s = %s; want %s", bytesTotalHeader, n, size)
+	}
+}
+
+/*
+ * Stream the result over a real connection, as trailers only exist on the
+ * wire, and get the body and trailers
+ */
+func streamTrailers(t *testing.T, result *Result, path string) (string, http.Header) {
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+	return readTrailers(t, srv.Client(), srv.URL + path)
+}
+
+/*
+ * Like streamTrailers, but over HTTP/2, where trailers are a HEADERS frame
+ * after the body rather than a part of the chunked encoding
+ */
+func streamTrailersHTTP2(
+	t      *testing.T,
+	result *Result,
+	path   string,
+) (string, http.Header) {
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	srv := httptest.NewUnstartedServer(app)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	return readTrailers(t, srv.Client(), srv.URL + path)
+}
+
+func readTrailers(t *testing.T, client *http.Client, url string) (string, http.Header) {
+	res, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d; want %d", res.StatusCode, http.StatusOK)
+	}
+	if _, ok := res.Trailer[http.CanonicalHeaderKey(statusTrailer)]; !ok {
+		t.Errorf("Trailer %s not declared; got %v", statusTrailer, res.Trailer)
+	}
+	/*
+	 * The trailers are only filled in once the body is read to the end
+	 */
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return string(body), res.Trailer
+}
+
+func TestStreamStatusTrailerWhenDone(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	for _, path := range []string {
+		"/result/pid/stream?trailer=true",
+		"/result/pid/stream?framing=v1&trailer=true",
+	} {
+		_, trailer := streamTrailers(t, &result, path)
+		if status := trailer.Get(statusTrailer); status != "done" {
+			t.Errorf("%s: status = %q; want done", path, status)
+		}
+	}
+}
+
+func TestStreamStatusTrailerIsOptIn(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+
+	res, err := srv.Client().Get(srv.URL + "/result/pid/stream")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer res.Body.Close()
+	if declared := res.Header.Get("Trailer"); declared != "" {
+		t.Errorf("Trailer = %q; want none without ?trailer=true", declared)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.HasSuffix(string(body), "tile-0tile-1") {
+		t.Errorf("expected the whole result in stream; got %q", body)
+	}
+	if len(res.Trailer) != 0 {
+		t.Errorf("trailers = %v; want none without ?trailer=true", res.Trailer)
+	}
+}
+
+func TestStreamStatusTrailerOverHTTP2(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	_, trailer := streamTrailersHTTP2(t, &result, "/result/pid/stream?framing=v2&trailer=true")
+	if status := trailer.Get(statusTrailer); status != "done" {
+		t.Errorf("status = %q; want done", status)
+	}
+
+	storage = newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	addCompressed(t, storage, "0/1", bytes.Repeat([]byte("x"), 1024 * 1024))
+	result = Result {
+		Storage:      storage,
+		MaxTileBytes: 1024,
+	}
+	_, trailer = streamTrailersHTTP2(t, &result, "/result/pid/stream?framing=v2&trailer=true")
+	if status := trailer.Get(statusTrailer); !strings.HasPrefix(status, "error: ") {
+		t.Errorf("status = %q; want error: <message>", status)
+	}
+}
+
+func TestStreamStatusTrailerOnTimeout(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+
+	body, trailer := streamTrailers(t, &result, "/result/pid/stream?trailer=true")
+	if !strings.HasSuffix(body, "tile-0") {
+		t.Errorf("expected partial result in stream; got %q", body)
+	}
+	if status := trailer.Get(statusTrailer); status != "timeout" {
+		t.Errorf("status = %q; want timeout", status)
+	}
+}
+
+func TestStreamStatusTrailerOnError(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	addCompressed(t, storage, "0/1", bytes.Repeat([]byte("x"), 1024 * 1024))
+	result := Result {
+		Storage:      storage,
+		MaxTileBytes: 1024,
+	}
+
+	_, trailer := streamTrailers(t, &result, "/result/pid/stream?trailer=true")
+	status := trailer.Get(statusTrailer)
+	if !strings.HasPrefix(status, "error: ") {
+		t.Errorf("status = %q; want error: <message>", status)
+	}
+}
+
+func TestFramedStreamReportsErrors(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1", "")
+	frames := decodeFrames(t, w.Body.Bytes())
+	last := frames[len(frames) - 1]
+	if last.Type != frame.Error {
+		t.Errorf("last frame = %v; want %v", last.Type, frame.Error)
+	}
+}
+
+/*
+ * Version 2 error frames tell the kind of failure and the task that failed,
+ * and are the last thing in the stream
+ */
+func TestFramedStreamReportsStructuredErrors(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("tile-0"))
+	result := Result { Storage: storage }
+
+	/*
+	 * The task fails after the stream started, as streams of processes that
+	 * are already failed are rejected up front
+	 */
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		storage.addValues("pid", map[string]interface{} {
+			"error": "1/3: fragment not found",
+		})
+	}()
+
+	w := requestResult(&result, "/result/pid/stream?framing=v2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	frames := decodeFrames(t, w.Body.Bytes())
+	last := frames[len(frames) - 1]
+	if last.Type != frame.Error {
+		t.Fatalf("last frame = %v; want %v", last.Type, frame.Error)
+	}
+	info, err := frame.UnpackError(last)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Code != frame.ErrorTaskFailed || info.Task != 1 {
+		t.Errorf("error = %+v; want task 1 failed", info)
+	}
+	if !strings.Contains(info.Message, "fragment not found") {
+		t.Errorf("message = %q; want the error of the task", info.Message)
+	}
+}
+
+func TestFramedStreamReportsTimeouts(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+
+	w := requestResult(&result, "/result/pid/stream?framing=v2", "")
+	frames := decodeFrames(t, w.Body.Bytes())
+	info, err := frame.UnpackError(frames[len(frames) - 1])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Code != frame.ErrorTimeout || info.Task != -1 {
+		t.Errorf("error = %+v; want timeout", info)
+	}
+}
+
+/*
+ * Get has sent nothing when the result turns out to be failed, so it gets
+ * a proper status, and the same error as streams
+ */
+func TestGetFailedResultIsFailedDependency(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.addValues("pid", map[string]interface{} {
+		"error": "1/2: fragment not found",
+	})
+	result := Result { Storage: storage }
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusFailedDependency {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusFailedDependency)
+	}
+	var body struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+		Task  *int   `json:"task"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v: %s", err, w.Body.String())
+	}
+	if body.Code != frame.ErrorTaskFailed || body.Task == nil || *body.Task != 1 {
+		t.Errorf("body = %s; want task 1 failed", w.Body.String())
+	}
+	if !strings.Contains(body.Error, "fragment not found") {
+		t.Errorf("error = %q; want the error of the task", body.Error)
+	}
+}
+
+/*
+ * The frames describe the uncompressed payload, so once the transport
+ * encoding is undone, a gzipped stream is the same as an uncompressed one
+ */
+func TestGzippedStreamHasUncompressedFrames(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage }
+
+	request := func(acceptEncoding string) *httptest.ResponseRecorder {
+		app := gin.New()
+		app.Use(util.Compression())
+		app.GET("/result/:pid/stream", result.Stream)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(
+			http.MethodGet,
+			"/result/pid/stream?framing=v1",
+			nil,
+		)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		app.ServeHTTP(w, req)
+		return w
+	}
+
+	plain := request("")
+	if ce := plain.Header().Get("Content-Encoding"); ce != "" {
+		t.Fatalf("Content-Encoding = %q; want none", ce)
+	}
+
+	compressed := request("gzip")
+	if ce := compressed.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q; want gzip", ce)
+	}
+	gz, err := gzip.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("decompressed stream differs from the uncompressed stream")
+	}
+	frames := decodeFrames(t, body)
+	if len(frames) != 6 {
+		t.Errorf("got %d frames; want 6", len(frames))
+	}
+}
+
+func TestGzippedResultRoundTrips(t *testing.T) {
+	storage := newFakeStorage()
+	header := fakeProcessHeader(2)
+	storage.set(headerkey("pid"), header)
+	tile := fakeSliceBundle(make([]float32, 1024)...)
+	storage.add("pid", "0/2", tile)
+	storage.add("pid", "1/2", tile)
+	result := Result { Storage: storage }
+
+	app := gin.New()
+	app.Use(util.Compression(util.WithMinSize(1024)))
+	app.GET("/result/:pid", result.Get)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	app.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q; want gzip", ce)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	want := append(append(append([]byte{}, header...), tile...), tile...)
+	if !bytes.Equal(body, want) {
+		t.Errorf("decompressed result differs from the result")
+	}
+}
+
+/*
+ * Decode the frames of a stream that was cut off, up to the last complete
+ * frame
+ */
+func decodeTruncatedFrames(body []byte) []*frame.Frame {
+	frames := make([]*frame.Frame, 0)
+	dec := frame.NewDecoder(bytes.NewReader(body))
+	for {
+		f, err := dec.Decode()
+		if err != nil {
+			return frames
+		}
+		frames = append(frames, f)
+	}
+}
+
+/*
+ * The payload of the stream, i.e. the header and tiles, without the framing
+ */
+func framePayload(frames []*frame.Frame) []byte {
+	var payload []byte
+	for _, f := range frames {
+		if f.Type == frame.Header || f.Type == frame.Tile {
+			payload = append(payload, f.Payload...)
+		}
+	}
+	return payload
+}
+
+func TestInterruptedStreamCanBeResumed(t *testing.T) {
+	ntasks := 5
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(fmt.Sprintf("tile-%d", i))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid/stream?framing=v1", "")
+	full := decodeFrames(t, w.Body.Bytes())
+
+	/*
+	 * Cut the connection midway through the third tile, and keep what the
+	 * client got up to the last cursor
+	 */
+	body := w.Body.Bytes()
+	cut := bytes.Index(body, []byte("tile-2")) + 3
+	frames := decodeTruncatedFrames(body[:cut])
+	last := -1
+	for i, f := range frames {
+		if f.Type == frame.Cursor {
+			last = i
+		}
+	}
+	if last < 0 {
+		t.Fatalf("no cursor frame before the cut")
+	}
+	cursor := string(frames[last].Payload)
+	frames = frames[:last + 1]
+
+	path := fmt.Sprintf("/result/pid/stream?framing=v1&from=%s", cursor)
+	w = requestResult(&result, path, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	resumed := decodeFrames(t, w.Body.Bytes())
+	if resumed[0].Type != frame.Tile {
+		t.Errorf("resumed stream starts with %v; want %v", resumed[0].Type, frame.Tile)
+	}
+	if end := resumed[len(resumed) - 1]; end.Type != frame.End {
+		t.Errorf("resumed stream ends with %v; want %v", end.Type, frame.End)
+	}
+
+	got := framePayload(append(frames, resumed...))
+	if !bytes.Equal(got, framePayload(full)) {
+		t.Errorf("resumed payload = %q; want %q", got, framePayload(full))
+	}
+}
+
+func TestResumeFromBadCursor(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage }
+
+	for _, cursor := range []string { "not-a-cursor", "1-999" } {
+		path := "/result/pid/stream?framing=v1&from=" + cursor
+		w := requestResult(&result, path, "")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf(
+				"from=%s: status = %d; want %d",
+				cursor,
+				w.Code,
+				http.StatusBadRequest,
+			)
+		}
+	}
+}
+
+func TestSlowHTTP2ClientBoundsBuffering(t *testing.T) {
+	tile := bytes.Repeat([]byte("x"), 64 * 1024)
+	ntasks := 400
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+
+	result := Result {
+		Storage:        storage,
+		ReadAheadBytes: 1024 * 1024,
+	}
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+	srv := httptest.NewUnstartedServer(app)
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL + "/result/pid/stream")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("proto = %s; want HTTP/2", resp.Proto)
+	}
+
+	/*
+	 * Read just a little, then stall, and give the server plenty of time to
+	 * fill up whatever buffers there are
+	 */
+	if _, err := io.ReadFull(resp.Body, make([]byte, len(tile))); err != nil {
+		t.Fatalf("%v", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	/*
+	 * The client buffers up to its flow control window (4M for go), and the
+	 * server a bit more, and reads 1M ahead, but nowhere near the whole (25M)
+	 * result
+	 */
+	read := storage.called("xread-messages")
+	if read >= ntasks / 2 {
+		t.Errorf(
+			"%d of %d tiles read from storage with stalled client",
+			read,
+			ntasks,
+		)
+	}
+
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n < int64((ntasks - 1) * len(tile)) {
+		t.Errorf("got %d bytes; want the whole result", n)
+	}
+}
+
+/*
+ * A response writer that throws the body away, so that the only memory held
+ * on to is in the handler
+ */
+type discardWriter struct {
+	header http.Header
+	code   int
+	size   int64
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) Write(b []byte) (int, error) {
+	w.size += int64(len(b))
+	return len(b), nil
+}
+
+func (w *discardWriter) WriteHeader(code int) {
+	w.code = code
+}
+
+func TestGetMemoryIsBounded(t *testing.T) {
+	tile := strings.Repeat("x", 256 * 1024)
+	ntasks := 300
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), []byte(tile))
+	}
+
+	result := Result { Storage: storage, VerifyBundles: true }
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+	w := &discardWriter { header: make(http.Header) }
+
+	/*
+	 * The fake storage itself holds on to the whole result, so with the
+	 * default GC settings there's room for a lot of garbage before the GC
+	 * kicks in. Collect aggressively, so the heap reflects what's live.
+	 */
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapAlloc
+
+	/*
+	 * Sample the heap while the request is served. The whole result is 75M,
+	 * and assembling it in memory would be at least that.
+	 */
+	done := make(chan struct{})
+	peak := make(chan uint64)
+	go func() {
+		var max uint64
+		var stats runtime.MemStats
+		for {
+			select {
+			case <-done:
+				peak <- max
+				return
+			case <-time.After(time.Millisecond):
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > max {
+					max = stats.HeapAlloc
+				}
+			}
+		}
+	}()
+	app.ServeHTTP(w, req)
+	close(done)
+	max := <-peak
+
+	if w.code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.code, http.StatusOK)
+	}
+	length := w.header.Get("Content-Length")
+	if length != fmt.Sprint(w.size) {
+		t.Errorf("Content-Length = %s; wrote %d bytes", length, w.size)
+	}
+	if w.size < int64(ntasks * len(tile)) {
+		t.Errorf("wrote %d bytes; want the whole result", w.size)
+	}
+
+	limit := uint64(32 << 20)
+	if max > baseline && max - baseline > limit {
+		t.Errorf(
+			"peak heap grew by %dM; want < %dM",
+			(max - baseline) >> 20,
+			limit >> 20,
+		)
+	}
+}
+
+/*
+ * Get streams the result rather than assembling it, so the cost per tile
+ * should be flat, regardless of the size of the result
+ */
+func BenchmarkGet10kTiles(b *testing.B) {
+	tile := []byte(strings.Repeat("x", 4 * 1024))
+	ntasks := 10000
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+
+	result := Result { Storage: storage, VerifyBundles: true }
+	app := gin.New()
+	app.GET("/result/:pid", result.Get)
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := &discardWriter { header: make(http.Header) }
+		app.ServeHTTP(w, req)
+		if w.code != http.StatusOK {
+			b.Fatalf("status = %d; want %d", w.code, http.StatusOK)
+		}
+	}
+}
+
+func TestCollectorExitsWhenCancelled(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go collectResult(ctx, storage, "pid", head, start, xreadBlock, backoff {}, &tiledecoder {}, nil, tiles, failure)
+
+	/*
+	 * Take the header and the first tile, so that the collector is blocked
+	 * waiting on redis for the task that never completes, then cancel
+	 */
+	<-tiles
+	<-tiles
+	cancel()
+
+	select {
+	case _, ok := <-tiles:
+		if ok {
+			t.Fatalf("expected no more tiles after cancel")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("collector still running 1s after cancel")
+	}
+
+	if err := <-failure; !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v; want %v", err, context.Canceled)
+	}
+}
+
+func TestCollectorBlockedOnSendExitsWhenCancelled(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		collectResult(ctx, storage, "pid", head, start, xreadBlock, backoff {}, &tiledecoder {}, nil, tiles, failure)
+		close(done)
+	}()
+
+	/*
+	 * No one reads the tiles, like when the handler has returned
+	 */
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("collector still running 1s after cancel")
+	}
+}
+
+func TestStalledWorkerTimesOutWithPeriodicReads(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("tile-0"))
+	head, _ := parseProcessHeader(fakeProcessHeader(3))
+
+	result := Result {
+		Storage:   storage,
+		ReadBlock: 10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go result.collect(ctx, "get", "pid", head, start, false, tiles, failure)
+
+	ntiles := 0
+	for range tiles {
+		ntiles++
+	}
+	/* the header and the one tile that made it */
+	if ntiles != 2 {
+		t.Errorf("got %d tiles; want 2", ntiles)
+	}
+
+	err := <-failure
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if !strings.Contains(err.Error(), "1/3") {
+		t.Errorf("err = %v; want progress 1/3", err)
+	}
+
+	/*
+	 * The reads time out and are retried while the worker is stalled, rather
+	 * than blocking for as long as redis would let them
+	 */
+	if n := storage.called("xread"); n < 3 {
+		t.Errorf("XREAD called %d times; want periodic reads", n)
+	}
+}
+
+/*
+ * A collection that times out while the reader is busy elsewhere must still
+ * be reported as failed when tiles is closed, also after read-ahead, or the
+ * result looks complete
+ */
+func TestTimeoutOfBusyReaderIsReported(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("tile-0"))
+	head, _ := parseProcessHeader(fakeProcessHeader(3))
+
+	for _, readahead := range []int { -1, 0 } {
+		for i := 0; i < 20; i++ {
+			result := Result {
+				Storage:   storage,
+				ReadBlock: time.Millisecond,
+				ReadAhead: readahead,
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Millisecond)
+			tiles := make(chan partial)
+			failure := make(chan error, 1)
+			go result.collect(ctx, "get", "pid", head, start, false, tiles, failure)
+
+			<-ctx.Done()
+			for range tiles {}
+			err := reportedFailure(failure)
+			cancel()
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("readahead %d: err = %v; want %v",
+					readahead, err, context.DeadlineExceeded)
+			}
+		}
+	}
+}
+
+/*
+ * A redis that replies to XREAD with the reply, like a non-blocking read of
+ * nothing could, or a server that is not quite redis
+ */
+type badReplyStorage struct {
+	*fakeStorage
+	reply []redis.XStream
+}
+
+func (s *badReplyStorage) XRead(
+	ctx  context.Context,
+	args *redis.XReadArgs,
+) *redis.XStreamSliceCmd {
+	return redis.NewXStreamSliceCmdResult(s.reply, nil)
+}
+
+func TestCollectorFailsOnBadXReadReply(t *testing.T) {
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+	replies := map[string][]redis.XStream {
+		"empty":        {},
+		"other stream": {{ Stream: "other-pid" }},
+		"two streams":  {{ Stream: "pid" }, { Stream: "pid" }},
+	}
+	for name, reply := range replies {
+		storage := &badReplyStorage { fakeStorage: newFakeStorage(), reply: reply }
+		tiles := make(chan partial)
+		failure := make(chan error, 1)
+		go collectResult(
+			context.Background(),
+			storage,
+			"pid",
+			head,
+			start,
+			xreadBlock,
+			backoff {},
+			&tiledecoder {},
+			nil,
+			tiles,
+			failure,
+		)
+
+		for range tiles {}
+		select {
+		case err := <-failure:
+			if !strings.Contains(err.Error(), "xread pid") {
+				t.Errorf("%s: err = %v; want xread error", name, err)
+			}
+		default:
+			t.Errorf("%s: collector finished without failure", name)
+		}
+	}
+}
+
+func TestFindPositionFailsOnBadXReadReply(t *testing.T) {
+	storage := &badReplyStorage { fakeStorage: newFakeStorage() }
+	_, err := findPosition(context.Background(), storage, "pid", "1-1")
+	if err == nil {
+		t.Errorf("findPosition succeeded on an empty reply")
+	}
+}
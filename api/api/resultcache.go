@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * The default for the max size of results cached whole, see
+ * Result.MaxCachedBytes
+ */
+const defaultMaxCachedBytes = 16 * 1024 * 1024
+
+/*
+ * How long the write of a result to the cache may take. The write happens
+ * after the response, so it can't use the request context.
+ */
+const cacheWriteTimeout = 30 * time.Second
+
+/*
+ * The result, as the concatenation of the header and all the partial results,
+ * i.e. exactly the body of Get. Finished results are immutable, so once a
+ * result has been read it's kept under this key, and later requests for the
+ * same result don't have to read (and measure) the stream again.
+ */
+func assembledkey(pid string) string {
+	return fmt.Sprintf("%s/assembled", pid)
+}
+
+func (r *Result) maxCachedBytes() int64 {
+	if r.MaxCachedBytes == 0 {
+		return defaultMaxCachedBytes
+	}
+	return r.MaxCachedBytes
+}
+
+/*
+ * Check if the result of size bytes is small enough to be cached
+ */
+func (r *Result) cacheable(size int64) bool {
+	return size <= r.maxCachedBytes()
+}
+
+/*
+ * The cached result, or nil if it isn't cached. Failing to read the cache is
+ * not an error, as the result can always be read from the stream.
+ */
+func (r *Result) cachedResult(ctx context.Context, pid string) []byte {
+	if r.maxCachedBytes() < 0 {
+		return nil
+	}
+	body, err := r.Storage.Get(ctx, assembledkey(pid)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			r.logger(pid).Warn("unable to read cached result", "error", err)
+		}
+		return nil
+	}
+	return body
+}
+
+/*
+ * Cache the result, in the background, so that the response is not held up
+ * by it. The result expires with the rest of the process.
+ */
+func (r *Result) cacheResult(pid string, body []byte) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheWriteTimeout)
+		defer cancel()
+		err := r.Storage.Set(ctx, assembledkey(pid), body, r.resultTTL()).Err()
+		if err != nil {
+			r.logger(pid).Warn("unable to cache result", "error", err)
+		}
+	}()
+}
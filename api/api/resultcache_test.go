@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+/*
+ * The result is cached in the background, after the response is written, so
+ * wait for it to show up in storage
+ */
+func waitForCache(t *testing.T, storage *fakeStorage, pid string) []byte {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		storage.mtx.Lock()
+		body, ok := storage.keys[assembledkey(pid)]
+		storage.mtx.Unlock()
+		if ok {
+			return []byte(body)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("result %s not cached", pid)
+	return nil
+}
+
+func TestGetCachesResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(3))
+	storage.add("pid", "0/3", []byte("tile-0"))
+	storage.add("pid", "1/3", []byte("tile-1"))
+	storage.add("pid", "2/3", []byte("tile-2"))
+	result := Result {
+		Storage:   storage,
+		ResultTTL: time.Hour,
+	}
+
+	first := getResult(&result, "pid")
+	if first.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", first.Code, http.StatusOK)
+	}
+	body := first.Body.Bytes()
+	cached := waitForCache(t, storage, "pid")
+	if !bytes.Equal(cached, body) {
+		t.Errorf("cached = %q; want %q", cached, body)
+	}
+	if ttl := storage.ttl(assembledkey("pid")); ttl != time.Hour {
+		t.Errorf("cached result expires after %v; want %v", ttl, time.Hour)
+	}
+
+	/*
+	 * Everything after the first Get should be served from the cache, without
+	 * reading the partial results again
+	 */
+	xreads := storage.called("xread")
+	second := getResult(&result, "pid")
+	if !bytes.Equal(second.Body.Bytes(), body) {
+		t.Errorf("body = %q; want %q", second.Body.Bytes(), body)
+	}
+	if cl := second.Header().Get("Content-Length"); cl != fmt.Sprint(len(body)) {
+		t.Errorf("Content-Length = %s; want %d", cl, len(body))
+	}
+
+	header := fmt.Sprintf("bytes=3-%d", len(body) - 4)
+	rng := getRange(&result, header, "")
+	if rng.Code != http.StatusPartialContent {
+		t.Errorf("%s: status = %d; want %d", header, rng.Code, http.StatusPartialContent)
+	}
+	if want := body[3:len(body) - 3]; !bytes.Equal(rng.Body.Bytes(), want) {
+		t.Errorf("%s: body = %q; want %q", header, rng.Body.Bytes(), want)
+	}
+
+	head := headResult(&result, "pid")
+	if head.Code != http.StatusOK {
+		t.Errorf("HEAD: status = %d; want %d", head.Code, http.StatusOK)
+	}
+	if cl := head.Header().Get("Content-Length"); cl != fmt.Sprint(len(body)) {
+		t.Errorf("HEAD: Content-Length = %s; want %d", cl, len(body))
+	}
+
+	if n := storage.called("xread"); n != xreads {
+		t.Errorf("%d reads of the stream; want result served from cache", n - xreads)
+	}
+}
+
+func TestLargeResultIsNotCached(t *testing.T) {
+	cases := []int64 { 8, -1 }
+	for _, limit := range cases {
+		storage := newFakeStorage()
+		storage.set(headerkey("pid"), fakeProcessHeader(2))
+		storage.add("pid", "0/2", []byte("tile-0"))
+		storage.add("pid", "1/2", []byte("tile-1"))
+		result := Result {
+			Storage:        storage,
+			MaxCachedBytes: limit,
+		}
+
+		if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+			t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+		}
+		/*
+		 * The cache write is asynchronous, so give it a chance to happen
+		 * before checking that it didn't
+		 */
+		time.Sleep(10 * time.Millisecond)
+		if n := storage.called("set"); n != 0 {
+			t.Errorf("limit %d: result cached; want not cached", limit)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The result as JSON, for clients that can't decode msgpack
+ */
+type jsonResult struct {
+	Header  map[string]interface{} `json:"header"`
+	Bundles []interface{}          `json:"bundles"`
+}
+
+/*
+ * GET /result/<pid>?format=json
+ * GET /result/<pid> with Accept: application/json
+ *
+ * The result converted to a single JSON document, with the result header and
+ * the array of bundles, for scripting clients (jq, fetch) that can't decode
+ * msgpack. The bundles have the same fields as in msgpack, by name, and the
+ * samples are numbers, or null for NaN and infinities, which JSON can't
+ * express.
+ *
+ * Results larger than the limit (see assembledLimit) get 413, before
+ * anything is converted. The limit is on the msgpack result, and the JSON is
+ * typically 2-4 times larger.
+ */
+func (r *Result) getJSON(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if acceptable(ctx, "application/json") == "" {
+		return
+	}
+
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	result := r.finished(ctx, collectctx, pid, nil, false)
+	if result == nil {
+		return
+	}
+	head := result.head
+
+	if limit := r.assembledLimit(); result.size > limit {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H {
+			"error": "result too large for conversion to JSON",
+			"limit": limit,
+		})
+		return
+	}
+
+	header, err := parseResultHeader(head.RawHeader)
+	if err != nil {
+		r.logger(pid).Error("bad result header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "json", pid, head, start, false, tiles, failure)
+
+	doc := jsonResult {
+		Header:  header,
+		Bundles: make([]interface{}, 0, head.Ntasks),
+	}
+	for tiles != nil {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					r.logger(pid).Error("unable to collect result", "error", err)
+					ctx.AbortWithStatus(http.StatusInternalServerError)
+					return
+				}
+				tiles = nil
+				break
+			}
+			if output.id == "" {
+				continue
+			}
+
+			bundle, err := message.UnpackBundle(head.Function, output.tile)
+			if err != nil {
+				r.logger(pid).Error("unable to parse bundle", "error", err)
+				ctx.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			doc.Bundles = append(doc.Bundles, bundle)
+
+		case err := <-failure:
+			r.logger(pid).Error("unable to collect result", "error", err)
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	body, err := json.Marshal(doc)
+	if err != nil {
+		r.logger(pid).Error("unable to encode result", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	cacheImmutable(ctx, result.etag)
+	setDisposition(ctx, pid, "json")
+	ctx.Data(http.StatusOK, "application/json", body)
+}
@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+func TestResultAsJSON(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", fakeSliceBundle(0.1, 2.5))
+	storage.add("pid", "1/2", fakeSliceBundle(float32(math.NaN()), 3e-7))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=json", "application/json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var doc struct {
+		Header  map[string]interface{} `json:"header"`
+		Bundles []message.SliceTiles   `json:"bundles"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, 2.0, doc.Header["nbundles"])
+	assert.Equal(t, 2, len(doc.Bundles))
+	assert.Equal(t, "data", doc.Bundles[0].Attr)
+
+	/*
+	 * The samples are written as float32, and not widened to float64 with
+	 * all the noise that comes with it
+	 */
+	body := w.Body.String()
+	assert.True(t, strings.Contains(body, `"v":[0.1,2.5]`), body)
+	assert.True(t, strings.Contains(body, `"v":[null,3e-07]`), body)
+}
+
+func TestResultAsJSONOfCurtain(t *testing.T) {
+	bundle := message.CurtainBundle {
+		Attr:    "data",
+		Size:    1,
+		Zlength: 2,
+		Major:   []int { 0, 1 },
+		Minor:   []int { 0, 2 },
+		Values:  []float32 { 1, 2 },
+	}
+	packed, err := bundle.Pack()
+	assert.Nil(t, err)
+
+	storage := newFakeStorage()
+	header := fakeFunctionHeader(message.FunctionCurtain, 1)
+	storage.set(headerkey("pid"), header)
+	storage.add("pid", "0/1", packed)
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=json", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var doc struct {
+		Bundles []message.CurtainBundle `json:"bundles"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, []message.CurtainBundle { bundle }, doc.Bundles)
+}
+
+func TestResultAsJSONTooLarge(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(make([]float32, 64)...))
+	result := Result {
+		Storage:        storage,
+		MaxResultBytes: 64,
+	}
+
+	w := requestResult(&result, "/result/pid?format=json", "")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestResultAsJSONOfPendingProcess(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", fakeSliceBundle(1))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=json", "")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+}
+
+func TestResultWithUnknownFormat(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(1))
+	result := Result { Storage: storage }
+
+	w := requestResult(&result, "/result/pid?format=xml", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = requestResult(&result, "/result/pid?format=msgpack", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, resultContentType, w.Header().Get("Content-Type"))
+}
+
+func TestResultAsJSONFromAccept(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(
+		headerkey("pid"),
+		fakeResultHeader(message.FunctionSlice, 2, []string { "data" }, []int { 2, 2 }),
+	)
+	storage.add("pid", "0/2", packSliceTiles("data", message.Tile {
+		Iterations: 1,
+		ChunkSize:  2,
+		V:          []float32 { 1, 2 },
+	}))
+	storage.add("pid", "1/2", packSliceTiles("data", message.Tile {
+		Iterations:  1,
+		ChunkSize:   2,
+		InitialSkip: 2,
+		V:           []float32 { 3, 4.5 },
+	}))
+	result := Result { Storage: storage }
+
+	want := `{
+		"header": {
+			"function":   1,
+			"nbundles":   2,
+			"attributes": ["data"],
+			"shapes":     [2, 2, 2]
+		},
+		"bundles": [
+			{
+				"attr": "data",
+				"tiles": [{
+					"iterations":   1,
+					"chunk_size":   2,
+					"initial_skip": 0,
+					"superstride":  0,
+					"substride":    0,
+					"v":            [1, 2]
+				}]
+			},
+			{
+				"attr": "data",
+				"tiles": [{
+					"iterations":   1,
+					"chunk_size":   2,
+					"initial_skip": 2,
+					"superstride":  0,
+					"substride":    0,
+					"v":            [3, 4.5]
+				}]
+			}
+		]
+	}`
+
+	w := requestResult(&result, "/result/pid", "application/json")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Values("Vary"), "Accept")
+	assert.JSONEq(t, want, w.Body.String())
+
+	/*
+	 * msgpack is still the default, and ?format wins over Accept
+	 */
+	for _, accept := range []string { "", "*/*", resultContentType } {
+		w := requestResult(&result, "/result/pid", accept)
+		ct := w.Header().Get("Content-Type")
+		assert.Equal(t, resultContentType, ct, "Accept: %s", accept)
+	}
+	w = requestResult(&result, "/result/pid?format=msgpack", "application/json")
+	assert.Equal(t, http.StatusNotAcceptable, w.Code)
+}
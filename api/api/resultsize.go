@@ -0,0 +1,111 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The size of a sample in the result - all attributes are float32
+ */
+const sampleBytes = 4
+
+/*
+ * Queries whose estimated result is larger than the limit are refused when
+ * they're scheduled, and results larger than the limit are refused by Get,
+ * with 413. Responses of the graphql endpoint carry the limit and size as
+ * extensions of the error.
+ */
+type resultTooLargeError struct {
+	limit int64
+	size  int64
+}
+
+func (e *resultTooLargeError) Error() string {
+	return fmt.Sprintf(
+		"result of %d bytes exceeds the limit of %d bytes",
+		e.size,
+		e.limit,
+	)
+}
+
+func (e *resultTooLargeError) Extensions() map[string]interface{} {
+	return map[string]interface{} {
+		"code":  "RESULT_TOO_LARGE",
+		"limit": e.limit,
+		"size":  e.size,
+	}
+}
+
+func resultTooLarge(ctx *gin.Context, limit int64, size int64) {
+	err := &resultTooLargeError { limit: limit, size: size }
+	ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H {
+		"error": err.Error(),
+		"limit": limit,
+		"size":  size,
+	})
+}
+
+/*
+ * Refuse the result of the process pid as too large for MaxResultBytes, see
+ * resultTooLarge. Refusals are logged with the pid, as they mean someone made
+ * a query they can't get the result of.
+ */
+func (r *Result) refuseTooLarge(ctx *gin.Context, pid string, size int64) {
+	r.logger(pid).Warn(
+		"result too large",
+		"limit", r.MaxResultBytes,
+		"size",  size,
+	)
+	resultTooLarge(ctx, r.MaxResultBytes, size)
+}
+
+/*
+ * The estimated size of the result of a process, from the shapes of the
+ * attributes in the process header. This is the size of the samples only,
+ * which is close to the size of the result for all but tiny results. Zero
+ * means unknown, i.e. the header has no shapes.
+ */
+func estimateResultBytes(header []byte) (int64, error) {
+	head, err := parseProcessHeader(header)
+	if err != nil {
+		return 0, err
+	}
+	result, err := parseAssemblyHeader(head.RawHeader)
+	if err != nil {
+		return 0, err
+	}
+
+	estimate := int64(0)
+	for _, attr := range result.Attributes {
+		shape, err := result.shape(attr)
+		if err != nil {
+			return 0, err
+		}
+		samples, err := gridSize(shape, math.MaxInt64 / sampleBytes)
+		if err != nil {
+			return 0, err
+		}
+		estimate += samples * sampleBytes
+	}
+	return estimate, nil
+}
+
+/*
+ * Refuse plans whose estimated result is larger than the limit of the
+ * endpoint. Plans without an estimate are let through, as Get checks the
+ * actual size anyway.
+ */
+func (be *BasicEndpoint) checkResultSize(plan *QueryPlan) error {
+	if be.maxResult <= 0 {
+		return nil
+	}
+	estimate, err := estimateResultBytes(plan.header)
+	if err == errResultTooLarge || (err == nil && estimate > be.maxResult) {
+		return &resultTooLargeError { limit: be.maxResult, size: estimate }
+	}
+	return nil
+}
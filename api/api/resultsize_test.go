@@ -0,0 +1,189 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	graphql "github.com/graph-gophers/graphql-go"
+	gqlerrors "github.com/graph-gophers/graphql-go/errors"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+func TestEstimateResultBytes(t *testing.T) {
+	header := fakeResultHeader(
+		message.FunctionSlice,
+		2,
+		[]string { "data", "cdpx" },
+		[]int { 10, 20 },
+		[]int { 10, 20 },
+	)
+	estimate, err := estimateResultBytes(header)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if estimate != 2 * 10 * 20 * sampleBytes {
+		t.Errorf("estimate = %d; want %d", estimate, 2 * 10 * 20 * sampleBytes)
+	}
+
+	estimate, err = estimateResultBytes(fakeProcessHeader(2))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if estimate != 0 {
+		t.Errorf("estimate = %d; want 0 (unknown) without shapes", estimate)
+	}
+}
+
+func TestCheckResultSize(t *testing.T) {
+	plan := &QueryPlan {
+		header: fakeResultHeader(
+			message.FunctionSlice,
+			1,
+			[]string { "data" },
+			[]int { 10, 20 },
+		),
+	}
+
+	cases := []struct {
+		limit   int64
+		refused bool
+	} {
+		{ 0,    false },
+		{ 800,  false },
+		{ 799,  true  },
+	}
+	for _, c := range cases {
+		endpoint := BasicEndpoint { maxResult: c.limit }
+		err := endpoint.checkResultSize(plan)
+		var tooLarge *resultTooLargeError
+		if refused := errors.As(err, &tooLarge); refused != c.refused {
+			t.Errorf("limit %d: err = %v; want refused = %v", c.limit, err, c.refused)
+			continue
+		}
+		if c.refused && (tooLarge.limit != c.limit || tooLarge.size != 800) {
+			t.Errorf("limit %d: err = %+v; want limit and size 800", c.limit, tooLarge)
+		}
+	}
+}
+
+func TestGetRefusesResultsOverLimit(t *testing.T) {
+	storage := uploadResult(3)
+	result := Result { Storage: storage, MaxResultBytes: 100 }
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if body["limit"] != float64(100) {
+		t.Errorf("limit = %v; want 100", body["limit"])
+	}
+	if size, _ := body["size"].(float64); size <= 100 {
+		t.Errorf("size = %v; want > 100", body["size"])
+	}
+	if body["error"] == nil {
+		t.Errorf("no error in %s", w.Body.String())
+	}
+}
+
+func TestGetLogsRefusedResult(t *testing.T) {
+	storage := uploadResult(3)
+	var logs bytes.Buffer
+	result := Result {
+		Storage:        storage,
+		MaxResultBytes: 100,
+		Logger:         logging.New(&logs, logging.Info),
+	}
+
+	if w := getResult(&result, "pid"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("%v", err)
+		}
+		if entry["msg"] != "result too large" {
+			continue
+		}
+		if entry["pid"] != "pid" || entry["limit"] != float64(100) {
+			t.Errorf("refusal = %v; want pid and limit", entry)
+		}
+		return
+	}
+	t.Errorf("no refusal in logs %q", logs.String())
+}
+
+func TestGetRefusesAnnouncedSizeOverLimit(t *testing.T) {
+	storage := newFakeStorage()
+	var body bytes.Buffer
+	enc := msgpack.NewEncoder(&body)
+	enc.SetSortMapKeys(true)
+	enc.Encode(map[string]interface{} {
+		"function":    message.FunctionSlice,
+		"nbundles":    2,
+		"total-bytes": 4096,
+	})
+	storage.set(headerkey("pid"), append([]byte{ 0x92 }, body.Bytes()...))
+	result := Result { Storage: storage, MaxResultBytes: 1024 }
+
+	/*
+	 * Refused right away, without waiting for the result to complete
+	 */
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	reads := storage.called("xrange") + storage.called("xread")
+	if n := reads + storage.called("xlen"); n != 0 {
+		t.Errorf("result read %d times; want none", n)
+	}
+}
+
+func TestGetAllowsResultsWithinLimit(t *testing.T) {
+	storage := uploadResult(3)
+	result := Result { Storage: storage, MaxResultBytes: 1024 }
+
+	if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestStreamIsExemptFromResultLimit(t *testing.T) {
+	storage := uploadResult(3)
+	result := Result { Storage: storage, MaxResultBytes: 100 }
+
+	w := requestResult(&result, "/result/pid/stream", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRefusedQueryIs413(t *testing.T) {
+	refused := &graphql.Response {
+		Errors: []*gqlerrors.QueryError {{
+			Message:       "too large",
+			ResolverError: &resultTooLargeError { limit: 1, size: 2 },
+		}},
+	}
+	if status := responseStatus(refused); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d; want %d", status, http.StatusRequestEntityTooLarge)
+	}
+
+	failed := &graphql.Response {
+		Errors: []*gqlerrors.QueryError {{ Message: "bad query" }},
+	}
+	if status := responseStatus(failed); status != http.StatusOK {
+		t.Errorf("status = %d; want %d", status, http.StatusOK)
+	}
+}
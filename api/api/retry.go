@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * The default for how many times a failed read of partial results is
+ * retried, see Result.MaxRetries
+ */
+const defaultMaxRetries = 5
+
+/*
+ * The bounds of the wait between retries, which doubles with every attempt
+ */
+const (
+	minRetryBackoff = 50 * time.Millisecond
+	maxRetryBackoff = 2 * time.Second
+)
+
+func (r *Result) retryBackoff() backoff {
+	retries := r.MaxRetries
+	if retries == 0 {
+		retries = defaultMaxRetries
+	}
+	if retries < 0 {
+		retries = 0
+	}
+	return backoff {
+		retries: retries,
+		min:     minRetryBackoff,
+		max:     maxRetryBackoff,
+	}
+}
+
+/*
+ * How many times, and how long to wait between, retries of transient redis
+ * errors. The zero backoff does not retry.
+ */
+type backoff struct {
+	retries int
+	min     time.Duration
+	max     time.Duration
+}
+
+/*
+ * The wait before retry number attempt, counting from 0
+ */
+func (b backoff) delay(attempt int) time.Duration {
+	wait := b.min
+	for i := 0; i < attempt && wait < b.max; i++ {
+		wait *= 2
+	}
+	if wait > b.max {
+		return b.max
+	}
+	return wait
+}
+
+/*
+ * Wait for retry number attempt, or until ctx is done
+ */
+func (b backoff) wait(ctx context.Context, attempt int) {
+	timer := time.NewTimer(b.delay(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+/*
+ * Transient errors are those of the connection to redis, e.g. a dropped
+ * connection or a redis that's (re)starting, which are likely to go away if
+ * the command is retried. Errors replied by redis, like a WRONGTYPE, will not
+ * go away, and neither will the errors of a cancelled context.
+ */
+func transientError(err error) bool {
+	if err == nil || err == redis.Nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var rerr redis.Error
+	if errors.As(err, &rerr) {
+		msg := rerr.Error()
+		return strings.HasPrefix(msg, "LOADING ") ||
+			strings.HasPrefix(msg, "TRYAGAIN ")
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
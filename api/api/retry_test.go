@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * Storage where the first reads, as many as failures, fail with err
+ */
+type flakyStorage struct {
+	*fakeStorage
+	err      error
+	mtx      sync.Mutex
+	failures int
+	reads    int
+}
+
+func (s *flakyStorage) XRead(
+	ctx  context.Context,
+	args *redis.XReadArgs,
+) *redis.XStreamSliceCmd {
+	s.mtx.Lock()
+	s.reads++
+	fail := s.reads <= s.failures
+	s.mtx.Unlock()
+	if fail {
+		return redis.NewXStreamSliceCmdResult(nil, s.err)
+	}
+	return s.fakeStorage.XRead(ctx, args)
+}
+
+/*
+ * An error replied by redis, see redis.Error
+ */
+type replyError string
+
+func (e replyError) Error() string { return string(e) }
+func (replyError) RedisError() {}
+
+var connreset = &net.OpError {
+	Op:  "read",
+	Net: "tcp",
+	Err: errors.New("connection reset by peer"),
+}
+
+func collectFlaky(storage *flakyStorage, retry backoff) (int, error) {
+	head, _ := parseProcessHeader(fakeProcessHeader(2))
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go collectResult(
+		context.Background(),
+		storage,
+		"pid",
+		head,
+		start,
+		xreadBlock,
+		retry,
+		&tiledecoder {},
+		nil,
+		tiles,
+		failure,
+	)
+
+	n := 0
+	for range tiles {
+		n++
+	}
+	select {
+	case err := <-failure:
+		return n, err
+	default:
+		return n, nil
+	}
+}
+
+func newFlakyStorage(failures int, err error) *flakyStorage {
+	storage := &flakyStorage {
+		fakeStorage: newFakeStorage(),
+		err:         err,
+		failures:    failures,
+	}
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	return storage
+}
+
+func TestTransientErrors(t *testing.T) {
+	transient := []error {
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		connreset,
+		fmt.Errorf("wrapped: %w", connreset),
+		replyError("LOADING Redis is loading the dataset in memory"),
+	}
+	for _, err := range transient {
+		if !transientError(err) {
+			t.Errorf("transientError(%v) = false; want true", err)
+		}
+	}
+
+	logical := []error {
+		nil,
+		redis.Nil,
+		errors.New("bad cursor"),
+		replyError("WRONGTYPE Operation against a key"),
+		context.Canceled,
+		context.DeadlineExceeded,
+		fmt.Errorf("wrapped: %w", context.Canceled),
+	}
+	for _, err := range logical {
+		if transientError(err) {
+			t.Errorf("transientError(%v) = true; want false", err)
+		}
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	b := backoff { retries: 10, min: 50 * time.Millisecond, max: time.Second }
+	want := []time.Duration {
+		50 * time.Millisecond,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for attempt, w := range want {
+		if got := b.delay(attempt); got != w {
+			t.Errorf("delay(%d) = %v; want %v", attempt, got, w)
+		}
+	}
+}
+
+func TestCollectorRetriesTransientErrors(t *testing.T) {
+	storage := newFlakyStorage(2, connreset)
+	retry := backoff { retries: 3, min: time.Millisecond, max: time.Millisecond }
+
+	n, err := collectFlaky(storage, retry)
+	if err != nil {
+		t.Fatalf("collector failed: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("collected %d partials; want header + 2 tiles", n)
+	}
+	if storage.reads < 3 {
+		t.Errorf("%d reads; want the 2 failed and at least one more", storage.reads)
+	}
+}
+
+func TestCollectorGivesUpAfterRetries(t *testing.T) {
+	storage := newFlakyStorage(10, connreset)
+	retry := backoff { retries: 3, min: time.Millisecond, max: time.Millisecond }
+
+	_, err := collectFlaky(storage, retry)
+	if !errors.Is(err, connreset) {
+		t.Fatalf("err = %v; want %v", err, connreset)
+	}
+	if !strings.Contains(err.Error(), "after 3 retries") {
+		t.Errorf("err = %v; want it to tell the number of retries", err)
+	}
+	if storage.reads != 4 {
+		t.Errorf("%d reads; want the first and 3 retries", storage.reads)
+	}
+}
+
+func TestCollectorDoesNotRetryLogicalErrors(t *testing.T) {
+	wrongtype := replyError("WRONGTYPE Operation against a key")
+	storage := newFlakyStorage(1, wrongtype)
+	retry := backoff { retries: 3, min: time.Millisecond, max: time.Millisecond }
+
+	_, err := collectFlaky(storage, retry)
+	if err != error(wrongtype) {
+		t.Errorf("err = %v; want %v", err, wrongtype)
+	}
+	if storage.reads != 1 {
+		t.Errorf("%d reads; want 1", storage.reads)
+	}
+}
+
+func TestResultMaxRetries(t *testing.T) {
+	cases := map[int]int {
+		0:  defaultMaxRetries,
+		-1: 0,
+		2:  2,
+	}
+	for max, want := range cases {
+		r := Result { MaxRetries: max }
+		if got := r.retryBackoff().retries; got != want {
+			t.Errorf("MaxRetries = %d: %d retries; want %d", max, got, want)
+		}
+	}
+}
@@ -18,22 +18,60 @@ import "unsafe"
 
 import(
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/equinor/oneseismic/api/internal/util"
 )
 
 type cppscheduler struct {
 	tasksize int
 	storage  redis.Cmdable
+	/*
+	 * The expiration of the process header and the other keys written when
+	 * scheduling, see DefaultResultTTL
+	 */
+	ttl      time.Duration
 }
 
 type QueryPlan struct {
 	header []byte
 	plan   [][]byte
+	/*
+	 * The priority of the tasks, which decides the stream they're scheduled
+	 * on, see util.JobStream
+	 */
+	priority util.Priority
+}
+
+/*
+ * A plan of the tasks, and the process header that goes with them, for
+ * schedulers other than the one of NewScheduler
+ */
+func NewQueryPlan(header []byte, tasks [][]byte) *QueryPlan {
+	return &QueryPlan {
+		header: header,
+		plan:   tasks,
+	}
+}
+
+func (p *QueryPlan) Header() []byte {
+	return p.header
+}
+
+func (p *QueryPlan) Tasks() [][]byte {
+	return p.plan
+}
+
+func (p *QueryPlan) Priority() util.Priority {
+	return p.priority
 }
 
 type QueryError struct {
@@ -50,20 +88,31 @@ func (qe *QueryError) Status() int {
 }
 
 /*
- * This interface does feel superfluous, and should probably not need to be
- * exported. Using an interface makes testing a lot easier though, and unless
- * it should introduce an absurd performance penalty it's worth keeping around
- * for now.
+ * The scheduler plans queries and makes the tasks of the plan available to
+ * the workers. MakeQuery plans the query, and Schedule hands the tasks of
+ * the plan to the workers, as the process pid.
+ *
+ * NewScheduler makes the scheduler of the C++ core library, which writes the
+ * tasks to redis. Tests and other deployments can pass their own to
+ * MakeBasicEndpoint.
  */
-type scheduler interface {
+type Scheduler interface {
 	MakeQuery(*message.Query) (*QueryPlan, error)
 	Schedule(context.Context, string, *QueryPlan) error
 }
 
-func newScheduler(storage redis.Cmdable) scheduler {
+/*
+ * The process header and the other keys written when scheduling expire after
+ * ttl, see DefaultResultTTL. Zero means the default.
+ */
+func NewScheduler(storage redis.Cmdable, ttl time.Duration) Scheduler {
+	if ttl <= 0 {
+		ttl = DefaultResultTTL
+	}
 	return &cppscheduler{
 		storage:  storage,
 		tasksize: 10,
+		ttl:      ttl,
 	}
 }
 
@@ -103,6 +152,26 @@ func (sched *cppscheduler) MakeQuery(query *message.Query) (*QueryPlan, error) {
 	}, nil
 }
 
+/*
+ * Store the layout of the plan, e.g. for the /admin/jobs/:pid/plan endpoint
+ */
+func (sched *cppscheduler) storePlan(
+	ctx    context.Context,
+	pid    string,
+	stream string,
+	plan   *QueryPlan,
+) error {
+	layout, err := makePlanLayout(pid, stream, plan)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(layout)
+	if err != nil {
+		return err
+	}
+	return sched.storage.Set(ctx, plankey(pid), doc, sched.ttl).Err()
+}
+
 func (sched *cppscheduler) Schedule(
 	ctx  context.Context,
 	pid  string,
@@ -113,12 +182,45 @@ func (sched *cppscheduler) Schedule(
 	 * well be split up into sub structs and functions which can then be
 	 * dependency-injected for some customisation and easier testing.
 	 */
+	ctx, span := tracer().Start(
+		ctx,
+		"oneseismic.schedule",
+		trace.WithAttributes(
+			pidAttribute(pid),
+			label.Int("oneseismic.ntasks", len(plan.plan)),
+			label.String("oneseismic.priority", plan.priority.String()),
+		),
+	)
+	defer span.End()
+
+	sched.storage.Set(ctx, headerkey(pid), plan.header, sched.ttl)
 	sched.storage.Set(
 		ctx,
-		fmt.Sprintf("%s/header.json", pid),
-		plan.header,
-		10 * time.Minute,
+		createdkey(pid),
+		time.Now().UnixNano() / int64(time.Millisecond),
+		sched.ttl,
 	)
+
+	/*
+	 * The plan is only for debugging, so failing to store it should not fail
+	 * the process
+	 */
+	stream := util.JobStream("jobs", plan.priority)
+	err := sched.storePlan(ctx, pid, stream, plan)
+	if err != nil {
+		logging.Default().Warn("unable to store plan", "pid", pid, "error", err)
+	}
+
+	/*
+	 * The trace context goes with the tasks, for the workers, and is stored
+	 * for the result collections to link to, see tracing.go
+	 */
+	fields := injectTrace(ctx)
+	if fields != nil {
+		doc, _ := json.Marshal(fields)
+		sched.storage.Set(ctx, tracekey(pid), doc, sched.ttl)
+	}
+
 	ntasks := len(plan.plan)
 	for i, task := range plan.plan {
 		if ctx.Err() != nil {
@@ -131,9 +233,13 @@ func (sched *cppscheduler) Schedule(
 			"part", part,
 			"task", task,
 		}
-		args := redis.XAddArgs{Stream: "jobs", Values: values}
+		for key, value := range fields {
+			values = append(values, key, value)
+		}
+		args := redis.XAddArgs{Stream: stream, Values: values}
 		_, err := sched.storage.XAdd(ctx, &args).Result()
 		if err != nil {
+			span.RecordError(err)
 			msg := "part=%v unable to put in storage; %w"
 			return fmt.Errorf(msg, part, err)
 		}
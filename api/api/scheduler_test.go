@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+func TestScheduleSetsResultTTL(t *testing.T) {
+	plan := &QueryPlan {
+		header: fakeProcessHeader(2),
+		plan:   [][]byte { []byte("task-0"), []byte("task-1") },
+	}
+
+	cases := []struct {
+		ttl  time.Duration
+		want time.Duration
+	} {
+		{ time.Hour, time.Hour },
+		{ 0,         DefaultResultTTL },
+	}
+	for _, c := range cases {
+		storage := newFakeStorage()
+		sched := NewScheduler(storage, c.ttl)
+		if err := sched.Schedule(context.Background(), "pid", plan); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		for _, key := range []string { headerkey("pid"), createdkey("pid") } {
+			if ttl := storage.ttl(key); ttl != c.want {
+				t.Errorf("%s expires after %v; want %v", key, ttl, c.want)
+			}
+		}
+	}
+}
+
+func TestScheduleOnPriorityStream(t *testing.T) {
+	cases := []struct {
+		priority util.Priority
+		stream   string
+	} {
+		{ util.PriorityLow,    "jobs:low"  },
+		{ util.PriorityNormal, "jobs"      },
+		{ util.PriorityHigh,   "jobs:high" },
+	}
+	for _, c := range cases {
+		storage := newFakeStorage()
+		sched := NewScheduler(storage, 0)
+		plan := NewQueryPlan(fakeProcessHeader(2), [][]byte {
+			[]byte("task-0"),
+			[]byte("task-1"),
+		})
+		plan.priority = c.priority
+		if err := sched.Schedule(context.Background(), "pid", plan); err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		for stream, msgs := range storage.streams {
+			if stream == c.stream && len(msgs) != 2 {
+				t.Errorf("%d tasks on %s; want 2", len(msgs), stream)
+			}
+			if stream != c.stream && len(msgs) != 0 {
+				t.Errorf("%v tasks on %s; want %s", c.priority, stream, c.stream)
+			}
+		}
+	}
+}
+
+func TestResultTTLAppliesToErrors(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.addValues("pid", map[string]interface{} { "error": "0/2: failed" })
+	result := Result {
+		Storage:   storage,
+		ResultTTL: time.Hour,
+	}
+
+	msg, err := result.failed(context.Background(), "pid", false)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if msg == "" {
+		t.Fatalf("expected the process to have failed")
+	}
+	if ttl := storage.ttl(errorkey("pid")); ttl != time.Hour {
+		t.Errorf("error expires after %v; want %v", ttl, time.Hour)
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+/*
+ * The default for how long a single write to a stream may block, see
+ * Result.StreamWriteTimeout
+ */
+const defaultStreamWriteTimeout = 30 * time.Second
+
+func (r *Result) streamWriteTimeout() time.Duration {
+	if r.StreamWriteTimeout == 0 {
+		return defaultStreamWriteTimeout
+	}
+	return r.StreamWriteTimeout
+}
+
+type connKey struct{}
+
+/*
+ * Make the connection available to the handlers, for write deadlines. Use
+ * as http.Server.ConnContext. Without it, writes never time out.
+ */
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+/*
+ * A writeDeadline bounds how long the writes of a stream can block. Stream
+ * extend()s it before every batch of writes, and checks if it was exceeded()
+ * after. When a write times out, net/http cancels the request context, so a
+ * stream that is cancelled after the deadline is stuck on a client that
+ * doesn't read.
+ *
+ * The deadline is on the connection, so it must be clear()ed when the stream
+ * is done, or it carries over to the next request on the connection. A nil
+ * writeDeadline does nothing, which is what streams without a connection
+ * (see ConnContext) or a timeout get.
+ */
+type writeDeadline struct {
+	ctx     context.Context
+	conn    net.Conn
+	timeout time.Duration
+	at      time.Time
+}
+
+func newWriteDeadline(ctx context.Context, timeout time.Duration) *writeDeadline {
+	conn, ok := ctx.Value(connKey{}).(net.Conn)
+	if !ok || timeout <= 0 {
+		return nil
+	}
+	return &writeDeadline {
+		ctx:     ctx,
+		conn:    conn,
+		timeout: timeout,
+	}
+}
+
+func (d *writeDeadline) extend() {
+	if d == nil {
+		return
+	}
+	d.at = time.Now().Add(d.timeout)
+	d.conn.SetWriteDeadline(d.at)
+}
+
+func (d *writeDeadline) exceeded() bool {
+	if d == nil {
+		return false
+	}
+	return d.ctx.Err() != nil && time.Now().After(d.at)
+}
+
+func (d *writeDeadline) clear() {
+	if d == nil {
+		return
+	}
+	d.conn.SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+)
+
+/*
+ * A bytes.Buffer that is safe to log to from many goroutines
+ */
+type syncBuffer struct {
+	mtx sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.buf.String()
+}
+
+/*
+ * Serve Stream on a real connection, with small socket buffers so that a
+ * client that doesn't read blocks the server after a few tiles. The returned
+ * channel is closed when the handler returns.
+ */
+func serveStream(t *testing.T, result *Result) (*httptest.Server, chan struct{}) {
+	done := make(chan struct{})
+	app := gin.New()
+	app.GET("/result/:pid/stream", func(ctx *gin.Context) {
+		defer close(done)
+		result.Stream(ctx)
+	})
+
+	srv := httptest.NewUnstartedServer(app)
+	srv.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		c.(*net.TCPConn).SetWriteBuffer(4096)
+		return ConnContext(ctx, c)
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, done
+}
+
+func largeResult(ntasks int, tilesize int) *fakeStorage {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(strings.Repeat("x", tilesize))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	return storage
+}
+
+func TestStreamAbortsOnClientThatNeverReads(t *testing.T) {
+	var logs syncBuffer
+	result := Result {
+		Storage:            largeResult(64, 64 * 1024),
+		StreamWriteTimeout: 50 * time.Millisecond,
+		Logger:             logging.New(&logs, logging.Info),
+	}
+	srv, done := serveStream(t, &result)
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4096)
+	fmt.Fprintf(conn, "GET /result/pid/stream HTTP/1.1\r\nHost: test\r\n\r\n")
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream still blocked on a client that doesn't read")
+	}
+
+	found := false
+	for _, line := range strings.Split(logs.String(), "\n") {
+		var entry map[string]interface{}
+		if json.Unmarshal([]byte(line), &entry) != nil {
+			continue
+		}
+		if entry["msg"] == "finished" {
+			t.Errorf("stream logged finished; want aborted")
+		}
+		if entry["msg"] == "slow client" && entry["pid"] == "pid" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no slow client event in %s", logs.String())
+	}
+}
+
+func TestStreamToReadingClientIsNotSlow(t *testing.T) {
+	var logs syncBuffer
+	result := Result {
+		Storage:            largeResult(16, 64 * 1024),
+		StreamWriteTimeout: time.Second,
+		Logger:             logging.New(&logs, logging.Info),
+	}
+	srv, done := serveStream(t, &result)
+
+	res, err := http.Get(srv.URL + "/result/pid/stream")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer res.Body.Close()
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(res.Body); err != nil {
+		t.Fatalf("%v", err)
+	}
+	<-done
+
+	if n := body.Len(); n < 16 * 64 * 1024 {
+		t.Errorf("got %d bytes; want the whole result", n)
+	}
+	if strings.Contains(logs.String(), "slow client") {
+		t.Errorf("reading client logged as slow: %s", logs.String())
+	}
+}
+
+func TestWriteDeadlineWithoutConnIsNoop(t *testing.T) {
+	deadline := newWriteDeadline(context.Background(), time.Millisecond)
+	if deadline != nil {
+		t.Fatalf("deadline = %v; want nil without a connection", deadline)
+	}
+	deadline.extend()
+	deadline.clear()
+	if deadline.exceeded() {
+		t.Errorf("nil deadline exceeded")
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const sseContentType = "text/event-stream"
+
+/*
+ * Write a single server-sent event [1]. The payload is written as a single
+ * data line, so any newlines in it are replaced with spaces.
+ *
+ * [1] https://html.spec.whatwg.org/multipage/server-sent-events.html
+ */
+func writeEvent(w gin.ResponseWriter, event, id, data string) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event: %s\n", event)
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	data = strings.ReplaceAll(data, "\n", " ")
+	fmt.Fprintf(&b, "data: %s\n\n", data)
+	w.WriteString(b.String())
+	w.(http.Flusher).Flush()
+}
+
+/*
+ * GET /result/<pid>/sse
+ *
+ * The result as server-sent events, for browser clients that can use
+ * EventSource, but would rather not parse the length-prefixed stream. The
+ * result header comes first as a header event, and every tile as a tile
+ * event, both base64-encoded, since events are text. The events end with
+ * a done event when the result is complete, or an error event with the
+ * message if it could not be read.
+ *
+ * The tile events carry the stream ID of the tile as the event ID, so
+ * EventSource resumes after the last tile on its own when reconnecting, by
+ * sending Last-Event-ID. Clients that reconnect by hand can pass the ID as
+ * ?from=, like for the stream.
+ *
+ * The connection is kept alive with a comment every 15 seconds, which
+ * EventSource ignores. EventSource can't set the Authorization header either,
+ * so this route should be authed with ResultAuth and WithQueryToken, which
+ * accepts the token as ?token=.
+ */
+func (r *Result) StreamSSE(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if acceptable(ctx, sseContentType) == "" {
+		return
+	}
+	if rejectDecimation(ctx, "streams") {
+		return
+	}
+
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cursor := ctx.GetHeader("Last-Event-ID")
+	if cursor == "" {
+		cursor = ctx.DefaultQuery("from", start.cursor)
+	}
+	from, err := findPosition(ctx, r.Storage, pid, cursor)
+	if err != nil {
+		r.logger(pid).Info("bad cursor", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+
+	collectctx, cancel := r.withCollectTimeout(ctx.Request.Context())
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(collectctx, "sse", pid, head, from, false, tiles, failure)
+
+	w := ctx.Writer
+	header := w.Header()
+	header.Set("Content-Type", sseContentType)
+	cacheNever(ctx)
+	w.WriteHeader(http.StatusOK)
+
+	keepalive := newIdleTimer(r.keepAlive())
+	defer keepalive.stop()
+
+	encode := base64.StdEncoding.EncodeToString
+	throttle := newThrottle(r.StreamBurst, r.StreamRate)
+	for {
+		select {
+		case <-keepalive.expired():
+			w.WriteString(": keep-alive\n\n")
+			w.(http.Flusher).Flush()
+			keepalive.reset()
+
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					r.logger(pid).Error("stream failed", "error", err)
+					writeEvent(w, "error", "", err.Error())
+					return
+				}
+				writeEvent(w, "done", "", "")
+				return
+			}
+			if output.id == "" {
+				writeEvent(w, "header", "", encode(output.tile))
+				keepalive.reset()
+				continue
+			}
+
+			if err := throttle.wait(collectctx); err != nil {
+				r.logger(pid).Error("stream failed", "error", err)
+				writeEvent(w, "error", "", err.Error())
+				return
+			}
+			writeEvent(w, "tile", output.id, encode(output.tile))
+			keepalive.reset()
+
+		case err := <-failure:
+			r.logger(pid).Error("stream failed", "error", err)
+			writeEvent(w, "error", "", err.Error())
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type event struct {
+	kind string
+	id   string
+	data string
+}
+
+func parseEvents(t *testing.T, body []byte) []event {
+	events := make([]event, 0)
+	var ev event
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		if line == "" {
+			events = append(events, ev)
+			ev = event {}
+			continue
+		}
+		field := strings.SplitN(line, ": ", 2)
+		if len(field) != 2 {
+			t.Fatalf("malformed event line %q", line)
+		}
+		switch field[0] {
+			case "event": ev.kind = field[1]
+			case "id":    ev.id   = field[1]
+			case "data":  ev.data = field[1]
+			default:
+				t.Fatalf("unknown event field %q", field[0])
+		}
+	}
+	return events
+}
+
+func getEvents(result *Result, path, lastEventID string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid/sse", result.StreamSSE)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestStreamSSE(t *testing.T) {
+	ntasks := 3
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(fmt.Sprintf("tile-%d", i))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	result := Result { Storage: storage }
+
+	w := getEvents(&result, "/result/pid/sse", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != sseContentType {
+		t.Errorf("Content-Type = %s; want %s", ct, sseContentType)
+	}
+
+	events := parseEvents(t, w.Body.Bytes())
+	if len(events) != ntasks + 2 {
+		t.Fatalf("got %d events; want %d", len(events), ntasks + 2)
+	}
+	if events[0].kind != "header" {
+		t.Errorf("first event = %s; want header", events[0].kind)
+	}
+	if end := events[len(events) - 1]; end.kind != "done" {
+		t.Errorf("last event = %s; want done", end.kind)
+	}
+
+	tiles := make(map[string]bool)
+	for _, ev := range events[1:len(events) - 1] {
+		if ev.kind != "tile" {
+			t.Errorf("event = %s; want tile", ev.kind)
+			continue
+		}
+		if ev.id == "" {
+			t.Errorf("tile event without id")
+		}
+		tile, err := base64.StdEncoding.DecodeString(ev.data)
+		if err != nil {
+			t.Fatalf("tile is not base64: %v", err)
+		}
+		tiles[string(tile)] = true
+	}
+	for i := 0; i < ntasks; i++ {
+		if tile := fmt.Sprintf("tile-%d", i); !tiles[tile] {
+			t.Errorf("missing %s", tile)
+		}
+	}
+}
+
+func TestStreamSSEResumesFromLastEventID(t *testing.T) {
+	ntasks := 3
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(fmt.Sprintf("tile-%d", i))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	result := Result { Storage: storage }
+
+	full := parseEvents(t, getEvents(&result, "/result/pid/sse", "").Body.Bytes())
+	w := getEvents(&result, "/result/pid/sse", full[1].id)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	resumed := parseEvents(t, w.Body.Bytes())
+	want := full[2:]
+	if len(resumed) != len(want) {
+		t.Fatalf("got %d events; want %d", len(resumed), len(want))
+	}
+	for i := range want {
+		if resumed[i] != want[i] {
+			t.Errorf("event %d = %v; want %v", i, resumed[i], want[i])
+		}
+	}
+}
+
+func TestStreamSSEKeepAlive(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage:   storage,
+		Timeout:   100 * time.Millisecond,
+		ReadBlock: 10 * time.Millisecond,
+		KeepAlive: 10 * time.Millisecond,
+	}
+
+	w := getEvents(&result, "/result/pid/sse", "")
+	if !bytes.Contains(w.Body.Bytes(), []byte(": keep-alive\n\n")) {
+		t.Errorf("no keep-alive in %q", w.Body.Bytes())
+	}
+
+	events := parseEvents(t, w.Body.Bytes())
+	if last := events[len(events) - 1]; last.kind != "error" {
+		t.Errorf("last event = %s; want error", last.kind)
+	}
+}
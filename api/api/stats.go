@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * Number of bins in the histogram of the summary statistics. The bins are
+ * evenly spaced between min and max.
+ */
+const statsBins = 64
+
+func statskey(pid string) string {
+	return fmt.Sprintf("%s/stats.json", pid)
+}
+
+var errResultTooLarge = errors.New("result too large")
+
+type histogram struct {
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Counts []int64 `json:"counts"`
+}
+
+/*
+ * Summary statistics of all the samples in a result. NaN and infinite samples
+ * (typically fill values) are not included in the statistics, but counted as
+ * excluded. When there are no samples to compute statistics from, the
+ * statistics are null.
+ */
+type summary struct {
+	Count     int64      `json:"count"`
+	Excluded  int64      `json:"excluded"`
+	Min       *float64   `json:"min"`
+	Max       *float64   `json:"max"`
+	Mean      *float64   `json:"mean"`
+	Stddev    *float64   `json:"stddev"`
+	RMS       *float64   `json:"rms"`
+	Histogram *histogram `json:"histogram"`
+}
+
+/*
+ * Running statistics, with Welford's algorithm for the variance, which is
+ * numerically stable even for the large sample counts of big results.
+ */
+type accumulator struct {
+	count    int64
+	excluded int64
+	min      float64
+	max      float64
+	mean     float64
+	m2       float64
+	sumsq    float64
+}
+
+func (a *accumulator) add(x float32) {
+	v := float64(x)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		a.excluded++
+		return
+	}
+
+	if a.count == 0 {
+		a.min = v
+		a.max = v
+	}
+	a.count++
+	a.min = math.Min(a.min, v)
+	a.max = math.Max(a.max, v)
+	delta := v - a.mean
+	a.mean += delta / float64(a.count)
+	a.m2 += delta * (v - a.mean)
+	a.sumsq += v * v
+}
+
+func (a *accumulator) summary() *summary {
+	s := &summary {
+		Count:    a.count,
+		Excluded: a.excluded,
+	}
+	if a.count == 0 {
+		return s
+	}
+
+	n := float64(a.count)
+	min    := a.min
+	max    := a.max
+	mean   := a.mean
+	stddev := math.Sqrt(a.m2 / n)
+	rms    := math.Sqrt(a.sumsq / n)
+	s.Min    = &min
+	s.Max    = &max
+	s.Mean   = &mean
+	s.Stddev = &stddev
+	s.RMS    = &rms
+	s.Histogram = &histogram {
+		Min:    min,
+		Max:    max,
+		Counts: make([]int64, statsBins),
+	}
+	return s
+}
+
+func (h *histogram) add(x float32) {
+	v := float64(x)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return
+	}
+
+	bin := 0
+	if h.Max > h.Min {
+		bin = int((v - h.Min) / (h.Max - h.Min) * float64(len(h.Counts)))
+	}
+	if bin >= len(h.Counts) {
+		bin = len(h.Counts) - 1
+	}
+	h.Counts[bin]++
+}
+
+/*
+ * Fold fn over all the samples in the result, one bundle at a time, so that
+ * the whole result never has to be in memory.
+ */
+func (r *Result) foldSamples(
+	ctx  context.Context,
+	pid  string,
+	head *message.ProcessHeader,
+	fn   func(float32),
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tiles   := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(ctx, "stats", pid, head, start, false, tiles, failure)
+
+	/*
+	 * The first tile is the result header, which holds no samples. Should
+	 * anything go wrong, keep reading until the collector is done, or it
+	 * would be stuck trying to send the next tile.
+	 */
+	<-tiles
+	size := int64(len(head.RawHeader))
+	var ferr error
+	for {
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if ferr != nil {
+					return ferr
+				}
+				return reportedFailure(failure)
+			}
+			if ferr != nil {
+				continue
+			}
+
+			tile := output.tile
+			size += int64(len(tile))
+			if r.MaxResultBytes > 0 && size > r.MaxResultBytes {
+				ferr = errResultTooLarge
+				continue
+			}
+
+			samples, err := message.BundleSamples(head.Function, tile)
+			if err != nil {
+				ferr = fmt.Errorf("unable to parse bundle: %w", err)
+				continue
+			}
+			for _, sample := range samples {
+				fn(sample)
+			}
+
+		case err := <-failure:
+			return err
+		}
+	}
+}
+
+func (r *Result) summarize(
+	ctx  context.Context,
+	pid  string,
+	head *message.ProcessHeader,
+) (*summary, error) {
+	acc := accumulator {}
+	err := r.foldSamples(ctx, pid, head, acc.add)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+	 * The bins of the histogram depend on min and max, which means a second
+	 * pass over the result
+	 */
+	s := acc.summary()
+	if s.Histogram != nil {
+		err = r.foldSamples(ctx, pid, head, s.Histogram.add)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+/*
+ * Summary statistics (count, min, max, mean, stddev, rms and a histogram) of a
+ * completed result, computed server-side. This saves clients from downloading
+ * the whole result only to compute some basic quality control numbers.
+ *
+ * The statistics are stored alongside the partial results, so they're only
+ * computed once per process.
+ */
+func (r *Result) Stats(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	cached, err := r.Storage.Get(ctx, statskey(pid)).Bytes()
+	if err == nil {
+		ctx.Data(http.StatusOK, "application/json", cached)
+		return
+	}
+	if err != redis.Nil {
+		r.logger(pid).Error("unable to read cached statistics", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	s := r.status(ctx, pid)
+	if s.body == nil {
+		ctx.AbortWithStatus(s.code)
+		return
+	}
+	if s.code != http.StatusOK {
+		ctx.JSON(s.code, s.body)
+		return
+	}
+
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	/*
+	 * Stop reading the result if the client goes away - the statistics are
+	 * not stored unless they're complete anyway
+	 */
+	stats, err := r.summarize(ctx.Request.Context(), pid, head)
+	if errors.Is(err, errResultTooLarge) {
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H {
+			"error": "result too large for server-side statistics",
+			"limit": r.MaxResultBytes,
+		})
+		return
+	}
+	if err != nil {
+		r.logger(pid).Error("unable to compute statistics", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	doc, err := json.Marshal(stats)
+	if err != nil {
+		r.logger(pid).Error("unable to encode statistics", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	err = r.Storage.Set(ctx, statskey(pid), doc, r.resultTTL()).Err()
+	if err != nil {
+		r.logger(pid).Warn("unable to store statistics", "error", err)
+	}
+	ctx.Data(http.StatusOK, "application/json", doc)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func getStats(result *Result, pid string) *httptest.ResponseRecorder {
+	app := gin.New()
+	app.GET("/result/:pid/stats", result.Stats)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/" + pid + "/stats", nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestStatsOfFinishedResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", fakeSliceBundle(1, 2, float32(math.NaN())))
+	storage.add("pid", "1/2", fakeSliceBundle(3, 4))
+
+	result := Result { Storage: storage }
+	w := getStats(&result, "pid")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := summary {}
+	err := json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), stats.Count)
+	assert.Equal(t, int64(1), stats.Excluded)
+	assert.Equal(t, 1.0, *stats.Min)
+	assert.Equal(t, 4.0, *stats.Max)
+	assert.Equal(t, 2.5, *stats.Mean)
+	assert.InDelta(t, math.Sqrt(1.25), *stats.Stddev, 1e-9)
+	assert.InDelta(t, math.Sqrt(7.5), *stats.RMS, 1e-9)
+
+	var total int64
+	for _, n := range stats.Histogram.Counts {
+		total += n
+	}
+	assert.Equal(t, int64(4), total)
+	assert.Equal(t, int64(1), stats.Histogram.Counts[0])
+	assert.Equal(t, int64(1), stats.Histogram.Counts[statsBins - 1])
+}
+
+func TestStatsAreCached(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(1, 2))
+
+	result := Result { Storage: storage }
+	first := getStats(&result, "pid")
+	assert.Equal(t, http.StatusOK, first.Code)
+	xreads := storage.called("xread")
+
+	second := getStats(&result, "pid")
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, xreads, storage.called("xread"), "stream read again")
+}
+
+func TestStatsOfUnfinishedResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", fakeSliceBundle(1, 2))
+
+	result := Result { Storage: storage }
+	w := getStats(&result, "pid")
+	assert.Equal(t, http.StatusAccepted, w.Code)
+
+	body := map[string]interface{} {}
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Nil(t, err)
+	assert.Equal(t, "working", body["status"])
+	assert.Equal(t, "1/2", body["progress"])
+	assert.Equal(t, 0.5, body["fraction"])
+}
+
+func TestStatsOfEmptyResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(float32(math.NaN())))
+
+	result := Result { Storage: storage }
+	w := getStats(&result, "pid")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	stats := summary {}
+	err := json.Unmarshal(w.Body.Bytes(), &stats)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stats.Count)
+	assert.Equal(t, int64(1), stats.Excluded)
+	assert.Nil(t, stats.Mean)
+	assert.Nil(t, stats.Histogram)
+}
+
+func TestStatsOfTooLargeResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", fakeSliceBundle(make([]float32, 100)...))
+
+	result := Result {
+		Storage:        storage,
+		MaxResultBytes: 64,
+	}
+	w := getStats(&result, "pid")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+}
@@ -0,0 +1,407 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * An in-memory stand-in for redis, implementing just the commands the result
+ * handlers use. The embedded (nil) redis.Cmdable satisfies the rest of the
+ * interface, so calling anything not implemented here panics, which is a
+ * pretty clear signal that the fake needs to be extended.
+ */
+type fakeStorage struct {
+	redis.Cmdable
+
+	mtx     sync.Mutex
+	keys    map[string]string
+	streams map[string][]redis.XMessage
+	calls   map[string]int
+	ttls    map[string]time.Duration
+	nextseq int
+	/*
+	 * Artificial latency for every command, to make concurrent requests
+	 * overlap reliably
+	 */
+	latency time.Duration
+	/*
+	 * When set, Ping fails with it, like an unreachable redis
+	 */
+	down error
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage {
+		keys:    make(map[string]string),
+		streams: make(map[string][]redis.XMessage),
+		calls:   make(map[string]int),
+		ttls:    make(map[string]time.Duration),
+	}
+}
+
+func (f *fakeStorage) called(cmd string) int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.calls[cmd]
+}
+
+/*
+ * The expiration the key was last Set with
+ */
+func (f *fakeStorage) ttl(key string) time.Duration {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.ttls[key]
+}
+
+func (f *fakeStorage) set(key string, val []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.keys[key] = string(val)
+}
+
+/*
+ * Add a message to the stream with a single key/value pair, like the workers
+ * do when they write a partial result.
+ */
+func (f *fakeStorage) add(stream string, key string, val []byte) {
+	f.addAt(stream, key, val, time.Now())
+}
+
+/*
+ * Add a message, as if it was written at time t. Like in redis, the message
+ * ID is the millisecond timestamp and a sequence number.
+ */
+func (f *fakeStorage) addAt(stream, key string, val []byte, t time.Time) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.nextseq++
+	ms := t.UnixNano() / int64(time.Millisecond)
+	id := fmt.Sprintf("%d-%d", ms, f.nextseq)
+	f.streams[stream] = append(f.streams[stream], redis.XMessage {
+		ID:     id,
+		Values: map[string]interface{} { key: string(val) },
+	})
+}
+
+/*
+ * Add a message with arbitrary fields, e.g. a compressed partial result with
+ * its encoding.
+ */
+func (f *fakeStorage) addValues(stream string, values map[string]interface{}) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.nextseq++
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	id := fmt.Sprintf("%d-%d", ms, f.nextseq)
+	f.streams[stream] = append(f.streams[stream], redis.XMessage {
+		ID:     id,
+		Values: values,
+	})
+}
+
+/*
+ * Wait for the artificial latency, or until the context is done, like a
+ * command with a slow round-trip would.
+ */
+func (f *fakeStorage) wait(ctx context.Context) error {
+	select {
+	case <-time.After(f.latency):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (f *fakeStorage) Ping(ctx context.Context) *redis.StatusCmd {
+	if err := f.wait(ctx); err != nil {
+		return redis.NewStatusResult("", err)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["ping"]++
+	if f.down != nil {
+		return redis.NewStatusResult("", f.down)
+	}
+	return redis.NewStatusResult("PONG", nil)
+}
+
+func (f *fakeStorage) Get(ctx context.Context, key string) *redis.StringCmd {
+	if err := f.wait(ctx); err != nil {
+		return redis.NewStringResult("", err)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["get"]++
+	val, ok := f.keys[key]
+	if !ok {
+		return redis.NewStringResult("", redis.Nil)
+	}
+	return redis.NewStringResult(val, nil)
+}
+
+func (f *fakeStorage) XLen(ctx context.Context, stream string) *redis.IntCmd {
+	if err := f.wait(ctx); err != nil {
+		return redis.NewIntResult(0, err)
+	}
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["xlen"]++
+	return redis.NewIntResult(int64(len(f.streams[stream])), nil)
+}
+
+func (f *fakeStorage) Set(
+	ctx        context.Context,
+	key        string,
+	value      interface{},
+	expiration time.Duration,
+) *redis.StatusCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["set"]++
+	f.store(key, value, expiration)
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeStorage) SetNX(
+	ctx        context.Context,
+	key        string,
+	value      interface{},
+	expiration time.Duration,
+) *redis.BoolCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["setnx"]++
+	if _, ok := f.keys[key]; ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	f.store(key, value, expiration)
+	return redis.NewBoolResult(true, nil)
+}
+
+/*
+ * Store the value like redis would, as a string. The caller must hold mtx.
+ */
+func (f *fakeStorage) store(key string, value interface{}, expiration time.Duration) {
+	f.ttls[key] = expiration
+	switch v := value.(type) {
+	case []byte:
+		f.keys[key] = string(v)
+	case string:
+		f.keys[key] = v
+	default:
+		f.keys[key] = fmt.Sprint(v)
+	}
+}
+
+func (f *fakeStorage) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["del"]++
+	var n int64
+	for _, key := range keys {
+		if _, ok := f.keys[key]; ok {
+			delete(f.keys, key)
+			n++
+		}
+		if _, ok := f.streams[key]; ok {
+			delete(f.streams, key)
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func (f *fakeStorage) XAdd(
+	ctx  context.Context,
+	args *redis.XAddArgs,
+) *redis.StringCmd {
+	values := make(map[string]interface{})
+	switch v := args.Values.(type) {
+	case []interface{}:
+		for i := 0; i + 1 < len(v); i += 2 {
+			values[fmt.Sprint(v[i])] = v[i + 1]
+		}
+	case map[string]interface{}:
+		values = v
+	default:
+		panic(fmt.Sprintf("fakeStorage.XAdd: unsupported values %T", v))
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["xadd"]++
+	f.nextseq++
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	id := fmt.Sprintf("%d-%d", ms, f.nextseq)
+	f.streams[args.Stream] = append(f.streams[args.Stream], redis.XMessage {
+		ID:     id,
+		Values: values,
+	})
+	return redis.NewStringResult(id, nil)
+}
+
+/*
+ * The sequence numbers of the message IDs are unique across all streams, so
+ * they're all that's needed to order messages.
+ */
+func sequence(id string) int {
+	var ms, n int64
+	fmt.Sscanf(id, "%d-%d", &ms, &n)
+	return int(n)
+}
+
+/*
+ * Messages are appended in sequence order, so the ones after the cursor can
+ * be found with a binary search. This keeps reading large streams linear,
+ * which matters for the benchmarks.
+ */
+func (f *fakeStorage) after(stream, cursor string, count int64) []redis.XMessage {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	stored := f.streams[stream]
+	seq := sequence(cursor)
+	first := sort.Search(len(stored), func(i int) bool {
+		return sequence(stored[i].ID) > seq
+	})
+
+	last := len(stored)
+	if count > 0 && first + int(count) < last {
+		last = first + int(count)
+	}
+	return append([]redis.XMessage{}, stored[first:last]...)
+}
+
+func (f *fakeStorage) XRange(
+	ctx    context.Context,
+	stream string,
+	start  string,
+	stop   string,
+) *redis.XMessageSliceCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["xrange"]++
+	if start != "-" || stop != "+" {
+		panic("fakeStorage.XRange only supports - +")
+	}
+	msgs := append([]redis.XMessage{}, f.streams[stream]...)
+	return redis.NewXMessageSliceCmdResult(msgs, nil)
+}
+
+func (f *fakeStorage) XRevRangeN(
+	ctx    context.Context,
+	stream string,
+	start  string,
+	stop   string,
+	count  int64,
+) *redis.XMessageSliceCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls["xrevrange"]++
+	if start != "+" || stop != "-" {
+		panic("fakeStorage.XRevRangeN only supports + -")
+	}
+	msgs := f.streams[stream]
+	rev := make([]redis.XMessage, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if count > 0 && int64(len(rev)) == count {
+			break
+		}
+		rev = append(rev, msgs[i])
+	}
+	return redis.NewXMessageSliceCmdResult(rev, nil)
+}
+
+/*
+ * XRead, like redis, blocks until there are messages after the cursor, the
+ * block duration elapses, or the context is cancelled. A negative block
+ * duration does not block at all. Only reading from a single stream is
+ * supported.
+ */
+func (f *fakeStorage) XRead(
+	ctx  context.Context,
+	args *redis.XReadArgs,
+) *redis.XStreamSliceCmd {
+	f.mtx.Lock()
+	f.calls["xread"]++
+	f.mtx.Unlock()
+
+	stream, cursor := args.Streams[0], args.Streams[1]
+	start := time.Now()
+	for {
+		msgs := f.after(stream, cursor, args.Count)
+		if len(msgs) > 0 {
+			f.mtx.Lock()
+			f.calls["xread-messages"] += len(msgs)
+			f.mtx.Unlock()
+			reply := []redis.XStream {{ Stream: stream, Messages: msgs }}
+			return redis.NewXStreamSliceCmdResult(reply, nil)
+		}
+
+		if ctx.Err() != nil {
+			return redis.NewXStreamSliceCmdResult(nil, ctx.Err())
+		}
+		if args.Block < 0 {
+			return redis.NewXStreamSliceCmdResult(nil, redis.Nil)
+		}
+		if args.Block > 0 && time.Since(start) >= args.Block {
+			return redis.NewXStreamSliceCmdResult(nil, redis.Nil)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/*
+ * The process header as the scheduler writes it, with the envelope, but with
+ * only the fields the API cares about.
+ */
+func fakeProcessHeader(ntasks int) []byte {
+	return fakeFunctionHeader(message.FunctionSlice, ntasks)
+}
+
+func fakeFunctionHeader(function int, ntasks int) []byte {
+	/*
+	 * Sort the keys, so that headers made from the same arguments are
+	 * byte-for-byte equal
+	 */
+	var body bytes.Buffer
+	enc := msgpack.NewEncoder(&body)
+	enc.SetSortMapKeys(true)
+	err := enc.Encode(map[string]interface{} {
+		"function": function,
+		"nbundles": ntasks,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{ 0x92 }, body.Bytes()...)
+}
+
+/*
+ * A slice bundle with a single tile holding the values
+ */
+func fakeSliceBundle(values ...float32) []byte {
+	bundle := message.SliceTiles {
+		Attr:  "data",
+		Tiles: []message.Tile {{
+			Iterations: 1,
+			ChunkSize:  len(values),
+			V:          values,
+		}},
+	}
+	packed, err := bundle.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * The default max number of concurrent result streams, see NewStreamLimiter
+ */
+const DefaultMaxStreams = 256
+
+/*
+ * A server-wide limit on the number of results that are read concurrently
+ * (Get and Stream), so that a burst of clients can't exhaust the redis
+ * connections or the memory of the API. Requests over the limit are not
+ * queued, but rejected right away with 429 Too Many Requests and a
+ * Retry-After, so that clients back off and try again.
+ *
+ * The number of active and rejected streams is reported by the health
+ * endpoint, see Maintenance.Streams.
+ */
+type StreamLimiter struct {
+	/*
+	 * How long rejected clients are told to wait before trying again. Zero
+	 * means no Retry-After header.
+	 */
+	RetryAfter time.Duration
+
+	slots    chan struct{}
+	rejected int64
+}
+
+/*
+ * A limiter for max concurrent streams. Zero means DefaultMaxStreams, and
+ * negative means no limit, in which case nil is returned. It's perfectly
+ * fine to acquire() from a nil limiter, which always succeeds.
+ */
+func NewStreamLimiter(max int, retryAfter time.Duration) *StreamLimiter {
+	if max < 0 {
+		return nil
+	}
+	if max == 0 {
+		max = DefaultMaxStreams
+	}
+	return &StreamLimiter {
+		RetryAfter: retryAfter,
+		slots:      make(chan struct{}, max),
+	}
+}
+
+/*
+ * Acquire a slot for a stream, and return the function that releases it. If
+ * the limiter is saturated, the 429 response is written and nil returned.
+ */
+func (l *StreamLimiter) acquire(ctx *gin.Context) func() {
+	if release := l.tryAcquire(); release != nil {
+		return release
+	}
+
+	setRetryAfter(ctx, l.RetryAfter)
+	ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H {
+		"error": "too many concurrent streams; try again later",
+	})
+	return nil
+}
+
+/*
+ * Acquire a slot, like acquire, for streams that are not over HTTP. If the
+ * limiter is saturated, the rejection is counted and nil returned.
+ */
+func (l *StreamLimiter) tryAcquire() func() {
+	if l == nil {
+		return func() {}
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return func() { <-l.slots }
+	default:
+	}
+
+	atomic.AddInt64(&l.rejected, 1)
+	return nil
+}
+
+/*
+ * The number of streams currently holding a slot
+ */
+func (l *StreamLimiter) Active() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+/*
+ * The number of streams rejected since the limiter was created
+ */
+func (l *StreamLimiter) Rejected() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.rejected)
+}
+
+func (l *StreamLimiter) Max() int {
+	if l == nil {
+		return 0
+	}
+	return cap(l.slots)
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ * Start n concurrent streams of a result that never completes, so that every
+ * stream that gets a slot holds on to it until cancel() is called
+ */
+func concurrentStreams(
+	result *Result,
+	n      int,
+) (codes chan int, cancel func()) {
+	app := gin.New()
+	app.GET("/result/:pid/stream", result.Stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	codes = make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(
+				ctx,
+				http.MethodGet,
+				"/result/pid/stream",
+				nil,
+			)
+			app.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+	return codes, cancel
+}
+
+func TestStreamLimitRejectsWithTooManyRequests(t *testing.T) {
+	const max = 4
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile"))
+	streams := NewStreamLimiter(max, 3 * time.Second)
+	result := Result {
+		Storage: storage,
+		Streams: streams,
+	}
+
+	codes, cancel := concurrentStreams(&result, max + 1)
+	defer cancel()
+
+	/*
+	 * The streams that got a slot are stuck waiting for the second tile, so
+	 * the first one to finish must be the one that was rejected
+	 */
+	select {
+	case code := <-codes:
+		if code != http.StatusTooManyRequests {
+			t.Errorf("status = %d; want %d", code, http.StatusTooManyRequests)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no stream rejected")
+	}
+	if n := streams.Active(); n != max {
+		t.Errorf("%d active streams; want %d", n, max)
+	}
+
+	cancel()
+	for i := 0; i < max; i++ {
+		if code := <-codes; code == http.StatusTooManyRequests {
+			t.Errorf("more than one stream rejected")
+		}
+	}
+	if n := streams.Rejected(); n != 1 {
+		t.Errorf("%d rejected streams; want 1", n)
+	}
+	if n := streams.Active(); n != 0 {
+		t.Errorf("%d active streams after they ended; want 0", n)
+	}
+}
+
+func TestStreamLimitRetryAfter(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	streams := NewStreamLimiter(1, 1500 * time.Millisecond)
+	result := Result {
+		Storage: storage,
+		Streams: streams,
+	}
+
+	/*
+	 * Hold the only slot, as if another stream was in progress
+	 */
+	streams.slots <- struct{}{}
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if ra := w.Header().Get("Retry-After"); ra != "2" {
+		t.Errorf("Retry-After = %q; want 2", ra)
+	}
+
+	<-streams.slots
+	if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d after the slot was released", w.Code, http.StatusOK)
+	}
+}
+
+func TestNewStreamLimiter(t *testing.T) {
+	if n := NewStreamLimiter(0, 0).Max(); n != DefaultMaxStreams {
+		t.Errorf("max = %d; want default %d", n, DefaultMaxStreams)
+	}
+	if streams := NewStreamLimiter(-1, 0); streams != nil {
+		t.Errorf("negative max gave a limiter; want nil")
+	}
+}
+
+func TestReadyReportsStreams(t *testing.T) {
+	streams := NewStreamLimiter(2, 0)
+	streams.slots <- struct{}{}
+	streams.rejected = 3
+	probes := Probes {
+		Storage:     newFakeStorage(),
+		Maintenance: &Maintenance { Streams: streams },
+	}
+
+	app := gin.New()
+	app.GET("/readyz", probes.Ready)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+	app.ServeHTTP(w, req)
+
+	var body struct {
+		Streams struct {
+			Active   int   `json:"active"`
+			Rejected int64 `json:"rejected"`
+			Max      int   `json:"max"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if body.Streams.Active != 1 || body.Streams.Rejected != 3 || body.Streams.Max != 2 {
+		t.Errorf("streams = %+v; want 1 active, 3 rejected, max 2", body.Streams)
+	}
+}
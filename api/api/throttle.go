@@ -0,0 +1,69 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+/*
+ * A throttle lets the first burst tiles through at full speed, and paces the
+ * rest to rate tiles per second. This gives viewers the first tiles (usually
+ * the visible region) fast, without saturating the downstream bandwidth with
+ * the remainder.
+ *
+ * Idle time does not build up credit - a slow producer doesn't buy a faster
+ * consumer a new burst later.
+ */
+type throttle struct {
+	burst    int
+	interval time.Duration
+	sent     int
+	last     time.Time
+}
+
+/*
+ * A throttle with burst and rate, or nil if rate is not positive. It's
+ * perfectly fine to wait() on a nil throttle, which never waits.
+ */
+func newThrottle(burst int, rate float64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &throttle {
+		burst:    burst,
+		interval: time.Duration(float64(time.Second) / rate),
+	}
+}
+
+/*
+ * Wait until the next tile can be sent, or until ctx is done, in which case
+ * the context error is returned.
+ */
+func (t *throttle) wait(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	t.sent++
+	now := time.Now()
+	if t.sent <= t.burst || t.last.IsZero() {
+		t.last = now
+		return nil
+	}
+
+	next := t.last.Add(t.interval)
+	if next.Before(now) {
+		t.last = now
+		return nil
+	}
+
+	timer := time.NewTimer(next.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		t.last = next
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestThrottleBurstsThenPaces(t *testing.T) {
+	interval := 40 * time.Millisecond
+	th := newThrottle(3, float64(time.Second / interval))
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		th.wait(ctx)
+	}
+	if elapsed := time.Since(start); elapsed > interval / 2 {
+		t.Errorf("burst took %v; want < %v", elapsed, interval / 2)
+	}
+
+	prev := time.Now()
+	for i := 0; i < 3; i++ {
+		th.wait(ctx)
+		now := time.Now()
+		/* leave some slack for timer granularity */
+		if gap := now.Sub(prev); gap < interval * 3 / 4 {
+			t.Errorf("tile %d after %v; want >= %v", i + 3, gap, interval)
+		}
+		prev = now
+	}
+}
+
+func TestNilThrottleNeverWaits(t *testing.T) {
+	th := newThrottle(0, 0)
+	if th != nil {
+		t.Fatalf("expected nil throttle for rate = 0")
+	}
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		th.wait(context.Background())
+	}
+	if elapsed := time.Since(start); elapsed > 10 * time.Millisecond {
+		t.Errorf("nil throttle waited %v", elapsed)
+	}
+}
+
+func TestThrottleWaitIsCancellable(t *testing.T) {
+	th := newThrottle(0, 0.001)
+	ctx, cancel := context.WithCancel(context.Background())
+	th.wait(ctx)
+	cancel()
+
+	if err := th.wait(ctx); err != context.Canceled {
+		t.Errorf("err = %v; want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * Workers may compress the partial results they write to the stream, to save
+ * memory in redis. Compressed partial results are flagged with an extra field
+ * in the stream entry, e.g. { "0/2": <tile>, "enc": "zstd" }, and entries
+ * without the field are uncompressed, so streams written by old and new
+ * workers can be mixed freely.
+ */
+const encfield = "enc"
+
+/*
+ * Workers write the CRC-32C (Castagnoli) of the (uncompressed) partial result
+ * in this field, formatted as 8 hex digits, so that corruption between the
+ * worker and the API can be pinned down to the part it happened to. Entries
+ * without it are not verified.
+ */
+const crcfield = "crc32c"
+
+var crctable = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(tile []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(tile, crctable))
+}
+
+/*
+ * The default for the max size of a decompressed partial result, see
+ * Result.MaxTileBytes.
+ */
+const defaultMaxTileBytes = 64 * 1024 * 1024
+
+/*
+ * An entry in the result stream, i.e. a partial result as the worker wrote it,
+ * or the error that failed the task.
+ */
+type entry struct {
+	part string
+	tile []byte
+	enc  string
+	crc  string
+	err  string
+	/*
+	 * The pooled buffer that backs tile, see getTileBuffer
+	 */
+	buf *[]byte
+}
+
+/*
+ * Parse the fields of a stream entry. Partial results have exactly one field
+ * that is not reserved, which is keyed by the part (n/m) and holds the tile.
+ */
+func parseEntry(values map[string]interface{}) (*entry, error) {
+	e := &entry {}
+	for key, val := range values {
+		str, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s.type = %T; expected []byte", key, val)
+		}
+
+		switch key {
+		case errorfield:
+			e.err = str
+		case encfield:
+			e.enc = str
+		case crcfield:
+			e.crc = str
+		default:
+			if e.part != "" {
+				return nil, fmt.Errorf(
+					"entry has both part %s and %s; expected one",
+					e.part,
+					key,
+				)
+			}
+			e.part = key
+			e.buf = getTileBuffer()
+			*e.buf = append(*e.buf, str...)
+			e.tile = *e.buf
+		}
+	}
+
+	/*
+	 * The partial results of empty results have no bytes at all, see
+	 * finishedResult.empty
+	 */
+	if e.err == "" && e.part == "" {
+		return nil, fmt.Errorf("entry has no partial result")
+	}
+	return e, nil
+}
+
+/*
+ * Decoder for the partial results in the stream. Compressed partial results
+ * are decompressed, unless passthrough is set, in which case they're handed
+ * over as they are. This is for responses that are zstd compressed anyway,
+ * where the compressed tiles can be written straight to the client.
+ *
+ * Decompression is bounded by limit, so that a corrupted (or malicious)
+ * partial result can't blow up in the API's memory.
+ *
+ * With verify, the checksums of the partial results are checked. Compressed
+ * partial results are checked after decompression, so passed through partial
+ * results are not checked at all - the zstd frames carry their own checksums,
+ * which the client checks.
+ */
+type tiledecoder struct {
+	zstd        func() *zstd.Decoder
+	limit       int64
+	passthrough bool
+	verify      bool
+}
+
+func newZstdDecoder(limit int64) (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(limit)))
+}
+
+func (d *tiledecoder) decode(e *entry) ([]byte, error) {
+	tile, err := d.decompress(e)
+	if err != nil {
+		return nil, err
+	}
+	if !d.verify || e.crc == "" || isZstdFrame(tile) {
+		return tile, nil
+	}
+
+	if crc := checksum(tile); crc != e.crc {
+		return nil, fmt.Errorf(
+			"part=%s checksum mismatch; crc32c = %s, want %s",
+			e.part,
+			crc,
+			e.crc,
+		)
+	}
+	return tile, nil
+}
+
+func (d *tiledecoder) decompress(e *entry) ([]byte, error) {
+	switch e.enc {
+	case "":
+		return e.tile, nil
+
+	case "zstd":
+		if d.passthrough {
+			return e.tile, nil
+		}
+		/*
+		 * The compressed tile is done with once decompressed, so its buffer
+		 * goes back to the pool, and the entry gets the buffer of the
+		 * decompressed tile instead
+		 */
+		buf := getTileBuffer()
+		tile, err := d.zstd().DecodeAll(e.tile, *buf)
+		*buf = tile
+		putTileBuffer(e.buf)
+		e.buf = buf
+		if err != nil {
+			return nil, fmt.Errorf("part=%s unable to decompress: %w", e.part, err)
+		}
+		if int64(len(tile)) > d.limit {
+			return nil, fmt.Errorf(
+				"part=%s decompressed to more than %d bytes",
+				e.part,
+				d.limit,
+			)
+		}
+		return tile, nil
+
+	default:
+		return nil, fmt.Errorf("part=%s unknown encoding %s", e.part, e.enc)
+	}
+}
+
+/*
+ * The magic number that starts every zstd frame, see
+ * https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#zstandard-frames
+ */
+const zstdFrameMagic = 0xFD2FB528
+
+/*
+ * Check if the tile is a zstd frame. Tiles are msgpack documents, which never
+ * start with the zstd magic, so tiles that were passed through compressed can
+ * be told apart from the rest without any extra bookkeeping.
+ */
+func isZstdFrame(tile []byte) bool {
+	if len(tile) < 4 {
+		return false
+	}
+	return binary.LittleEndian.Uint32(tile[:4]) == zstdFrameMagic
+}
+
+/*
+ * The writer for compressed tiles, if the response is zstd compressed and
+ * they can be passed through, or nil if they must be decompressed first.
+ */
+func passthroughWriter(w gin.ResponseWriter) util.ZstdFrameWriter {
+	zw, ok := w.(util.ZstdFrameWriter)
+	if !ok {
+		return nil
+	}
+	return zw
+}
+
+func writeTile(w gin.ResponseWriter, zw util.ZstdFrameWriter, tile []byte) {
+	if zw != nil && isZstdFrame(tile) {
+		zw.WriteZstdFrame(tile)
+		return
+	}
+	w.Write(tile)
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/equinor/oneseismic/api/frame"
+	"github.com/equinor/oneseismic/api/internal/util"
+)
+
+/*
+ * Add a partial result compressed like the workers do with --compress
+ */
+func addCompressed(t *testing.T, storage *fakeStorage, part string, tile []byte) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	storage.addValues("pid", map[string]interface{} {
+		part:  string(enc.EncodeAll(tile, nil)),
+		"enc": "zstd",
+	})
+}
+
+/*
+ * A stream of compressed and uncompressed partial results, and the result
+ * they make once assembled
+ */
+func mixedStorage(t *testing.T) (*fakeStorage, []byte) {
+	header := fakeProcessHeader(3)
+	tiles := [][]byte {
+		fakeSliceBundle(1, 2, 3),
+		fakeSliceBundle(4, 5, 6),
+		fakeSliceBundle(7, 8, 9),
+	}
+
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), header)
+	addCompressed(t, storage, "0/3", tiles[0])
+	storage.add("pid", "1/3", tiles[1])
+	addCompressed(t, storage, "2/3", tiles[2])
+
+	want := append([]byte{}, header...)
+	for _, tile := range tiles {
+		want = append(want, tile...)
+	}
+	return storage, want
+}
+
+func TestMixedCompressedResult(t *testing.T) {
+	storage, want := mixedStorage(t)
+	result := Result { Storage: storage, VerifyBundles: true }
+
+	for _, path := range []string { "/result/pid", "/result/pid/stream" } {
+		w := requestResult(&result, path, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d; want %d", path, w.Code, http.StatusOK)
+		}
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("%s: result differs from the uncompressed tiles", path)
+		}
+	}
+}
+
+func TestCompressedTileOverLimitFails(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	addCompressed(t, storage, "0/1", bytes.Repeat([]byte("x"), 1024 * 1024))
+	result := Result {
+		Storage:      storage,
+		MaxTileBytes: 1024,
+	}
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+/*
+ * When the response is zstd compressed anyway, the compressed tiles are
+ * written as they are, and the client decodes the response like any other
+ */
+func TestCompressedTilesPassThrough(t *testing.T) {
+	storage, want := mixedStorage(t)
+	result := Result { Storage: storage }
+
+	for _, path := range []string { "/result/pid", "/result/pid/stream" } {
+		app := gin.New()
+		app.Use(util.Compression())
+		app.GET("/result/:pid", result.Get)
+		app.GET("/result/:pid/stream", result.Stream)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path + "?compression=zstd", nil)
+		app.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d; want %d", path, w.Code, http.StatusOK)
+		}
+
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		body, err := dec.DecodeAll(w.Body.Bytes(), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if !bytes.Equal(body, want) {
+			t.Errorf("%s: decompressed result differs from the tiles", path)
+		}
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	e, err := parseEntry(map[string]interface{} {
+		"0/2": "tile",
+		"enc": "zstd",
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if e.part != "0/2" || string(e.tile) != "tile" || e.enc != "zstd" {
+		t.Errorf("entry = %+v; want part 0/2, tile and enc zstd", e)
+	}
+
+	_, err = parseEntry(map[string]interface{} {
+		"0/2": "tile",
+		"1/2": "tile",
+	})
+	if err == nil {
+		t.Errorf("expected entry with two parts to fail")
+	}
+
+	_, err = parseEntry(map[string]interface{} { "enc": "zstd" })
+	if err == nil {
+		t.Errorf("expected entry without a partial result to fail")
+	}
+}
+
+func TestChecksumsAreVerified(t *testing.T) {
+	tiles := [][]byte {
+		fakeSliceBundle(1, 2, 3),
+		fakeSliceBundle(4, 5, 6),
+	}
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.addValues("pid", map[string]interface{} {
+		"0/2":    string(tiles[0]),
+		"crc32c": checksum(tiles[0]),
+	})
+	storage.addValues("pid", map[string]interface{} {
+		"1/2":    string(tiles[1]),
+		"crc32c": checksum(tiles[1]),
+	})
+
+	result := Result { Storage: storage, VerifyChecksums: true }
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestChecksumMismatchNamesPart(t *testing.T) {
+	tile := fakeSliceBundle(1, 2, 3)
+	corrupted := append([]byte{}, tile...)
+	corrupted[len(corrupted) - 1] ^= 0xFF
+
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.addValues("pid", map[string]interface{} {
+		"0/2":    string(tile),
+		"crc32c": checksum(tile),
+	})
+	storage.addValues("pid", map[string]interface{} {
+		"1/2":    string(corrupted),
+		"crc32c": checksum(tile),
+	})
+
+	/*
+	 * Verification is opt-in
+	 */
+	result := Result { Storage: storage }
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	result = Result { Storage: storage, VerifyChecksums: true }
+	w = getResult(&result, "pid")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	w = requestResult(&result, "/result/pid/stream?framing=v1", "")
+	frames := decodeFrames(t, w.Body.Bytes())
+	last := frames[len(frames) - 1]
+	if last.Type != frame.Error {
+		t.Fatalf("last frame = %v; want %v", last.Type, frame.Error)
+	}
+	if !strings.Contains(string(last.Payload), "part=1/2") {
+		t.Errorf("error = %s; want it to name part=1/2", last.Payload)
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/*
+ * Result.FirstResultTimeout bounds the wait for the first partial result of a
+ * collection, on top of Result.Timeout, which bounds the whole collection. A
+ * process that is slow to start, or never starts, can then be given up on
+ * early, without cutting short the results that are merely large. The wait is
+ * over when the first partial result is read from storage, see stopWaiting.
+ *
+ * The context is like the one from context.WithTimeout, and when the timer
+ * fires it's done with context.DeadlineExceeded, so that callers can tell
+ * timeouts apart from other failures. It has a done channel of its own,
+ * rather than that of an embedded cancel context, so that contexts derived
+ * from it get their error from Err(), and don't mistake timeouts for
+ * cancellations.
+ */
+type waitContext struct {
+	context.Context
+	done  chan struct{}
+	timer *time.Timer
+
+	mtx sync.Mutex
+	err error
+}
+
+type waitKey struct {}
+
+func (c *waitContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *waitContext) Err() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.err
+}
+
+func (c *waitContext) Value(key interface{}) interface{} {
+	if key == (waitKey {}) {
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+func (c *waitContext) cancel(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+}
+
+/*
+ * Bound ctx by the configured timeout, if any.
+ */
+func (r *Result) withTimeout(
+	ctx context.Context,
+) (context.Context, context.CancelFunc) {
+	if r.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, r.Timeout)
+}
+
+/*
+ * Bound the collection of a result in ctx by the configured timeout, like
+ * withTimeout, and the wait for its first partial result by
+ * FirstResultTimeout, if any.
+ */
+func (r *Result) withCollectTimeout(
+	ctx context.Context,
+) (context.Context, context.CancelFunc) {
+	ctx, cancelTimeout := r.withTimeout(ctx)
+	if r.FirstResultTimeout <= 0 {
+		return ctx, cancelTimeout
+	}
+
+	c := &waitContext {
+		Context: ctx,
+		done:    make(chan struct{}),
+	}
+	c.timer = time.AfterFunc(r.FirstResultTimeout, func() {
+		c.cancel(context.DeadlineExceeded)
+	})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.cancel(ctx.Err())
+		case <-c.done:
+		}
+	}()
+	return c, func() {
+		c.timer.Stop()
+		c.cancel(context.Canceled)
+		cancelTimeout()
+	}
+}
+
+/*
+ * The wait for the first partial result bounded by ctx is over, so ctx no
+ * longer times out for it, but is still bounded by Result.Timeout. Contexts
+ * that are not from withCollectTimeout, or without FirstResultTimeout, are
+ * left alone.
+ */
+func stopWaiting(ctx context.Context) {
+	if c, ok := ctx.Value(waitKey {}).(*waitContext); ok {
+		c.timer.Stop()
+	}
+}
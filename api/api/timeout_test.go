@@ -0,0 +1,112 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutBoundsWholeCollection(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage:            storage,
+		Timeout:            50 * time.Millisecond,
+		FirstResultTimeout: time.Second,
+		ReadBlock:          10 * time.Millisecond,
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		storage.add("pid", "1/2", []byte("tile-1"))
+	}()
+
+	body, trailer := streamTrailers(t, &result, "/result/pid/stream?trailer=true")
+	if !strings.HasSuffix(body, "tile-0") {
+		t.Errorf("expected partial result in stream; got %q", body)
+	}
+	if status := trailer.Get(statusTrailer); status != "timeout" {
+		t.Errorf("status = %q; want timeout", status)
+	}
+}
+
+func TestFirstResultTimeoutOnlyBoundsWaitForFirstTile(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage:            storage,
+		FirstResultTimeout: 50 * time.Millisecond,
+		ReadBlock:          10 * time.Millisecond,
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		storage.add("pid", "1/2", []byte("tile-1"))
+	}()
+
+	body, trailer := streamTrailers(t, &result, "/result/pid/stream?trailer=true")
+	if !strings.HasSuffix(body, "tile-0tile-1") {
+		t.Errorf("expected the whole result in stream; got %q", body)
+	}
+	if status := trailer.Get(statusTrailer); status != "done" {
+		t.Errorf("status = %q; want done", status)
+	}
+}
+
+func TestGetTimesOutWaitingForFirstTile(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	w := newTestWatcher(storage)
+	w.complete("pid", 1)
+	result := Result {
+		Storage:            storage,
+		Completions:        w,
+		Timeout:            time.Minute,
+		FirstResultTimeout: 50 * time.Millisecond,
+	}
+
+	if rec := getResult(&result, "pid"); rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("status = %d; want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+}
+
+/*
+ * Contexts derived from the wait must see timeouts as timeouts, and not as
+ * cancellations
+ */
+func TestDerivedContextsTimeOut(t *testing.T) {
+	result := Result { FirstResultTimeout: 10 * time.Millisecond }
+	ctx, cancel := result.withCollectTimeout(context.Background())
+	defer cancel()
+	derived, cancelDerived := context.WithCancel(ctx)
+	defer cancelDerived()
+
+	select {
+	case <-derived.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("derived context not done after timeout")
+	}
+	if err := derived.Err(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStopWaitingDisarmsTimeout(t *testing.T) {
+	result := Result { FirstResultTimeout: 10 * time.Millisecond }
+	ctx, cancel := result.withCollectTimeout(context.Background())
+	stopWaiting(context.WithValue(ctx, "key", "value"))
+
+	select {
+	case <-ctx.Done():
+		t.Fatalf("context done after the wait was over: %v", ctx.Err())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	if err := ctx.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v; want %v", err, context.Canceled)
+	}
+}
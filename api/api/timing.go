@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+ * The time spent in the phases of a request, for the Server-Timing header
+ * [1], which browser devtools show as a breakdown of the server latency.
+ *
+ * The phases are consecutive, and each one ends when the next is marked. It's
+ * perfectly fine to mark phases on a nil serverTiming, which does nothing, so
+ * handlers don't have to check if timing is enabled.
+ *
+ * [1] https://www.w3.org/TR/server-timing/
+ */
+type serverTiming struct {
+	last    time.Time
+	metrics []string
+}
+
+/*
+ * Start timing, or nil if not enabled
+ */
+func newServerTiming(enabled bool) *serverTiming {
+	if !enabled {
+		return nil
+	}
+	return &serverTiming { last: time.Now() }
+}
+
+/*
+ * End the current phase, and record it as name
+ */
+func (t *serverTiming) mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	ms := float64(now.Sub(t.last)) / float64(time.Millisecond)
+	t.metrics = append(t.metrics, fmt.Sprintf("%s;dur=%.3f", name, ms))
+	t.last = now
+}
+
+/*
+ * The value of the Server-Timing header, or empty if not enabled
+ */
+func (t *serverTiming) String() string {
+	if t == nil {
+		return ""
+	}
+	return strings.Join(t.metrics, ", ")
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestServerTimingOnGet(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result {
+		Storage:      storage,
+		ServerTiming: true,
+	}
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	timing := w.Header().Get("Server-Timing")
+	metrics := strings.Split(timing, ", ")
+	want := []string { "header", "first-tile", "assembly" }
+	if len(metrics) != len(want) {
+		t.Fatalf("Server-Timing = %s; want %v", timing, want)
+	}
+	for i, name := range want {
+		if !strings.HasPrefix(metrics[i], name + ";dur=") {
+			t.Errorf("metric %d = %s; want %s;dur=", i, metrics[i], name)
+		}
+	}
+}
+
+func TestNoServerTimingByDefault(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+
+	w := getResult(&Result { Storage: storage }, "pid")
+	if timing := w.Header().Get("Server-Timing"); timing != "" {
+		t.Errorf("Server-Timing = %s; want none", timing)
+	}
+}
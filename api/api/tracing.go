@@ -0,0 +1,118 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ * Queries are traced from the query endpoint, through scheduling, to the
+ * collection of the result:
+ *
+ *     oneseismic.query                    (graphql)
+ *     └── oneseismic.schedule             (writes header and tasks)
+ *     oneseismic.collect  ··· link ···>   (result endpoints)
+ *
+ * The collection happens in other requests, possibly much later, so it's a
+ * span of its own, linked to the query. The trace context of the schedule
+ * span goes with every task in the jobs stream (as W3C traceparent and
+ * tracestate fields), so that workers can continue the trace, and in
+ * tracekey, for the collections to link to.
+ *
+ * The spans are made with the global tracer provider (see
+ * otel.SetTracerProvider), which does nothing unless one is installed.
+ */
+const tracerName = "github.com/equinor/oneseismic/api"
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+var propagator = propagation.TraceContext{}
+
+func tracekey(pid string) string {
+	return fmt.Sprintf("%s/trace", pid)
+}
+
+func pidAttribute(pid string) label.KeyValue {
+	return label.String("oneseismic.pid", pid)
+}
+
+/*
+ * The trace context fields, as a propagation.TextMapCarrier
+ */
+type traceFields map[string]string
+
+func (f traceFields) Get(key string) string {
+	return f[key]
+}
+
+func (f traceFields) Set(key string, value string) {
+	f[key] = value
+}
+
+/*
+ * A background context with the span of ctx, for work that outlives the
+ * request, like scheduling
+ */
+func detachTrace(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+/*
+ * The trace context fields of the span in ctx, or nil if there is none
+ */
+func injectTrace(ctx context.Context) traceFields {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return nil
+	}
+	fields := traceFields{}
+	propagator.Inject(ctx, fields)
+	return fields
+}
+
+/*
+ * The trace context of the incoming request, if the client sent one
+ */
+func extractTrace(ctx context.Context, header http.Header) context.Context {
+	fields := traceFields{}
+	for _, key := range propagator.Fields() {
+		if value := header.Get(key); value != "" {
+			fields[key] = value
+		}
+	}
+	return propagator.Extract(ctx, fields)
+}
+
+/*
+ * The span context stored for pid by the scheduler, or the zero (invalid)
+ * span context if there is none.
+ */
+func storedTrace(
+	ctx     context.Context,
+	storage redis.Cmdable,
+	pid     string,
+) (trace.SpanContext, error) {
+	doc, err := storage.Get(ctx, tracekey(pid)).Bytes()
+	if err == redis.Nil {
+		return trace.SpanContext{}, nil
+	}
+	if err != nil {
+		return trace.SpanContext{}, err
+	}
+
+	fields := traceFields{}
+	if err := json.Unmarshal(doc, &fields); err != nil {
+		return trace.SpanContext{}, fmt.Errorf("bad trace context: %w", err)
+	}
+	extracted := propagator.Extract(context.Background(), fields)
+	return trace.RemoteSpanContextFromContext(extracted), nil
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/oteltest"
+)
+
+/*
+ * Record the spans made with the global tracer provider for the duration of
+ * the test
+ */
+func recordSpans(t *testing.T) *oteltest.StandardSpanRecorder {
+	recorder := new(oteltest.StandardSpanRecorder)
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(
+		oteltest.NewTracerProvider(oteltest.WithSpanRecorder(recorder)),
+	)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return recorder
+}
+
+func findSpan(t *testing.T, spans []*oteltest.Span, name string) *oteltest.Span {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	t.Fatalf("no %s span", name)
+	return nil
+}
+
+func assertPidAttribute(t *testing.T, span *oteltest.Span, pid string) {
+	key := label.Key("oneseismic.pid")
+	if got := span.Attributes()[key].AsString(); got != pid {
+		t.Errorf("%s: %s = %q; want %q", span.Name(), key, got, pid)
+	}
+}
+
+func scheduleTraced(t *testing.T, storage *fakeStorage, pid string) {
+	plan := &QueryPlan {
+		header: fakeProcessHeader(2),
+		plan:   [][]byte { []byte("task-0"), []byte("task-1") },
+	}
+	ctx, span := tracer().Start(context.Background(), "oneseismic.query")
+	defer span.End()
+
+	sched := NewScheduler(storage, time.Hour)
+	if err := sched.Schedule(detachTrace(ctx), pid, plan); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestScheduleSpanIsChildOfQuery(t *testing.T) {
+	recorder := recordSpans(t)
+	storage := newFakeStorage()
+	scheduleTraced(t, storage, "pid")
+
+	spans := recorder.Completed()
+	query := findSpan(t, spans, "oneseismic.query")
+	schedule := findSpan(t, spans, "oneseismic.schedule")
+
+	qsc := query.SpanContext()
+	ssc := schedule.SpanContext()
+	if ssc.TraceID != qsc.TraceID {
+		t.Errorf("schedule trace = %v; want %v", ssc.TraceID, qsc.TraceID)
+	}
+	if parent := schedule.ParentSpanID(); parent != qsc.SpanID {
+		t.Errorf("schedule parent = %v; want %v", parent, qsc.SpanID)
+	}
+	assertPidAttribute(t, schedule, "pid")
+}
+
+func TestScheduledTasksCarryTraceContext(t *testing.T) {
+	recorder := recordSpans(t)
+	storage := newFakeStorage()
+	scheduleTraced(t, storage, "pid")
+
+	schedule := findSpan(t, recorder.Completed(), "oneseismic.schedule")
+	sc := schedule.SpanContext()
+	want := fmt.Sprintf("00-%s-%s-00", sc.TraceID, sc.SpanID)
+
+	storage.mtx.Lock()
+	tasks := storage.streams["jobs"]
+	storage.mtx.Unlock()
+	if len(tasks) != 2 {
+		t.Fatalf("%d tasks scheduled; want 2", len(tasks))
+	}
+	for _, task := range tasks {
+		if got := task.Values["traceparent"]; got != want {
+			t.Errorf("task traceparent = %v; want %s", got, want)
+		}
+	}
+
+	stored, err := storedTrace(context.Background(), storage, "pid")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stored.SpanID != sc.SpanID {
+		t.Errorf("stored span = %v; want %v", stored.SpanID, sc.SpanID)
+	}
+}
+
+func TestCollectSpanLinksToSchedule(t *testing.T) {
+	recorder := recordSpans(t)
+	storage := newFakeStorage()
+	scheduleTraced(t, storage, "pid")
+	storage.add("pid", "0/2", []byte("tile-0"))
+	storage.add("pid", "1/2", []byte("tile-1"))
+	result := Result { Storage: storage, TraceLinks: true }
+
+	if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+
+	/*
+	 * The links and attributes are set when the span starts, and the
+	 * collection may still be ending after the response is written
+	 */
+	schedule := findSpan(t, recorder.Completed(), "oneseismic.schedule")
+	collect := findSpan(t, recorder.Started(), "oneseismic.collect")
+	if collect.ParentSpanID().IsValid() {
+		t.Errorf("collect has parent %v; want a root span", collect.ParentSpanID())
+	}
+
+	links := collect.Links()
+	if len(links) != 1 {
+		t.Fatalf("collect has %d links; want 1", len(links))
+	}
+	if links[0].SpanContext.SpanID != schedule.SpanContext().SpanID {
+		t.Errorf(
+			"collect links to %v; want %v",
+			links[0].SpanContext.SpanID,
+			schedule.SpanContext().SpanID,
+		)
+	}
+	assertPidAttribute(t, collect, "pid")
+}
+
+func TestCollectWithoutStoredTraceIsUnlinked(t *testing.T) {
+	recorder := recordSpans(t)
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile"))
+	result := Result { Storage: storage, TraceLinks: true }
+
+	if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	collect := findSpan(t, recorder.Started(), "oneseismic.collect")
+	if links := collect.Links(); len(links) != 0 {
+		t.Errorf("collect has %d links; want none", len(links))
+	}
+}
@@ -0,0 +1,271 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * Results in the multi-GB range are better served straight from blob storage
+ * than proxied through the API. With Uploads, the first Get of a completed
+ * result of at least Threshold bytes starts uploading the result to a blob,
+ * and is itself served inline as usual. Once the upload is done, Status
+ * reports the result as "uploaded", and Get redirects (307) to a short-lived
+ * signed URL of the blob. Smaller results are always served inline.
+ */
+type Uploads struct {
+	Store BlobStore
+	/*
+	 * Results of at least this many bytes are uploaded. Zero means the
+	 * default, 1GB.
+	 */
+	Threshold int64
+	/*
+	 * How long the signed URLs Get redirects to are valid. Zero means the
+	 * default, 15m.
+	 */
+	URLTTL time.Duration
+	/*
+	 * The maximum time to spend uploading a result. Zero means the default,
+	 * 1h.
+	 */
+	Timeout time.Duration
+}
+
+/*
+ * Where uploaded results are kept, e.g. an Azure blob container, see
+ * AzureBlobStore.
+ */
+type BlobStore interface {
+	/*
+	 * Upload the contents of body as the blob name
+	 */
+	Upload(ctx context.Context, name string, body io.Reader) error
+	/*
+	 * A URL that gives read access to the blob name for ttl, without any
+	 * other credentials
+	 */
+	SignedURL(name string, ttl time.Duration) (string, error)
+	/*
+	 * Delete the blob name. Deleting a blob that doesn't exist is not an
+	 * error.
+	 */
+	Delete(ctx context.Context, name string) error
+	/*
+	 * Delete the blobs last modified before t, and get the number deleted
+	 */
+	Expire(ctx context.Context, before time.Time) (int, error)
+}
+
+const (
+	DefaultUploadThreshold = 1 << 30
+	defaultUploadURLTTL    = 15 * time.Minute
+	defaultUploadTimeout   = time.Hour
+)
+
+/*
+ * The state of the upload of a result, in uploadkey
+ */
+const (
+	uploading = "uploading"
+	uploaded  = "uploaded"
+)
+
+func uploadkey(pid string) string {
+	return fmt.Sprintf("%s/upload", pid)
+}
+
+func (u *Uploads) threshold() int64 {
+	if u.Threshold <= 0 {
+		return DefaultUploadThreshold
+	}
+	return u.Threshold
+}
+
+func (u *Uploads) urlTTL() time.Duration {
+	if u.URLTTL <= 0 {
+		return defaultUploadURLTTL
+	}
+	return u.URLTTL
+}
+
+func (u *Uploads) timeout() time.Duration {
+	if u.Timeout <= 0 {
+		return defaultUploadTimeout
+	}
+	return u.Timeout
+}
+
+/*
+ * Check if the result of pid is uploaded. Without uploads, no result ever
+ * is.
+ */
+func (r *Result) isUploaded(ctx context.Context, pid string) bool {
+	if r.Uploads == nil {
+		return false
+	}
+	state, err := r.Storage.Get(ctx, uploadkey(pid)).Result()
+	if err != nil && err != redis.Nil {
+		r.logger(pid).Warn("unable to get upload state", "error", err)
+	}
+	return state == uploaded
+}
+
+/*
+ * Redirect to the uploaded result of pid, if it is uploaded, and report if
+ * the response was written. The signed URL expires, so the redirect must
+ * not be cached.
+ */
+func (r *Result) redirectUploaded(ctx *gin.Context, pid string) bool {
+	if !r.isUploaded(ctx, pid) {
+		return false
+	}
+	url, err := r.Uploads.Store.SignedURL(pid, r.Uploads.urlTTL())
+	if err != nil {
+		r.logger(pid).Error("unable to sign upload URL", "error", err)
+		return false
+	}
+	cacheNever(ctx)
+	ctx.Redirect(http.StatusTemporaryRedirect, url)
+	return true
+}
+
+/*
+ * Start uploading the completed result of pid, of size bytes, unless it's
+ * too small, or already uploading or uploaded. Only one upload of a result
+ * runs at a time, across all instances sharing the storage. The upload runs
+ * in the background, and outlives the request that started it.
+ */
+func (r *Result) startUpload(
+	pid  string,
+	head *message.ProcessHeader,
+	size int64,
+) {
+	if r.Uploads == nil || size < r.Uploads.threshold() {
+		return
+	}
+
+	timeout := r.Uploads.timeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	claimed, err := r.Storage.SetNX(ctx, uploadkey(pid), uploading, timeout).Result()
+	if err != nil || !claimed {
+		if err != nil {
+			r.logger(pid).Warn("unable to claim upload", "error", err)
+		}
+		cancel()
+		return
+	}
+
+	go func() {
+		defer cancel()
+		start := time.Now()
+		if err := r.upload(ctx, pid, head, size); err != nil {
+			r.logger(pid).Error("upload failed", "error", err)
+			/*
+			 * Release the claim, so that the next Get tries again
+			 */
+			r.Storage.Del(context.Background(), uploadkey(pid))
+			return
+		}
+		err := r.Storage.Set(ctx, uploadkey(pid), uploaded, r.resultTTL()).Err()
+		if err != nil {
+			r.logger(pid).Error("unable to mark upload done", "error", err)
+			return
+		}
+		r.logger(pid).Info(
+			"uploaded",
+			"bytes",   size,
+			"seconds", time.Since(start).Seconds(),
+		)
+	}()
+}
+
+/*
+ * Collect the result of pid and upload it, checking that all size bytes
+ * made it
+ */
+func (r *Result) upload(
+	ctx  context.Context,
+	pid  string,
+	head *message.ProcessHeader,
+	size int64,
+) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tiles := make(chan partial)
+	failure := make(chan error, 1)
+	go r.collect(ctx, "upload", pid, head, start, false, tiles, failure)
+
+	pr, pw := io.Pipe()
+	go func() {
+		var written int64
+		for output := range tiles {
+			n, err := pw.Write(output.tile)
+			output.release()
+			written += int64(n)
+			if err != nil {
+				cancel()
+				return
+			}
+		}
+		select {
+		case err := <-failure:
+			pw.CloseWithError(err)
+			return
+		default:
+		}
+		if written != size {
+			pw.CloseWithError(fmt.Errorf(
+				"uploaded %d bytes; result has %d",
+				written,
+				size,
+			))
+			return
+		}
+		pw.Close()
+	}()
+
+	err := r.Uploads.Store.Upload(ctx, pid, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+/*
+ * Delete the uploaded blobs older than ttl every interval, until ctx is
+ * done, so that they expire with the rest of the result.
+ */
+func (u *Uploads) ExpireEvery(
+	ctx      context.Context,
+	ttl      time.Duration,
+	interval time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.expire(ctx, time.Now().Add(-ttl))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (u *Uploads) expire(ctx context.Context, before time.Time) {
+	n, err := u.Store.Expire(ctx, before)
+	if err != nil {
+		logging.Default().Warn("unable to expire uploads", "error", err)
+	}
+	if n > 0 {
+		logging.Default().Info("expired uploads", "blobs", n)
+	}
+}
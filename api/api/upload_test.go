@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type fakeBlobStore struct {
+	mtx     sync.Mutex
+	blobs   map[string][]byte
+	fail    error
+	uploads int
+}
+
+func newFakeBlobStore() *fakeBlobStore {
+	return &fakeBlobStore { blobs: make(map[string][]byte) }
+}
+
+func (s *fakeBlobStore) Upload(
+	ctx  context.Context,
+	name string,
+	body io.Reader,
+) error {
+	doc, err := ioutil.ReadAll(body)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.uploads++
+	if err != nil {
+		return err
+	}
+	if s.fail != nil {
+		return s.fail
+	}
+	s.blobs[name] = doc
+	return nil
+}
+
+func (s *fakeBlobStore) SignedURL(name string, ttl time.Duration) (string, error) {
+	return "https://blobs.example/" + name + "?sig=signed", nil
+}
+
+func (s *fakeBlobStore) Delete(ctx context.Context, name string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.blobs, name)
+	return nil
+}
+
+func (s *fakeBlobStore) Expire(ctx context.Context, before time.Time) (int, error) {
+	return 0, nil
+}
+
+func (s *fakeBlobStore) blob(name string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	doc, ok := s.blobs[name]
+	return doc, ok
+}
+
+func uploadResult(ntasks int) *fakeStorage {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(strings.Repeat("x", 64))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	return storage
+}
+
+/*
+ * Wait for the upload of pid to finish, one way or the other
+ */
+func waitForUpload(t *testing.T, storage *fakeStorage, pid string) string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		storage.mtx.Lock()
+		state := storage.keys[uploadkey(pid)]
+		storage.mtx.Unlock()
+		if state != uploading {
+			return state
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("upload of %s not done", pid)
+	return ""
+}
+
+func TestLargeResultIsUploadedAndRedirected(t *testing.T) {
+	storage := uploadResult(3)
+	blobs := newFakeBlobStore()
+	result := Result {
+		Storage: storage,
+		Uploads: &Uploads { Store: blobs, Threshold: 100 },
+	}
+
+	w := getResult(&result, "pid")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if state := waitForUpload(t, storage, "pid"); state != uploaded {
+		t.Fatalf("upload state = %q; want %q", state, uploaded)
+	}
+	blob, ok := blobs.blob("pid")
+	if !ok {
+		t.Fatalf("result not uploaded")
+	}
+	if !bytes.Equal(blob, w.Body.Bytes()) {
+		t.Errorf("uploaded blob differs from the result")
+	}
+
+	var status map[string]interface{}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &status)
+	if status["status"] != uploaded {
+		t.Errorf("status = %v; want %s", status["status"], uploaded)
+	}
+
+	w = getResult(&result, "pid")
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusTemporaryRedirect)
+	}
+	location := w.Header().Get("Location")
+	if location != "https://blobs.example/pid?sig=signed" {
+		t.Errorf("Location = %s; want the signed URL", location)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %s; want no-store", cc)
+	}
+	if blobs.uploads != 1 {
+		t.Errorf("uploaded %d times; want 1", blobs.uploads)
+	}
+}
+
+func TestSmallResultIsNotUploaded(t *testing.T) {
+	storage := uploadResult(1)
+	blobs := newFakeBlobStore()
+	result := Result {
+		Storage: storage,
+		Uploads: &Uploads { Store: blobs, Threshold: 1 << 20 },
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+			t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+		}
+	}
+	if n := storage.called("setnx"); n != 0 {
+		t.Errorf("upload claimed %d times; want 0", n)
+	}
+
+	var status map[string]interface{}
+	json.Unmarshal(getStatus(&result, "pid").Body.Bytes(), &status)
+	if status["status"] != "finished" {
+		t.Errorf("status = %v; want finished", status["status"])
+	}
+}
+
+func TestFailedUploadIsRetried(t *testing.T) {
+	storage := uploadResult(3)
+	blobs := newFakeBlobStore()
+	blobs.fail = errors.New("storage unavailable")
+	result := Result {
+		Storage: storage,
+		Uploads: &Uploads { Store: blobs, Threshold: 100 },
+	}
+
+	getResult(&result, "pid")
+	if state := waitForUpload(t, storage, "pid"); state != "" {
+		t.Fatalf("upload state = %q; want claim released", state)
+	}
+
+	blobs.mtx.Lock()
+	blobs.fail = nil
+	blobs.mtx.Unlock()
+	if w := getResult(&result, "pid"); w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d while uploading", w.Code, http.StatusOK)
+	}
+	if state := waitForUpload(t, storage, "pid"); state != uploaded {
+		t.Errorf("upload state = %q; want %q", state, uploaded)
+	}
+}
+
+func TestDeleteRemovesUpload(t *testing.T) {
+	storage := uploadResult(3)
+	blobs := newFakeBlobStore()
+	result := Result {
+		Storage: storage,
+		Uploads: &Uploads { Store: blobs, Threshold: 100 },
+	}
+	getResult(&result, "pid")
+	waitForUpload(t, storage, "pid")
+
+	app := gin.New()
+	app.DELETE("/result/:pid", result.Delete)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodDelete, "/result/pid", nil)
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusNoContent)
+	}
+	if _, ok := blobs.blob("pid"); ok {
+		t.Errorf("uploaded blob not deleted")
+	}
+	if storage.ttl(uploadkey("pid")) == 0 {
+		t.Errorf("upload state was never set with the result TTL")
+	}
+}
+
+func TestAzureBlobStoreSignsReadOnlyURL(t *testing.T) {
+	store, err := NewAzureBlobStore(
+		"https://account.blob.core.windows.net/results",
+		"a2V5",
+	)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	signed, err := store.SignedURL("pid", time.Minute)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if u.Path != "/results/pid" {
+		t.Errorf("path = %s; want /results/pid", u.Path)
+	}
+	query := u.Query()
+	if query.Get("sp") != "r" || query.Get("sig") == "" || query.Get("spr") != "https" {
+		t.Errorf("query = %v; want a signed, read-only https URL", query)
+	}
+}
+
+func TestAzureBlobStoreNeedsContainer(t *testing.T) {
+	_, err := NewAzureBlobStore("https://account.blob.core.windows.net", "a2V5")
+	if err == nil {
+		t.Errorf("expected error for URL without container")
+	}
+}
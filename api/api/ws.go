@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+/*
+ * The reason in a close frame must fit in a control frame, which is at most
+ * 125 bytes including the 2-byte close code
+ */
+const maxCloseReason = 123
+
+/*
+ * Results are authorized by the token, not by cookies, so there is no
+ * cross-site request forgery to protect against by checking the origin, and
+ * visualization clients are rarely served from the same origin as the API.
+ */
+var upgrader = websocket.Upgrader {
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+func closeMessage(code int, reason string) []byte {
+	if len(reason) > maxCloseReason {
+		reason = reason[:maxCloseReason]
+	}
+	return websocket.FormatCloseMessage(code, reason)
+}
+
+/*
+ * A transfer of the result, from some position, over the WebSocket. The
+ * client can cancel transfers and start new ones, so a connection can have
+ * many transfers, but only one at a time.
+ */
+type wstransfer struct {
+	cancel  context.CancelFunc
+	tiles   chan partial
+	failure chan error
+}
+
+/*
+ * GET /result/<pid>/ws
+ *
+ * The result over a WebSocket, for interactive clients that would rather
+ * not deal with chunked HTTP, and that want to cancel and re-request parts
+ * of the result without reconnecting. The result header and every tile is
+ * sent as a binary message, in the same order as in the stream, so the
+ * messages put together make up the msgpack document. Every tile is followed
+ * by the text message "cursor <id>", with the stream ID of the tile.
+ *
+ * The client can send these text messages:
+ *
+ *     cancel           stop the transfer, which the server confirms with the
+ *                      text message "cancelled", and wait for resume-from
+ *     resume-from <id> (re)start the transfer after the tile with the cursor
+ *                      id, or from the beginning, with the header, if id is 0
+ *     ack              acknowledge the tiles received so far
+ *
+ * Acks are only needed with ?window=n, in which case the server sends no more
+ * than n tiles before waiting for an ack. Messages the server does not
+ * understand are answered with "error <message>", and otherwise ignored.
+ *
+ * When all tiles are sent, the connection is closed normally, and if the
+ * result could not be read, it is closed with 1011 Internal Error and the
+ * message as the reason.
+ *
+ * Like the stream, ?from= starts the first transfer after the tile with that
+ * stream ID. Errors before the upgrade, such as a missing process, are plain
+ * HTTP responses.
+ *
+ * Browsers can't set the Authorization header on WebSocket requests, so this
+ * route should be authed with ResultAuth and WithQueryToken.
+ */
+func (r *Result) StreamWS(ctx *gin.Context) {
+	pid := ctx.Param("pid")
+	if rejectDecimation(ctx, "streams") {
+		return
+	}
+	body, err := r.Storage.Get(ctx, headerkey(pid)).Bytes()
+	if err != nil {
+		r.logger(pid).Info("no process header", "error", err)
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	head, err := parseProcessHeader(body)
+	if err != nil {
+		r.logger(pid).Error("bad process header", "error", err)
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	window, err := strconv.Atoi(ctx.DefaultQuery("window", "0"))
+	if err != nil || window < 0 {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": "window must be a non-negative integer",
+		})
+		return
+	}
+
+	from, err := findPosition(ctx, r.Storage, pid, ctx.DefaultQuery("from", "0"))
+	if err != nil {
+		r.logger(pid).Info("bad cursor", "error", err)
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H {
+			"error": err.Error(),
+		})
+		return
+	}
+
+	/*
+	 * The upgrader responds to failed handshakes itself
+	 */
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		r.logger(pid).Info("websocket upgrade failed", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	/*
+	 * The request context is not cancelled when a hijacked connection goes
+	 * away, so the client disconnecting is only noticed by reading, which
+	 * is also needed to handle control messages.
+	 */
+	connctx, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+	commands := make(chan string)
+	go func() {
+		defer cancel()
+		defer close(commands)
+		for {
+			kind, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if kind != websocket.TextMessage {
+				continue
+			}
+			select {
+			case commands <- string(msg):
+			case <-connctx.Done():
+				return
+			}
+		}
+	}()
+
+	send := func(kind int, msg []byte) bool {
+		if err := conn.WriteMessage(kind, msg); err != nil {
+			r.logger(pid).Info("unable to send message", "error", err)
+			return false
+		}
+		return true
+	}
+	fail := func(err error) {
+		r.logger(pid).Error("stream failed", "error", err)
+		msg := closeMessage(websocket.CloseInternalServerErr, err.Error())
+		conn.WriteMessage(websocket.CloseMessage, msg)
+	}
+
+	/*
+	 * Every transfer gets the full timeout
+	 */
+	var transfer *wstransfer
+	start := func(from position) {
+		collectctx, cancel := r.withCollectTimeout(connctx)
+		transfer = &wstransfer {
+			cancel:  cancel,
+			tiles:   make(chan partial),
+			failure: make(chan error, 1),
+		}
+		go r.collect(
+			collectctx,
+			"ws",
+			pid,
+			head,
+			from,
+			false,
+			transfer.tiles,
+			transfer.failure,
+		)
+	}
+	stop := func() {
+		if transfer != nil {
+			transfer.cancel()
+			transfer = nil
+		}
+	}
+	defer stop()
+	start(from)
+
+	unacked := 0
+	throttle := newThrottle(r.StreamBurst, r.StreamRate)
+	for {
+		/*
+		 * Without a transfer, or with a full window, there is nothing to do
+		 * but wait for the client
+		 */
+		var tiles chan partial
+		var failure chan error
+		if transfer != nil {
+			failure = transfer.failure
+			if window == 0 || unacked < window {
+				tiles = transfer.tiles
+			}
+		}
+
+		select {
+		case output, ok := <-tiles:
+			if !ok {
+				if err := reportedFailure(failure); err != nil {
+					fail(err)
+					return
+				}
+				msg := closeMessage(websocket.CloseNormalClosure, "")
+				conn.WriteMessage(websocket.CloseMessage, msg)
+				return
+			}
+			if output.id == "" {
+				if !send(websocket.BinaryMessage, output.tile) {
+					return
+				}
+				continue
+			}
+
+			if err := throttle.wait(connctx); err != nil {
+				fail(err)
+				return
+			}
+			if !send(websocket.BinaryMessage, output.tile) {
+				return
+			}
+			if !send(websocket.TextMessage, []byte("cursor " + output.id)) {
+				return
+			}
+			unacked++
+
+		case err := <-failure:
+			fail(err)
+			return
+
+		case cmd, ok := <-commands:
+			if !ok {
+				return
+			}
+
+			reply := ""
+			fields := strings.Fields(cmd)
+			switch {
+			case cmd == "ack":
+				unacked = 0
+			case cmd == "cancel":
+				stop()
+				reply = "cancelled"
+			case len(fields) == 2 && fields[0] == "resume-from":
+				pos, err := findPosition(connctx, r.Storage, pid, fields[1])
+				if err != nil {
+					reply = fmt.Sprintf("error %v", err)
+					break
+				}
+				stop()
+				unacked = 0
+				start(pos)
+			default:
+				reply = fmt.Sprintf("error unknown command %q", cmd)
+			}
+
+			if reply != "" && !send(websocket.TextMessage, []byte(reply)) {
+				return
+			}
+		}
+	}
+}
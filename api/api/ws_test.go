@@ -0,0 +1,228 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+func dialWS(t *testing.T, result *Result, query string) (*websocket.Conn, func()) {
+	app := gin.New()
+	app.GET("/result/:pid/ws", result.StreamWS)
+	server := httptest.NewServer(app)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/result/pid/ws" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("unable to connect: %v", err)
+	}
+	return conn, func() {
+		conn.Close()
+		server.Close()
+	}
+}
+
+/*
+ * Read the messages from the WebSocket of result until it's closed, and
+ * return the binary messages and cursors with the close error
+ */
+func readWS(
+	t      *testing.T,
+	result *Result,
+) ([][]byte, []string, *websocket.CloseError) {
+	conn, done := dialWS(t, result, "")
+	defer done()
+
+	messages := make([][]byte, 0)
+	cursors := make([]string, 0)
+	for {
+		kind, msg, err := conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				t.Fatalf("connection not closed cleanly: %v", err)
+			}
+			return messages, cursors, closeErr
+		}
+		if kind == websocket.TextMessage {
+			cursors = append(cursors, strings.TrimPrefix(string(msg), "cursor "))
+			continue
+		}
+		messages = append(messages, msg)
+	}
+}
+
+/*
+ * Read the next message, and check that it is of kind and is want
+ */
+func expectWS(t *testing.T, conn *websocket.Conn, kind int, want string) {
+	t.Helper()
+	got, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("expected %q, got %v", want, err)
+	}
+	if got != kind || string(msg) != want {
+		t.Fatalf("message = %d %q; want %d %q", got, msg, kind, want)
+	}
+}
+
+func TestStreamWS(t *testing.T) {
+	ntasks := 3
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(fmt.Sprintf("tile-%d", i))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	result := Result { Storage: storage }
+
+	messages, cursors, closeErr := readWS(t, &result)
+	if closeErr.Code != websocket.CloseNormalClosure {
+		t.Errorf("close code = %d; want %d", closeErr.Code, websocket.CloseNormalClosure)
+	}
+
+	/*
+	 * The messages put together are the same document as the stream
+	 */
+	stream := requestResult(&result, "/result/pid/stream", "").Body.Bytes()
+	if len(messages) != ntasks + 1 {
+		t.Fatalf("got %d messages; want %d", len(messages), ntasks + 1)
+	}
+	if got := bytes.Join(messages, nil); !bytes.Equal(got, stream) {
+		t.Errorf("messages = %q; want %q", got, stream)
+	}
+
+	for i, cursor := range cursors {
+		if id := storage.streams["pid"][i].ID; cursor != id {
+			t.Errorf("cursor %d = %s; want %s", i, cursor, id)
+		}
+	}
+	if len(cursors) != ntasks {
+		t.Errorf("got %d cursors; want %d", len(cursors), ntasks)
+	}
+}
+
+func TestStreamWSCancelAndResume(t *testing.T) {
+	ntasks := 3
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(ntasks))
+	for i := 0; i < ntasks; i++ {
+		tile := []byte(fmt.Sprintf("tile-%d", i))
+		storage.add("pid", fmt.Sprintf("%d/%d", i, ntasks), tile)
+	}
+	ids := []string {
+		storage.streams["pid"][0].ID,
+		storage.streams["pid"][1].ID,
+		storage.streams["pid"][2].ID,
+	}
+	result := Result { Storage: storage }
+
+	/*
+	 * With a window of one, the server waits for an ack after every tile,
+	 * which makes it possible to cancel at a known point
+	 */
+	conn, done := dialWS(t, &result, "?window=1")
+	defer done()
+	expectWS(t, conn, websocket.BinaryMessage, string(fakeProcessHeader(ntasks)))
+	expectWS(t, conn, websocket.BinaryMessage, "tile-0")
+	expectWS(t, conn, websocket.TextMessage, "cursor " + ids[0])
+
+	conn.WriteMessage(websocket.TextMessage, []byte("cancel"))
+	expectWS(t, conn, websocket.TextMessage, "cancelled")
+
+	conn.WriteMessage(websocket.TextMessage, []byte("resume-from " + ids[0]))
+	expectWS(t, conn, websocket.BinaryMessage, "tile-1")
+	expectWS(t, conn, websocket.TextMessage, "cursor " + ids[1])
+	conn.WriteMessage(websocket.TextMessage, []byte("ack"))
+	expectWS(t, conn, websocket.BinaryMessage, "tile-2")
+	expectWS(t, conn, websocket.TextMessage, "cursor " + ids[2])
+	conn.WriteMessage(websocket.TextMessage, []byte("ack"))
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("err = %v; want normal closure", err)
+	}
+}
+
+func TestStreamWSBadCommands(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	storage.add("pid", "0/1", []byte("tile-0"))
+	id := storage.streams["pid"][0].ID
+	result := Result { Storage: storage }
+
+	conn, done := dialWS(t, &result, "?window=1")
+	defer done()
+	expectWS(t, conn, websocket.BinaryMessage, string(fakeProcessHeader(1)))
+	expectWS(t, conn, websocket.BinaryMessage, "tile-0")
+	expectWS(t, conn, websocket.TextMessage, "cursor " + id)
+
+	conn.WriteMessage(websocket.TextMessage, []byte("rewind"))
+	expectWS(t, conn, websocket.TextMessage, `error unknown command "rewind"`)
+	conn.WriteMessage(websocket.TextMessage, []byte("resume-from not-a-cursor"))
+	expectWS(t, conn, websocket.TextMessage, `error bad cursor "not-a-cursor"`)
+
+	/*
+	 * The transfer is still going
+	 */
+	conn.WriteMessage(websocket.TextMessage, []byte("ack"))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("err = %v; want normal closure", err)
+	}
+}
+
+func TestStreamWSBadWindow(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(1))
+	app := gin.New()
+	app.GET("/result/:pid/ws", (&Result { Storage: storage }).StreamWS)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid/ws?window=-1", nil)
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestStreamWSClosesWithReasonOnFailure(t *testing.T) {
+	storage := newFakeStorage()
+	storage.set(headerkey("pid"), fakeProcessHeader(2))
+	storage.add("pid", "0/2", []byte("tile-0"))
+	result := Result {
+		Storage: storage,
+		Timeout: 50 * time.Millisecond,
+	}
+
+	_, _, closeErr := readWS(t, &result)
+	if closeErr.Code != websocket.CloseInternalServerErr {
+		t.Errorf(
+			"close code = %d; want %d",
+			closeErr.Code,
+			websocket.CloseInternalServerErr,
+		)
+	}
+	if closeErr.Text == "" {
+		t.Errorf("close frame without reason")
+	}
+}
+
+func TestStreamWSMissingProcess(t *testing.T) {
+	app := gin.New()
+	app.GET("/result/:pid/ws", (&Result { Storage: newFakeStorage() }).StreamWS)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid/ws", nil)
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
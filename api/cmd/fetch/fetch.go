@@ -9,6 +9,7 @@ import "unsafe"
 import (
 	"context"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"net/url"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/go-redis/redis/v8"
+	"github.com/klauspost/compress/zstd"
 )
 
 /*
@@ -66,6 +68,22 @@ type process struct {
 	 * maps between bytes and oneseismic concepts.
 	 */
 	cpp *C.struct_proc
+	/*
+	 * The pub/sub channel to announce the completion of the process on, if
+	 * this task turns out to be the last one to be written.
+	 */
+	completions string
+	/*
+	 * Compress the partial result before it is written to storage, if set.
+	 * The encoder is shared between processes, and only used with
+	 * EncodeAll, which is safe for concurrent use.
+	 */
+	compressor *zstd.Encoder
+	/*
+	 * The expiration of the stream of partial results, which is reset every
+	 * time a task writes to it. This should match the API's result TTL.
+	 */
+	ttl time.Duration
 }
 
 /*
@@ -279,6 +297,15 @@ func (p *process) gather(
 			}
 		case e := <-errors:
 			log.Printf("%s download failed: %v", p.logpid(), e)
+			/*
+			 * The downloads of cancelled processes fail because they are
+			 * cancelled, and no-one is waiting for the result anyway
+			 */
+			if p.cancelled(storage) {
+				log.Printf("%s cancelled; dropping result", p.logpid())
+			} else {
+				p.fail(storage, e)
+			}
 			for {
 				// Grab the remaining available errors to log them, but don't
 				// wait around for any new ones to come in
@@ -294,16 +321,171 @@ func (p *process) gather(
 
 	packed := p.pack()
 	log.Printf("%s ready", p.logpid())
+	p.write(storage, packed)
+}
+
+/*
+ * Write the packed partial result to the stream, and announce the completion
+ * of the process if this was the last task.
+ *
+ * The result of a cancelled process is dropped instead. The downloads may
+ * well have finished before the cancellation was noticed, but no-one is
+ * waiting for the result, and the API has already removed the stream (see
+ * Result.Cancel), so writing it would only make the stream again.
+ */
+func (p *process) write(storage redis.Cmdable, packed []byte) {
+	if p.cancelled(storage) {
+		log.Printf("%s cancelled; dropping result", p.logpid())
+		return
+	}
+
+	/*
+	 * The checksum is of the uncompressed partial result, so the API can
+	 * verify it regardless of how it's stored
+	 */
+	crc := crc32.Checksum(packed, crc32.MakeTable(crc32.Castagnoli))
+	values := map[string]interface{}{
+		p.part:   packed,
+		"crc32c": fmt.Sprintf("%08x", crc),
+	}
+	if p.compressor != nil {
+		/*
+		 * The API tells compressed partial results apart by the enc field
+		 */
+		values[p.part] = p.compressor.EncodeAll(packed, nil)
+		values["enc"] = "zstd"
+	}
 	args := redis.XAddArgs{
 		Stream: p.pid,
-		Values: map[string]interface{}{p.part: packed},
+		Values: values,
 	}
 	err := storage.XAdd(p.ctx, &args).Err()
 	if err != nil {
 		log.Printf("%s write to storage failed: %v", p.logpid(), err)
 	}
-	storage.Expire(p.ctx, p.pid, 10 * time.Minute)
+	storage.Expire(p.ctx, p.pid, p.ttl)
 	log.Printf("%s written to storage", p.logpid())
+	p.announce(storage)
+}
+
+/*
+ * The key that is set when the client cancels the process, see Result.Cancel
+ * in the api package
+ */
+func cancelledkey(pid string) string {
+	return fmt.Sprintf("%s/cancelled", pid)
+}
+
+/*
+ * How often running processes check if they are cancelled
+ */
+const cancelPollInterval = time.Second
+
+/*
+ * Check if the process is cancelled. This is also used after the process
+ * context is cancelled, so it does not use it. Should the check fail, the
+ * process is assumed to not be cancelled - finishing a cancelled task is only
+ * a waste, but dropping a task fails the process.
+ */
+func (p *process) cancelled(storage redis.Cmdable) bool {
+	n, err := storage.Exists(context.Background(), cancelledkey(p.pid)).Result()
+	if err != nil {
+		log.Printf("%s unable to check for cancellation: %v", p.logpid(), err)
+		return false
+	}
+	return n > 0
+}
+
+/*
+ * Poll for the cancellation of the process, and cancel the pending downloads
+ * when it is cancelled. This stops when the process is cleaned up.
+ */
+func (p *process) watch(storage redis.Cmdable, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			if p.cancelled(storage) {
+				log.Printf("%s cancelled", p.logpid())
+				p.cancel()
+				return
+			}
+		}
+	}
+}
+
+/*
+ * The key with the error that failed the process, see errorkey in the api
+ * package
+ */
+func errorkey(pid string) string {
+	return fmt.Sprintf("%s/error", pid)
+}
+
+/*
+ * Write the error to the stream in place of the partial result, so that the
+ * API can report the process as failed rather than waiting for a partial
+ * result that never comes.
+ *
+ * The error is also recorded in the error key, so the API can find it without
+ * scanning the stream. Only the first error is kept.
+ */
+func (p *process) fail(storage redis.Cmdable, e error) {
+	msg := fmt.Sprintf("%s: %v", p.part, e)
+	args := redis.XAddArgs{
+		Stream: p.pid,
+		Values: map[string]interface{}{
+			"error": msg,
+		},
+	}
+	err := storage.XAdd(p.ctx, &args).Err()
+	if err != nil {
+		log.Printf("%s write error to storage failed: %v", p.logpid(), err)
+	}
+	storage.Expire(p.ctx, p.pid, p.ttl)
+
+	err = storage.SetNX(p.ctx, errorkey(p.pid), msg, p.ttl).Err()
+	if err != nil {
+		log.Printf("%s record error failed: %v", p.logpid(), err)
+	}
+}
+
+/*
+ * Announce the completion of the process if this was the last task to be
+ * written, so that the API does not have to poll for it.
+ *
+ * The part is formatted as n/m, so the number of tasks is readily available.
+ * It is possible that several workers finish at the same time and all see the
+ * stream as complete - that's fine, subscribers are only notified once.
+ */
+func (p *process) announce(storage redis.Cmdable) {
+	if p.completions == "" {
+		return
+	}
+
+	var part, ntasks int64
+	_, err := fmt.Sscanf(p.part, "%d/%d", &part, &ntasks)
+	if err != nil {
+		log.Printf("%s unable to parse part: %v", p.logpid(), err)
+		return
+	}
+
+	count, err := storage.XLen(p.ctx, p.pid).Result()
+	if err != nil {
+		log.Printf("%s unable to get stream length: %v", p.logpid(), err)
+		return
+	}
+	if count < ntasks {
+		return
+	}
+
+	err = storage.Publish(p.ctx, p.completions, p.pid).Err()
+	if err != nil {
+		log.Printf("%s unable to announce completion: %v", p.logpid(), err)
+	}
 }
 
 /*
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/go-redis/redis/v8"
 )
 
 func testpipeline() pipeline.Pipeline {
@@ -77,19 +79,161 @@ func TestMessageOnErrorCancelsGather(t *testing.T) {
 	// in the struct layout, but such changes should probably be detected
 	// compile time anyway, and this test is then easily updated.
 	proc := process {
+		pid: "pid",
+		part: "0/2",
 		ctx: ctx,
 		cancel: cancel,
 		cpp: nil,
 	}
 
+	storage := newFakeStorage()
 	errors <- fmt.Errorf("Test error")
 	// Pretend that there are 2 fragments to be fetched. None will be sent, but
 	// it increases the confidence that the worker loop is aborted immediately
 	// rather than waiting for more data.
-	proc.gather(nil, 2, fragments, errors)
+	proc.gather(storage, 2, fragments, errors)
 	select {
 	case <-ctx.Done():
 	default:
 		t.Errorf("Expected context to be cancelled, but it is not")
 	}
+
+	if len(storage.entries["pid"]) != 1 {
+		t.Fatalf("stream = %v; want one error entry", storage.entries["pid"])
+	}
+	want := "0/2: Test error"
+	if msg := storage.entries["pid"][0]["error"]; msg != want {
+		t.Errorf("error entry = %v; want %s", msg, want)
+	}
+	if msg := storage.keys[errorkey("pid")]; msg != want {
+		t.Errorf("error key = %v; want %s", msg, want)
+	}
+}
+
+/*
+ * Just enough of redis for writing partial results, which records the
+ * entries written to the streams, the keys that are set, and the expiration
+ * of the streams
+ */
+type fakeStorage struct {
+	redis.Cmdable
+	entries map[string][]map[string]interface{}
+	keys    map[string]interface{}
+	ttls    map[string]time.Duration
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage {
+		entries: make(map[string][]map[string]interface{}),
+		keys:    make(map[string]interface{}),
+		ttls:    make(map[string]time.Duration),
+	}
+}
+
+func (s *fakeStorage) XAdd(
+	ctx  context.Context,
+	args *redis.XAddArgs,
+) *redis.StringCmd {
+	values := args.Values.(map[string]interface{})
+	s.entries[args.Stream] = append(s.entries[args.Stream], values)
+	id := fmt.Sprintf("0-%d", len(s.entries[args.Stream]))
+	return redis.NewStringResult(id, nil)
+}
+
+func (s *fakeStorage) XLen(ctx context.Context, stream string) *redis.IntCmd {
+	return redis.NewIntResult(int64(len(s.entries[stream])), nil)
+}
+
+func (s *fakeStorage) Expire(
+	ctx        context.Context,
+	key        string,
+	expiration time.Duration,
+) *redis.BoolCmd {
+	s.ttls[key] = expiration
+	return redis.NewBoolResult(true, nil)
+}
+
+func (s *fakeStorage) SetNX(
+	ctx        context.Context,
+	key        string,
+	value      interface{},
+	expiration time.Duration,
+) *redis.BoolCmd {
+	if _, ok := s.keys[key]; ok {
+		return redis.NewBoolResult(false, nil)
+	}
+	s.keys[key] = value
+	return redis.NewBoolResult(true, nil)
+}
+
+func (s *fakeStorage) Exists(
+	ctx  context.Context,
+	keys ...string,
+) *redis.IntCmd {
+	n := int64(0)
+	for _, key := range keys {
+		if _, ok := s.keys[key]; ok {
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func TestFailSetsResultTTL(t *testing.T) {
+	storage := newFakeStorage()
+	proc := process {
+		pid:  "pid",
+		part: "0/1",
+		ctx:  context.Background(),
+		ttl:  time.Hour,
+	}
+	proc.fail(storage, fmt.Errorf("Test error"))
+	if ttl := storage.ttls["pid"]; ttl != time.Hour {
+		t.Errorf("stream expires after %v; want %v", ttl, time.Hour)
+	}
+}
+
+func TestWriteAddsResultToStream(t *testing.T) {
+	storage := newFakeStorage()
+	proc := process {
+		pid:  "pid",
+		part: "0/2",
+		ctx:  context.Background(),
+		ttl:  time.Hour,
+	}
+	proc.write(storage, []byte("result"))
+
+	if len(storage.entries["pid"]) != 1 {
+		t.Fatalf("stream = %v; want one result entry", storage.entries["pid"])
+	}
+	if tile := storage.entries["pid"][0]["0/2"]; string(tile.([]byte)) != "result" {
+		t.Errorf("result entry = %v; want result", tile)
+	}
+	if ttl := storage.ttls["pid"]; ttl != time.Hour {
+		t.Errorf("stream expires after %v; want %v", ttl, time.Hour)
+	}
+}
+
+func TestCancelledProcessWritesNoResult(t *testing.T) {
+	storage := newFakeStorage()
+	storage.keys[cancelledkey("pid")] = "cancelled"
+	/*
+	 * The fake storage does not publish, so announcing the completion would
+	 * fail the test too
+	 */
+	proc := process {
+		pid:         "pid",
+		part:        "1/2",
+		ctx:         context.Background(),
+		ttl:         time.Hour,
+		completions: "completed",
+	}
+	proc.write(storage, []byte("result"))
+
+	if entries := storage.entries["pid"]; len(entries) != 0 {
+		t.Errorf("stream = %v; want no entries for cancelled process", entries)
+	}
+	if ttl, ok := storage.ttls["pid"]; ok {
+		t.Errorf("stream expires after %v; want it left alone", ttl)
+	}
 }
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"github.com/equinor/oneseismic/api/internal/util"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/go-redis/redis/v8"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pborman/getopt/v2"
 )
 
@@ -20,13 +22,28 @@ type opts struct {
 	consumerid string
 	jobs       int
 	retries    int
+	completions string
+	compress    bool
+	resultTTL   time.Duration
 }
 
 func parseopts() opts {
 	help := getopt.BoolLong("help", 0, "print this help text")
+	/* the same default as the API */
+	resultTTL := 10 * time.Minute
+	if env := os.Getenv("RESULT_TTL"); env != "" {
+		ttl, err := time.ParseDuration(env)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "RESULT_TTL must be a duration, was %s\n", env)
+			os.Exit(1)
+		}
+		resultTTL = ttl
+	}
 	opts := opts {
 		group:  "fetch",
 		stream: "jobs",
+		completions: "completed",
+		resultTTL: resultTTL,
 	}
 	getopt.FlagLong(
 		&opts.redis,
@@ -50,6 +67,8 @@ func parseopts() opts {
 		"stream",
 		'S',
 		"Stream ID to read tasks from. Must be consistent with the producer. " +
+		    "High and low priority tasks are read from <name>:high and " +
+		    "<name>:low. " +
 		    "You should normally not need to change this.",
 		"name",
 	)
@@ -63,6 +82,32 @@ func parseopts() opts {
 			"to specify a consumer ID.",
 		"id",
 	)
+	getopt.FlagLong(
+		&opts.completions,
+		"completion-channel",
+		0,
+		"Pub/sub channel to announce completed processes on. " +
+		    "Must be consistent with the API. " +
+		    "You should normally not need to change this.",
+		"name",
+	)
+	getopt.FlagLong(
+		&opts.compress,
+		"compress",
+		0,
+		"Compress partial results with zstd before writing them to redis. " +
+		    "Saves memory in redis, at the cost of CPU in both the workers " +
+		    "and the API",
+	)
+	getopt.FlagLong(
+		&opts.resultTTL,
+		"result-ttl",
+		0,
+		"How long partial results are kept in redis. " +
+		    "Must be the same for the API and the workers. " +
+		    "Defaults to 10m, or $RESULT_TTL",
+		"duration",
+	)
 	jobs := getopt.IntLong(
 		"jobs",
 		'j',
@@ -89,6 +134,15 @@ func parseopts() opts {
 	}
 	opts.jobs = *jobs
 	opts.retries = *retries
+
+	if opts.resultTTL <= 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--result-ttl must be positive, was %v\n",
+			opts.resultTTL,
+		)
+		os.Exit(1)
+	}
 	return opts
 }
 
@@ -98,10 +152,13 @@ type task struct {
 }
 
 func run(
-	storage redis.Cmdable,
-	njobs   int,
-	retries int,
-	process map[string]interface{},
+	storage     redis.Cmdable,
+	njobs       int,
+	retries     int,
+	completions string,
+	compressor  *zstd.Encoder,
+	ttl         time.Duration,
+	process     map[string]interface{},
 ) {
 	/*
 	 * Curiously, the XReadGroup/XStream values end up being map[string]string
@@ -122,6 +179,14 @@ func run(
 		log.Printf("%s dropping bad process %v", proc.logpid(), err)
 		return
 	}
+	proc.completions = completions
+	proc.compressor = compressor
+	proc.ttl = ttl
+	if proc.cancelled(storage) {
+		log.Printf("%s dropping cancelled process", proc.logpid())
+		proc.cleanup()
+		return
+	}
 	/*
 	 * Build the container-URL early, in case it should be broken,
 	 * so that no goroutines are scheduled before any sanity
@@ -151,6 +216,7 @@ func run(
 	}
 	fragments := proc.fragments()
 	go proc.gather(storage, len(fragments), frags, errors)
+	go proc.watch(storage, cancelPollInterval)
 	for i, id := range fragments {
 		select {
 		case tasks <- task { index: i, blob: container.NewBlobURL(id) }:
@@ -173,53 +239,53 @@ func main() {
 	defer storage.Close()
 
 	ctx := context.Background()
+	// TODO: destroy consumers on shutdown
+	queue := util.JobQueue {
+		Storage:  storage,
+		Group:    opts.group,
+		Consumer: opts.consumerid,
+		Stream:   opts.stream,
+	}
 	/*
-	 * Always try to create the group and stream on start-up. The stream may
+	 * Always try to create the group and streams on start-up. The streams may
 	 * have already been created, but that is a soft error to be discarded. In
-	 * fact, the stream and group *probably* exists already because nodes
+	 * fact, the streams and group *probably* exists already because nodes
 	 * connect in parallel.
 	 *
 	 * The XGroupCreate command is really just a try-create and fits well here,
 	 * it offloads all the concurrency issues to redis. Consequently, this
-	 * program can immediately go into the work loop assuming that the stream
+	 * program can immediately go into the work loop assuming that the streams
 	 * and group exists, without having to do any chatter or sync.
 	 */
-	err := storage.XGroupCreateMkStream(ctx, opts.stream, opts.group, "0").Err()
+	err := queue.CreateGroups(ctx)
 	if err != nil {
-		 // Check if the response is a redis error (= BUSYGROUP), which just
-		 // means the group already exists and nothing happens, or if it is a
-		 // network error or something
-		_, busygroup := err.(interface{RedisError()});
-		if !busygroup {
-			log.Fatalf(
-				"Unable to create group %s for stream %s: %v",
-				opts.group,
-				opts.stream,
-				err,
-			)
+		log.Fatalf("%v", err)
+	}
+	var compressor *zstd.Encoder
+	if opts.compress {
+		compressor, err = zstd.NewWriter(
+			nil,
+			zstd.WithEncoderLevel(zstd.SpeedFastest),
+		)
+		if err != nil {
+			log.Fatalf("Unable to make zstd encoder: %v", err)
 		}
 	}
+
 	log.Printf(
-		"consumer %s in group %s connecting to stream %s",
+		"consumer %s in group %s connecting to streams %v",
 		opts.consumerid,
 		opts.group,
-		opts.stream,
+		util.JobStreams(opts.stream),
 	)
 
-	// TODO: destroy consumers on shutdown
-	// All reads can re-use the same group-args
-	// NoAck is turned on - we can afford to fail requests and lose messages
-	// should a node crash.
-	args := redis.XReadGroupArgs {
-		Group:    opts.group,
-		Consumer: opts.consumerid,
-		Streams:  []string { opts.stream, ">", },
-		Count:    1,
-		NoAck:    true,
-	}
-
+	/*
+	 * Higher priority tasks are read first, see util.JobQueue. NoAck is
+	 * turned on - we can afford to fail requests and lose messages should a
+	 * node crash.
+	 */
 	for {
-		msgs, err := storage.XReadGroup(ctx, &args).Result()
+		msgs, err := queue.Next(ctx)
 		if err != nil {
 			log.Fatalf("Unable to read from redis: %v", err)
 		}
@@ -239,15 +305,15 @@ func main() {
 			 *
 			 * [1] except in some crashing scenarios
 			 */
-			ids := make([]string, 0, 3)
 			for _, xmsg := range msgs {
+				ids := make([]string, 0, len(xmsg.Messages))
 				for _, msg := range xmsg.Messages {
 					ids = append(ids, msg.ID)
 				}
-			}
-			err := storage.XDel(ctx, opts.stream, ids...).Err()
-			if err != nil {
-				log.Fatalf("Unable to XDEL: %v", err)
+				err := storage.XDel(ctx, xmsg.Stream, ids...).Err()
+				if err != nil {
+					log.Fatalf("Unable to XDEL: %v", err)
+				}
 			}
 		}()
 
@@ -259,7 +325,9 @@ func main() {
 		 * be increased with little code change, but it also means more nested
 		 * loops.
 		 *
-		 * For ease of understanding, the loops can be ignored.
+		 * For ease of understanding, the loops can be ignored. A read can
+		 * return a message from more than one of the priority streams, and
+		 * they are in order of priority.
 		 *
 		 * [1] Instead opting for multiple fragments to download per message.
 		 *     This is a design decision from before redis streams, but it
@@ -268,7 +336,15 @@ func main() {
 		for _, xmsg := range msgs {
 			for _, message := range xmsg.Messages {
 				// TODO: graceful shutdown and/or cancellation
-				run(storage, opts.jobs, opts.retries, message.Values)
+				run(
+					storage,
+					opts.jobs,
+					opts.retries,
+					opts.completions,
+					compressor,
+					opts.resultTTL,
+					message.Values,
+				)
 			}
 		}
 	}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/equinor/oneseismic/api/internal/util"
 	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
 )
@@ -36,7 +37,8 @@ func parseopts() opts {
 		&opts.stream,
 		"stream",
 		'S',
-		"Stream to garbage collect",
+		"Stream to garbage collect, and its <key>:high and <key>:low " +
+			"priority streams",
 		"key",
 	)
 	getopt.FlagLong(
@@ -92,7 +94,26 @@ func main() {
 	defer storage.Close()
 	ctx := context.Background()
 
-	cmd := storage.XInfoConsumers(ctx, opts.stream, opts.group)
+	/*
+	 * The workers create the group on the streams of all priorities on
+	 * start-up, see util.JobQueue
+	 */
+	for _, stream := range util.JobStreams(opts.stream) {
+		collect(ctx, storage, stream, opts)
+	}
+}
+
+/*
+ * Remove the consumers of the group that have been idle on stream for longer
+ * than the threshold
+ */
+func collect(
+	ctx     context.Context,
+	storage *redis.Client,
+	stream  string,
+	opts    opts,
+) {
+	cmd := storage.XInfoConsumers(ctx, stream, opts.group)
 	consumers, err := cmd.Result()
 	if err != nil {
 		log.Fatal(err)
@@ -110,7 +131,7 @@ func main() {
 			"Removing consumer %s from group %s in stream %s",
 			id,
 			opts.group,
-			opts.stream,
+			stream,
 		)
 		if opts.dryrun {
 			continue
@@ -125,7 +146,7 @@ func main() {
 		 * found a good reference with guarantees from redis, so this *might*
 		 * come to bite us later.
 		 */
-		err := storage.XGroupDelConsumer(ctx, opts.stream, opts.group, id).Err()
+		err := storage.XGroupDelConsumer(ctx, stream, opts.group, id).Err()
 		if err != nil {
 			log.Fatalf("Could not delete consumer %s; %v", id, err)
 		}
@@ -1,34 +1,158 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/equinor/oneseismic/api/api"
 	"github.com/equinor/oneseismic/api/internal/auth"
+	"github.com/equinor/oneseismic/api/internal/logging"
 	"github.com/equinor/oneseismic/api/internal/util"
+	"github.com/equinor/oneseismic/api/rpc"
+	"github.com/form3tech-oss/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/pborman/getopt/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.opentelemetry.io/otel/semconv"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 type opts struct {
-	clientID     string
-	storageURL   string
-	redisURL     string
-	bind         string
-	signkey      string
+	clientID        string
+	authserver      string
+	priorityScope   string
+	storageURL      string
+	redisURL        string
+	bind            string
+	signkey         string
+	completions     string
+	statusWindow    time.Duration
+	maxResult       int64
+	maxCached       int64
+	uploadContainer string
+	uploadKey       string
+	uploadThreshold int64
+	uploadURLTTL    time.Duration
+	pidClaim        string
+	tokenTTL        time.Duration
+	tokenLeeway     time.Duration
+	tokenCacheSize  int
+	resultTTL       time.Duration
+	resultTimeout   time.Duration
+	firstTimeout    time.Duration
+	maxStall        time.Duration
+	trailingSlash   string
+	streamBurst     int
+	streamRate      float64
+	streamFlush     int
+	streamDelay     time.Duration
+	keepAlive       time.Duration
+	writeTimeout    time.Duration
+	admin           bool
+	dedup           bool
+	streamType      string
+	readBlock       time.Duration
+	maxRetries      int
+	readAhead       int
+	readAheadBytes  int64
+	caseInsensitive bool
+	zstdDictionary  string
+	gzipLevel       int
+	minCompressSize int
+	maintenance     bool
+	retryAfter      time.Duration
+	maxStreams      int
+	streamRetry     time.Duration
+	pollRetry       time.Duration
+	completionWait  time.Duration
+	shutdownGrace   time.Duration
+	grpcPort        int
+	maxTile         int64
+	maxReorder      int64
+	verifyChecksums bool
+	serverTiming    bool
+	metrics         bool
+	logLevel        logging.Level
+	traceEndpoint   string
 }
 
 func parseopts() opts {
 	help := getopt.BoolLong("help", 0, "print this help text")
+	resultTTL := api.DefaultResultTTL
+	if env := os.Getenv("RESULT_TTL"); env != "" {
+		ttl, err := time.ParseDuration(env)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "RESULT_TTL must be a duration, was %s\n", env)
+			os.Exit(1)
+		}
+		resultTTL = ttl
+	}
+	resultTimeout := 15 * time.Second
+	if env := os.Getenv("RESULT_TIMEOUT"); env != "" {
+		timeout, err := time.ParseDuration(env)
+		if err != nil {
+			fmt.Fprintf(
+				os.Stderr,
+				"RESULT_TIMEOUT must be a duration, was %s\n",
+				env,
+			)
+			os.Exit(1)
+		}
+		resultTimeout = timeout
+	}
+	logLevel := logging.Info
+	if env := os.Getenv("LOG_LEVEL"); env != "" {
+		level, err := logging.ParseLevel(env)
+		if err != nil {
+			fmt.Fprintf(
+				os.Stderr,
+				"LOG_LEVEL must be debug, info, warn or error, was %s\n",
+				env,
+			)
+			os.Exit(1)
+		}
+		logLevel = level
+	}
 	opts := opts {
-		clientID:     os.Getenv("CLIENT_ID"),
-		storageURL:   os.Getenv("STORAGE_URL"),
-		redisURL:     os.Getenv("REDIS_URL"),
-		signkey:      os.Getenv("SIGN_KEY"),
+		clientID:        os.Getenv("CLIENT_ID"),
+		authserver:      os.Getenv("AUTHSERVER"),
+		storageURL:      os.Getenv("STORAGE_URL"),
+		redisURL:        os.Getenv("REDIS_URL"),
+		signkey:         os.Getenv("SIGN_KEY"),
+		uploadKey:       os.Getenv("UPLOAD_ACCOUNT_KEY"),
+		traceEndpoint:   os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		completions:     "completed",
+		pidClaim:        "pid",
+		trailingSlash:   "redirect",
+		gzipLevel:       gzip.BestSpeed,
+		minCompressSize: 1024,
+		retryAfter:      5 * time.Minute,
+		maxStreams:      api.DefaultMaxStreams,
+		streamRetry:     time.Second,
+		shutdownGrace:   30 * time.Second,
+		tokenLeeway:     auth.DefaultLeeway,
+		tokenCacheSize:  auth.DefaultCacheSize,
+		resultTTL:       resultTTL,
+		resultTimeout:   resultTimeout,
+		logLevel:        logLevel,
 	}
 
 	getopt.FlagLong(
@@ -63,9 +187,416 @@ func parseopts() opts {
 		&opts.signkey,
 		"sign-key",
 		0,
-		"Signing key used for response authorization tokens",
+		"Signing key used for response authorization tokens. " +
+			"Must be at least 32 bytes",
 		"key",
 	)
+	getopt.FlagLong(
+		&opts.pidClaim,
+		"pid-claim",
+		0,
+		"Name of the claim that carries the pid in result tokens. " +
+			"Defaults to pid",
+		"claim",
+	)
+	getopt.FlagLong(
+		&opts.tokenTTL,
+		"token-ttl",
+		0,
+		"How long result tokens are valid. Should be longer than it takes " +
+			"to assemble the largest results. Defaults to 5m",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.tokenLeeway,
+		"token-leeway",
+		0,
+		"Clock skew tolerated when checking the expiry and issue time of " +
+			"tokens. Defaults to 30s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.tokenCacheSize,
+		"token-cache-size",
+		0,
+		"Number of validated result tokens to keep, so that the signature " +
+			"of a token is only checked once. 0 disables the cache. " +
+			"Defaults to 4096",
+		"n",
+	)
+	getopt.FlagLong(
+		&opts.resultTTL,
+		"result-ttl",
+		0,
+		"How long results are kept in redis. Must be the same for the API " +
+			"and the workers. Defaults to 10m, or $RESULT_TTL",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.resultTimeout,
+		"result-timeout",
+		0,
+		"How long requests for results may spend collecting the result, " +
+			"and how long status lookups may take. " +
+			"0 means no limit. Defaults to 15s, or $RESULT_TIMEOUT",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.firstTimeout,
+		"first-result-timeout",
+		0,
+		"How long requests for results wait for the process to produce " +
+			"its first partial result. 0 (the default) means only " +
+			"--result-timeout applies",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.completions,
+		"completion-channel",
+		0,
+		"Pub/sub channel workers announce completed processes on. " +
+			"Must be consistent with the workers. " +
+			"You should normally not need to change this.",
+		"name",
+	)
+	getopt.FlagLong(
+		&opts.statusWindow,
+		"status-window",
+		0,
+		"Share the status lookup of a process with requests arriving " +
+			"within this window. Concurrent requests always share lookups.",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.maxStall,
+		"max-stall",
+		0,
+		"Consider processes without progress for this long after their " +
+			"last partial result as failed. 0 (the default) means processes " +
+			"never stall",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.maxResult,
+		"max-result-bytes",
+		0,
+		"Max size of results. Larger queries are refused when " +
+			"scheduled, and larger results by all but the stream endpoint. " +
+			"0 means no limit",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.maxCached,
+		"max-cached-bytes",
+		0,
+		"Max size of results kept whole in redis after the first " +
+			"/result/<pid>, so that repeated requests don't read the " +
+			"partial results again. Defaults to 16MB, negative disables",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.uploadContainer,
+		"upload-container",
+		0,
+		"Upload large results to this blob container, and redirect " +
+			"/result/<pid> to them, e.g. " +
+			"https://<account>.blob.core.windows.net/<container>. " +
+			"The account key must be in UPLOAD_ACCOUNT_KEY",
+		"url",
+	)
+	getopt.FlagLong(
+		&opts.uploadThreshold,
+		"upload-threshold",
+		0,
+		"Min size of results uploaded with --upload-container. " +
+			"Defaults to 1GB",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.uploadURLTTL,
+		"upload-url-ttl",
+		0,
+		"How long the signed URLs of uploaded results are valid. " +
+			"Defaults to 15m",
+		"duration",
+	)
+
+	getopt.FlagLong(
+		&opts.maxTile,
+		"max-tile-bytes",
+		0,
+		"Max size of a partial result compressed by the workers, once " +
+			"decompressed. Defaults to 64MB",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.maxReorder,
+		"max-reorder-bytes",
+		0,
+		"Max size of the tiles held back to send ordered streams " +
+			"(?ordered=true) in task order. Defaults to 256MB",
+		"bytes",
+	)
+
+	getopt.FlagLong(
+		&opts.verifyChecksums,
+		"verify-checksums",
+		0,
+		"Verify the checksums of partial results when collecting them, " +
+			"and fail requests on mismatch. Costs CPU",
+	)
+
+	getopt.FlagLong(
+		&opts.serverTiming,
+		"server-timing",
+		0,
+		"Report the time spent in the phases of /result/<pid> in the " +
+			"Server-Timing header. Meant for debugging, not production",
+	)
+
+	getopt.FlagLong(
+		&opts.metrics,
+		"metrics",
+		0,
+		"Serve metrics on result assembly, and of the process and the Go " +
+			"runtime, in the Prometheus text format on /metrics",
+	)
+
+	getopt.FlagLong(
+		&opts.streamBurst,
+		"stream-burst",
+		0,
+		"Number of tiles /result/<pid>/stream sends at full speed, " +
+			"before throttling to --stream-rate",
+		"tiles",
+	)
+	getopt.FlagLong(
+		&opts.streamRate,
+		"stream-rate",
+		0,
+		"Max rate of tiles after the burst in /result/<pid>/stream. " +
+			"0 means no throttling",
+		"tiles/s",
+	)
+	getopt.FlagLong(
+		&opts.streamFlush,
+		"stream-flush-bytes",
+		0,
+		"Bytes /result/<pid>/stream writes before flushing. " +
+			"Defaults to 256KB",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.streamDelay,
+		"stream-flush-delay",
+		0,
+		"Max time /result/<pid>/stream holds on to written tiles " +
+			"before flushing. Defaults to 10ms",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.streamType,
+		"stream-content-type",
+		0,
+		"Content-Type of /result/<pid>/stream responses. " +
+			"Defaults to application/x-oneseismic-stream",
+		"type",
+	)
+	getopt.FlagLong(
+		&opts.readBlock,
+		"read-block",
+		0,
+		"How long a single read of partial results from redis blocks. " +
+			"Defaults to 1s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.maxRetries,
+		"redis-retries",
+		0,
+		"How many times a failed read of partial results from redis is " +
+			"retried, with exponential backoff. Defaults to 5, negative " +
+			"means no retries",
+		"n",
+	)
+	getopt.FlagLong(
+		&opts.readAhead,
+		"read-ahead",
+		0,
+		"Max number of partial results read from redis ahead of the " +
+			"client, so that slow clients don't stall the reads. " +
+			"Defaults to 1000, negative disables reading ahead",
+		"n",
+	)
+	getopt.FlagLong(
+		&opts.readAheadBytes,
+		"read-ahead-bytes",
+		0,
+		"Max size of the partial results read from redis ahead of the " +
+			"client, per request. Defaults to 8MB",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.admin,
+		"admin",
+		0,
+		"Enable the /admin endpoints for debugging. These are not " +
+			"authenticated, and should not be exposed to users",
+	)
+	getopt.FlagLong(
+		&opts.dedup,
+		"dedup",
+		0,
+		"Give queries identical to one that is still running, with the " +
+			"same credentials, the pid of the running one rather than " +
+			"scheduling it again",
+	)
+	getopt.FlagLong(
+		&opts.trailingSlash,
+		"trailing-slash",
+		0,
+		"How to handle requests with a trailing slash, e.g. /result/<pid>/. " +
+			"redirect (301) to the path without it, or strict (404). " +
+			"Defaults to redirect",
+		"redirect|strict",
+	)
+	getopt.FlagLong(
+		&opts.caseInsensitive,
+		"case-insensitive-routes",
+		0,
+		"Redirect (301) requests to paths with the wrong case, e.g. " +
+			"/Result/<pid>, to the right path. Path parameters keep " +
+			"their case. Without this, such requests are 404",
+	)
+	getopt.FlagLong(
+		&opts.zstdDictionary,
+		"zstd-dictionary",
+		0,
+		"zstd dictionary, trained on tiles, for ?compression=zstd. Clients " +
+			"opt in with ?dictionary=<id>, and get it from /zstd-dictionary",
+		"path",
+	)
+	getopt.FlagLong(
+		&opts.gzipLevel,
+		"gzip-level",
+		0,
+		"Compression level of gzip responses, for clients that send " +
+			"Accept-Encoding: gzip or ask for ?compression=gz. From 1 " +
+			"(fastest) to 9 (smallest). Defaults to 1",
+		"level",
+	)
+	getopt.FlagLong(
+		&opts.minCompressSize,
+		"compression-min-size",
+		0,
+		"Send responses smaller than this uncompressed, even if the client " +
+			"accepts compression. Defaults to 1024",
+		"bytes",
+	)
+	getopt.FlagLong(
+		&opts.maintenance,
+		"maintenance",
+		0,
+		"Start in maintenance mode, where new queries are rejected with " +
+			"503, but results are still served. With --admin, the mode " +
+			"can be toggled with PUT and DELETE /admin/maintenance",
+	)
+	getopt.FlagLong(
+		&opts.retryAfter,
+		"retry-after",
+		0,
+		"Retry-After of queries rejected in maintenance mode. " +
+			"Defaults to 5m",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.keepAlive,
+		"stream-keepalive",
+		0,
+		"Send a keepalive in framed and SSE streams that have sent nothing " +
+			"for this long, so that proxies don't close them as idle. " +
+			"Defaults to 15s, negative disables",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.writeTimeout,
+		"stream-write-timeout",
+		0,
+		"Abort streams when a write blocks for this long, i.e. the client " +
+			"stopped reading. Defaults to 30s, negative disables",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.maxStreams,
+		"max-streams",
+		0,
+		"Max number of results read concurrently (/result/<pid> and " +
+			"/result/<pid>/stream). Requests over the limit are rejected " +
+			"with 429. Defaults to 256, negative means no limit",
+		"n",
+	)
+	getopt.FlagLong(
+		&opts.streamRetry,
+		"stream-retry-after",
+		0,
+		"Retry-After of results rejected because of --max-streams. " +
+			"Defaults to 1s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.pollRetry,
+		"poll-retry-after",
+		0,
+		"Retry-After of 202 from /result/<pid> and /result/<pid>/status " +
+			"when there is no progress to estimate it from. Otherwise it " +
+			"is estimated from the progress, within 1s and 30s. " +
+			"Defaults to 2s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.completionWait,
+		"completion-wait",
+		0,
+		"Let /result/<pid> wait this long for running processes to " +
+			"complete before answering 202. Disabled by default",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.shutdownGrace,
+		"shutdown-grace",
+		0,
+		"On SIGINT or SIGTERM, wait this long for requests in flight, " +
+			"e.g. result streams, to finish before ending them. " +
+			"Defaults to 30s",
+		"duration",
+	)
+	getopt.FlagLong(
+		&opts.grpcPort,
+		"grpc-port",
+		0,
+		"Serve the results over gRPC on this port too, see " +
+			"rpc/results.proto. Disabled by default",
+		"port",
+	)
+	getopt.FlagLong(
+		&opts.authserver,
+		"authserver",
+		0,
+		"OpenID configuration URL of the provider of the tokens that are " +
+			"checked for --priority-scope, e.g. " +
+			"https://login.microsoftonline.com/<tenant>/v2.0/" +
+			".well-known/openid-configuration. Defaults to $AUTHSERVER",
+		"url",
+	)
+	getopt.FlagLong(
+		&opts.priorityScope,
+		"priority-scope",
+		0,
+		"Scope clients must have to schedule high priority queries " +
+			"(?priority=high), e.g. One.Priority. Requires --authserver " +
+			"and --client-id. Disabled by default",
+		"scope",
+	)
 
 	getopt.Parse()
 	if *help {
@@ -73,6 +604,88 @@ func parseopts() opts {
 		os.Exit(0)
 	}
 
+	if opts.trailingSlash != "redirect" && opts.trailingSlash != "strict" {
+		fmt.Fprintf(
+			os.Stderr,
+			"--trailing-slash must be redirect or strict, was %s\n",
+			opts.trailingSlash,
+		)
+		os.Exit(1)
+	}
+
+	if opts.gzipLevel < gzip.BestSpeed || opts.gzipLevel > gzip.BestCompression {
+		fmt.Fprintf(
+			os.Stderr,
+			"--gzip-level must be between %d and %d, was %d\n",
+			gzip.BestSpeed,
+			gzip.BestCompression,
+			opts.gzipLevel,
+		)
+		os.Exit(1)
+	}
+
+	if opts.minCompressSize < 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--compression-min-size must be non-negative, was %d\n",
+			opts.minCompressSize,
+		)
+		os.Exit(1)
+	}
+
+	if opts.tokenCacheSize < 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--token-cache-size must be non-negative, was %d\n",
+			opts.tokenCacheSize,
+		)
+		os.Exit(1)
+	}
+
+	if opts.resultTTL <= 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--result-ttl must be positive, was %v\n",
+			opts.resultTTL,
+		)
+		os.Exit(1)
+	}
+
+	if opts.resultTimeout < 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--result-timeout must not be negative, was %v\n",
+			opts.resultTimeout,
+		)
+		os.Exit(1)
+	}
+
+	if opts.firstTimeout < 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--first-result-timeout must not be negative, was %v\n",
+			opts.firstTimeout,
+		)
+		os.Exit(1)
+	}
+
+	if opts.priorityScope != "" && (opts.authserver == "" || opts.clientID == "") {
+		fmt.Fprintf(
+			os.Stderr,
+			"--priority-scope requires --authserver and --client-id\n",
+		)
+		os.Exit(1)
+	}
+
+	if opts.tokenLeeway < 0 {
+		fmt.Fprintf(
+			os.Stderr,
+			"--token-leeway must be non-negative, was %v\n",
+			opts.tokenLeeway,
+		)
+		os.Exit(1)
+	}
+
 	return opts
 }
 
@@ -93,10 +706,11 @@ type clientconfig struct {
 	appid      string
 	scopes     []string
 	defaultStorageResource string
+	zstdDictionary         *util.ZstdDictionary
 }
 
 func (c *clientconfig) Get(ctx *gin.Context) {
-	ctx.JSON(http.StatusOK, gin.H {
+	cfg := gin.H {
 		/*
 		 * oneseismic's app-id
 		 */
@@ -117,28 +731,362 @@ func (c *clientconfig) Get(ctx *gin.Context) {
 		 * oneseismic instance and query the rest from there.
 		 */
 		"default-storage-resource": c.defaultStorageResource,
-	})
+	}
+
+	/*
+	 * The ID of the zstd dictionary, if any, so clients can ask for
+	 * dictionary compressed results with ?dictionary=<id>, and know when the
+	 * dictionary they have cached is stale.
+	 */
+	if c.zstdDictionary != nil {
+		cfg["zstd-dictionary"] = gin.H {
+			"id":  c.zstdDictionary.ID,
+			"url": "/zstd-dictionary",
+		}
+	}
+	ctx.JSON(http.StatusOK, cfg)
+}
+
+/*
+ * Configure how the router handles requests that don't quite match a route.
+ * The gin defaults are to redirect trailing slashes, but treat paths with the
+ * wrong case as not found, which is a bit inconsistent, so it's up to the
+ * operator to choose.
+ *
+ * Redirects are 301 for GET, and 307 for other methods, so that POSTs to
+ * /graphql/ keep their body. Case-insensitive matching only applies to the
+ * static parts of the path - /Result/<pid> and /result/<pid> are the same,
+ * but the pid itself is not changed.
+ */
+func configureRouting(app *gin.Engine, redirectSlash, caseInsensitive bool) {
+	app.RedirectTrailingSlash = redirectSlash
+	app.RedirectFixedPath = caseInsensitive
+}
+
+/*
+ * The priorities of queries. High priority requires a token from the
+ * authserver with the scope, and the keys of the authserver are refreshed
+ * every hour, since providers rotate them.
+ */
+func makePriorities(opts opts, logger *logging.Logger) *api.Priorities {
+	if opts.priorityScope == "" {
+		return &api.Priorities {}
+	}
+
+	cfg, err := auth.GetOpenIDConfig(http.DefaultClient, opts.authserver)
+	if err != nil {
+		logger.Fatal("unable to get openid configuration", "error", err)
+	}
+	keys := auth.NewKeySet(http.DefaultClient, cfg.JwksURI, cfg.Jwks)
+	keys.Logger = logger
+	go keys.RefreshEvery(context.Background(), time.Hour)
+
+	/*
+	 * v1 tokens are for api://<client-id>, and v2 tokens for the client ID
+	 */
+	audiences := []string {
+		opts.clientID,
+		fmt.Sprintf("api://%s", opts.clientID),
+	}
+	return &api.Priorities {
+		Scope: opts.priorityScope,
+		Validate: func(token string) (jwt.MapClaims, error) {
+			return auth.ValidateJWT(
+				token,
+				keys,
+				cfg.Issuer,
+				opts.tokenLeeway,
+				audiences...,
+			)
+		},
+	}
+}
+
+/*
+ * A context that is cancelled on any of the signals
+ */
+func signalled(signals ...os.Signal) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, signals...)
+	go func() {
+		select {
+		case sig := <-sigs:
+			logging.Default().Info("shutting down", "signal", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		cancel()
+	}
+}
+
+/*
+ * Serve on ln until ctx is done, and then shut down gracefully. The server
+ * stops accepting connections, and waits up to grace for the requests in
+ * flight to finish, so that result streams are not cut mid-tile.
+ *
+ * Requests that are still going when the grace period is up are asked to
+ * stop by cancelling their context, which the result handlers respond to by
+ * ending the response properly, e.g. with an error frame for framed streams,
+ * rather than by having the connection reset. Connections that are hijacked,
+ * like WebSockets, are not waited for.
+ */
+func serve(
+	ctx   context.Context,
+	srv   *http.Server,
+	ln    net.Listener,
+	grace time.Duration,
+) error {
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv.BaseContext = func(net.Listener) context.Context {
+		return base
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	graceful, stop := context.WithTimeout(context.Background(), grace)
+	defer stop()
+	err := srv.Shutdown(graceful)
+	if err == nil {
+		return nil
+	}
+	logging.Default().Warn(
+		"requests still in flight after grace period; ending them",
+		"grace", grace,
+	)
+
+	cancel()
+	final, stopfinal := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer stopfinal()
+	if err := srv.Shutdown(final); err != nil {
+		logging.Default().Error("unable to end requests in flight", "error", err)
+		return srv.Close()
+	}
+	return nil
+}
+
+/*
+ * Serve gRPC on ln until ctx is done, and then shut down gracefully, like
+ * serve. Calls that are still going when the grace period is up are ended.
+ */
+func serveRPC(
+	ctx   context.Context,
+	srv   *grpc.Server,
+	ln    net.Listener,
+	grace time.Duration,
+) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(grace):
+		logging.Default().Warn(
+			"grpc calls still in flight after grace period; ending them",
+			"grace", grace,
+		)
+		srv.Stop()
+	}
+	return nil
+}
+
+/*
+ * Export spans over OTLP/gRPC to the endpoint, e.g. the
+ * OTEL_EXPORTER_OTLP_ENDPOINT of an opentelemetry collector, by installing a
+ * tracer provider that batches them. The endpoint is host:port, or an URL
+ * where the scheme decides if the connection is encrypted, which it is not
+ * for bare host:port.
+ *
+ * The returned function flushes the spans that are still batched and shuts
+ * the exporter down, and should be called on exit.
+ */
+func startTracing(ctx context.Context, endpoint string) (func(), error) {
+	options := []otlpgrpc.Option { otlpgrpc.WithInsecure() }
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("bad trace endpoint: %w", err)
+		}
+		endpoint = u.Host
+		if u.Scheme == "https" {
+			options = []otlpgrpc.Option {
+				otlpgrpc.WithTLSCredentials(
+					credentials.NewClientTLSFromCert(nil, ""),
+				),
+			}
+		}
+	}
+	options = append(options, otlpgrpc.WithEndpoint(endpoint))
+
+	exporter, err := otlp.NewExporter(ctx, otlpgrpc.NewDriver(options...))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(sdktrace.NewBatchSpanProcessor(exporter)),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.ServiceNameKey.String("oneseismic-query"),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			logging.Default().Error("unable to flush spans", "error", err)
+		}
+	}, nil
 }
 
 func main() {
 	opts := parseopts()
 
-	keyring := auth.MakeKeyring([]byte(opts.signkey))
 	cmdable := redis.NewClient(
 		&redis.Options {
 			Addr: opts.redisURL,
 			DB: 0,
 		},
 	)
-	gql := api.MakeGraphQL(&keyring, opts.storageURL, cmdable)
+	logger := logging.New(os.Stderr, opts.logLevel)
+	logging.SetDefault(logger)
+	keyring, err := auth.NewKeyring(
+		[]byte(opts.signkey),
+		auth.WithPidClaim(opts.pidClaim),
+		auth.WithTTL(opts.tokenTTL),
+		auth.WithLeeway(opts.tokenLeeway),
+		auth.WithCacheSize(opts.tokenCacheSize),
+		auth.WithRevocations(cmdable),
+		auth.WithLogger(logger),
+	)
+	if err != nil {
+		logger.Fatal("unable to make keyring", "error", err)
+	}
+
+	compression := []util.CompressionOption {
+		util.WithGzipLevel(opts.gzipLevel),
+		util.WithMinSize(opts.minCompressSize),
+	}
+	var dict *util.ZstdDictionary
+	if opts.zstdDictionary != "" {
+		dict, err = util.LoadZstdDictionary(opts.zstdDictionary)
+		if err != nil {
+			logger.Fatal("unable to load zstd dictionary", "error", err)
+		}
+		compression = append(compression, util.WithZstdDictionary(dict))
+	}
+
+	var uploads *api.Uploads
+	if opts.uploadContainer != "" {
+		store, err := api.NewAzureBlobStore(opts.uploadContainer, opts.uploadKey)
+		if err != nil {
+			logger.Fatal("unable to make upload store", "error", err)
+		}
+		uploads = &api.Uploads {
+			Store:     store,
+			Threshold: opts.uploadThreshold,
+			URLTTL:    opts.uploadURLTTL,
+		}
+		go uploads.ExpireEvery(context.Background(), opts.resultTTL, 10 * time.Minute)
+	}
+
+	/*
+	 * Without an endpoint the spans go nowhere, and the result collections
+	 * are not linked to the queries, which costs a lookup per collection.
+	 */
+	stopTracing := func() {}
+	if opts.traceEndpoint != "" {
+		stopTracing, err = startTracing(context.Background(), opts.traceEndpoint)
+		if err != nil {
+			logger.Fatal("unable to start tracing", "error", err)
+		}
+	}
+
+	streams := api.NewStreamLimiter(opts.maxStreams, opts.streamRetry)
+	completions := api.NewCompletionWatcher(cmdable, opts.completions)
+	completions.Logger = logger
+	go completions.Run(context.Background())
+	var dedup *api.Dedup
+	if opts.dedup {
+		dedup = &api.Dedup {
+			Storage:     cmdable,
+			TTL:         opts.resultTTL,
+			Completions: completions,
+		}
+	}
+	gql := api.MakeGraphQL(
+		keyring,
+		opts.storageURL,
+		api.NewScheduler(cmdable, opts.resultTTL),
+		opts.maxResult,
+		dedup,
+	)
 	result := api.Result {
-		Timeout: time.Second * 15,
+		Timeout: opts.resultTimeout,
+		FirstResultTimeout: opts.firstTimeout,
 		StorageURL: opts.storageURL,
 		Storage: redis.NewClient(&redis.Options {
 			Addr: opts.redisURL,
 			DB: 0,
 		}),
-		Keyring: &keyring,
+		Keyring: keyring,
+		Logger: logger,
+		Completions: completions,
+		CompletionWait: opts.completionWait,
+		Uploads: uploads,
+		TraceLinks: opts.traceEndpoint != "",
+		StatusWindow: opts.statusWindow,
+		MaxResultBytes: opts.maxResult,
+		MaxCachedBytes: opts.maxCached,
+		MaxTileBytes: opts.maxTile,
+		MaxReorderBytes: opts.maxReorder,
+		VerifyBundles: true,
+		VerifyChecksums: opts.verifyChecksums,
+		ServerTiming: opts.serverTiming,
+		MaxStall: opts.maxStall,
+		StreamBurst: opts.streamBurst,
+		StreamRate: opts.streamRate,
+		StreamFlushBytes: opts.streamFlush,
+		StreamFlushDelay: opts.streamDelay,
+		KeepAlive: opts.keepAlive,
+		StreamWriteTimeout: opts.writeTimeout,
+		ResultTTL: opts.resultTTL,
+		StreamContentType: opts.streamType,
+		ReadBlock: opts.readBlock,
+		MaxRetries: opts.maxRetries,
+		ReadAhead: opts.readAhead,
+		ReadAheadBytes: opts.readAheadBytes,
+		Streams: streams,
+		RetryAfter: opts.pollRetry,
+	}
+	if opts.metrics {
+		result.Metrics = api.NewMetrics(prometheus.DefaultRegisterer)
 	}
 
 	cfg := clientconfig {
@@ -147,22 +1095,113 @@ func main() {
 			fmt.Sprintf("api://%s/One.Read", opts.clientID),
 		},
 		defaultStorageResource: opts.storageURL,
+		zstdDictionary: dict,
 	}
 
 	app := gin.Default()
+	configureRouting(
+		app,
+		opts.trailingSlash == "redirect",
+		opts.caseInsensitive,
+	)
 	
+	maintenance := &api.Maintenance {
+		RetryAfter: opts.retryAfter,
+		Streams:    streams,
+	}
+	if opts.maintenance {
+		maintenance.Enable()
+	}
+
 	graphql := app.Group("/graphql")
+	graphql.Use(maintenance.Reject)
 	graphql.Use(util.GeneratePID)
+	graphql.Use(makePriorities(opts, logger).Parse)
 	graphql.GET( "", gql.Get)
 	graphql.POST("", gql.Post)
 
+	/*
+	 * Browsers can't set the Authorization header on WebSocket or EventSource
+	 * requests, so those routes accept the token in the query string too. The
+	 * other endpoints don't, see auth.ResultAuth.
+	 */
+	querytoken := app.Group("/result")
+	querytoken.Use(auth.ResultAuth(keyring, auth.WithQueryToken()))
+	querytoken.Use(util.Compression(compression...))
+	querytoken.GET("/:pid/sse", result.StreamSSE)
+	querytoken.GET("/:pid/ws", result.StreamWS)
+
 	results := app.Group("/result")
-	results.Use(auth.ResultAuth(&keyring))
-	results.Use(util.Compression())
+	results.Use(auth.ResultAuth(keyring))
+	results.Use(util.Compression(compression...))
 	results.GET("/:pid", result.Get)
+	results.HEAD("/:pid", result.Head)
+	results.DELETE("/:pid", result.Delete)
+	results.POST("/:pid/cancel", result.Cancel)
 	results.GET("/:pid/stream", result.Stream)
 	results.GET("/:pid/status", result.Status)
+	results.GET("/:pid/header", result.Header)
+	results.GET("/:pid/stats", result.Stats)
 
+	axis := api.MakeAxisEndpoint(opts.storageURL)
+	app.GET("/query/:guid/axis/:dim", axis.Get)
+
+	if opts.admin {
+		admin := api.Admin {
+			Storage:     cmdable,
+			Maintenance: maintenance,
+		}
+		app.GET("/admin/jobs/:pid/plan", admin.Plan)
+		app.PUT("/admin/maintenance", admin.EnableMaintenance)
+		app.DELETE("/admin/maintenance", admin.DisableMaintenance)
+	}
+
+	probes := api.Probes {
+		Storage:     cmdable,
+		Maintenance: maintenance,
+	}
+	app.GET("/healthz", probes.Live)
+	app.GET("/readyz", probes.Ready)
+	app.GET("/health", probes.Ready)
+	if opts.metrics {
+		app.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	}
 	app.GET("/config", cfg.Get)
-	app.Run(":8080")
+	if dict != nil {
+		app.GET("/zstd-dictionary", dict.Get)
+	}
+	ln, err := net.Listen("tcp", ":8080")
+	if err != nil {
+		logger.Fatal("unable to listen", "error", err)
+	}
+	ctx, stop := signalled(syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var rpcs sync.WaitGroup
+	if opts.grpcPort != 0 {
+		rpcln, err := net.Listen("tcp", fmt.Sprintf(":%d", opts.grpcPort))
+		if err != nil {
+			logger.Fatal("unable to listen for grpc", "error", err)
+		}
+		rpcsrv := grpc.NewServer()
+		rpc.RegisterResultsServer(rpcsrv, &api.ResultService { Result: &result })
+		rpcs.Add(1)
+		go func() {
+			defer rpcs.Done()
+			if err := serveRPC(ctx, rpcsrv, rpcln, opts.shutdownGrace); err != nil {
+				logger.Error("grpc serve failed", "error", err)
+			}
+		}()
+	}
+
+	srv := &http.Server {
+		Handler:     app,
+		ConnContext: api.ConnContext,
+	}
+	err = serve(ctx, srv, ln, opts.shutdownGrace)
+	rpcs.Wait()
+	stopTracing()
+	if err != nil {
+		logger.Fatal("serve failed", "error", err)
+	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func testrouter(redirectSlash, caseInsensitive bool) *gin.Engine {
+	app := gin.New()
+	configureRouting(app, redirectSlash, caseInsensitive)
+	app.GET("/result/:pid", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, ctx.Param("pid"))
+	})
+	return app
+}
+
+func request(app *gin.Engine, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, path, nil)
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestTrailingSlash(t *testing.T) {
+	cases := []struct {
+		redirect bool
+		status   int
+	} {
+		{ redirect: true,  status: http.StatusMovedPermanently },
+		{ redirect: false, status: http.StatusNotFound },
+	}
+
+	for _, c := range cases {
+		w := request(testrouter(c.redirect, false), "/result/PID-1/")
+		if w.Code != c.status {
+			t.Errorf(
+				"redirect = %v: status = %d; want %d",
+				c.redirect,
+				w.Code,
+				c.status,
+			)
+		}
+		if c.redirect {
+			location := w.Header().Get("Location")
+			if location != "/result/PID-1" {
+				t.Errorf("Location = %s; want /result/PID-1", location)
+			}
+		}
+	}
+}
+
+func TestMixedCasePath(t *testing.T) {
+	cases := []struct {
+		caseInsensitive bool
+		status          int
+	} {
+		{ caseInsensitive: true,  status: http.StatusMovedPermanently },
+		{ caseInsensitive: false, status: http.StatusNotFound },
+	}
+
+	for _, c := range cases {
+		w := request(testrouter(true, c.caseInsensitive), "/Result/PID-1")
+		if w.Code != c.status {
+			t.Errorf(
+				"case insensitive = %v: status = %d; want %d",
+				c.caseInsensitive,
+				w.Code,
+				c.status,
+			)
+		}
+		if c.caseInsensitive {
+			/* The pid is a parameter, and must keep its case */
+			location := w.Header().Get("Location")
+			if location != "/result/PID-1" {
+				t.Errorf("Location = %s; want /result/PID-1", location)
+			}
+		}
+	}
+}
+
+func TestExactPathIsNotRedirected(t *testing.T) {
+	w := request(testrouter(true, true), "/result/PID-1")
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	if body := w.Body.String(); body != "PID-1" {
+		t.Errorf("pid = %s; want PID-1", body)
+	}
+}
+
+/*
+ * Start serving a handler that writes the first part of the response, and
+ * then waits for release or for the request to be cancelled before it writes
+ * the rest. Returns the response body as the client got it.
+ */
+func serveUntilSignal(
+	t       *testing.T,
+	grace   time.Duration,
+	release chan struct{},
+) (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first;")
+		w.(http.Flusher).Flush()
+		close(started)
+		select {
+		case <-release:
+			io.WriteString(w, "last")
+		case <-r.Context().Done():
+			io.WriteString(w, "cancelled")
+		}
+	})
+
+	ctx, stop := signalled(syscall.SIGTERM)
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		srv := &http.Server { Handler: handler }
+		served <- serve(ctx, srv, ln, grace)
+	}()
+
+	body := make(chan string, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Errorf("%v", err)
+			body <- ""
+			return
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("response not ended cleanly: %v", err)
+		}
+		body <- string(b)
+	}()
+
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	return <-body, <-served
+}
+
+func TestShutdownWaitsForRequestsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+
+	body, err := serveUntilSignal(t, time.Minute, release)
+	if err != nil {
+		t.Errorf("serve() = %v", err)
+	}
+	if body != "first;last" {
+		t.Errorf("body = %q; want first;last", body)
+	}
+}
+
+func TestShutdownEndsRequestsAfterGrace(t *testing.T) {
+	body, err := serveUntilSignal(t, 50 * time.Millisecond, make(chan struct{}))
+	if err != nil {
+		t.Errorf("serve() = %v", err)
+	}
+	if body != "first;cancelled" {
+		t.Errorf("body = %q; want first;cancelled", body)
+	}
+}
+
+func TestTracingInstallsProvider(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	for _, endpoint := range []string {
+		"localhost:4317",
+		"http://localhost:4317",
+	} {
+		stop, err := startTracing(context.Background(), endpoint)
+		if err != nil {
+			t.Fatalf("%s: startTracing() = %v", endpoint, err)
+		}
+		provider := otel.GetTracerProvider()
+		if _, ok := provider.(*sdktrace.TracerProvider); !ok {
+			t.Errorf("%s: provider = %T; want sdk provider", endpoint, provider)
+		}
+		stop()
+	}
+}
+
+func TestTracingRejectsBadEndpoint(t *testing.T) {
+	if _, err := startTracing(context.Background(), "http://%zz"); err == nil {
+		t.Errorf("startTracing() = nil; want error")
+	}
+}
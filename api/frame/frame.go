@@ -0,0 +1,480 @@
+/*
+ * Package frame implements the framing of the oneseismic result stream.
+ *
+ * By default, the result stream is the bare msgpack document, delivered
+ * piecemeal, and clients have to decode it incrementally to know where one
+ * bundle ends and the next begins. Framing makes the boundaries explicit, and
+ * makes it possible to report errors and the end of the stream in-band, after
+ * the HTTP status has already been sent.
+ *
+ * A frame is a 7-byte header followed by the payload:
+ *
+ *     +-------+---------+------+-----------------+---------+
+ *     | magic | version | type | length (u32 BE) | payload |
+ *     +-------+---------+------+-----------------+---------+
+ *
+ * The magic byte is always 0xd5, and the version is 1 (see below for version
+ * 2, which has the same frames with checksums). The stream is a header
+ * frame (the msgpack result header), one tile frame per bundle, and an end
+ * frame. A stream that fails midway ends with an error frame, whose payload
+ * is the (utf-8) error message, instead of the end frame. The error frame is
+ * the last frame of the stream, so a stream that ends with neither was cut
+ * short, e.g. by the network, rather than failed by the server. The stream
+ * of an empty result, e.g. of a query outside the cube, is the header frame
+ * followed right by the end frame.
+ *
+ * Every tile frame is followed by a cursor frame, whose payload is the
+ * position of the tile in the result (as an opaque string). A client that
+ * loses the connection can resume the stream after the last tile it got, with
+ * ?from=<cursor>. Resumed streams have no header frame.
+ *
+ * When there are no tiles to send for a while, the stream has keepalive
+ * frames, with no payload, so that proxies don't close it as idle. They can
+ * come anywhere between the other frames, carry no information, and the
+ * Decoder skips them.
+ *
+ * Clients that want to report progress can ask for a progress frame after
+ * every tile (and its cursor), whose payload is the number of bundles sent so
+ * far and in total, and the number of bytes of the result sent so far:
+ *
+ *     +-----------------+------------------+----------------+
+ *     | bundle (u32 BE) | bundles (u32 BE) | bytes (u64 BE) |
+ *     +-----------------+------------------+----------------+
+ *
+ * see ProgressInfo. The bytes are those of the header and tile payloads, i.e. of
+ * the msgpack result.
+ *
+ * Version 2 guards against streams that are corrupted or cut short on the
+ * way, e.g. by proxies. The header has the CRC32C (Castagnoli) of the payload
+ * after the length:
+ *
+ *     +-------+---------+------+-----------------+-----------------+---------+
+ *     | magic | version | type | length (u32 BE) | crc32c (u32 BE) | payload |
+ *     +-------+---------+------+-----------------+-----------------+---------+
+ *
+ * and the payload of the end frame is a digest of the frames before it - the
+ * number of frames (u64 BE) and the SHA-256 of their payloads, in order:
+ *
+ *     +------------------+-------------------+
+ *     | nframes (u64 BE) | sha256 (32 bytes) |
+ *     +------------------+-------------------+
+ *
+ * The payload of version 2 error frames is a msgpack map with the kind of
+ * failure (code), the error message, and the index of the task that failed
+ * (task), or -1 when the failure is not that of a task:
+ *
+ *     { "code": "task-failed", "message": "3/8: ...", "task": 3 }
+ *
+ * see ErrorInfo and the Error* codes.
+ *
+ * A stream without the end frame is incomplete in either version.
+ */
+package frame
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	Magic    = 0xd5
+	Version1 = 1
+	Version2 = 2
+	/*
+	 * The size of the frame header, in bytes, in the versions
+	 */
+	HeaderSize1 = 7
+	HeaderSize2 = 11
+	/*
+	 * The size of the digest in version 2 end frames
+	 */
+	DigestSize = 8 + sha256.Size
+	/*
+	 * The size of the progress frame payload
+	 */
+	ProgressSize = 16
+)
+
+var crctable = crc32.MakeTable(crc32.Castagnoli)
+
+type Type uint8
+
+const (
+	Header    Type = 1
+	Tile      Type = 2
+	Error     Type = 3
+	End       Type = 4
+	Cursor    Type = 5
+	Keepalive Type = 6
+	Progress  Type = 7
+)
+
+func (t Type) String() string {
+	switch t {
+	case Header:    return "header"
+	case Tile:      return "tile"
+	case Error:     return "error"
+	case End:       return "end"
+	case Cursor:    return "cursor"
+	case Keepalive: return "keepalive"
+	case Progress:  return "progress"
+	default:        return fmt.Sprintf("Type(%d)", uint8(t))
+	}
+}
+
+/*
+ * The kinds of failure in the error frames of version 2 streams, see
+ * ErrorInfo
+ */
+const (
+	/*
+	 * A task of the process failed, so the result can never be completed
+	 */
+	ErrorTaskFailed = "task-failed"
+	/*
+	 * The stream ran out of time
+	 */
+	ErrorTimeout = "timeout"
+	/*
+	 * Any other failure on the server, e.g. a corrupted partial result or
+	 * lost connection to storage
+	 */
+	ErrorInternal = "internal"
+)
+
+type Frame struct {
+	/*
+	 * The version of the frame, as read by Decoder
+	 */
+	Version byte
+	Type    Type
+	Payload []byte
+}
+
+/*
+ * The payload of progress frames - bundle of bundles sent, and the bytes of
+ * the result sent so far.
+ */
+type ProgressInfo struct {
+	Bundle  uint32
+	Bundles uint32
+	Bytes   uint64
+}
+
+func (p ProgressInfo) Pack() []byte {
+	payload := make([]byte, ProgressSize)
+	binary.BigEndian.PutUint32(payload[0:], p.Bundle)
+	binary.BigEndian.PutUint32(payload[4:], p.Bundles)
+	binary.BigEndian.PutUint64(payload[8:], p.Bytes)
+	return payload
+}
+
+func UnpackProgress(payload []byte) (ProgressInfo, error) {
+	if len(payload) != ProgressSize {
+		return ProgressInfo{}, &FormatError {
+			Reason: fmt.Sprintf(
+				"progress frame has %d bytes; want %d",
+				len(payload),
+				ProgressSize,
+			),
+		}
+	}
+	return ProgressInfo {
+		Bundle:  binary.BigEndian.Uint32(payload[0:]),
+		Bundles: binary.BigEndian.Uint32(payload[4:]),
+		Bytes:   binary.BigEndian.Uint64(payload[8:]),
+	}, nil
+}
+
+/*
+ * The payload of error frames - the kind of failure, the error message, and
+ * the index of the task that failed, or -1.
+ */
+type ErrorInfo struct {
+	Code    string `msgpack:"code"`
+	Message string `msgpack:"message"`
+	Task    int    `msgpack:"task"`
+}
+
+func (e ErrorInfo) Error() string {
+	return e.Message
+}
+
+func (e ErrorInfo) Pack() []byte {
+	payload, err := msgpack.Marshal(&e)
+	if err != nil {
+		/*
+		 * Marshalling a struct of strings and ints does not fail
+		 */
+		panic(err)
+	}
+	return payload
+}
+
+/*
+ * The error of the error frame f. Version 1 error frames only have the
+ * message, and no code or task.
+ */
+func UnpackError(f *Frame) (ErrorInfo, error) {
+	if f.Type != Error {
+		return ErrorInfo{}, fmt.Errorf("%s frame is not an error frame", f.Type)
+	}
+	if f.Version == Version1 {
+		return ErrorInfo { Message: string(f.Payload), Task: -1 }, nil
+	}
+
+	info := ErrorInfo { Task: -1 }
+	if err := msgpack.Unmarshal(f.Payload, &info); err != nil {
+		return ErrorInfo{}, &FormatError {
+			Reason: "bad error frame payload",
+			Err:    err,
+		}
+	}
+	return info, nil
+}
+
+/*
+ * FormatError is the error for malformed frames - bad magic, unsupported
+ * version, unknown type or a frame cut short.
+ */
+type FormatError struct {
+	Reason string
+	/*
+	 * The underlying error, if any, e.g. io.ErrUnexpectedEOF
+	 */
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("malformed frame: %s: %v", e.Reason, e.Err)
+	}
+	return fmt.Sprintf("malformed frame: %s", e.Reason)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+/*
+ * IntegrityError is the error for version 2 streams that are well-formed, but
+ * whose contents don't check out - a payload that doesn't match its checksum,
+ * or frames that don't match the digest in the end frame.
+ */
+type IntegrityError struct {
+	Reason string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("corrupted stream: %s", e.Reason)
+}
+
+/*
+ * The number of frames and the running SHA-256 of their payloads, for the
+ * end frame of version 2 streams
+ */
+type digest struct {
+	nframes uint64
+	sha     hash.Hash
+}
+
+func newDigest() *digest {
+	return &digest { sha: sha256.New() }
+}
+
+func (d *digest) add(payload []byte) {
+	d.nframes++
+	d.sha.Write(payload)
+}
+
+func (d *digest) sum() []byte {
+	sum := make([]byte, 8, DigestSize)
+	binary.BigEndian.PutUint64(sum, d.nframes)
+	return d.sha.Sum(sum)
+}
+
+type Encoder struct {
+	w       io.Writer
+	version byte
+	digest  *digest
+	/*
+	 * The frame header, reused for every frame
+	 */
+	head    [HeaderSize2]byte
+}
+
+/*
+ * Make an encoder for frames of version, which must be Version1 or Version2.
+ */
+func NewEncoder(w io.Writer, version byte) *Encoder {
+	return &Encoder {
+		w:       w,
+		version: version,
+		digest:  newDigest(),
+	}
+}
+
+/*
+ * Write a frame of type t with payload. The header and payload are written
+ * separately, so the payload is never copied.
+ *
+ * In version 2, the payload of the end frame is always the digest of the
+ * frames written so far, and the payload given is ignored. Keepalive frames
+ * are not part of the digest.
+ */
+func (e *Encoder) Encode(t Type, payload []byte) error {
+	if uint64(len(payload)) > uint64(^uint32(0)) {
+		return fmt.Errorf("frame payload too large (%d bytes)", len(payload))
+	}
+
+	var head []byte
+	switch e.version {
+	case Version1:
+		head = e.head[:HeaderSize1]
+	case Version2:
+		if t == End {
+			payload = e.digest.sum()
+		}
+		if t != Keepalive {
+			e.digest.add(payload)
+		}
+		head = e.head[:HeaderSize2]
+		binary.BigEndian.PutUint32(head[7:], crc32.Checksum(payload, crctable))
+	default:
+		return fmt.Errorf("unsupported frame version %d", e.version)
+	}
+
+	head[0] = Magic
+	head[1] = e.version
+	head[2] = byte(t)
+	binary.BigEndian.PutUint32(head[3:], uint32(len(payload)))
+	if _, err := e.w.Write(head); err != nil {
+		return err
+	}
+	_, err := e.w.Write(payload)
+	return err
+}
+
+type Decoder struct {
+	r      io.Reader
+	digest *digest
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder { r: r, digest: newDigest() }
+}
+
+/*
+ * Read the next frame, of either version, skipping keepalive frames. At the
+ * end of the input, between frames, Decode returns io.EOF. Input that ends
+ * mid-frame is a *FormatError.
+ *
+ * Version 2 frames are checked against their checksum, and the end frame
+ * against the frames read before it, and those that don't check out are an
+ * *IntegrityError.
+ */
+func (d *Decoder) Decode() (*Frame, error) {
+	for {
+		f, err := d.decode()
+		if err != nil || f.Type != Keepalive {
+			return f, err
+		}
+	}
+}
+
+func (d *Decoder) decode() (*Frame, error) {
+	var head [HeaderSize2]byte
+	_, err := io.ReadFull(d.r, head[:HeaderSize1])
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, truncated(err)
+	}
+
+	if head[0] != Magic {
+		return nil, &FormatError {
+			Reason: fmt.Sprintf("bad magic byte 0x%02x", head[0]),
+		}
+	}
+	version := head[1]
+	if version != Version1 && version != Version2 {
+		return nil, &FormatError {
+			Reason: fmt.Sprintf("unsupported version %d", head[1]),
+		}
+	}
+	t := Type(head[2])
+	if t < Header || t > Progress {
+		return nil, &FormatError {
+			Reason: fmt.Sprintf("unknown frame type %d", head[2]),
+		}
+	}
+	if version == Version2 {
+		_, err := io.ReadFull(d.r, head[HeaderSize1:])
+		if err != nil {
+			return nil, truncated(err)
+		}
+	}
+
+	length := binary.BigEndian.Uint32(head[3:])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(d.r, payload); err != nil {
+		return nil, truncated(err)
+	}
+
+	if version == Version2 {
+		if err := d.verify(t, head[7:], payload); err != nil {
+			return nil, err
+		}
+	}
+	return &Frame { Version: version, Type: t, Payload: payload }, nil
+}
+
+func (d *Decoder) verify(t Type, crc []byte, payload []byte) error {
+	want := binary.BigEndian.Uint32(crc)
+	if got := crc32.Checksum(payload, crctable); got != want {
+		return &IntegrityError {
+			Reason: fmt.Sprintf(
+				"%s frame %d: crc32c = %08x; want %08x",
+				t,
+				d.digest.nframes,
+				got,
+				want,
+			),
+		}
+	}
+
+	if t == Keepalive {
+		return nil
+	}
+	if t == End {
+		if sum := d.digest.sum(); !bytes.Equal(payload, sum) {
+			return &IntegrityError {
+				Reason: fmt.Sprintf(
+					"end frame digest does not match the %d frames read",
+					d.digest.nframes,
+				),
+			}
+		}
+	}
+	d.digest.add(payload)
+	return nil
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &FormatError {
+			Reason: "truncated",
+			Err:    io.ErrUnexpectedEOF,
+		}
+	}
+	return err
+}
@@ -0,0 +1,309 @@
+package frame
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := []Frame {
+		{ Type: Header, Payload: []byte("header") },
+		{ Type: Tile,   Payload: []byte("tile-0") },
+		{ Type: Cursor, Payload: []byte("1-1") },
+		{ Type: Tile,   Payload: []byte{} },
+		{ Type: Error,  Payload: []byte("failed") },
+		{ Type: End,    Payload: []byte{} },
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, Version1)
+	for _, f := range frames {
+		if err := enc.Encode(f.Type, f.Payload); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	for i, want := range frames {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Type != want.Type {
+			t.Errorf("frame %d: type = %v; want %v", i, got.Type, want.Type)
+		}
+		if !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("frame %d: payload = %q; want %q", i, got.Payload, want.Payload)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("err = %v; want io.EOF", err)
+	}
+}
+
+func TestFrameHeaderLayout(t *testing.T) {
+	var buf bytes.Buffer
+	NewEncoder(&buf, Version1).Encode(Tile, []byte("ab"))
+	want := []byte { Magic, Version1, byte(Tile), 0, 0, 0, 2, 'a', 'b' }
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("frame = %v; want %v", buf.Bytes(), want)
+	}
+}
+
+func TestMalformedFrames(t *testing.T) {
+	cases := map[string][]byte {
+		"bad magic":         { 0x00, Version1, byte(Tile), 0, 0, 0, 0 },
+		"bad version":       { Magic, 9, byte(Tile), 0, 0, 0, 0 },
+		"bad type":          { Magic, Version1, 0, 0, 0, 0, 0 },
+		"truncated header":  { Magic, Version1, byte(Tile) },
+		"truncated payload": { Magic, Version1, byte(Tile), 0, 0, 0, 4, 'a' },
+	}
+
+	for name, doc := range cases {
+		_, err := NewDecoder(bytes.NewReader(doc)).Decode()
+		var ferr *FormatError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: err = %v; want *FormatError", name, err)
+		}
+	}
+}
+
+func TestTruncatedFrameIsUnexpectedEOF(t *testing.T) {
+	doc := []byte { Magic, Version1, byte(Tile), 0, 0, 0, 4, 'a' }
+	_, err := NewDecoder(bytes.NewReader(doc)).Decode()
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("err = %v; want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func encodeV2(t *testing.T, frames []Frame) []byte {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, Version2)
+	for _, f := range frames {
+		if err := enc.Encode(f.Type, f.Payload); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func decodeAll(doc []byte) ([]*Frame, error) {
+	frames := make([]*Frame, 0)
+	dec := NewDecoder(bytes.NewReader(doc))
+	for {
+		f, err := dec.Decode()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+var v2frames = []Frame {
+	{ Type: Header, Payload: []byte("header") },
+	{ Type: Tile,   Payload: []byte("tile-0") },
+	{ Type: Cursor, Payload: []byte("1-1") },
+	{ Type: Tile,   Payload: []byte("tile-1") },
+	{ Type: Cursor, Payload: []byte("1-2") },
+	{ Type: End,    Payload: nil },
+}
+
+func TestVersion2RoundTrip(t *testing.T) {
+	frames, err := decodeAll(encodeV2(t, v2frames))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(frames) != len(v2frames) {
+		t.Fatalf("got %d frames; want %d", len(frames), len(v2frames))
+	}
+	for i, want := range v2frames[:len(v2frames) - 1] {
+		if frames[i].Type != want.Type || !bytes.Equal(frames[i].Payload, want.Payload) {
+			t.Errorf("frame %d = %v %q; want %v %q",
+				i, frames[i].Type, frames[i].Payload, want.Type, want.Payload)
+		}
+	}
+
+	end := frames[len(frames) - 1]
+	if len(end.Payload) != DigestSize {
+		t.Fatalf("end frame payload is %d bytes; want %d", len(end.Payload), DigestSize)
+	}
+	if n := end.Payload[7]; n != byte(len(v2frames) - 1) {
+		t.Errorf("end frame nframes = %d; want %d", n, len(v2frames) - 1)
+	}
+}
+
+func TestVersion2DetectsCorruptedByte(t *testing.T) {
+	doc := encodeV2(t, v2frames)
+	at := bytes.Index(doc, []byte("tile-1")) + 2
+	doc[at] ^= 0x01
+
+	frames, err := decodeAll(doc)
+	var ierr *IntegrityError
+	if !errors.As(err, &ierr) {
+		t.Fatalf("err = %v; want *IntegrityError", err)
+	}
+	if len(frames) != 3 {
+		t.Errorf("got %d frames before the corruption; want 3", len(frames))
+	}
+}
+
+func TestVersion2DetectsDroppedFrame(t *testing.T) {
+	/*
+	 * Drop the second tile and its cursor, which are all fine on their own
+	 */
+	doc := encodeV2(t, v2frames)
+	first := bytes.Index(doc, []byte("tile-1")) - HeaderSize2
+	last := bytes.Index(doc, []byte("1-2")) + len("1-2")
+	doc = append(doc[:first:first], doc[last:]...)
+
+	_, err := decodeAll(doc)
+	var ierr *IntegrityError
+	if !errors.As(err, &ierr) {
+		t.Errorf("err = %v; want *IntegrityError", err)
+	}
+}
+
+func TestVersion2TruncatedHeader(t *testing.T) {
+	doc := encodeV2(t, v2frames[:1])
+	_, err := decodeAll(doc[:HeaderSize1 + 2])
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("err = %v; want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestDecoderSkipsKeepalives(t *testing.T) {
+	for _, version := range []byte { Version1, Version2 } {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, version)
+		enc.Encode(Keepalive, nil)
+		enc.Encode(Header, []byte("header"))
+		enc.Encode(Keepalive, nil)
+		enc.Encode(Keepalive, nil)
+		enc.Encode(Tile, []byte("tile-0"))
+		enc.Encode(Keepalive, nil)
+		enc.Encode(End, nil)
+		enc.Encode(Keepalive, nil)
+
+		frames, err := decodeAll(buf.Bytes())
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		types := make([]Type, len(frames))
+		for i, f := range frames {
+			types[i] = f.Type
+		}
+		want := []Type { Header, Tile, End }
+		if len(types) != len(want) {
+			t.Fatalf("version %d: frames = %v; want %v", version, types, want)
+		}
+		for i := range want {
+			if types[i] != want[i] {
+				t.Errorf("version %d: frames = %v; want %v", version, types, want)
+				break
+			}
+		}
+	}
+}
+
+func TestKeepaliveLayout(t *testing.T) {
+	var buf bytes.Buffer
+	NewEncoder(&buf, Version1).Encode(Keepalive, nil)
+	want := []byte { Magic, Version1, byte(Keepalive), 0, 0, 0, 0 }
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("frame = %v; want %v", buf.Bytes(), want)
+	}
+}
+
+func TestProgressRoundTrip(t *testing.T) {
+	want := ProgressInfo { Bundle: 3, Bundles: 10, Bytes: 1 << 33 }
+	for _, version := range []byte { Version1, Version2 } {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, version)
+		enc.Encode(Header, []byte("header"))
+		enc.Encode(Progress, want.Pack())
+		enc.Encode(End, nil)
+
+		frames, err := decodeAll(buf.Bytes())
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if frames[1].Type != Progress {
+			t.Fatalf("version %d: frame = %s; want progress", version, frames[1].Type)
+		}
+		got, err := UnpackProgress(frames[1].Payload)
+		if err != nil {
+			t.Fatalf("version %d: %v", version, err)
+		}
+		if got != want {
+			t.Errorf("version %d: progress = %+v; want %+v", version, got, want)
+		}
+	}
+}
+
+func TestUnpackProgressRejectsShortPayload(t *testing.T) {
+	_, err := UnpackProgress(make([]byte, ProgressSize - 1))
+	var formatError *FormatError
+	if !errors.As(err, &formatError) {
+		t.Errorf("err = %v; want *FormatError", err)
+	}
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	want := ErrorInfo {
+		Code:    ErrorTaskFailed,
+		Message: "3/8: fragment not found",
+		Task:    3,
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf, Version2)
+	enc.Encode(Header, []byte("header"))
+	enc.Encode(Error, want.Pack())
+
+	frames, err := decodeAll(buf.Bytes())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	got, err := UnpackError(frames[1])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got != want {
+		t.Errorf("error = %+v; want %+v", got, want)
+	}
+}
+
+func TestUnpackVersion1Error(t *testing.T) {
+	var buf bytes.Buffer
+	NewEncoder(&buf, Version1).Encode(Error, []byte("failed"))
+
+	frames, err := decodeAll(buf.Bytes())
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	got, err := UnpackError(frames[0])
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	want := ErrorInfo { Message: "failed", Task: -1 }
+	if got != want {
+		t.Errorf("error = %+v; want %+v", got, want)
+	}
+}
+
+func TestUnpackErrorRejectsOtherFrames(t *testing.T) {
+	frames := []*Frame {
+		{ Version: Version2, Type: Tile, Payload: []byte("tile") },
+		{ Version: Version2, Type: Error, Payload: []byte("not msgpack") },
+	}
+	for _, f := range frames {
+		if _, err := UnpackError(f); err == nil {
+			t.Errorf("%s frame %q: expected error", f.Type, f.Payload)
+		}
+	}
+}
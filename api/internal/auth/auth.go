@@ -1,13 +1,17 @@
 package auth
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
 	"time"
 
 	"github.com/form3tech-oss/jwt-go"
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
 )
 
 /*
@@ -22,25 +26,272 @@ import (
  */
 type Keyring struct {
 	key []byte
+	/*
+	 * The algorithm tokens are signed with, and the keys to sign and verify
+	 * them. This is HS256 with the pre-shared key for both, unless
+	 * configured with WithSigningMethod.
+	 */
+	method    jwt.SigningMethod
+	signkey   interface {}
+	verifykey interface {}
+	/*
+	 * The name of the claim that carries the pid. This is "pid" for tokens
+	 * made by oneseismic, but can be changed to interoperate with tokens from
+	 * other issuers, or to avoid collisions with their claims.
+	 */
+	claim string
+	/*
+	 * How long tokens made by Sign are valid.
+	 */
+	ttl time.Duration
+	/*
+	 * The minimum key length accepted by NewKeyring.
+	 */
+	minKeyLength int
+	/*
+	 * How far off the clocks of the token issuer and this service can be,
+	 * see WithLeeway.
+	 */
+	leeway time.Duration
+	/*
+	 * The tokens already validated, see WithCacheSize. This is a pointer, so
+	 * that copies of the keyring share the cache.
+	 */
+	cache     *tokenCache
+	cacheSize int
+	/*
+	 * The revoked pids, see WithRevocations and Revoke. When nil, no tokens
+	 * are revoked.
+	 */
+	revocations redis.Cmdable
+	/*
+	 * The logger of ResultAuth, see WithLogger. Nil means the default.
+	 */
+	logger *logging.Logger
+}
+
+/*
+ * The default lifetime of tokens. This is enough for most queries, but large
+ * extractions may take longer to assemble than this.
+ */
+const DefaultTTL = 5 * time.Minute
+
+/*
+ * The default minimum length of signing keys, in bytes. HS256 keys should be
+ * at least as long as the hash (256 bits), or the signatures become easier to
+ * brute-force than the hash itself.
+ */
+const DefaultMinKeyLength = 32
+
+/*
+ * The default clock skew tolerated when validating tokens. Keep it small -
+ * it extends the lifetime of every token.
+ */
+const DefaultLeeway = 30 * time.Second
+
+/*
+ * Validate fails with this error (wrapped) for tokens that were valid for the
+ * pid, but have expired. This is different from a token that was never valid,
+ * as the process it refers to probably existed, but its results are likely
+ * gone.
+ */
+var ErrTokenExpired = errors.New("token expired")
+
+/*
+ * Options for MakeKeyring, for when the defaults are not good enough.
+ */
+type KeyringOption func(*Keyring)
+
+/*
+ * Use a different claim than "pid" to carry the pid in the tokens.
+ */
+func WithPidClaim(claim string) KeyringOption {
+	return func(k *Keyring) {
+		k.claim = claim
+	}
+}
+
+/*
+ * Make Sign issue tokens that are valid for ttl. A zero ttl means the
+ * DefaultTTL.
+ */
+func WithTTL(ttl time.Duration) KeyringOption {
+	return func(k *Keyring) {
+		k.ttl = ttl
+	}
+}
+
+/*
+ * Require signing keys of at least n bytes in NewKeyring.
+ */
+func WithMinKeyLength(n int) KeyringOption {
+	return func(k *Keyring) {
+		k.minKeyLength = n
+	}
+}
+
+/*
+ * Tolerate clocks that are off by up to leeway when checking the exp, nbf and
+ * iat claims of tokens, i.e. a token is accepted until leeway after it
+ * expired, and from leeway before it is valid. Zero means no tolerance, which
+ * is only reasonable when the tokens are made and validated on the same host.
+ */
+func WithLeeway(leeway time.Duration) KeyringOption {
+	return func(k *Keyring) {
+		k.leeway = leeway
+	}
+}
+
+/*
+ * Keep up to n validated tokens, so that Validate only checks the signature
+ * of a token once, and not on every request. Tokens are kept until they
+ * expire, or are pushed out by more recently used ones. Zero disables the
+ * cache.
+ */
+func WithCacheSize(n int) KeyringOption {
+	return func(k *Keyring) {
+		k.cacheSize = n
+	}
+}
+
+/*
+ * Sign and validate tokens with method, rather than HS256 with the pre-shared
+ * key. This is mainly for asymmetric methods, e.g. RS256 with the private key
+ * to sign and the public key to verify, so that services that only validate
+ * tokens don't need the secret to make them. These services can leave
+ * signkey nil, and will then fail to Sign.
+ *
+ * Only tokens signed with method are accepted by Validate, regardless of
+ * what the token header says.
+ */
+func WithSigningMethod(
+	method    jwt.SigningMethod,
+	signkey   interface {},
+	verifykey interface {},
+) KeyringOption {
+	return func(k *Keyring) {
+		k.method = method
+		k.signkey = signkey
+		k.verifykey = verifykey
+	}
+}
+
+/*
+ * Log rejected requests and warnings about the key to logger, rather than the
+ * default logger.
+ */
+func WithLogger(logger *logging.Logger) KeyringOption {
+	return func(k *Keyring) {
+		k.logger = logger
+	}
+}
+
+/*
+ * A stupid constructor function, really only to hide the key field. It does
+ * not validate the key at all, and happily accepts weak or even empty keys,
+ * which makes it convenient for tests. Programs should use NewKeyring.
+ */
+func MakeKeyring(key []byte, options ...KeyringOption) Keyring {
+	k := Keyring {
+		key:          key,
+		claim:        "pid",
+		minKeyLength: DefaultMinKeyLength,
+		leeway:       DefaultLeeway,
+		cacheSize:    DefaultCacheSize,
+	}
+	for _, option := range options {
+		option(&k)
+	}
+	k.cache = newTokenCache(k.cacheSize)
+	if k.method == nil {
+		k.method = jwt.SigningMethodHS256
+		k.signkey = key
+		k.verifykey = key
+	}
+	if k.ttl == 0 {
+		k.ttl = DefaultTTL
+	}
+	return k
+}
+
+/*
+ * Make a keyring, but fail if the key is shorter than the minimum length (see
+ * WithMinKeyLength). Keys that are long enough, but look like they have little
+ * entropy, e.g. a repeated character, are accepted with a warning - there's no
+ * reliable way to tell a weak key from a strong one.
+ *
+ * With an asymmetric signing method (see WithSigningMethod), key is unused,
+ * and it's the verification key that must be given.
+ */
+func NewKeyring(key []byte, options ...KeyringOption) (*Keyring, error) {
+	k := MakeKeyring(key, options...)
+	if k.method.Alg() == jwt.SigningMethodNone.Alg() {
+		return nil, fmt.Errorf("tokens must be signed; got signing method none")
+	}
+	if _, hmac := k.method.(*jwt.SigningMethodHMAC); !hmac {
+		if k.verifykey == nil {
+			return nil, fmt.Errorf(
+				"no verification key for signing method %s",
+				k.method.Alg(),
+			)
+		}
+		return &k, nil
+	}
+
+	if len(key) < k.minKeyLength {
+		return nil, fmt.Errorf(
+			"signing key too short; got %d bytes, want at least %d",
+			len(key),
+			k.minKeyLength,
+		)
+	}
+
+	if entropy(key) < minKeyEntropy {
+		k.logger.Warn("signing key looks weak (low entropy); consider a random key")
+	}
+	return &k, nil
 }
 
 /*
- * A stupid constructor function, really only to hide the key field and maybe
- * at some point do validation.
+ * Keys with fewer bits of entropy per byte (as estimated by entropy()) than
+ * this are considered weak. Random printable keys are around 5-6 bits per
+ * byte (for hex it's 4), whereas words and repeated patterns are far below.
  */
-func MakeKeyring(key []byte) Keyring {
-	return Keyring {
-		key: key,
+const minKeyEntropy = 3.0
+
+/*
+ * An estimate of the Shannon entropy of the key, in bits per byte, from the
+ * frequency of the byte values. This does not catch *all* weak keys, e.g. a
+ * sentence from a book, but it catches the really bad ones.
+ */
+func entropy(key []byte) float64 {
+	if len(key) == 0 {
+		return 0
+	}
+
+	var freq [256]int
+	for _, b := range key {
+		freq[b]++
+	}
+	n := float64(len(key))
+	h := 0.0
+	for _, f := range freq {
+		if f == 0 {
+			continue
+		}
+		p := float64(f) / n
+		h -= p * math.Log2(p)
 	}
+	return h
 }
 
 /*
- * Sign with the default timeout - in practice, this is the only sign function
+ * Sign with the keyring's timeout (see WithTTL) - in practice, this is the only sign function
  * there should be a need for, and gives a single point for updates, bugfixes
  * and reasonable configuration.
  */
 func (k *Keyring) Sign(pid string) (string, error) {
-	expiration := time.Now().Add(5 * time.Minute)
+	expiration := time.Now().Add(k.ttl)
 	return k.SignWithTimeout(pid, expiration)
 }
 
@@ -55,33 +306,141 @@ func (r *Keyring) SignWithTimeout(
 	exp time.Time,
 ) (string, error) {
 	claims := &jwt.MapClaims {
-		"pid": pid,
-		"exp": exp.Unix(),
+		r.claim: pid,
+		"iat":   time.Now().Unix(),
+		"exp":   exp.Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(r.key)
+	if r.signkey == nil {
+		return "", fmt.Errorf("no key to sign tokens with %s", r.method.Alg())
+	}
+	token := jwt.NewWithClaims(r.method, claims)
+	return token.SignedString(r.signkey)
+}
+
+/*
+ * Check the exp, iat and nbf claims, like jwt.MapClaims.Valid, but with
+ * leeway for clock skew. Like in jwt-go, the claims are optional, and the
+ * failures are reported as a *jwt.ValidationError.
+ */
+func verifyTimes(claims jwt.Claims, leeway time.Duration) error {
+	m, ok := claims.(jwt.MapClaims)
+	if !ok {
+		return fmt.Errorf("expected 'claims' of type jwt.MapClaims; was %T", claims)
+	}
+
+	now := jwt.TimeFunc()
+	early := now.Add(leeway).Unix()
+	late := now.Add(-leeway).Unix()
+
+	verr := &jwt.ValidationError {}
+	if !m.VerifyExpiresAt(late, false) {
+		verr.Inner = errors.New("Token is expired")
+		verr.Errors |= jwt.ValidationErrorExpired
+	}
+	if !m.VerifyIssuedAt(early, false) {
+		verr.Inner = errors.New("Token used before issued")
+		verr.Errors |= jwt.ValidationErrorIssuedAt
+	}
+	if !m.VerifyNotBefore(early, false) {
+		verr.Inner = errors.New("Token is not valid yet")
+		verr.Errors |= jwt.ValidationErrorNotValidYet
+	}
+	if verr.Errors != 0 {
+		return verr
+	}
+	return nil
 }
 
 /*
  * Validate a key - if this function returns nil, the token is valid for
- * accessing the result and status of the process $pid.
+ * accessing the result and status of the process $pid. Tokens for revoked
+ * pids fail with ErrTokenRevoked.
  */
 func (r *Keyring) Validate(tokenstr string, pid string) error {
+	now := jwt.TimeFunc()
+	if hit, ok := r.cache.get(tokenstr, now); ok && hit.pid == pid {
+		/*
+		 * Revocations are checked even for cached tokens, as the pid may
+		 * have been revoked (by any instance) since the token was cached
+		 */
+		return r.revoked(pid)
+	}
+
+	exp, err := r.validate(tokenstr, pid)
+	if err != nil {
+		return err
+	}
+	if err := r.revoked(pid); err != nil {
+		return err
+	}
+	if now.Before(exp) {
+		r.cache.add(tokenstr, pid, exp)
+	}
+	return nil
+}
+
+/*
+ * Validate the token, without the cache, and get when it expires. Tokens
+ * without exp get the zero time, and are never cached.
+ */
+func (r *Keyring) validate(tokenstr string, pid string) (time.Time, error) {
+	var never time.Time
 	/*
 	 * The jwt library is built around having multiple keys available, and
 	 * choosing the right one from the token header (see the key-id (kid) logic
-	 * in this module). This is not used currently, and it's only the
-	 * pre-shared key in play. This may certainly change in the future, in
+	 * in this module). This is not used currently, and it's only the one
+	 * verification key in play. This may certainly change in the future, in
 	 * which case it's the keyfunc that's responsible for picking out and
 	 * returning the right key.
+	 *
+	 * The algorithm in the token header is chosen by whoever made the token,
+	 * so it must be the keyring's own method. Otherwise, a token with
+	 * alg: none would need no signature at all, and a token signed with HS256
+	 * would be checked with the (public) RS256 verification key as the
+	 * shared secret.
 	 */
 	keyfunc := func (t *jwt.Token) (interface {}, error) {
-		return r.key, nil
+		/*
+		 * Unsigned tokens are never valid, not even for a keyring that was
+		 * (mis)configured to use none
+		 */
+		if t.Method.Alg() == jwt.SigningMethodNone.Alg() {
+			return nil, fmt.Errorf("unsigned token (alg: none)")
+		}
+		if t.Method.Alg() != r.method.Alg() {
+			return nil, fmt.Errorf(
+				"unexpected signing method %v; want %s",
+				t.Header["alg"],
+				r.method.Alg(),
+			)
+		}
+		return r.verifykey, nil
+	}
+	parser := jwt.Parser {
+		ValidMethods:         []string { r.method.Alg() },
+		SkipClaimsValidation: true,
+	}
+	token, err := parser.Parse(tokenstr, keyfunc)
+	if err == nil {
+		err = verifyTimes(token.Claims, r.leeway)
+	}
+
+	/*
+	 * jwt-go checks the signature even when the token has expired, so a token
+	 * that fails *only* on being expired is genuine. It's reported as expired
+	 * only if it was issued for this pid, otherwise it's just invalid.
+	 */
+	var verr *jwt.ValidationError
+	if errors.As(err, &verr) && verr.Errors == jwt.ValidationErrorExpired {
+		claims, ok := token.Claims.(jwt.MapClaims)
+		if ok && claims[r.claim] == pid {
+			return never, fmt.Errorf("%w: %v", ErrTokenExpired, err)
+		}
+		return never, fmt.Errorf("token with invalid pid; got %v", claims[r.claim])
 	}
-	token, err := jwt.Parse(tokenstr, keyfunc)
 
 	if err != nil {
-		return err
+		return never, err
 	}
 
 	if token.Valid {
@@ -98,7 +457,7 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
 		claims, ok := token.Claims.(jwt.MapClaims)
 		if !ok {
 			msg := "expected 'claims' of type jwt.MapClaims; was %T"
-			return fmt.Errorf(msg, claims)
+			return never, fmt.Errorf(msg, claims)
 		}
 
 		/*
@@ -112,14 +471,17 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
 		 * possible to use a valid token for a different process to both pass
 		 * the signature check *and* the string comparison.
 		 */
-		tokenpid := claims["pid"]
-		if tokenpid == pid {
-			return nil
+		tokenpid := claims[r.claim]
+		if tokenpid != pid {
+			return never, fmt.Errorf("token with invalid pid; got %v", tokenpid)
+		}
+		if exp, ok := claims["exp"].(float64); ok {
+			return time.Unix(int64(exp), 0), nil
 		}
-		return fmt.Errorf("token with invalid pid; got %v", tokenpid)
+		return never, nil
 	}
 
-	return fmt.Errorf("Keyring.Validate fell through; This is a logic error")
+	return never, fmt.Errorf("Keyring.Validate fell through; This is a logic error")
 }
 
 /*
@@ -135,13 +497,33 @@ func (r *Keyring) Validate(tokenstr string, pid string) error {
  *
  * That way, only the one who made the request can query the status or get the
  * result.
+ *
+ * Requests with expired tokens get 410 Gone rather than 403 Forbidden - the
+ * token was good, but the process is so old that its results have most likely
+ * expired too, and the client should make the query again.
+ *
+ * Browsers can't set headers on WebSocket or EventSource requests, so the
+ * token can be passed as ?token= instead on the routes that serve those, see
+ * WithQueryToken. This is not accepted by default, since the query string ends
+ * up in access logs and browser history far more often than headers do.
  */
-func ResultAuth(keyring *Keyring) gin.HandlerFunc {
+func ResultAuth(keyring *Keyring, options ...ResultAuthOption) gin.HandlerFunc {
+	config := resultAuthConfig {}
+	for _, option := range options {
+		option(&config)
+	}
+
 	return func (ctx *gin.Context) {
 		pid := ctx.Param("pid")
+		logger := keyring.logger.With("pid", pid)
 		authorization := ctx.GetHeader("Authorization")
+		if authorization == "" && config.queryToken {
+			if token := ctx.Query("token"); token != "" {
+				authorization = "Bearer " + token
+			}
+		}
 		if authorization == "" {
-			log.Printf("%s No Authorization header", pid)
+			logger.Info("rejected", "error", "no Authorization header")
 			/*
 			 * MDN docs
 			 * --------
@@ -158,11 +540,7 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 		token := ""
 		_, err := fmt.Sscanf(authorization, "Bearer %s", &token)
 		if err != nil {
-			log.Printf(
-				"%s malformed header Authorization; was %s",
-				pid,
-				authorization,
-			)
+			logger.Info("rejected", "error", "malformed Authorization header")
 			/*
 			 * Malformed authorization header - not quite sure if this is
 			 * Unauthorized, BadRequest or some other status code. Unauthorized
@@ -174,9 +552,37 @@ func ResultAuth(keyring *Keyring) gin.HandlerFunc {
 		}
 
 		err = keyring.Validate(token, pid)
+		if errors.Is(err, ErrTokenExpired) {
+			logger.Info("rejected", "error", err)
+			ctx.AbortWithStatusJSON(http.StatusGone, gin.H {
+				"error": "token expired",
+			})
+			return
+		}
 		if err != nil {
-			log.Printf("%s %v", pid, err)
+			logger.Info("rejected", "error", err)
 			ctx.AbortWithStatus(http.StatusForbidden)
 		}
 	}
 }
+
+type resultAuthConfig struct {
+	queryToken bool
+}
+
+/*
+ * Options for ResultAuth, which are set per route.
+ */
+type ResultAuthOption func(*resultAuthConfig)
+
+/*
+ * Accept the token as ?token= when there is no Authorization header. Only use
+ * this on routes that serve clients which can't set headers, like WebSocket
+ * and EventSource in browsers.
+ */
+func WithQueryToken() ResultAuthOption {
+	return func(c *resultAuthConfig) {
+		c.queryToken = true
+	}
+}
+
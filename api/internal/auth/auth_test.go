@@ -1,6 +1,10 @@
 package auth
 
 import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +13,8 @@ import (
 
 	"github.com/form3tech-oss/jwt-go"
 	"github.com/gin-gonic/gin"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
 )
 
 func TestTokenSignRoundTrip(t *testing.T) {
@@ -123,3 +129,536 @@ func TestResultAuthTokens(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenWithCustomPidClaim(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key, WithPidClaim("job"))
+
+	pid := "pid"
+	token, err := keyring.Sign(pid)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	err = keyring.Validate(token, pid)
+	if err != nil {
+		t.Errorf("Expected valid token; got %v", err)
+	}
+
+	keyfunc := func (tok *jwt.Token) (interface {}, error) {
+		return key, nil
+	}
+	parsed, err := jwt.Parse(token, keyfunc)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	claims := parsed.Claims.(jwt.MapClaims)
+	if claims["job"] != pid {
+		t.Errorf("Expected pid in claim 'job'; claims were %v", claims)
+	}
+	if _, ok := claims["pid"]; ok {
+		t.Errorf("Expected no 'pid' claim; claims were %v", claims)
+	}
+}
+
+func TestCustomPidClaimRejectsDefaultClaim(t *testing.T) {
+	key := []byte("pre-shared-key")
+	defaultKeyring := MakeKeyring(key)
+	customKeyring  := MakeKeyring(key, WithPidClaim("job"))
+
+	pid := "pid"
+	token, err := defaultKeyring.Sign(pid)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	err = customKeyring.Validate(token, pid)
+	if err == nil {
+		t.Errorf("Expected token without the 'job' claim to be invalid")
+	}
+}
+
+/*
+ * Pretend it's later by moving the clock jwt-go validates against
+ */
+func withClockAhead(d time.Duration, fn func()) {
+	timefunc := jwt.TimeFunc
+	defer func() { jwt.TimeFunc = timefunc }()
+	jwt.TimeFunc = func() time.Time {
+		return time.Now().Add(d)
+	}
+	fn()
+}
+
+func TestTokenWithLongTTLOutlivesDefault(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key, WithTTL(time.Hour))
+
+	pid := "pid"
+	token, err := keyring.Sign(pid)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	withClockAhead(10 * time.Minute, func() {
+		err = keyring.Validate(token, pid)
+	})
+	if err != nil {
+		t.Errorf("Expected 1h token to be valid after 10m; %v", err)
+	}
+}
+
+func TestZeroTTLMeansDefault(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key, WithTTL(0))
+
+	pid := "pid"
+	token, err := keyring.Sign(pid)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	withClockAhead(DefaultTTL - time.Minute, func() {
+		err = keyring.Validate(token, pid)
+	})
+	if err != nil {
+		t.Errorf("Expected token to be valid before default TTL; %v", err)
+	}
+
+	withClockAhead(DefaultTTL + time.Minute, func() {
+		err = keyring.Validate(token, pid)
+	})
+	if err == nil {
+		t.Errorf("Expected token to be expired after default TTL")
+	}
+}
+
+func TestExpiredTokenIsDistinguishable(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	exp := time.Now().Add(-5 * time.Minute)
+	token, err := keyring.SignWithTimeout("pid", exp)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	err = keyring.Validate(token, "pid")
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v; want %v", err, ErrTokenExpired)
+	}
+
+	/*
+	 * An expired token for a different process is simply invalid
+	 */
+	err = keyring.Validate(token, "other-pid")
+	if err == nil || errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v; want invalid pid", err)
+	}
+}
+
+func TestExpiredTokenWithBadSignatureIsNotExpired(t *testing.T) {
+	keyringA := MakeKeyring([]byte("pre-shared-key"))
+	keyringB := MakeKeyring([]byte("pre-shared-diff-key"))
+	exp := time.Now().Add(-5 * time.Minute)
+	token, err := keyringA.SignWithTimeout("pid", exp)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	err = keyringB.Validate(token, "pid")
+	if err == nil || errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v; want invalid signature", err)
+	}
+}
+
+func TestTokenHasIssuedAt(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key)
+	before := time.Now().Unix()
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	claims := jwt.MapClaims {}
+	_, err = jwt.ParseWithClaims(token, claims, func (*jwt.Token) (interface {}, error) {
+		return key, nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok || int64(iat) < before {
+		t.Errorf("iat = %v; want >= %d", claims["iat"], before)
+	}
+}
+
+func TestResultAuthExpiredTokenIsGone(t *testing.T) {
+	keyring := MakeKeyring([]byte("psk"))
+	expired, err := keyring.SignWithTimeout("pid", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	w := httptest.NewRecorder()
+	_, r := gin.CreateTestContext(w)
+	r.GET("/result/:pid", ResultAuth(&keyring))
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid", nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", expired))
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusGone {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusGone)
+	}
+}
+
+func TestResultAuthLogsRejectionsWithPid(t *testing.T) {
+	var logs bytes.Buffer
+	keyring := MakeKeyring(
+		[]byte("psk"),
+		WithLogger(logging.New(&logs, logging.Info)),
+	)
+
+	w := httptest.NewRecorder()
+	_, r := gin.CreateTestContext(w)
+	r.GET("/result/:pid", ResultAuth(&keyring))
+	req, _ := http.NewRequest(http.MethodGet, "/result/some-pid", nil)
+	req.Header.Add("Authorization", "Bearer not-a-token")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusForbidden)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log %q is not a JSON line: %v", logs.String(), err)
+	}
+	if entry["msg"] != "rejected" || entry["pid"] != "some-pid" {
+		t.Errorf("log = %v; want rejected with pid some-pid", entry)
+	}
+	if bytes.Contains(logs.Bytes(), []byte("not-a-token")) {
+		t.Errorf("log = %s; token was logged", logs.String())
+	}
+}
+
+func TestResultAuthTokenInQueryOnlyWhenEnabled(t *testing.T) {
+	keyring := MakeKeyring([]byte("psk"))
+	good, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	cases := []struct {
+		options  []ResultAuthOption
+		upgrade  string
+		accept   string
+		expected int
+	} {
+		{ nil,                                     "",          "",                  http.StatusUnauthorized },
+		{ nil,                                     "",          "text/event-stream", http.StatusUnauthorized },
+		{ nil,                                     "websocket", "",                  http.StatusUnauthorized },
+		{ []ResultAuthOption { WithQueryToken() }, "",          "",                  http.StatusOK           },
+		{ []ResultAuthOption { WithQueryToken() }, "websocket", "",                  http.StatusOK           },
+		{ []ResultAuthOption { WithQueryToken() }, "",          "text/event-stream", http.StatusOK           },
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		_, r := gin.CreateTestContext(w)
+		r.GET("/result/:pid", ResultAuth(&keyring, c.options...))
+		req, _ := http.NewRequest(http.MethodGet, "/result/pid?token=" + good, nil)
+		if c.upgrade != "" {
+			req.Header.Add("Connection", "Upgrade")
+			req.Header.Add("Upgrade", c.upgrade)
+		}
+		if c.accept != "" {
+			req.Header.Add("Accept", c.accept)
+		}
+		r.ServeHTTP(w, req)
+		if w.Code != c.expected {
+			t.Errorf(
+				"options: %d, Upgrade: %q, Accept: %q status = %d; want %d",
+				len(c.options),
+				c.upgrade,
+				c.accept,
+				w.Code,
+				c.expected,
+			)
+		}
+	}
+}
+
+func TestResultAuthQueryTokenIsStillValidated(t *testing.T) {
+	keyring := MakeKeyring([]byte("psk"))
+	other, err := keyring.Sign("other-pid")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	w := httptest.NewRecorder()
+	_, r := gin.CreateTestContext(w)
+	r.GET("/result/:pid", ResultAuth(&keyring, WithQueryToken()))
+	req, _ := http.NewRequest(http.MethodGet, "/result/pid?token=" + other, nil)
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status = %d; want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestNewKeyringRejectsShortKey(t *testing.T) {
+	for _, key := range []string { "", "short-key" } {
+		_, err := NewKeyring([]byte(key))
+		if err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+func TestNewKeyringAcceptsLongKey(t *testing.T) {
+	key := []byte("b1f0e3a9d772c4e58a9b6d2f01c3e7a4")
+	keyring, err := NewKeyring(key)
+	if err != nil {
+		t.Fatalf("expected %d byte key to be accepted; %v", len(key), err)
+	}
+
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := keyring.Validate(token, "pid"); err != nil {
+		t.Errorf("%v", err)
+	}
+}
+
+func TestNewKeyringCustomMinKeyLength(t *testing.T) {
+	key := []byte("b1f0e3a9d772c4e5")
+	if _, err := NewKeyring(key); err == nil {
+		t.Errorf("expected %d byte key to be rejected by default", len(key))
+	}
+	if _, err := NewKeyring(key, WithMinKeyLength(16)); err != nil {
+		t.Errorf("expected %d byte key to be accepted; %v", len(key), err)
+	}
+}
+
+func TestRepeatedKeyHasLowEntropy(t *testing.T) {
+	weak := bytes.Repeat([]byte("a"), 64)
+	if h := entropy(weak); h >= minKeyEntropy {
+		t.Errorf("entropy(%s) = %f; want < %f", weak, h, minKeyEntropy)
+	}
+
+	strong := []byte("b1f0e3a9d772c4e58a9b6d2f01c3e7a4")
+	if h := entropy(strong); h < minKeyEntropy {
+		t.Errorf("entropy(%s) = %f; want >= %f", strong, h, minKeyEntropy)
+	}
+}
+
+func TestLeewayAcceptsRecentlyExpiredTokens(t *testing.T) {
+	key := []byte("pre-shared-key")
+	exp := time.Now().Add(-30 * time.Second)
+
+	lenient := MakeKeyring(key, WithLeeway(time.Minute))
+	token, err := lenient.SignWithTimeout("pid", exp)
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+	if err := lenient.Validate(token, "pid"); err != nil {
+		t.Errorf("Expected token within leeway to be valid; %v", err)
+	}
+
+	strict := MakeKeyring(key, WithLeeway(0))
+	err = strict.Validate(token, "pid")
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v; want %v", err, ErrTokenExpired)
+	}
+}
+
+func TestLeewayAcceptsTokensIssuedAhead(t *testing.T) {
+	key := []byte("pre-shared-key")
+	keyring := MakeKeyring(key, WithLeeway(time.Minute))
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	/*
+	 * A clock that is behind sees the token as issued in the future
+	 */
+	withClockAhead(-30 * time.Second, func() {
+		err = keyring.Validate(token, "pid")
+	})
+	if err != nil {
+		t.Errorf("Expected token within leeway to be valid; %v", err)
+	}
+
+	strict := MakeKeyring(key, WithLeeway(0))
+	withClockAhead(-30 * time.Second, func() {
+		err = strict.Validate(token, "pid")
+	})
+	if err == nil {
+		t.Errorf("Expected token issued ahead to be invalid without leeway")
+	}
+}
+
+func TestSigningMethods(t *testing.T) {
+	rsakey := newRSAKey(t)
+	cases := []struct {
+		name    string
+		keyring Keyring
+	} {
+		{
+			"HS256",
+			MakeKeyring([]byte("pre-shared-key")),
+		},
+		{
+			"RS256",
+			MakeKeyring(nil, WithSigningMethod(
+				jwt.SigningMethodRS256,
+				rsakey,
+				&rsakey.PublicKey,
+			)),
+		},
+	}
+
+	for _, c := range cases {
+		token, err := c.keyring.Sign("pid")
+		if err != nil {
+			t.Fatalf("%s: Error creating token; %v", c.name, err)
+		}
+		parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims {})
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if alg := parsed.Header["alg"]; alg != c.name {
+			t.Errorf("%s: token alg = %v", c.name, alg)
+		}
+		if err := c.keyring.Validate(token, "pid"); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if err := c.keyring.Validate(token, "other-pid"); err == nil {
+			t.Errorf("%s: token validated for other pid", c.name)
+		}
+	}
+}
+
+/*
+ * A service with only the public key can validate, but not make, tokens
+ */
+func TestVerifyOnlyKeyring(t *testing.T) {
+	rsakey := newRSAKey(t)
+	signer := MakeKeyring(nil, WithSigningMethod(
+		jwt.SigningMethodRS256,
+		rsakey,
+		&rsakey.PublicKey,
+	))
+	verifier, err := NewKeyring(nil, WithSigningMethod(
+		jwt.SigningMethodRS256,
+		nil,
+		&rsakey.PublicKey,
+	))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	token, err := signer.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+	if err := verifier.Validate(token, "pid"); err != nil {
+		t.Errorf("%v", err)
+	}
+	if _, err := verifier.Sign("pid"); err == nil {
+		t.Errorf("Sign without signing key succeeded")
+	}
+}
+
+func TestNewKeyringRequiresVerificationKey(t *testing.T) {
+	_, err := NewKeyring(nil, WithSigningMethod(
+		jwt.SigningMethodRS256,
+		newRSAKey(t),
+		nil,
+	))
+	if err == nil {
+		t.Errorf("Expected keyring without verification key to fail")
+	}
+}
+
+func TestUnsignedTokenIsInvalid(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims {
+		"pid": "pid",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	unsigned, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := keyring.Validate(unsigned, "pid"); err == nil {
+		t.Errorf("Expected token with alg: none to be invalid")
+	}
+}
+
+func TestUnsignedTokenIsInvalidForNoneKeyring(t *testing.T) {
+	keyring := MakeKeyring(nil, WithSigningMethod(
+		jwt.SigningMethodNone,
+		jwt.UnsafeAllowNoneSignatureType,
+		jwt.UnsafeAllowNoneSignatureType,
+	))
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := keyring.Validate(token, "pid"); err == nil {
+		t.Errorf("Expected token with alg: none to be invalid")
+	}
+
+	_, err = NewKeyring(nil, WithSigningMethod(
+		jwt.SigningMethodNone,
+		jwt.UnsafeAllowNoneSignatureType,
+		jwt.UnsafeAllowNoneSignatureType,
+	))
+	if err == nil {
+		t.Errorf("Expected keyring with signing method none to fail")
+	}
+}
+
+func TestRS256TokenIsInvalidForHMACKeyring(t *testing.T) {
+	rsakey := newRSAKey(t)
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims {
+		"pid": "pid",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	signed, err := token.SignedString(rsakey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := keyring.Validate(signed, "pid"); err == nil {
+		t.Errorf("Expected RS256 token to be invalid for HS256 keyring")
+	}
+}
+
+/*
+ * The RS256 public key is, well, public, and must not be accepted as the
+ * secret of an HS256 token
+ */
+func TestAlgorithmConfusionIsRejected(t *testing.T) {
+	rsakey := newRSAKey(t)
+	public, err := x509.MarshalPKIXPublicKey(&rsakey.PublicKey)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	keyring := MakeKeyring(nil, WithSigningMethod(
+		jwt.SigningMethodRS256,
+		rsakey,
+		&rsakey.PublicKey,
+	))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims {
+		"pid": "pid",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	forged, err := token.SignedString(public)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := keyring.Validate(forged, "pid"); err == nil {
+		t.Errorf("Expected HS256 token to be invalid for RS256 keyring")
+	}
+}
@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+/*
+ * The default number of validated tokens kept by the Keyring, see
+ * WithCacheSize
+ */
+const DefaultCacheSize = 4096
+
+type cachedToken struct {
+	token string
+	pid   string
+	exp   time.Time
+}
+
+/*
+ * A least-recently-used cache of tokens that have been validated, with the
+ * pid they were valid for and when they expire. Clients poll /result
+ * frequently with the same token, and checking the signature every time is
+ * wasted work.
+ *
+ * Only successfully validated tokens are cached, so a cache hit can only ever
+ * grant access that a full validation would. A nil cache is valid, and
+ * caches nothing.
+ */
+type tokenCache struct {
+	mtx     sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+func newTokenCache(size int) *tokenCache {
+	if size <= 0 {
+		return nil
+	}
+	return &tokenCache {
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+/*
+ * Get the cached token, unless it has expired by now, in which case it's
+ * dropped so that it will be validated again
+ */
+func (c *tokenCache) get(token string, now time.Time) (cachedToken, bool) {
+	if c == nil {
+		return cachedToken {}, false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	elem, ok := c.entries[token]
+	if !ok {
+		return cachedToken {}, false
+	}
+	entry := elem.Value.(cachedToken)
+	if !now.Before(entry.exp) {
+		c.order.Remove(elem)
+		delete(c.entries, token)
+		return cachedToken {}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *tokenCache) add(token, pid string, exp time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry := cachedToken { token: token, pid: pid, exp: exp }
+	if elem, ok := c.entries[token]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[token] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(cachedToken).token)
+	}
+}
+
+func (c *tokenCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTokenCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := newTokenCache(2)
+	now := time.Now()
+	exp := now.Add(time.Minute)
+
+	cache.add("a", "pid-a", exp)
+	cache.add("b", "pid-b", exp)
+	if _, ok := cache.get("a", now); !ok {
+		t.Fatalf("a not cached")
+	}
+	cache.add("c", "pid-c", exp)
+
+	if _, ok := cache.get("b", now); ok {
+		t.Errorf("b cached; want evicted as least recently used")
+	}
+	for _, token := range []string { "a", "c" } {
+		if _, ok := cache.get(token, now); !ok {
+			t.Errorf("%s not cached", token)
+		}
+	}
+	if n := cache.len(); n != 2 {
+		t.Errorf("len = %d; want 2", n)
+	}
+}
+
+func TestTokenCacheDropsExpiredTokens(t *testing.T) {
+	cache := newTokenCache(2)
+	now := time.Now()
+	cache.add("token", "pid", now.Add(time.Second))
+
+	if _, ok := cache.get("token", now.Add(time.Second)); ok {
+		t.Errorf("expired token was a cache hit")
+	}
+	if n := cache.len(); n != 0 {
+		t.Errorf("len = %d; want expired token dropped", n)
+	}
+}
+
+func TestValidateCachesValidTokens(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	if err := keyring.Validate(token, "pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := keyring.cache.len(); n != 1 {
+		t.Errorf("cache has %d tokens; want 1", n)
+	}
+
+	/*
+	 * A cached token is still only valid for its own pid
+	 */
+	if err := keyring.Validate(token, "other-pid"); err == nil {
+		t.Errorf("cached token validated for other pid")
+	}
+	if err := keyring.Validate("not-a-token", "pid"); err == nil {
+		t.Errorf("invalid token validated")
+	}
+	if n := keyring.cache.len(); n != 1 {
+		t.Errorf("cache has %d tokens; want only the valid one", n)
+	}
+}
+
+func TestExpiredCachedTokenIsValidatedAgain(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"), WithLeeway(0))
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+	if err := keyring.Validate(token, "pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	withClockAhead(DefaultTTL + time.Minute, func() {
+		err = keyring.Validate(token, "pid")
+	})
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v; want %v", err, ErrTokenExpired)
+	}
+}
+
+func TestZeroCacheSizeDisablesCache(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"), WithCacheSize(0))
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+	if err := keyring.Validate(token, "pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if n := keyring.cache.len(); n != 0 {
+		t.Errorf("cache has %d tokens; want disabled", n)
+	}
+}
+
+func benchmarkValidate(b *testing.B, cacheSize int) {
+	keyring := MakeKeyring(
+		[]byte("pre-shared-key"),
+		WithCacheSize(cacheSize),
+	)
+	tokens := make([]string, 64)
+	for i := range tokens {
+		token, err := keyring.Sign(fmt.Sprintf("pid-%d", i))
+		if err != nil {
+			b.Fatalf("%v", err)
+		}
+		tokens[i] = token
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			n := i % len(tokens)
+			if err := keyring.Validate(tokens[n], fmt.Sprintf("pid-%d", n)); err != nil {
+				b.Error(err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkValidateUncached(b *testing.B) {
+	benchmarkValidate(b, 0)
+}
+
+func BenchmarkValidateCached(b *testing.B) {
+	benchmarkValidate(b, DefaultCacheSize)
+}
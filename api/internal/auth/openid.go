@@ -1,13 +1,20 @@
 package auth
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math/big"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/form3tech-oss/jwt-go"
+
+	"github.com/equinor/oneseismic/api/internal/logging"
 )
 
 /*
@@ -161,6 +168,10 @@ func fromB64(b64 string) (big.Int, error) {
  */
 type OpenIDConfig struct {
 	Jwks          map[string]rsa.PublicKey
+	/*
+	 * Where the keys were fetched from, for refreshing them, see KeySet
+	 */
+	JwksURI       string
 	Issuer        string
 	TokenEndpoint string
 }
@@ -212,6 +223,27 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 	 * certainly fail if there are no RSA keys, but arguably the function
 	 * succeeds with a good response even without any RSA keys in the key set
 	 */
+	keys := rsaKeys(keyset, nil)
+
+	err = nil
+	if len(keys) == 0 {
+		err = &noRSAKeys{}
+		logging.Default().Warn("no RSA keys", "keyset", keyset)
+	}
+
+	return &OpenIDConfig {
+		Jwks:          keys,
+		JwksURI:       oidc.JwksURI,
+		Issuer:        oidc.Issuer,
+		TokenEndpoint: oidc.TokenEndpoint,
+	}, err
+}
+
+/*
+ * The RSA keys in the key set, by key ID. Keys that don't meet the
+ * expectations of GetOpenIDConfig are skipped, and logged to logger.
+ */
+func rsaKeys(keyset []jwk, logger *logging.Logger) map[string]rsa.PublicKey {
 	keys := make(map[string]rsa.PublicKey)
 	for _, key := range keyset {
 		if key.Kty == "RSA" {
@@ -220,21 +252,21 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 			 * so skip it and look for other viable keys.
 			 */
 	                if key.E == "" {
-				log.Printf("missing field 'e'")
+				logger.Warn("skipping key", "kid", key.Kid, "error", "missing field 'e'")
 				continue
 	                }
 	                if key.N == "" {
-				log.Printf("missing field 'n'")
+				logger.Warn("skipping key", "kid", key.Kid, "error", "missing field 'n'")
 				continue
 	                }
 			e, err := fromB64(key.E)
 			if err != nil {
-				log.Printf("Key.E (id = %s): %v", key.Kid, err)
+				logger.Warn("skipping key", "kid", key.Kid, "error", err)
 				continue
 			}
 			n, err := fromB64(key.N)
 			if err != nil {
-				log.Printf("Key.N (id = %s): %v", key.Kid, err)
+				logger.Warn("skipping key", "kid", key.Kid, "error", err)
 				continue
 			}
 
@@ -245,15 +277,228 @@ func GetOpenIDConfig(c HttpClient, authserver string) (*OpenIDConfig, error) {
 		}
 	}
 
-	err = nil
+	return keys
+}
+
+/*
+ * The RSA keys of an OpenID provider, by key ID (kid), kept fresh by
+ * refetching them from the provider's JWKS URI. Providers rotate their keys,
+ * and a static set of keys would eventually turn down tokens signed with new
+ * keys, until the service is restarted.
+ *
+ * Failing to fetch the keys is not fatal - the keys already fetched are kept
+ * until the next successful refresh, since keys are usually valid long after
+ * new ones are published.
+ */
+type KeySet struct {
+	client HttpClient
+	uri    string
+	/*
+	 * Optional - where failed refreshes are logged. Nil means the default.
+	 */
+	Logger *logging.Logger
+
+	mtx  sync.RWMutex
+	keys map[string]rsa.PublicKey
+}
+
+/*
+ * Make a key set, with the keys already fetched from uri, e.g. by
+ * GetOpenIDConfig
+ */
+func NewKeySet(
+	c    HttpClient,
+	uri  string,
+	keys map[string]rsa.PublicKey,
+) *KeySet {
+	return &KeySet {
+		client: c,
+		uri:    uri,
+		keys:   keys,
+	}
+}
+
+/*
+ * Fetch the keys, and replace the current ones with them. A response without
+ * any usable RSA keys is treated as a failure, and the current keys are kept.
+ */
+func (ks *KeySet) Refresh() error {
+	keyset, err := getWebKeySet(ks.client, ks.uri)
+	if err != nil {
+		return fmt.Errorf("Refreshing keyset: %w", err)
+	}
+
+	keys := rsaKeys(keyset, ks.Logger)
 	if len(keys) == 0 {
-		err = &noRSAKeys{}
-		log.Printf("Keyset: %v", keyset)
+		return &noRSAKeys{}
 	}
 
-	return &OpenIDConfig {
-		Jwks:          keys,
-		Issuer:        oidc.Issuer,
-		TokenEndpoint: oidc.TokenEndpoint,
-	}, err
+	ks.mtx.Lock()
+	defer ks.mtx.Unlock()
+	ks.keys = keys
+	return nil
+}
+
+/*
+ * Refresh the keys every interval, until ctx is done
+ */
+func (ks *KeySet) RefreshEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := ks.Refresh(); err != nil {
+				ks.Logger.Warn(
+					"keeping cached keys",
+					"error", err,
+					"keys",  ks.len(),
+				)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ks *KeySet) len() int {
+	ks.mtx.RLock()
+	defer ks.mtx.RUnlock()
+	return len(ks.keys)
+}
+
+/*
+ * Get the key with the key ID kid
+ */
+func (ks *KeySet) Lookup(kid string) (*rsa.PublicKey, bool) {
+	ks.mtx.RLock()
+	defer ks.mtx.RUnlock()
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, false
+	}
+	return &key, true
+}
+
+/*
+ * The jwt.Keyfunc for validating RS256 (or other RSA) tokens against the
+ * current keys, by the kid in the token header
+ */
+func (ks *KeySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("token has no kid")
+	}
+	key, ok := ks.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", kid)
+	}
+	return key, nil
+}
+
+/*
+ * Check that the token is issued by issuer, for (at least) one of the
+ * audiences. The same API can be fronted by several app registrations, each
+ * with its own audience, e.g. in multi-tenant deployments.
+ */
+func verifyIssuerAudience(
+	claims    jwt.MapClaims,
+	issuer    string,
+	audiences []string,
+) error {
+	if !claims.VerifyIssuer(issuer, true) {
+		return fmt.Errorf("token issued by %v; want %s", claims["iss"], issuer)
+	}
+
+	/*
+	 * The aud claim is either a single audience or an array of them [1].
+	 * jwt-go's VerifyAudience only understands []string, which is not what
+	 * decoding an array gives, so the claim is picked apart here.
+	 *
+	 * [1] https://tools.ietf.org/html/rfc7519#section-4.1.3
+	 */
+	var claimed []interface{}
+	switch aud := claims["aud"].(type) {
+	case string:
+		claimed = []interface{} { aud }
+	case []interface{}:
+		claimed = aud
+	}
+	for _, aud := range audiences {
+		for _, c := range claimed {
+			if c == aud {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf(
+		"token for audience %v; want one of %v",
+		claims["aud"],
+		audiences,
+	)
+}
+
+/*
+ * Validate a token from the OpenID provider - if this function returns nil,
+ * the token is signed by one of the keys, has not expired, and is issued by
+ * issuer for one of the audiences. It is an error to not accept any
+ * audiences.
+ *
+ * The provider's clock is likely not quite in sync with ours, so the times in
+ * the token are checked with leeway, see WithLeeway. DefaultLeeway is a good
+ * choice.
+ */
+func ValidateJWT(
+	tokenstr  string,
+	keys      *KeySet,
+	issuer    string,
+	leeway    time.Duration,
+	audiences ...string,
+) (jwt.MapClaims, error) {
+	if len(audiences) == 0 {
+		return nil, fmt.Errorf("no audiences to validate against")
+	}
+
+	claims := jwt.MapClaims {}
+	parser := jwt.Parser { SkipClaimsValidation: true }
+	_, err := parser.ParseWithClaims(tokenstr, claims, keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyTimes(claims, leeway); err != nil {
+		return nil, err
+	}
+
+	if err := verifyIssuerAudience(claims, issuer, audiences); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+/*
+ * Check if the token has the scope. Delegated tokens carry their scopes in
+ * the scp claim, separated by spaces, and application tokens carry them in
+ * the roles claim, as an array [1].
+ *
+ * [1] https://docs.microsoft.com/en-us/azure/active-directory/develop/access-tokens#payload-claims
+ */
+func HasScope(claims jwt.MapClaims, scope string) bool {
+	if scp, ok := claims["scp"].(string); ok {
+		for _, s := range strings.Fields(scp) {
+			if s == scope {
+				return true
+			}
+		}
+	}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			if role == scope {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -2,11 +2,21 @@ package auth
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/form3tech-oss/jwt-go"
 )
 
 type singleResponseClient struct {
@@ -192,3 +202,277 @@ func TestOpenIDConfigWithoutKeys(t *testing.T) {
 		t.Errorf("Expected err to be noRSAKeys; was %#v", err)
 	}
 }
+
+/*
+ * A JWKS endpoint that serves the public keys in keys, which tests can rotate
+ * by replacing them
+ */
+type jwksServer struct {
+	mtx    sync.Mutex
+	keys   map[string]*rsa.PrivateKey
+	status int
+}
+
+func (s *jwksServer) rotate(keys map[string]*rsa.PrivateKey) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.keys = keys
+}
+
+func (s *jwksServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.status != 0 {
+		w.WriteHeader(s.status)
+		return
+	}
+
+	doc := map[string][]map[string]string { "keys": {} }
+	for kid, key := range s.keys {
+		e := big.NewInt(int64(key.E)).Bytes()
+		doc["keys"] = append(doc["keys"], map[string]string {
+			"kty": "RSA",
+			"kid": kid,
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(e),
+		})
+	}
+	json.NewEncoder(w).Encode(doc)
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return key
+}
+
+func signRS256(t *testing.T, kid string, key *rsa.PrivateKey) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims {
+		"sub": "user",
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return signed
+}
+
+func TestKeySetRefreshPicksUpRotatedKeys(t *testing.T) {
+	old := newRSAKey(t)
+	rotated := newRSAKey(t)
+	jwks := &jwksServer { keys: map[string]*rsa.PrivateKey { "old": old } }
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	ks := NewKeySet(http.DefaultClient, server.URL, nil)
+	if err := ks.Refresh(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := jwt.Parse(signRS256(t, "old", old), ks.Keyfunc); err != nil {
+		t.Errorf("token signed with old key: %v", err)
+	}
+
+	newtoken := signRS256(t, "new", rotated)
+	if _, err := jwt.Parse(newtoken, ks.Keyfunc); err == nil {
+		t.Errorf("token signed with rotated key validated before refresh")
+	}
+
+	jwks.rotate(map[string]*rsa.PrivateKey { "new": rotated })
+	if err := ks.Refresh(); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := jwt.Parse(newtoken, ks.Keyfunc); err != nil {
+		t.Errorf("token signed with rotated key: %v", err)
+	}
+	if _, err := jwt.Parse(signRS256(t, "old", old), ks.Keyfunc); err == nil {
+		t.Errorf("token signed with retired key validated after refresh")
+	}
+}
+
+func TestKeySetKeepsCachedKeysOnFailure(t *testing.T) {
+	key := newRSAKey(t)
+	jwks := &jwksServer { keys: map[string]*rsa.PrivateKey { "kid": key } }
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	ks := NewKeySet(http.DefaultClient, server.URL, nil)
+	if err := ks.Refresh(); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	failures := []func() {
+		func() { jwks.status = http.StatusInternalServerError },
+		func() { jwks.status = 0; jwks.keys = nil },
+	}
+	for _, fail := range failures {
+		jwks.mtx.Lock()
+		fail()
+		jwks.mtx.Unlock()
+		if err := ks.Refresh(); err == nil {
+			t.Errorf("expected refresh to fail")
+		}
+		if _, err := jwt.Parse(signRS256(t, "kid", key), ks.Keyfunc); err != nil {
+			t.Errorf("cached key was dropped: %v", err)
+		}
+	}
+}
+
+func TestKeySetRefreshEvery(t *testing.T) {
+	rotated := newRSAKey(t)
+	jwks := &jwksServer {}
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ks := NewKeySet(http.DefaultClient, server.URL, nil)
+	go ks.RefreshEvery(ctx, 10 * time.Millisecond)
+
+	jwks.rotate(map[string]*rsa.PrivateKey { "new": rotated })
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := ks.Lookup("new"); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("rotated key not picked up by periodic refresh")
+}
+
+func TestKeySetRejectsOtherSigningMethods(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims {})
+	token.Header["kid"] = "kid"
+	signed, _ := token.SignedString([]byte("secret"))
+
+	ks := NewKeySet(http.DefaultClient, "", nil)
+	if _, err := jwt.Parse(signed, ks.Keyfunc); err == nil {
+		t.Errorf("HS256 token validated against RSA key set")
+	}
+}
+
+func signClaims(
+	t      *testing.T,
+	kid    string,
+	key    *rsa.PrivateKey,
+	claims jwt.MapClaims,
+) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return signed
+}
+
+func TestValidateJWTAcceptsAnyAudience(t *testing.T) {
+	key := newRSAKey(t)
+	ks := NewKeySet(nil, "", map[string]rsa.PublicKey { "kid": key.PublicKey })
+	issuer := "https://issuer"
+	audiences := []string { "api://first", "api://second" }
+
+	cases := []struct {
+		aud   interface{}
+		valid bool
+	} {
+		{ "api://first",  true  },
+		{ "api://second", true  },
+		{ []string { "api://other", "api://second" }, true },
+		{ "api://other",  false },
+		{ nil,            false },
+	}
+	for _, c := range cases {
+		claims := jwt.MapClaims { "iss": issuer }
+		if c.aud != nil {
+			claims["aud"] = c.aud
+		}
+		token := signClaims(t, "kid", key, claims)
+		_, err := ValidateJWT(token, ks, issuer, DefaultLeeway, audiences...)
+		if c.valid && err != nil {
+			t.Errorf("aud = %v: %v", c.aud, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("aud = %v validated against %v", c.aud, audiences)
+		}
+	}
+}
+
+func TestValidateJWTSingleAudience(t *testing.T) {
+	key := newRSAKey(t)
+	ks := NewKeySet(nil, "", map[string]rsa.PublicKey { "kid": key.PublicKey })
+	claims := jwt.MapClaims { "iss": "https://issuer", "aud": "api://app" }
+	token := signClaims(t, "kid", key, claims)
+
+	got, err := ValidateJWT(token, ks, "https://issuer", DefaultLeeway, "api://app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got["aud"] != "api://app" {
+		t.Errorf("claims = %v", got)
+	}
+
+	if _, err := ValidateJWT(token, ks, "https://issuer", DefaultLeeway); err == nil {
+		t.Errorf("validated without any audiences")
+	}
+}
+
+func TestValidateJWTRejectsOtherIssuers(t *testing.T) {
+	key := newRSAKey(t)
+	ks := NewKeySet(nil, "", map[string]rsa.PublicKey { "kid": key.PublicKey })
+	claims := jwt.MapClaims { "iss": "https://other", "aud": "api://app" }
+	token := signClaims(t, "kid", key, claims)
+
+	if _, err := ValidateJWT(token, ks, "https://issuer", DefaultLeeway, "api://app"); err == nil {
+		t.Errorf("token from other issuer validated")
+	}
+}
+
+func TestValidateJWTLeeway(t *testing.T) {
+	key := newRSAKey(t)
+	ks := NewKeySet(nil, "", map[string]rsa.PublicKey { "kid": key.PublicKey })
+	now := time.Now()
+	cases := []struct {
+		name   string
+		claims jwt.MapClaims
+	} {
+		{ "expired", jwt.MapClaims { "exp": now.Add(-30 * time.Second).Unix() } },
+		{ "not yet valid", jwt.MapClaims { "nbf": now.Add(30 * time.Second).Unix() } },
+		{ "issued ahead", jwt.MapClaims { "iat": now.Add(30 * time.Second).Unix() } },
+	}
+	for _, c := range cases {
+		c.claims["iss"] = "https://issuer"
+		c.claims["aud"] = "api://app"
+		token := signClaims(t, "kid", key, c.claims)
+
+		_, err := ValidateJWT(token, ks, "https://issuer", time.Minute, "api://app")
+		if err != nil {
+			t.Errorf("%s: rejected with 60s leeway: %v", c.name, err)
+		}
+		_, err = ValidateJWT(token, ks, "https://issuer", 0, "api://app")
+		if err == nil {
+			t.Errorf("%s: accepted without leeway", c.name)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	cases := []struct {
+		claims jwt.MapClaims
+		want   bool
+	} {
+		{ jwt.MapClaims { "scp": "One.Read One.Priority" }, true },
+		{ jwt.MapClaims { "scp": "One.Read" }, false },
+		{ jwt.MapClaims { "scp": "One.PriorityLevel" }, false },
+		{ jwt.MapClaims { "roles": []interface{} { "One.Priority" } }, true },
+		{ jwt.MapClaims { "roles": "One.Priority" }, false },
+		{ jwt.MapClaims {}, false },
+	}
+	for _, c := range cases {
+		if got := HasScope(c.claims, "One.Priority"); got != c.want {
+			t.Errorf("HasScope(%v) = %v; want %v", c.claims, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * Validate fails with this error (wrapped) for otherwise valid tokens for a
+ * pid that has been revoked, see Revoke.
+ */
+var ErrTokenRevoked = errors.New("token revoked")
+
+/*
+ * How long to wait for the revocation set before giving up. Validate runs on
+ * every request to /result, so it should not hang on a slow redis.
+ */
+const revocationTimeout = 2 * time.Second
+
+func revokedkey(pid string) string {
+	return fmt.Sprintf("%s/revoked", pid)
+}
+
+/*
+ * Keep the revocation set (see Revoke) in storage. Without it, Revoke fails
+ * and Validate never considers tokens revoked.
+ *
+ * The set is shared by all services using the same storage, so a pid revoked
+ * by one instance is rejected by all of them.
+ */
+func WithRevocations(storage redis.Cmdable) KeyringOption {
+	return func(k *Keyring) {
+		k.revocations = storage
+	}
+}
+
+/*
+ * Revoke all tokens for the pid, so that Validate rejects them from now on,
+ * even the ones that are already cached.
+ *
+ * The revocation is only kept for as long as tokens made by Sign are valid
+ * (plus the leeway), after which any token for the pid has expired anyway, so
+ * the set cleans itself up.
+ */
+func (r *Keyring) Revoke(pid string) error {
+	if r.revocations == nil {
+		return fmt.Errorf("unable to revoke %s; no revocation storage", pid)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), revocationTimeout)
+	defer cancel()
+	err := r.revocations.Set(ctx, revokedkey(pid), 1, r.ttl + r.leeway).Err()
+	if err != nil {
+		return fmt.Errorf("unable to revoke %s: %w", pid, err)
+	}
+	return nil
+}
+
+/*
+ * Check if the pid has been revoked. This fails closed, i.e. if the
+ * revocation set can't be read the pid is considered revoked, as there's no
+ * way of knowing it isn't.
+ */
+func (r *Keyring) revoked(pid string) error {
+	if r.revocations == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), revocationTimeout)
+	defer cancel()
+	n, err := r.revocations.Exists(ctx, revokedkey(pid)).Result()
+	if err != nil {
+		return fmt.Errorf("unable to check revocation of %s: %w", pid, err)
+	}
+	if n > 0 {
+		return fmt.Errorf("%w: %s", ErrTokenRevoked, pid)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * Just enough of redis for the revocation set, which records the expiration
+ * of keys rather than expiring them
+ */
+type fakeRevocations struct {
+	redis.Cmdable
+
+	mtx  sync.Mutex
+	keys map[string]time.Duration
+	err  error
+}
+
+func newFakeRevocations() *fakeRevocations {
+	return &fakeRevocations { keys: make(map[string]time.Duration) }
+}
+
+func (f *fakeRevocations) Set(
+	ctx        context.Context,
+	key        string,
+	value      interface{},
+	expiration time.Duration,
+) *redis.StatusCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return redis.NewStatusResult("", f.err)
+	}
+	f.keys[key] = expiration
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRevocations) Exists(
+	ctx  context.Context,
+	keys ...string,
+) *redis.IntCmd {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if f.err != nil {
+		return redis.NewIntResult(0, f.err)
+	}
+	n := int64(0)
+	for _, key := range keys {
+		if _, ok := f.keys[key]; ok {
+			n++
+		}
+	}
+	return redis.NewIntResult(n, nil)
+}
+
+func TestRevokedTokenIsRejected(t *testing.T) {
+	revocations := newFakeRevocations()
+	keyring := MakeKeyring(
+		[]byte("pre-shared-key"),
+		WithRevocations(revocations),
+	)
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+	other, err := keyring.Sign("other-pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	if err := keyring.Validate(token, "pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := keyring.Revoke("pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	/*
+	 * The token is cached by the first Validate, but must still be rejected
+	 */
+	err = keyring.Validate(token, "pid")
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("err = %v; want %v", err, ErrTokenRevoked)
+	}
+	if err := keyring.Validate(other, "other-pid"); err != nil {
+		t.Errorf("token for other pid rejected: %v", err)
+	}
+}
+
+func TestRevocationIsSharedBetweenKeyrings(t *testing.T) {
+	revocations := newFakeRevocations()
+	key := []byte("pre-shared-key")
+	revoker := MakeKeyring(key, WithRevocations(revocations))
+	validator := MakeKeyring(key, WithRevocations(revocations))
+
+	token, err := validator.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+	if err := revoker.Revoke("pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = validator.Validate(token, "pid")
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("err = %v; want %v", err, ErrTokenRevoked)
+	}
+}
+
+func TestRevocationExpiresWithTokens(t *testing.T) {
+	revocations := newFakeRevocations()
+	keyring := MakeKeyring(
+		[]byte("pre-shared-key"),
+		WithTTL(time.Minute),
+		WithLeeway(10 * time.Second),
+		WithRevocations(revocations),
+	)
+	if err := keyring.Revoke("pid"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	ttl, ok := revocations.keys[revokedkey("pid")]
+	if !ok {
+		t.Fatalf("pid not in revocation set")
+	}
+	if want := time.Minute + 10 * time.Second; ttl != want {
+		t.Errorf("revocation expires after %v; want %v", ttl, want)
+	}
+}
+
+func TestValidateFailsWhenRevocationsAreUnavailable(t *testing.T) {
+	revocations := newFakeRevocations()
+	keyring := MakeKeyring(
+		[]byte("pre-shared-key"),
+		WithRevocations(revocations),
+	)
+	token, err := keyring.Sign("pid")
+	if err != nil {
+		t.Fatalf("Error creating token; %v", err)
+	}
+
+	revocations.err = errors.New("connection refused")
+	if err := keyring.Validate(token, "pid"); err == nil {
+		t.Errorf("token validated without checking revocations")
+	}
+}
+
+func TestRevokeWithoutStorageFails(t *testing.T) {
+	keyring := MakeKeyring([]byte("pre-shared-key"))
+	if err := keyring.Revoke("pid"); err == nil {
+		t.Errorf("Revoke without storage succeeded")
+	}
+}
@@ -0,0 +1,185 @@
+/*
+ * Package logging is the structured logger of the API, writing one JSON
+ * object per line, with the time, level and message, and the fields of the
+ * logger and of the call:
+ *
+ *     {"time":"...","level":"info","msg":"finished","pid":"...","bytes":10}
+ *
+ * The fields are key-value pairs, where keys are strings and values anything
+ * that encodes as JSON. Errors are logged as their message.
+ *
+ * It is a thin layer over zap [1], which does the encoding and writing, so
+ * that the rest of the API logs with plain key-value pairs rather than typed
+ * zap fields.
+ *
+ * [1] https://pkg.go.dev/go.uber.org/zap
+ */
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug: return "debug"
+	case Info:  return "info"
+	case Warn:  return "warn"
+	case Error: return "error"
+	default:    return fmt.Sprintf("Level(%d)", int(l))
+	}
+}
+
+/*
+ * ParseLevel parses the names of the levels, as written in the logs.
+ */
+func ParseLevel(s string) (Level, error) {
+	for _, l := range []Level { Debug, Info, Warn, Error } {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+func (l Level) zap() zapcore.Level {
+	switch l {
+	case Debug: return zapcore.DebugLevel
+	case Warn:  return zapcore.WarnLevel
+	case Error: return zapcore.ErrorLevel
+	default:    return zapcore.InfoLevel
+	}
+}
+
+/*
+ * A Logger is safe for concurrent use. A nil *Logger logs to Default, so
+ * types that take an optional logger can use it without checking.
+ */
+type Logger struct {
+	zap *zap.Logger
+}
+
+var encoderConfig = zapcore.EncoderConfig {
+	TimeKey:        "time",
+	LevelKey:       "level",
+	MessageKey:     "msg",
+	LineEnding:     zapcore.DefaultLineEnding,
+	EncodeLevel:    zapcore.LowercaseLevelEncoder,
+	EncodeDuration: zapcore.StringDurationEncoder,
+	EncodeTime: func(t time.Time, enc zapcore.PrimitiveArrayEncoder) {
+		enc.AppendString(t.UTC().Format(time.RFC3339Nano))
+	},
+}
+
+/*
+ * A logger writing to w, discarding messages below level. Lines are written
+ * whole, so that concurrent loggers don't interleave.
+ */
+func New(w io.Writer, level Level) *Logger {
+	core := zapcore.NewCore(
+		zapcore.NewJSONEncoder(encoderConfig),
+		zapcore.Lock(zapcore.AddSync(w)),
+		level.zap(),
+	)
+	return &Logger { zap: zap.New(core) }
+}
+
+var std = New(os.Stderr, Info)
+
+/*
+ * The logger used by nil loggers, which writes to stderr unless replaced
+ * with SetDefault
+ */
+func Default() *Logger {
+	return std
+}
+
+/*
+ * Replace the default logger. This is meant to be called once on startup,
+ * before there's anything to log, e.g. to set the level from the command
+ * line.
+ */
+func SetDefault(l *Logger) {
+	std = l
+}
+
+/*
+ * A logger that adds the fields kv to every message, in addition to those of
+ * l.
+ */
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		l = std
+	}
+	return &Logger { zap: l.zap.With(fields(kv)...) }
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.get().Debug(msg, fields(kv)...) }
+func (l *Logger) Info (msg string, kv ...interface{}) { l.get().Info (msg, fields(kv)...) }
+func (l *Logger) Warn (msg string, kv ...interface{}) { l.get().Warn (msg, fields(kv)...) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.get().Error(msg, fields(kv)...) }
+
+/*
+ * Log at the fatal level, and exit with status 1. Only for startup, when
+ * the API can't run at all.
+ */
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.get().Fatal(msg, fields(kv)...)
+}
+
+func (l *Logger) get() *zap.Logger {
+	if l == nil {
+		return std.zap
+	}
+	return l.zap
+}
+
+/*
+ * The key-value pairs as zap fields. A key without a value is logged with
+ * the value null, rather than dropped, so that the mistake shows.
+ */
+func fields(kv []interface{}) []zap.Field {
+	fs := make([]zap.Field, 0, (len(kv) + 1) / 2)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if i + 1 < len(kv) {
+			fs = append(fs, zap.Any(key, value(kv[i + 1])))
+		} else {
+			fs = append(fs, zap.Reflect(key, nil))
+		}
+	}
+	return fs
+}
+
+/*
+ * Errors, Stringers and byte slices are logged as strings, rather than as
+ * zap would have them, i.e. errors with their verbose form and byte slices
+ * as base64.
+ */
+func value(v interface{}) interface{} {
+	switch x := v.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	case []byte:
+		return string(x)
+	default:
+		return v
+	}
+}
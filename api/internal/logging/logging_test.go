@@ -0,0 +1,142 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func decodeLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	lines := make([]map[string]interface{}, 0)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var doc map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &doc); err != nil {
+			t.Fatalf("line %q is not JSON: %v", line, err)
+		}
+		lines = append(lines, doc)
+	}
+	return lines
+}
+
+func TestLoggerWritesJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Info).With("pid", "some-pid")
+	logger.Info("finished", "bytes", 10, "ordered", true)
+	logger.Error("failed", "error", errors.New("bad \"tile\"\nend"))
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines; want 2", len(lines))
+	}
+	want := map[string]interface{} {
+		"level":   "info",
+		"msg":     "finished",
+		"pid":     "some-pid",
+		"bytes":   float64(10),
+		"ordered": true,
+	}
+	for key, value := range want {
+		if lines[0][key] != value {
+			t.Errorf("%s = %v; want %v", key, lines[0][key], value)
+		}
+	}
+	if _, ok := lines[0]["time"]; !ok {
+		t.Errorf("line has no time: %v", lines[0])
+	}
+	if lines[1]["level"] != "error" || lines[1]["error"] != "bad \"tile\"\nend" {
+		t.Errorf("line = %v; want error level with the error message", lines[1])
+	}
+	if lines[1]["pid"] != "some-pid" {
+		t.Errorf("pid = %v; want some-pid", lines[1]["pid"])
+	}
+}
+
+func TestLoggerDiscardsBelowLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Warn)
+	logger.Debug("debug")
+	logger.Info("info")
+	logger.Warn("warn")
+
+	lines := decodeLines(t, &buf)
+	if len(lines) != 1 || lines[0]["msg"] != "warn" {
+		t.Errorf("lines = %v; want only the warning", lines)
+	}
+}
+
+func TestWithDoesNotChangeParent(t *testing.T) {
+	var buf bytes.Buffer
+	parent := New(&buf, Info).With("a", 1)
+	parent.With("b", 2)
+	parent.Info("msg")
+
+	lines := decodeLines(t, &buf)
+	if _, ok := lines[0]["b"]; ok {
+		t.Errorf("line = %v; want no b from the child logger", lines[0])
+	}
+}
+
+func TestKeyWithoutValueIsNull(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, Info).Info("msg", "dangling")
+
+	lines := decodeLines(t, &buf)
+	value, ok := lines[0]["dangling"]
+	if !ok || value != nil {
+		t.Errorf("dangling = %v (%v); want null", value, ok)
+	}
+}
+
+func TestNilLoggerUsesDefault(t *testing.T) {
+	var buf bytes.Buffer
+	saved := std
+	std = New(&buf, Info)
+	defer func() { std = saved }()
+
+	var logger *Logger
+	logger.With("pid", "pid").Info("msg")
+	logger.Info("msg")
+
+	if n := len(decodeLines(t, &buf)); n != 2 {
+		t.Errorf("got %d lines; want 2", n)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level { Debug, Info, Warn, Error } {
+		got, err := ParseLevel(level.String())
+		if err != nil || got != level {
+			t.Errorf("ParseLevel(%s) = %v, %v", level, got, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("expected error for unknown level")
+	}
+}
+
+func TestBytesAreLoggedAsStrings(t *testing.T) {
+	var buf bytes.Buffer
+	New(&buf, Info).Info("msg", "header", []byte("doc"))
+
+	lines := decodeLines(t, &buf)
+	if lines[0]["header"] != "doc" {
+		t.Errorf("header = %v; want doc", lines[0]["header"])
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	var buf bytes.Buffer
+	saved := std
+	SetDefault(New(&buf, Debug))
+	defer SetDefault(saved)
+
+	Default().Debug("msg")
+	if n := len(decodeLines(t, &buf)); n != 1 {
+		t.Errorf("got %d lines; want 1", n)
+	}
+}
@@ -1,7 +1,11 @@
 package message
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
 
 	"github.com/vmihailenco/msgpack/v5"
 )
@@ -89,15 +93,59 @@ func (m *DimensionDescription) Pack() ([]byte, error) {
  * parse the response and properly pre-allocate buffers.
  */
 type ProcessHeader struct {
+	/*
+	 * The version of the result layout, see ResultVersion. Headers from
+	 * before the version was added have none, which unpacks as 0.
+	 */
+	Version int   `msgpack:"version"`
 	/*
 	 * The number of separate parts this is broken into, where each part can be
 	 * handled by a separate worker. This is the number of "bundles"
 	 * (parts-of-results) the client will receive.
 	 */
 	Ntasks int    `msgpack:"nbundles"`
+	/*
+	 * The function (kind of query) that produced this process, which
+	 * determines the layout of the bundles. See the Function* constants.
+	 */
+	Function int  `msgpack:"function"`
+	/*
+	 * The size of the complete result, in bytes, when the scheduler knows it
+	 * up front. Optional - zero means unknown.
+	 */
+	TotalBytes int64 `msgpack:"total-bytes,omitempty"`
+	/*
+	 * Set by the scheduler when the query selects nothing, e.g. a slice
+	 * outside the cube, so the result has no data. Optional - processes
+	 * without tasks are empty either way.
+	 */
+	Empty bool `msgpack:"empty,omitempty"`
 	RawHeader []byte
 }
 
+/*
+ * Check if the result is known to be empty from the header alone, see Empty
+ */
+func (m *ProcessHeader) IsEmpty() bool {
+	return m.Empty || m.Ntasks == 0
+}
+
+/*
+ * The version of the result layout the scheduler writes, announced in the
+ * process header (and so in the first part of every result). Corresponds to
+ * process_header::current_version in oneseismic/messages.hpp, and must be
+ * bumped with it when the on-wire layout changes.
+ */
+const ResultVersion = 1
+
+/*
+ * Corresponds to functionid in oneseismic/messages.hpp
+ */
+const (
+	FunctionSlice   = 1
+	FunctionCurtain = 2
+)
+
 func (m *ProcessHeader) Pack() ([]byte, error) {
 	return msgpack.Marshal(m);
 }
@@ -109,3 +157,166 @@ func (m *ProcessHeader) Unpack(doc []byte) (*ProcessHeader, error) {
 	// that follows immediately after
 	return m, msgpack.Unmarshal(doc[1:], m)
 }
+
+/*
+ * The sample values in the bundles are packed as msgpack bin of (little
+ * endian) float32, rather than as a msgpack array of floats. It's a lot faster
+ * to pack and parse, and much more compact.
+ */
+type Float32s []float32
+
+func (v *Float32s) DecodeMsgpack(dec *msgpack.Decoder) error {
+	b, err := dec.DecodeBytes()
+	if err != nil {
+		return err
+	}
+	if len(b) % 4 != 0 {
+		return fmt.Errorf("len(values) = %d; want multiple of 4", len(b))
+	}
+
+	xs := make([]float32, len(b) / 4)
+	for i := range xs {
+		xs[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	*v = xs
+	return nil
+}
+
+func (v Float32s) EncodeMsgpack(enc *msgpack.Encoder) error {
+	b := make([]byte, 4 * len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(x))
+	}
+	return enc.EncodeBytes(b)
+}
+
+/*
+ * The samples as a JSON array of numbers, formatted as float32 so that e.g.
+ * 0.1 stays 0.1, rather than the 0.10000000149011612 it would be as float64.
+ * JSON has no NaN or infinities, so non-finite samples (typically fill
+ * values) are null.
+ */
+func (v Float32s) MarshalJSON() ([]byte, error) {
+	b := make([]byte, 0, 2 + 10 * len(v))
+	b = append(b, '[')
+	for i, x := range v {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		f := float64(x)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			b = append(b, "null"...)
+			continue
+		}
+		/*
+		 * Like encoding/json, only very small and very large numbers get
+		 * an exponent
+		 */
+		format := byte('f')
+		if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+			format = 'e'
+		}
+		b = strconv.AppendFloat(b, f, format, -1, 32)
+	}
+	return append(b, ']'), nil
+}
+
+/*
+ * Corresponds to tile in oneseismic/messages.hpp. Tiles are packed as tuples
+ * (msgpack arrays), not maps, and the order of the fields must match the C++
+ * implementation.
+ */
+type Tile struct {
+	_msgpack    struct{} `msgpack:",as_array"`
+	Iterations  int      `json:"iterations"`
+	ChunkSize   int      `json:"chunk_size"`
+	InitialSkip int      `json:"initial_skip"`
+	Superstride int      `json:"superstride"`
+	Substride   int      `json:"substride"`
+	V           Float32s `json:"v"`
+}
+
+/*
+ * Corresponds to slice_tiles in oneseismic/messages.hpp, the bundle written
+ * by the workers for slice processes.
+ */
+type SliceTiles struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Attr     string   `json:"attr"`
+	Tiles    []Tile   `json:"tiles"`
+}
+
+func (m *SliceTiles) Pack() ([]byte, error) {
+	return msgpack.Marshal(m)
+}
+
+func (m *SliceTiles) Unpack(doc []byte) (*SliceTiles, error) {
+	return m, msgpack.Unmarshal(doc, m)
+}
+
+/*
+ * Corresponds to curtain_bundle in oneseismic/messages.hpp, the bundle written
+ * by the workers for curtain processes.
+ */
+type CurtainBundle struct {
+	_msgpack struct{} `msgpack:",as_array"`
+	Attr     string   `json:"attr"`
+	Size     int      `json:"size"`
+	Zlength  int      `json:"zlength"`
+	Major    []int    `json:"major"`
+	Minor    []int    `json:"minor"`
+	Values   Float32s `json:"values"`
+}
+
+func (m *CurtainBundle) Pack() ([]byte, error) {
+	return msgpack.Marshal(m)
+}
+
+func (m *CurtainBundle) Unpack(doc []byte) (*CurtainBundle, error) {
+	return m, msgpack.Unmarshal(doc, m)
+}
+
+/*
+ * Unpack a bundle into the type for the function of the process, i.e.
+ * SliceTiles or CurtainBundle
+ */
+func UnpackBundle(function int, doc []byte) (interface{}, error) {
+	switch function {
+	case FunctionSlice:
+		return (&SliceTiles{}).Unpack(doc)
+	case FunctionCurtain:
+		return (&CurtainBundle{}).Unpack(doc)
+	default:
+		return nil, fmt.Errorf("unknown function %d", function)
+	}
+}
+
+/*
+ * Get all the sample values of a bundle, regardless of layout. The layout
+ * (and the position of the samples in the final result) is determined by the
+ * function of the process.
+ */
+func BundleSamples(function int, doc []byte) ([]float32, error) {
+	switch function {
+	case FunctionSlice:
+		bundle, err := (&SliceTiles{}).Unpack(doc)
+		if err != nil {
+			return nil, err
+		}
+		samples := make([]float32, 0)
+		for _, tile := range bundle.Tiles {
+			samples = append(samples, tile.V...)
+		}
+		return samples, nil
+
+	case FunctionCurtain:
+		bundle, err := (&CurtainBundle{}).Unpack(doc)
+		if err != nil {
+			return nil, err
+		}
+		return bundle.Values, nil
+
+	default:
+		return nil, fmt.Errorf("unknown function %d", function)
+	}
+}
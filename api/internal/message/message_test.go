@@ -0,0 +1,175 @@
+package message
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestSliceTilesRoundTrip(t *testing.T) {
+	tiles := SliceTiles {
+		Attr: "data",
+		Tiles: []Tile {
+			{
+				Iterations:  2,
+				ChunkSize:   2,
+				InitialSkip: 1,
+				Superstride: 3,
+				Substride:   2,
+				V:           []float32{ 1, 2, 3, 4 },
+			},
+		},
+	}
+	packed, err := tiles.Pack()
+	assert.Nil(t, err)
+
+	unpacked, err := (&SliceTiles{}).Unpack(packed)
+	assert.Nil(t, err)
+	assert.Equal(t, tiles, *unpacked)
+}
+
+/*
+ * The C++ implementation packs the samples as bin of little-endian float32,
+ * so build that by hand rather than relying on the go encoder
+ */
+func TestCurtainBundleSamplesFromBin(t *testing.T) {
+	doc, err := msgpack.Marshal([]interface{} {
+		"data",
+		1,
+		2,
+		[]int{ 0, 1 },
+		[]int{ 0, 2 },
+		[]byte{ 0x00, 0x00, 0x80, 0x3f, 0x00, 0x00, 0x00, 0x40 },
+	})
+	assert.Nil(t, err)
+
+	samples, err := BundleSamples(FunctionCurtain, doc)
+	assert.Nil(t, err)
+	assert.Equal(t, []float32{ 1, 2 }, samples)
+}
+
+func TestBadSampleLengthFails(t *testing.T) {
+	doc, err := msgpack.Marshal([]interface{} {
+		"data", 1, 1, []int{}, []int{}, []byte{ 0x00, 0x00, 0x80 },
+	})
+	assert.Nil(t, err)
+
+	_, err = BundleSamples(FunctionCurtain, doc)
+	assert.NotNil(t, err)
+}
+
+func TestFloat32sAsJSON(t *testing.T) {
+	inf := float32(math.Inf(1))
+	nan := float32(math.NaN())
+	values := Float32s { 0.1, -2.5, 3, 1e-7, 1e22, 0, inf, nan }
+	doc, err := json.Marshal(values)
+	assert.Nil(t, err)
+	assert.Equal(t, `[0.1,-2.5,3,1e-07,1e+22,0,null,null]`, string(doc))
+
+	var roundtrip []*float32
+	assert.Nil(t, json.Unmarshal(doc, &roundtrip))
+	for i, x := range values[:6] {
+		assert.Equal(t, x, *roundtrip[i])
+	}
+}
+
+/*
+ * The process header is written by the scheduler with the envelope (array of
+ * 2) in front, see pack_with_envelope
+ */
+func withEnvelope(t *testing.T, header interface{}) []byte {
+	doc, err := msgpack.Marshal(header)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return append([]byte { 0x92 }, doc...)
+}
+
+func TestProcessHeaderVersionRoundTrip(t *testing.T) {
+	doc := withEnvelope(t, map[string]interface{} {
+		"version":  ResultVersion,
+		"pid":      "pid",
+		"function": FunctionSlice,
+		"nbundles": 3,
+	})
+
+	head, err := (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.Equal(t, ResultVersion, head.Version)
+	assert.Equal(t, 3, head.Ntasks)
+	assert.Equal(t, FunctionSlice, head.Function)
+
+	packed, err := head.Pack()
+	assert.Nil(t, err)
+	var repacked map[string]interface{}
+	assert.Nil(t, msgpack.Unmarshal(packed, &repacked))
+	assert.EqualValues(t, ResultVersion, repacked["version"])
+}
+
+func TestProcessHeaderWithoutVersion(t *testing.T) {
+	doc := withEnvelope(t, map[string]interface{} {
+		"pid":      "pid",
+		"function": FunctionCurtain,
+		"nbundles": 1,
+	})
+
+	head, err := (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, head.Version)
+	assert.Equal(t, 1, head.Ntasks)
+}
+
+func TestProcessHeaderTotalBytesIsOptional(t *testing.T) {
+	doc := withEnvelope(t, map[string]interface{} {
+		"function":    FunctionSlice,
+		"nbundles":    2,
+		"total-bytes": 4096,
+	})
+	head, err := (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4096, head.TotalBytes)
+
+	doc = withEnvelope(t, map[string]interface{} {
+		"function": FunctionSlice,
+		"nbundles": 2,
+	})
+	head, err = (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, head.TotalBytes)
+
+	packed, err := head.Pack()
+	assert.Nil(t, err)
+	var repacked map[string]interface{}
+	assert.Nil(t, msgpack.Unmarshal(packed, &repacked))
+	assert.NotContains(t, repacked, "total-bytes")
+}
+
+func TestProcessHeaderEmpty(t *testing.T) {
+	doc := withEnvelope(t, map[string]interface{} {
+		"function": FunctionSlice,
+		"nbundles": 2,
+		"empty":    true,
+	})
+	head, err := (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.True(t, head.IsEmpty())
+
+	doc = withEnvelope(t, map[string]interface{} {
+		"function": FunctionSlice,
+		"nbundles": 2,
+	})
+	head, err = (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.False(t, head.IsEmpty())
+
+	doc = withEnvelope(t, map[string]interface{} {
+		"function": FunctionSlice,
+		"nbundles": 0,
+	})
+	head, err = (&ProcessHeader{}).Unpack(doc)
+	assert.Nil(t, err)
+	assert.True(t, head.IsEmpty())
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * The priority of a job. Jobs are scheduled on one stream per priority, see
+ * JobStream, and the workers drain the streams of higher priority first, see
+ * JobQueue. The zero value is the normal priority.
+ */
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	PriorityLow
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "low":
+		return PriorityLow, nil
+	case "normal":
+		return PriorityNormal, nil
+	case "high":
+		return PriorityHigh, nil
+	default:
+		return PriorityNormal, fmt.Errorf(
+			"priority must be low, normal or high, was %s",
+			s,
+		)
+	}
+}
+
+/*
+ * The stream of the jobs of priority p. Normal jobs go on the base stream, so
+ * that workers that don't know about priorities still get them.
+ */
+func JobStream(base string, p Priority) string {
+	switch p {
+	case PriorityLow:
+		return base + ":low"
+	case PriorityHigh:
+		return base + ":high"
+	default:
+		return base
+	}
+}
+
+/*
+ * The job streams of base, in the order they should be drained
+ */
+func JobStreams(base string) []string {
+	return []string {
+		JobStream(base, PriorityHigh),
+		JobStream(base, PriorityNormal),
+		JobStream(base, PriorityLow),
+	}
+}
+
+/*
+ * The job streams of a worker group, which are read in order of priority. A
+ * job of lower priority is only read when there are no jobs of higher
+ * priority, but workers are not preempted, so long-running low priority jobs
+ * still hold up the workers that picked them up.
+ *
+ * Jobs are read with NOACK - losing a job when a worker crashes is acceptable.
+ */
+type JobQueue struct {
+	Storage  redis.Cmdable
+	Group    string
+	Consumer string
+	/*
+	 * The base name of the streams, see JobStream
+	 */
+	Stream string
+}
+
+/*
+ * Create the group on all the streams, if it does not already exist
+ */
+func (q *JobQueue) CreateGroups(ctx context.Context) error {
+	for _, stream := range JobStreams(q.Stream) {
+		err := q.Storage.XGroupCreateMkStream(ctx, stream, q.Group, "0").Err()
+		/*
+		 * A redis error (= BUSYGROUP) just means the group already exists
+		 */
+		_, busygroup := err.(interface{RedisError()})
+		if err != nil && !busygroup {
+			return fmt.Errorf(
+				"unable to create group %s for stream %s: %w",
+				q.Group,
+				stream,
+				err,
+			)
+		}
+	}
+	return nil
+}
+
+func (q *JobQueue) read(
+	ctx     context.Context,
+	streams []string,
+	block   bool,
+) ([]redis.XStream, error) {
+	args := redis.XReadGroupArgs {
+		Group:    q.Group,
+		Consumer: q.Consumer,
+		Count:    1,
+		Block:    -1,
+		NoAck:    true,
+	}
+	if block {
+		args.Block = 0
+	}
+	for _, stream := range streams {
+		args.Streams = append(args.Streams, stream)
+	}
+	for range streams {
+		args.Streams = append(args.Streams, ">")
+	}
+	return q.Storage.XReadGroup(ctx, &args).Result()
+}
+
+/*
+ * Read the next job, and block until there is one. The streams are polled in
+ * order of priority first, and if they're all empty, the read blocks on all
+ * of them. A blocking read can return a job from more than one stream, and
+ * the streams are then in order of priority.
+ */
+func (q *JobQueue) Next(ctx context.Context) ([]redis.XStream, error) {
+	streams := JobStreams(q.Stream)
+	for _, stream := range streams {
+		msgs, err := q.read(ctx, []string { stream }, false)
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return msgs, nil
+	}
+	return q.read(ctx, streams, true)
+}
@@ -0,0 +1,168 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+ * The job streams, in memory. Reads take the oldest messages of the streams,
+ * and blocking reads of empty streams are recorded and return nothing, rather
+ * than block.
+ */
+type fakeJobs struct {
+	redis.Cmdable
+	streams map[string][]redis.XMessage
+	groups  map[string]bool
+	blocked [][]string
+}
+
+func newFakeJobs() *fakeJobs {
+	return &fakeJobs {
+		streams: make(map[string][]redis.XMessage),
+		groups:  make(map[string]bool),
+	}
+}
+
+func (f *fakeJobs) add(stream string, id string) {
+	msg := redis.XMessage { ID: id }
+	f.streams[stream] = append(f.streams[stream], msg)
+}
+
+type busyGroup struct {}
+func (busyGroup) Error() string { return "BUSYGROUP group already exists" }
+func (busyGroup) RedisError() {}
+
+func (f *fakeJobs) XGroupCreateMkStream(
+	ctx    context.Context,
+	stream string,
+	group  string,
+	start  string,
+) *redis.StatusCmd {
+	if f.groups[stream] {
+		return redis.NewStatusResult("", busyGroup {})
+	}
+	f.groups[stream] = true
+	return redis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeJobs) XReadGroup(
+	ctx  context.Context,
+	args *redis.XReadGroupArgs,
+) *redis.XStreamSliceCmd {
+	streams := args.Streams[:len(args.Streams) / 2]
+
+	var reply []redis.XStream
+	for _, stream := range streams {
+		msgs := f.streams[stream]
+		n := int(args.Count)
+		if n > len(msgs) {
+			n = len(msgs)
+		}
+		if n == 0 {
+			continue
+		}
+		reply = append(reply, redis.XStream {
+			Stream:   stream,
+			Messages: msgs[:n],
+		})
+		f.streams[stream] = msgs[n:]
+	}
+
+	if len(reply) == 0 {
+		if args.Block >= 0 {
+			f.blocked = append(f.blocked, streams)
+		}
+		return redis.NewXStreamSliceCmdResult(nil, redis.Nil)
+	}
+	return redis.NewXStreamSliceCmdResult(reply, nil)
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, want := range []Priority { PriorityLow, PriorityNormal, PriorityHigh } {
+		got, err := ParsePriority(want.String())
+		if err != nil {
+			t.Errorf("%v", err)
+		}
+		if got != want {
+			t.Errorf("ParsePriority(%s) = %v", want, got)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Errorf("urgent is not a priority")
+	}
+}
+
+func TestJobStreams(t *testing.T) {
+	want := []string { "jobs:high", "jobs", "jobs:low" }
+	if got := JobStreams("jobs"); !reflect.DeepEqual(got, want) {
+		t.Errorf("streams = %v; want %v", got, want)
+	}
+	if s := JobStream("jobs", Priority(0)); s != "jobs" {
+		t.Errorf("zero priority is on %s; want jobs", s)
+	}
+}
+
+func TestJobQueueDrainsHigherPrioritiesFirst(t *testing.T) {
+	storage := newFakeJobs()
+	storage.add("jobs:low",  "low-0")
+	storage.add("jobs",      "normal-0")
+	storage.add("jobs:high", "high-0")
+	storage.add("jobs",      "normal-1")
+	storage.add("jobs:high", "high-1")
+	queue := JobQueue { Storage: storage, Group: "fetch", Stream: "jobs" }
+
+	want := []string { "high-0", "high-1", "normal-0", "normal-1", "low-0" }
+	var got []string
+	for range want {
+		msgs, err := queue.Next(context.Background())
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if len(msgs) != 1 || len(msgs[0].Messages) != 1 {
+			t.Fatalf("read %v; want one job", msgs)
+		}
+		got = append(got, msgs[0].Messages[0].ID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("jobs read in order %v; want %v", got, want)
+	}
+	if len(storage.blocked) != 0 {
+		t.Errorf("blocked on %v with jobs in the queue", storage.blocked)
+	}
+}
+
+func TestJobQueueBlocksOnAllStreams(t *testing.T) {
+	storage := newFakeJobs()
+	queue := JobQueue { Storage: storage, Group: "fetch", Stream: "jobs" }
+
+	_, err := queue.Next(context.Background())
+	if !errors.Is(err, redis.Nil) {
+		t.Fatalf("err = %v; want redis.Nil from the fake", err)
+	}
+	want := [][]string { { "jobs:high", "jobs", "jobs:low" } }
+	if !reflect.DeepEqual(storage.blocked, want) {
+		t.Errorf("blocked on %v; want %v", storage.blocked, want)
+	}
+}
+
+func TestJobQueueCreateGroupsIsIdempotent(t *testing.T) {
+	storage := newFakeJobs()
+	queue := JobQueue { Storage: storage, Group: "fetch", Stream: "jobs" }
+
+	for i := 0; i < 2; i++ {
+		if err := queue.CreateGroups(context.Background()); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	for _, stream := range JobStreams("jobs") {
+		if !storage.groups[stream] {
+			t.Errorf("no group on %s", stream)
+		}
+	}
+}
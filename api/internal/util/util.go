@@ -7,6 +7,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,7 @@ import (
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/klauspost/compress/zstd"
 )
 
 func MakePID() string {
@@ -33,13 +36,252 @@ func (gz *gzipWriter) Write(b []byte) (int, error) {
 	return gz.writer.Write(b)
 }
 
-// Compress the response if requested with a ?compression=kind query
+/*
+ * Flush what's compressed so far, so that streamed tiles reach the client as
+ * they're written. This costs a few bytes per flush, which is a pittance
+ * compared to the tiles themselves.
+ */
+func (gz *gzipWriter) Flush() {
+	gz.writer.Flush()
+	gz.ResponseWriter.Flush()
+}
+
+/*
+ * The quality (q-value) of the content-codings [1] in an Accept-Encoding
+ * header, by name, where "*" is the wildcard. Codings that are not mentioned
+ * are not in the map, and x-gzip is the same as gzip. If a coding is listed
+ * more than once, the first one counts.
+ *
+ * [1] https://tools.ietf.org/html/rfc7231#section-5.3.4
+ */
+func encodingQualities(acceptEncoding string) map[string]float64 {
+	qualities := make(map[string]float64)
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil {
+				v = 0
+			}
+			q = v
+		}
+
+		if _, ok := qualities[name]; !ok {
+			qualities[name] = q
+		}
+	}
+	return qualities
+}
+
+/*
+ * The quality of gzip. The wildcard is only honoured when gzip is not
+ * mentioned explicitly, and q=0 means not acceptable.
+ */
+func gzipQuality(qualities map[string]float64) float64 {
+	if q, ok := qualities["gzip"]; ok {
+		return q
+	}
+	return qualities["*"]
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	return gzipQuality(encodingQualities(acceptEncoding)) > 0
+}
+
+/*
+ * Pick the compression for the response from the Accept-Encoding header, as
+ * the kind in ?compression=kind, or "" for none. Of zstd and gzip, the one
+ * with the higher quality wins, and zstd wins ties - it is faster, and tiles
+ * the workers compressed can be passed straight through.
+ *
+ * Unlike gzip, zstd must be asked for by name. Clients that send * can't be
+ * assumed to know zstd, which is still fairly new to HTTP.
+ */
+func negotiateCompression(acceptEncoding string) string {
+	qualities := encodingQualities(acceptEncoding)
+	zq := qualities["zstd"]
+	gq := gzipQuality(qualities)
+	switch {
+	case zq > 0 && zq >= gq:
+		return "zstd"
+	case gq > 0:
+		return "gz"
+	default:
+		return ""
+	}
+}
+
+/*
+ * A writer that holds on to the response until at least minsize bytes are
+ * written, and only then starts compressing it. Responses that end before
+ * that are written as they are, without the Content-Encoding, as compressing
+ * a tiny response costs more than it saves.
+ *
+ * A flush means the handler wants what it has written so far to reach the
+ * client, and starts the compression right away. Streamed responses flush
+ * early, and are never considered small. Likewise, the headers are held back
+ * until it's decided whether the response is compressed.
+ *
+ * A strong ETag promises byte-for-byte equal responses, which the compressed
+ * response is not, so it is made weak once the compression starts. Weak
+ * ETags still work for If-None-Match, but not for If-Range.
+ */
+type pendingWriter struct {
+	gin.ResponseWriter
+	compressed gin.ResponseWriter
+	minsize    int
+	buffer     []byte
+	started    bool
+}
+
+func (p *pendingWriter) start() error {
+	if p.started {
+		return nil
+	}
+	p.started = true
+	if etag := p.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		p.Header().Set("ETag", "W/" + etag)
+	}
+	if len(p.buffer) == 0 {
+		return nil
+	}
+	_, err := p.compressed.Write(p.buffer)
+	p.buffer = nil
+	return err
+}
+
+func (p *pendingWriter) Write(b []byte) (int, error) {
+	if p.started {
+		return p.compressed.Write(b)
+	}
+
+	p.buffer = append(p.buffer, b...)
+	if len(p.buffer) >= p.minsize {
+		if err := p.start(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (p *pendingWriter) WriteString(s string) (int, error) {
+	return p.Write([]byte(s))
+}
+
+func (p *pendingWriter) WriteHeaderNow() {
+	if p.started {
+		p.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (p *pendingWriter) Flush() {
+	p.start()
+	p.compressed.Flush()
+}
+
+/*
+ * Write the response as it is if it never got big enough to be compressed,
+ * and report whether it was compressed.
+ */
+func (p *pendingWriter) finish() bool {
+	if p.started {
+		return true
+	}
+
+	p.Header().Del("Content-Encoding")
+	if len(p.buffer) > 0 {
+		p.Header().Set("Content-Length", fmt.Sprint(len(p.buffer)))
+		p.ResponseWriter.Write(p.buffer)
+	}
+	return false
+}
+
+/*
+ * The pendingWriter for zstd, which can also pass already compressed frames
+ * through. Compressed frames are big enough to be worth it, so they start the
+ * compression.
+ */
+type pendingZstdWriter struct {
+	*pendingWriter
+	zstd *zstdWriter
+}
+
+func (p *pendingZstdWriter) WriteZstdFrame(frame []byte) (int, error) {
+	if err := p.start(); err != nil {
+		return 0, err
+	}
+	return p.zstd.WriteZstdFrame(frame)
+}
+
+type compression struct {
+	gzipLevel  int
+	minsize    int
+	dictionary *ZstdDictionary
+}
+
+type CompressionOption func(*compression)
+
+/*
+ * The gzip compression level, from gzip.BestSpeed (the default) to
+ * gzip.BestCompression. See the notes in Compression() before turning it up.
+ */
+func WithGzipLevel(level int) CompressionOption {
+	return func(c *compression) {
+		c.gzipLevel = level
+	}
+}
+
+/*
+ * Only compress responses of at least size bytes. Smaller responses are sent
+ * uncompressed, see pendingWriter.
+ */
+func WithMinSize(size int) CompressionOption {
+	return func(c *compression) {
+		c.minsize = size
+	}
+}
+
+/*
+ * Compress with the dictionary when the request asks for it with
+ * ?compression=zstd&dictionary=<id>. Requests for other dictionaries (e.g.
+ * one cached from before a restart) fall back to plain zstd, and the
+ * Oneseismic-Zstd-Dictionary header is only set when the dictionary is used.
+ */
+func WithZstdDictionary(dict *ZstdDictionary) CompressionOption {
+	return func(c *compression) {
+		c.dictionary = dict
+	}
+}
+
+// Compress the response if requested with a ?compression=kind query, where
+// kind is gz or zstd, or with what the client accepts in the Accept-Encoding
+// header. The query takes precedence, so that clients that can't control the
+// Accept-Encoding header can still ask for zstd. Without either, the response
+// is not touched.
 //
 // The implementation is roughly based on https://github.com/gin-contrib/gzip/
 // with a couple of changed assumptions. The gin-contrib/gzip does not quite
 // fit our usecase, and is very much geared towards compressing small
 // text-responses and serving files, in a proper webserver fashion.
-func Compression() gin.HandlerFunc {
+func Compression(options ...CompressionOption) gin.HandlerFunc {
+	c := compression { gzipLevel: gzip.BestSpeed }
+	for _, opt := range options {
+		opt(&c)
+	}
+
 	// responses are not very compressible (usually compressible to half the
 	// size), and *speed* is the key anyway. Within the data centre it seems
 	// like the break-even for compression time vs. saved transport cost is at
@@ -64,33 +306,105 @@ func Compression() gin.HandlerFunc {
 	// https://github.com/gin-contrib/gzip/blob/7bbc855cce8a575268c8f3e8d0f7a6a67f3dee65/handler.go#L22
 	gzpool := sync.Pool {
 		New: func() interface {} {
-			gz, err := gzip.NewWriterLevel(ioutil.Discard, 1)
+			gz, err := gzip.NewWriterLevel(ioutil.Discard, c.gzipLevel)
 			if err != nil {
 				panic(err)
 			}
 			return gz
 		},
 	}
+	zstdpool := sync.Pool {
+		New: func() interface {} {
+			enc, err := newZstdEncoder(nil)
+			if err != nil {
+				panic(err)
+			}
+			return enc
+		},
+	}
+	zstddictpool := sync.Pool {
+		New: func() interface {} {
+			enc, err := newZstdEncoder(c.dictionary)
+			if err != nil {
+				panic(err)
+			}
+			return enc
+		},
+	}
 
 	// It is very important that ctx.Next() is called - it effectively suspends
 	// this handler and performs the request, then resumes where it left off.
 	// It ensures that the Close(), Reset() and Put() are performed *after*
 	// everything is properly written, and resources can be cleaned up.
 	return func (ctx *gin.Context) {
-		if (ctx.Query("compression") == "gz") {
+		kind := ctx.Query("compression")
+		if kind == "" {
+			/*
+			 * The response depends on Accept-Encoding, which caches must
+			 * know about
+			 */
+			ctx.Writer.Header().Add("Vary", "Accept-Encoding")
+			kind = negotiateCompression(ctx.GetHeader("Accept-Encoding"))
+		}
+
+		/*
+		 * When the response turns out too small to compress, the encoder is
+		 * pointed elsewhere before it is closed, so that it doesn't write
+		 * its trailer to the response
+		 */
+		switch kind {
+		case "gz":
 			gz := gzpool.Get().(*gzip.Writer)
 			defer gzpool.Put(gz)
 			defer gz.Reset(ioutil.Discard)
 			defer gz.Close()
 
 			gz.Reset(ctx.Writer)
-			ctx.Writer = &gzipWriter{ctx.Writer, gz}
+			pending := &pendingWriter {
+				ResponseWriter: ctx.Writer,
+				compressed:     &gzipWriter{ctx.Writer, gz},
+				minsize:        c.minsize,
+			}
+			ctx.Writer = pending
 			ctx.Header("Content-Encoding", "gzip")
 			ctx.Next()
 
+			if !pending.finish() {
+				gz.Reset(ioutil.Discard)
+				return
+			}
 			if (ctx.GetHeader("Transfer-Encoding") != "chunked") {
 				ctx.Header("Content-Length", fmt.Sprint(ctx.Writer.Size()))
 			}
+
+		case "zstd":
+			pool := &zstdpool
+			dict := c.dictionary
+			if dict != nil && ctx.Query("dictionary") == fmt.Sprint(dict.ID) {
+				pool = &zstddictpool
+				ctx.Header("Oneseismic-Zstd-Dictionary", fmt.Sprint(dict.ID))
+			}
+
+			enc := pool.Get().(*zstd.Encoder)
+			defer pool.Put(enc)
+			defer enc.Reset(ioutil.Discard)
+			defer enc.Close()
+
+			enc.Reset(ctx.Writer)
+			zw := &zstdWriter{ctx.Writer, enc}
+			pending := &pendingWriter {
+				ResponseWriter: ctx.Writer,
+				compressed:     zw,
+				minsize:        c.minsize,
+			}
+			ctx.Writer = &pendingZstdWriter{pending, zw}
+			ctx.Header("Content-Encoding", "zstd")
+			ctx.Next()
+
+			if !pending.finish() {
+				enc.Reset(ioutil.Discard)
+				ctx.Writer.Header().Del("Oneseismic-Zstd-Dictionary")
+			}
 		}
 	}
 }
@@ -1,7 +1,10 @@
 package util
 
 import (
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -10,6 +13,7 @@ import (
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -108,3 +112,271 @@ func TestAbortOnManifest404(t *testing.T) {
 	assert.Equal(t, want, text, "Wrong response body")
 	assert.True(t, ctx.IsAborted(), "gin.Context was not aborted as it should")
 }
+
+func TestAcceptsGzip(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		accepted       bool
+	} {
+		{ "",                      false },
+		{ "gzip",                  true  },
+		{ "GZIP",                  true  },
+		{ "deflate, gzip;q=1.0",   true  },
+		{ "x-gzip",                true  },
+		{ "gzip;q=0",              false },
+		{ "identity",              false },
+		{ "*",                     true  },
+		{ "*;q=0",                 false },
+		{ "gzip;q=0, *",           false },
+		{ "br;q=1.0, gzip;q=0.5",  true  },
+	}
+
+	for _, c := range cases {
+		if got := acceptsGzip(c.acceptEncoding); got != c.accepted {
+			t.Errorf(
+				"acceptsGzip(%q) = %v; want %v",
+				c.acceptEncoding,
+				got,
+				c.accepted,
+			)
+		}
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		kind           string
+	} {
+		{ "",                         ""     },
+		{ "identity",                 ""     },
+		{ "gzip",                     "gz"   },
+		{ "zstd",                     "zstd" },
+		{ "gzip, zstd",               "zstd" },
+		{ "gzip;q=1.0, zstd;q=0.5",   "gz"   },
+		{ "gzip;q=0.5, zstd",         "zstd" },
+		{ "zstd;q=0, gzip",           "gz"   },
+		{ "zstd;q=0",                 ""     },
+		{ "*",                        "gz"   },
+		{ "br, *;q=0.1",              "gz"   },
+	}
+
+	for _, c := range cases {
+		if got := negotiateCompression(c.acceptEncoding); got != c.kind {
+			t.Errorf(
+				"negotiateCompression(%q) = %q; want %q",
+				c.acceptEncoding,
+				got,
+				c.kind,
+			)
+		}
+	}
+}
+
+func compressedRequest(
+	mw             gin.HandlerFunc,
+	query          string,
+	acceptEncoding string,
+	handler        gin.HandlerFunc,
+) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	_, app := gin.CreateTestContext(w)
+	app.GET("/result", mw, handler)
+	req, _ := http.NewRequest(http.MethodGet, "/result?" + query, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	app.ServeHTTP(w, req)
+	return w
+}
+
+func TestGzipFromAcceptEncoding(t *testing.T) {
+	payload := bytes.Repeat([]byte("tile"), 1024)
+	handler := func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/x-msgpack", payload)
+	}
+
+	w := compressedRequest(Compression(), "", "gzip", handler)
+	if ce := w.Header().Get("Content-Encoding"); ce != "gzip" {
+		t.Fatalf("Content-Encoding = %q; want gzip", ce)
+	}
+	if vary := w.Header().Values("Vary"); len(vary) != 1 || vary[0] != "Accept-Encoding" {
+		t.Errorf("Vary = %v; want [Accept-Encoding]", vary)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("decompressed body differs from the payload")
+	}
+
+	/*
+	 * The query takes precedence over Accept-Encoding
+	 */
+	w = compressedRequest(Compression(), "compression=zstd", "gzip", handler)
+	if ce := w.Header().Get("Content-Encoding"); ce != "zstd" {
+		t.Errorf("Content-Encoding = %q; want zstd", ce)
+	}
+}
+
+func TestZstdFromAcceptEncoding(t *testing.T) {
+	payload := bytes.Repeat([]byte("tile"), 1024)
+	handler := func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/x-msgpack", payload)
+	}
+
+	w := compressedRequest(Compression(), "", "gzip, zstd", handler)
+	if ce := w.Header().Get("Content-Encoding"); ce != "zstd" {
+		t.Fatalf("Content-Encoding = %q; want zstd", ce)
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer dec.Close()
+	body, err := dec.DecodeAll(w.Body.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("decompressed body differs from the payload")
+	}
+}
+
+func TestSmallResponsesAreNotCompressed(t *testing.T) {
+	small := []byte("small tile")
+	large := bytes.Repeat([]byte("tile"), 1024)
+	respond := func(payload []byte) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			ctx.Data(http.StatusOK, "application/x-msgpack", payload)
+		}
+	}
+
+	for _, acceptEncoding := range []string { "gzip", "zstd" } {
+		mw := Compression(WithMinSize(len(large)))
+		w := compressedRequest(mw, "", acceptEncoding, respond(small))
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("%s: Content-Encoding = %q; want none", acceptEncoding, ce)
+		}
+		if !bytes.Equal(w.Body.Bytes(), small) {
+			t.Errorf("%s: body = %q; want %q", acceptEncoding, w.Body.Bytes(), small)
+		}
+		cl := w.Header().Get("Content-Length")
+		if cl != fmt.Sprint(len(small)) {
+			t.Errorf("%s: Content-Length = %s; want %d", acceptEncoding, cl, len(small))
+		}
+
+		w = compressedRequest(mw, "", acceptEncoding, respond(large))
+		if ce := w.Header().Get("Content-Encoding"); ce == "" {
+			t.Errorf("%s: Content-Encoding = none; want compressed", acceptEncoding)
+		}
+		if w.Body.Len() >= len(large) {
+			t.Errorf("%s: body is not compressed", acceptEncoding)
+		}
+	}
+}
+
+func TestCompressionWeakensETag(t *testing.T) {
+	small := []byte("small tile")
+	large := bytes.Repeat([]byte("tile"), 1024)
+	respond := func(payload []byte) gin.HandlerFunc {
+		return func(ctx *gin.Context) {
+			ctx.Header("ETag", `"pid-1"`)
+			ctx.Data(http.StatusOK, "application/x-msgpack", payload)
+		}
+	}
+	mw := Compression(WithMinSize(len(large)))
+
+	for _, acceptEncoding := range []string { "gzip", "zstd" } {
+		w := compressedRequest(mw, "", acceptEncoding, respond(large))
+		if etag := w.Header().Get("ETag"); etag != `W/"pid-1"` {
+			t.Errorf("%s: ETag = %s; want W/\"pid-1\"", acceptEncoding, etag)
+		}
+
+		w = compressedRequest(mw, "", acceptEncoding, respond(small))
+		if etag := w.Header().Get("ETag"); etag != `"pid-1"` {
+			t.Errorf("%s: ETag = %s; want \"pid-1\"", acceptEncoding, etag)
+		}
+	}
+
+	w := compressedRequest(mw, "", "", respond(large))
+	if etag := w.Header().Get("ETag"); etag != `"pid-1"` {
+		t.Errorf("ETag = %s; want \"pid-1\"", etag)
+	}
+}
+
+func TestNoCompressionWithoutAcceptEncoding(t *testing.T) {
+	payload := bytes.Repeat([]byte("tile"), 1024)
+	handler := func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/x-msgpack", payload)
+	}
+
+	for _, acceptEncoding := range []string { "", "identity", "gzip;q=0" } {
+		w := compressedRequest(Compression(), "", acceptEncoding, handler)
+		if ce := w.Header().Get("Content-Encoding"); ce != "" {
+			t.Errorf("%q: Content-Encoding = %q; want none", acceptEncoding, ce)
+		}
+		if !bytes.Equal(w.Body.Bytes(), payload) {
+			t.Errorf("%q: body is not the payload", acceptEncoding)
+		}
+	}
+}
+
+func TestGzipLevelIsConfigurable(t *testing.T) {
+	payload := bytes.Repeat([]byte("tile and some more tile "), 4096)
+	handler := func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/x-msgpack", payload)
+	}
+
+	fast := compressedRequest(Compression(), "", "gzip", handler)
+	best := compressedRequest(
+		Compression(WithGzipLevel(gzip.BestCompression)),
+		"",
+		"gzip",
+		handler,
+	)
+	if best.Body.Len() >= fast.Body.Len() {
+		t.Errorf(
+			"best compression = %d bytes; want less than best speed (%d)",
+			best.Body.Len(),
+			fast.Body.Len(),
+		)
+	}
+}
+
+/*
+ * Flushing the writer must push everything written so far through the
+ * compressor, so that a client can decode it without waiting for the rest of
+ * the response
+ */
+func TestGzipFlushesWrittenData(t *testing.T) {
+	w := httptest.NewRecorder()
+	_, app := gin.CreateTestContext(w)
+	app.GET("/result", Compression(), func(ctx *gin.Context) {
+		ctx.Writer.WriteHeader(http.StatusOK)
+		ctx.Writer.Write([]byte("first tile"))
+		ctx.Writer.Flush()
+
+		gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		flushed := make([]byte, len("first tile"))
+		if _, err := io.ReadFull(gz, flushed); err != nil {
+			t.Fatalf("unable to read the flushed tile: %v", err)
+		}
+		if string(flushed) != "first tile" {
+			t.Errorf("flushed = %q; want %q", flushed, "first tile")
+		}
+
+		ctx.Writer.Write([]byte("second tile"))
+	})
+	req, _ := http.NewRequest(http.MethodGet, "/result", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	app.ServeHTTP(w, req)
+}
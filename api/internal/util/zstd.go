@@ -0,0 +1,128 @@
+package util
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+ * A zstd dictionary, trained on representative tiles. Tiles are small and
+ * compress poorly on their own, but they have a lot in common - the msgpack
+ * envelope, and samples that repeat across tiles - which is what a dictionary
+ * captures.
+ *
+ * The ID is read from the dictionary itself, and is what clients use to pick
+ * (and cache) the dictionary. zstd also writes it into the frame header, so a
+ * decoder that has the dictionary will pick it up automatically.
+ */
+type ZstdDictionary struct {
+	ID   uint32
+	Data []byte
+}
+
+/*
+ * The magic number of dictionaries in the zstd format, see
+ * https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#dictionary-format
+ */
+const zstdDictMagic = 0xEC30A437
+
+func ParseZstdDictionary(data []byte) (*ZstdDictionary, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("zstd dictionary too short (%d bytes)", len(data))
+	}
+	if magic := binary.LittleEndian.Uint32(data[:4]); magic != zstdDictMagic {
+		return nil, fmt.Errorf("not a zstd dictionary; magic = %#x", magic)
+	}
+	id := binary.LittleEndian.Uint32(data[4:8])
+	if id == 0 {
+		return nil, fmt.Errorf("zstd dictionary has reserved ID 0")
+	}
+	return &ZstdDictionary { ID: id, Data: data }, nil
+}
+
+func LoadZstdDictionary(path string) (*ZstdDictionary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := ParseZstdDictionary(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return dict, nil
+}
+
+/*
+ * GET /zstd-dictionary
+ *
+ * Serve the dictionary, so clients can decompress dictionary-compressed
+ * responses. The dictionary only changes on restart, and clients should
+ * cache it by its ID, which is in the Oneseismic-Zstd-Dictionary header.
+ */
+func (d *ZstdDictionary) Get(ctx *gin.Context) {
+	ctx.Header("Oneseismic-Zstd-Dictionary", fmt.Sprint(d.ID))
+	ctx.Data(http.StatusOK, "application/octet-stream", d.Data)
+}
+
+type zstdWriter struct {
+	gin.ResponseWriter
+	writer *zstd.Encoder
+}
+
+func (z *zstdWriter) Write(b []byte) (int, error) {
+	return z.writer.Write(b)
+}
+
+/*
+ * Streamed tiles are flushed as they arrive, which only reaches the client if
+ * the encoder emits what it has buffered first.
+ */
+func (z *zstdWriter) Flush() {
+	z.writer.Flush()
+	z.ResponseWriter.Flush()
+}
+
+/*
+ * Writers for zstd compressed responses, that can also write data which is
+ * already compressed, e.g. tiles the workers compressed with zstd. A zstd
+ * stream is a sequence of frames, so the already compressed frame is written
+ * between the frames of the encoder, and the client decodes the response like
+ * any other.
+ */
+type ZstdFrameWriter interface {
+	WriteZstdFrame(frame []byte) (int, error)
+}
+
+/*
+ * End the encoder's current frame, write the compressed frame as it is, and
+ * have the encoder start a new frame for whatever comes next.
+ */
+func (z *zstdWriter) WriteZstdFrame(frame []byte) (int, error) {
+	if err := z.writer.Close(); err != nil {
+		return 0, err
+	}
+	n, err := z.ResponseWriter.Write(frame)
+	z.writer.Reset(z.ResponseWriter)
+	return n, err
+}
+
+/*
+ * Encoders for zstd with and without a dictionary. Like for gzip the level is
+ * set to the fastest, and every encoder is single threaded since the requests
+ * already run concurrently.
+ */
+func newZstdEncoder(dict *ZstdDictionary) (*zstd.Encoder, error) {
+	options := []zstd.EOption {
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderConcurrency(1),
+	}
+	if dict != nil {
+		options = append(options, zstd.WithEncoderDict(dict.Data))
+	}
+	return zstd.NewWriter(nil, options...)
+}
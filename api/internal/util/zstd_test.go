@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/equinor/oneseismic/api/internal/message"
+)
+
+/*
+ * A tile that looks like the real thing - the msgpack envelope of a slice
+ * bundle around a smooth trace, with samples quantized like in a cube with
+ * little dynamic range. The testdata/tiles.dict dictionary was trained on
+ * tiles 1000-1099 from this function, so the tiles in the tests are similar,
+ * but not the same.
+ */
+func sampleTile(n int) []byte {
+	values := make([]float32, 128)
+	for i := range values {
+		x := math.Sin(float64(i) / 8 + float64(n % 7)) * float64(1 + n % 5)
+		values[i] = float32(math.Round(x * 4) / 4)
+	}
+	bundle := message.SliceTiles {
+		Attr:  "data",
+		Tiles: []message.Tile {{
+			Iterations:  1,
+			ChunkSize:   len(values),
+			InitialSkip: n * len(values),
+			V:           values,
+		}},
+	}
+	packed, err := bundle.Pack()
+	if err != nil {
+		panic(err)
+	}
+	return packed
+}
+
+func loadTestDictionary(t *testing.T) *ZstdDictionary {
+	dict, err := LoadZstdDictionary("testdata/tiles.dict")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return dict
+}
+
+/*
+ * Compress a single tile, as a response of its own, through the middleware
+ */
+func compressTile(
+	t     *testing.T,
+	mw    gin.HandlerFunc,
+	query string,
+	tile  []byte,
+) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	_, app := gin.CreateTestContext(w)
+	app.GET("/tile", mw, func(ctx *gin.Context) {
+		ctx.Data(http.StatusOK, "application/x-msgpack", tile)
+	})
+	req, _ := http.NewRequest(http.MethodGet, "/tile?" + query, nil)
+	app.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	return w
+}
+
+func TestParseZstdDictionary(t *testing.T) {
+	dict := loadTestDictionary(t)
+	if dict.ID == 0 {
+		t.Errorf("dictionary ID = 0; want non-zero")
+	}
+
+	for _, bad := range [][]byte {
+		nil,
+		[]byte("short"),
+		[]byte("not-a-zstd-dictionary"),
+	} {
+		if _, err := ParseZstdDictionary(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestZstdDictionaryCompressesTilesSmaller(t *testing.T) {
+	dict := loadTestDictionary(t)
+	mw := Compression(WithZstdDictionary(dict))
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dict.Data))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer decoder.Close()
+
+	withdict := fmt.Sprintf("compression=zstd&dictionary=%d", dict.ID)
+	plain, compressed := 0, 0
+	for i := 0; i < 50; i++ {
+		tile := sampleTile(i)
+		for _, query := range []string { "compression=zstd", withdict } {
+			w := compressTile(t, mw, query, tile)
+			if enc := w.Header().Get("Content-Encoding"); enc != "zstd" {
+				t.Fatalf("Content-Encoding = %s; want zstd", enc)
+			}
+
+			body := w.Body.Bytes()
+			decoded, err := decoder.DecodeAll(body, nil)
+			if err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			if !bytes.Equal(decoded, tile) {
+				t.Fatalf("%s: decompressed tile %d differs from input", query, i)
+			}
+
+			header := w.Header().Get("Oneseismic-Zstd-Dictionary")
+			if query == withdict {
+				compressed += len(body)
+				if header != fmt.Sprint(dict.ID) {
+					t.Errorf("dictionary header = %q; want %d", header, dict.ID)
+				}
+			} else {
+				plain += len(body)
+				if header != "" {
+					t.Errorf("dictionary header = %q; want none", header)
+				}
+			}
+		}
+	}
+
+	t.Logf("50 tiles: %d bytes with dictionary, %d without", compressed, plain)
+	if compressed >= plain {
+		t.Errorf(
+			"expected dictionary to compress better; %d >= %d",
+			compressed,
+			plain,
+		)
+	}
+}
+
+/*
+ * Clients may have cached a dictionary from before a restart. Asking for a
+ * dictionary that is not loaded should still give a response, but compressed
+ * without the dictionary, so plain zstd decoders can read it.
+ */
+func TestZstdUnknownDictionaryFallsBack(t *testing.T) {
+	dict := loadTestDictionary(t)
+	tile := sampleTile(0)
+	queries := []string {
+		fmt.Sprintf("compression=zstd&dictionary=%d", dict.ID + 1),
+		"compression=zstd&dictionary=garbage",
+	}
+	for _, mw := range []gin.HandlerFunc {
+		Compression(),
+		Compression(WithZstdDictionary(dict)),
+	} {
+		for _, query := range queries {
+			w := compressTile(t, mw, query, tile)
+			if header := w.Header().Get("Oneseismic-Zstd-Dictionary"); header != "" {
+				t.Errorf("%s: dictionary header = %q; want none", query, header)
+			}
+
+			decoder, _ := zstd.NewReader(nil)
+			decoded, err := decoder.DecodeAll(w.Body.Bytes(), nil)
+			decoder.Close()
+			if err != nil {
+				t.Fatalf("%s: %v", query, err)
+			}
+			if !bytes.Equal(decoded, tile) {
+				t.Errorf("%s: decompressed tile differs from input", query)
+			}
+		}
+	}
+}
+
+func TestZstdDictionaryEndpoint(t *testing.T) {
+	dict := loadTestDictionary(t)
+	w := httptest.NewRecorder()
+	_, app := gin.CreateTestContext(w)
+	app.GET("/zstd-dictionary", dict.Get)
+	req, _ := http.NewRequest(http.MethodGet, "/zstd-dictionary", nil)
+	app.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d", w.Code, http.StatusOK)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	if !bytes.Equal(body, dict.Data) {
+		t.Errorf("served dictionary differs from the loaded one")
+	}
+	if header := w.Header().Get("Oneseismic-Zstd-Dictionary"); header != fmt.Sprint(dict.ID) {
+		t.Errorf("dictionary header = %q; want %d", header, dict.ID)
+	}
+}
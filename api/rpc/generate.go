@@ -0,0 +1,8 @@
+package rpc
+
+/*
+ * The generated code is checked in, so that building needs no protoc. Run go
+ * generate after changing results.proto, with protoc-gen-go and
+ * protoc-gen-go-grpc in PATH.
+ */
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative results.proto
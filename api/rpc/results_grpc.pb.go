@@ -0,0 +1,217 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// ResultsClient is the client API for Results service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ResultsClient interface {
+	//
+	// The status of the process, like GET /result/<pid>/status
+	GetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*Status, error)
+	//
+	// The result of the process, as it's being computed, like
+	// GET /result/<pid>/stream. The stream ends with a tile that carries the
+	// status of the stream, and nothing else.
+	StreamResult(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (Results_StreamResultClient, error)
+	//
+	// Cancel the process and delete its result, like DELETE /result/<pid>
+	CancelJob(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*CancelReply, error)
+}
+
+type resultsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewResultsClient(cc grpc.ClientConnInterface) ResultsClient {
+	return &resultsClient{cc}
+}
+
+func (c *resultsClient) GetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/oneseismic.v1.Results/GetStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *resultsClient) StreamResult(ctx context.Context, in *StreamRequest, opts ...grpc.CallOption) (Results_StreamResultClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Results_ServiceDesc.Streams[0], "/oneseismic.v1.Results/StreamResult", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &resultsStreamResultClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Results_StreamResultClient interface {
+	Recv() (*Tile, error)
+	grpc.ClientStream
+}
+
+type resultsStreamResultClient struct {
+	grpc.ClientStream
+}
+
+func (x *resultsStreamResultClient) Recv() (*Tile, error) {
+	m := new(Tile)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *resultsClient) CancelJob(ctx context.Context, in *CancelRequest, opts ...grpc.CallOption) (*CancelReply, error) {
+	out := new(CancelReply)
+	err := c.cc.Invoke(ctx, "/oneseismic.v1.Results/CancelJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ResultsServer is the server API for Results service.
+// All implementations must embed UnimplementedResultsServer
+// for forward compatibility
+type ResultsServer interface {
+	//
+	// The status of the process, like GET /result/<pid>/status
+	GetStatus(context.Context, *StatusRequest) (*Status, error)
+	//
+	// The result of the process, as it's being computed, like
+	// GET /result/<pid>/stream. The stream ends with a tile that carries the
+	// status of the stream, and nothing else.
+	StreamResult(*StreamRequest, Results_StreamResultServer) error
+	//
+	// Cancel the process and delete its result, like DELETE /result/<pid>
+	CancelJob(context.Context, *CancelRequest) (*CancelReply, error)
+	mustEmbedUnimplementedResultsServer()
+}
+
+// UnimplementedResultsServer must be embedded to have forward compatible implementations.
+type UnimplementedResultsServer struct {
+}
+
+func (UnimplementedResultsServer) GetStatus(context.Context, *StatusRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedResultsServer) StreamResult(*StreamRequest, Results_StreamResultServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamResult not implemented")
+}
+func (UnimplementedResultsServer) CancelJob(context.Context, *CancelRequest) (*CancelReply, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CancelJob not implemented")
+}
+func (UnimplementedResultsServer) mustEmbedUnimplementedResultsServer() {}
+
+// UnsafeResultsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ResultsServer will
+// result in compilation errors.
+type UnsafeResultsServer interface {
+	mustEmbedUnimplementedResultsServer()
+}
+
+func RegisterResultsServer(s grpc.ServiceRegistrar, srv ResultsServer) {
+	s.RegisterService(&Results_ServiceDesc, srv)
+}
+
+func _Results_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ResultsServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/oneseismic.v1.Results/GetStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ResultsServer).GetStatus(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Results_StreamResult_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(StreamRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ResultsServer).StreamResult(m, &resultsStreamResultServer{stream})
+}
+
+type Results_StreamResultServer interface {
+	Send(*Tile) error
+	grpc.ServerStream
+}
+
+type resultsStreamResultServer struct {
+	grpc.ServerStream
+}
+
+func (x *resultsStreamResultServer) Send(m *Tile) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Results_CancelJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CancelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ResultsServer).CancelJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/oneseismic.v1.Results/CancelJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ResultsServer).CancelJob(ctx, req.(*CancelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Results_ServiceDesc is the grpc.ServiceDesc for Results service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Results_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "oneseismic.v1.Results",
+	HandlerType: (*ResultsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler:    _Results_GetStatus_Handler,
+		},
+		{
+			MethodName: "CancelJob",
+			Handler:    _Results_CancelJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamResult",
+			Handler:       _Results_StreamResult_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "results.proto",
+}
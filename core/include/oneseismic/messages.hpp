@@ -172,6 +172,15 @@ enum class functionid {
 };
 
 struct process_header : MsgPackable< process_header > {
+    /*
+     * The version of the result layout, so that clients can tell which one
+     * they are getting. Bump it when the on-wire layout of the header or the
+     * bundles changes. Headers written before the version was added have
+     * none, which reads as version 0.
+     */
+    static constexpr int current_version = 1;
+
+    int                                 version = current_version;
     std::string                         pid;
     functionid                          function;
     int                                 nbundles;
@@ -42,10 +42,15 @@ struct convert< one::process_header > {
 
         const auto& kvs = o.via.map;
         std::string key;
+        /*
+         * Headers from before the version was added have no version
+         */
+        head.version = 0;
         for (int i = 0; i < kvs.size; ++i) {
             const auto& kv = kvs.ptr[i];
             kv.key >> key;
-                 if (key == "pid")        kv.val >> head.pid;
+                 if (key == "version")    kv.val >> head.version;
+            else if (key == "pid")        kv.val >> head.pid;
             else if (key == "function")   kv.val >> head.function;
             else if (key == "nbundles")   kv.val >> head.nbundles;
             else if (key == "ndims")      kv.val >> head.ndims;
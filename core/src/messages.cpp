@@ -272,6 +272,7 @@ void from_json(const nlohmann::json& doc, basic_task& task) noexcept (false) {
 }
 
 void to_json(nlohmann::json& doc, const process_header& head) noexcept (false) {
+    doc["version"]      = head.version;
     doc["pid"]          = head.pid;
     doc["function"]     = head.function;
     doc["nbundles"]     = head.nbundles;
@@ -283,6 +284,7 @@ void to_json(nlohmann::json& doc, const process_header& head) noexcept (false) {
 }
 
 void from_json(const nlohmann::json& doc, process_header& head) noexcept (false) {
+    head.version = doc.value("version", 0);
     doc.at("pid")       .get_to(head.pid);
     doc.at("function")  .get_to(head.function);
     doc.at("nbundles")  .get_to(head.nbundles);
@@ -4,6 +4,7 @@
 
 #include <catch/catch.hpp>
 #include <fmt/format.h>
+#include <nlohmann/json.hpp>
 
 #include <oneseismic/messages.hpp>
 
@@ -179,3 +180,46 @@ TEST_CASE("slice-task can round trip packing") {
 
     CHECK(task == unpacked);
 }
+
+TEST_CASE("process-header round trips with the version") {
+    one::process_header head;
+    head.pid = "pid";
+    head.function = one::functionid::slice;
+    head.nbundles = 2;
+    head.ndims = 3;
+    head.index = { 0, 1, 2 };
+    head.labels = { "inline", "crossline", "time" };
+    head.attributes = { "data" };
+    head.shapes = { 2, 3, 4 };
+    CHECK(head.version == one::process_header::current_version);
+
+    const auto packed = head.pack();
+    one::process_header unpacked;
+    unpacked.version = -1;
+    unpacked.unpack(packed.data(), packed.data() + packed.size());
+
+    CHECK(unpacked.version == one::process_header::current_version);
+    CHECK(unpacked.pid == head.pid);
+    CHECK(unpacked.nbundles == head.nbundles);
+    CHECK(unpacked.shapes == head.shapes);
+}
+
+TEST_CASE("process-header without version unpacks as version 0") {
+    const auto doc = nlohmann::json::parse(R"({
+        "pid": "pid",
+        "function": 1,
+        "nbundles": 1,
+        "ndims": 0,
+        "index": [],
+        "labels": [],
+        "shapes": [],
+        "attributes": []
+    })");
+    const auto packed = nlohmann::json::to_msgpack(doc);
+    one::process_header unpacked;
+    unpacked.unpack(
+        reinterpret_cast< const char* >(packed.data()),
+        reinterpret_cast< const char* >(packed.data() + packed.size())
+    );
+    CHECK(unpacked.version == 0);
+}
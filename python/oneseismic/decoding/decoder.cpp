@@ -42,6 +42,7 @@ void register_writer(
 
 PYBIND11_MODULE(decoder, m) {
     py::class_<one::process_header>(m, "header")
+        .def_readonly("version",    &one::process_header::version)
         .def_readonly("attrs",      &one::process_header::attributes)
         .def_readonly("ndims",      &one::process_header::ndims)
         .def_readonly("index",      &one::process_header::index)
@@ -27,6 +27,7 @@ class process_header:
     with regular reference mechanics.
     """
     def __init__(self, h):
+        self.version  = h.version
         self.attrs    = h.attrs
         self.ndims    = h.ndims
         self.index    = h.index